@@ -0,0 +1,857 @@
+/**
+ *  author: lim
+ *  data  : 18-8-12 下午3:25
+ */
+
+package binlog
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+)
+
+const (
+	DDL_CREATE_DATABASE = iota + 1
+	DDL_DROP_DATABASE
+	DDL_CREATE_TABLE
+	DDL_ALTER_TABLE
+	DDL_DROP_TABLE
+	DDL_RENAME_TABLE
+	DDL_TRUNCATE_TABLE
+)
+
+const (
+	ALTER_ADD_COLUMN = iota + 1
+	ALTER_DROP_COLUMN
+	ALTER_CHANGE_COLUMN
+	ALTER_RENAME_COLUMN
+	ALTER_ADD_KEY
+	ALTER_DROP_KEY
+	ALTER_RENAME_KEY
+	ALTER_CONVERT_CHARSET
+)
+
+// DDL changes one table or database
+type DDL struct {
+	Type   int
+	Schema string
+	Table  string
+
+	// RENAME TABLE / ALTER TABLE RENAME TO: the new name, CREATE TABLE LIKE: the source table
+	NewSchema string
+	NewTable  string
+
+	Columns []*Field       // CREATE TABLE
+	Keys    []event.KeyDef // CREATE TABLE, primary and unique keys only
+	Alters  []*alterSpec   // ALTER TABLE
+	Charset string         // default charset of the table if given
+
+	// columns can't be known from the statement, such as CREATE TABLE ... SELECT,
+	// fetch them from master
+	refetch bool
+}
+
+type alterSpec struct {
+	op     int
+	column string // the column altered
+	field  *Field // the new definition for ADD / CHANGE / MODIFY, or the new name for RENAME COLUMN
+	first  bool
+	after  string
+
+	// the key added or dropped, the new name for RENAME KEY whose old name is column,
+	// also the key defined along with the column by ADD / CHANGE / MODIFY
+	key event.KeyDef
+
+	charset string // CONVERT TO CHARACTER SET
+}
+
+type token struct {
+	val    string
+	quoted bool // `identifier` or 'string', never a keyword
+}
+
+func (tok token) is(keywords ...string) bool {
+	if tok.quoted {
+		return false
+	}
+	for _, kw := range keywords {
+		if strings.EqualFold(tok.val, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenize split sql into words, quoted strings and punctuations, comments are dropped
+func tokenize(sql string) []token {
+	toks := []token{}
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#' || c == '-' && strings.HasPrefix(sql[i:], "-- "):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				return toks
+			}
+			i += end + 1
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return toks
+			}
+			i += end + 4
+		case c == '`':
+			val, next := readQuoted(sql, i)
+			toks = append(toks, token{val: val, quoted: true})
+			i = next
+		case c == '\'' || c == '"':
+			// keep the quotes, string literals only matters as part of column type
+			_, next := readQuoted(sql, i)
+			toks = append(toks, token{val: sql[i:next], quoted: true})
+			i = next
+		case isWordChar(c):
+			start := i
+			for i < len(sql) && isWordChar(sql[i]) {
+				i++
+			}
+			toks = append(toks, token{val: sql[start:i]})
+		default:
+			toks = append(toks, token{val: sql[i : i+1]})
+			i++
+		}
+	}
+	return toks
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '$' || c >= 0x80
+}
+
+// readQuoted read the quoted string start at sql[start], doubled or escaped quotes are unquoted
+func readQuoted(sql string, start int) (string, int) {
+	quote := sql[start]
+	val := make([]byte, 0, 16)
+	i := start + 1
+	for i < len(sql) {
+		c := sql[i]
+		if c == '\\' && quote != '`' && i+1 < len(sql) {
+			val = append(val, sql[i+1])
+			i += 2
+			continue
+		}
+		if c == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				val = append(val, quote)
+				i += 2
+				continue
+			}
+			return string(val), i + 1
+		}
+		val = append(val, c)
+		i++
+	}
+	return string(val), i
+}
+
+type ddlParser struct {
+	toks   []token
+	pos    int
+	schema string // default schema of the query
+}
+
+func (p *ddlParser) eof() bool {
+	return p.pos >= len(p.toks)
+}
+
+func (p *ddlParser) peek() token {
+	if p.eof() {
+		return token{}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *ddlParser) next() token {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+// accept consume the keywords if they are next in order
+func (p *ddlParser) accept(keywords ...string) bool {
+	if p.pos+len(keywords) > len(p.toks) {
+		return false
+	}
+	for idx, kw := range keywords {
+		if !p.toks[p.pos+idx].is(kw) {
+			return false
+		}
+	}
+	p.pos += len(keywords)
+	return true
+}
+
+func (p *ddlParser) ident() (string, error) {
+	tok := p.next()
+	if len(tok.val) == 0 || !tok.quoted && !isWordChar(tok.val[0]) {
+		return "", errors.Errorf("expect identifier, but got '%s'", tok.val)
+	}
+	return tok.val, nil
+}
+
+// tableName parse [schema.]table
+func (p *ddlParser) tableName() (string, string, error) {
+	name, err := p.ident()
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	if p.peek().val != "." || p.peek().quoted {
+		return p.schema, name, nil
+	}
+	p.next()
+	table, err := p.ident()
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	return name, table, nil
+}
+
+// group consume a parenthesized group start at current position,
+// return the tokens inside split by top level commas
+func (p *ddlParser) group() ([][]token, error) {
+	if tok := p.next(); tok.val != "(" || tok.quoted {
+		return nil, errors.Errorf("expect '(', but got '%s'", tok.val)
+	}
+
+	items := [][]token{}
+	item := []token{}
+	depth := 0
+	for !p.eof() {
+		tok := p.next()
+		if !tok.quoted {
+			switch tok.val {
+			case "(":
+				depth++
+			case ")":
+				if depth == 0 {
+					return append(items, item), nil
+				}
+				depth--
+			case ",":
+				if depth == 0 {
+					items = append(items, item)
+					item = []token{}
+					continue
+				}
+			}
+		}
+		item = append(item, tok)
+	}
+	return nil, errors.New("unclosed '('")
+}
+
+// splitTop split the rest tokens by top level commas
+func (p *ddlParser) splitTop() [][]token {
+	items := [][]token{}
+	item := []token{}
+	depth := 0
+	for !p.eof() {
+		tok := p.next()
+		if !tok.quoted {
+			switch tok.val {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			case ",":
+				if depth == 0 {
+					items = append(items, item)
+					item = []token{}
+					continue
+				}
+			case ";":
+				if depth == 0 {
+					continue
+				}
+			}
+		}
+		item = append(item, tok)
+	}
+	if len(item) != 0 {
+		items = append(items, item)
+	}
+	return items
+}
+
+// ParseDDL parse the table and database changes in query, schema is the default schema.
+// statements do not change table structures return nil
+func ParseDDL(schema, query string) ([]*DDL, error) {
+	p := &ddlParser{toks: tokenize(query), schema: schema}
+
+	switch tok := p.next(); {
+	case tok.is("CREATE"):
+		return p.parseCreate()
+	case tok.is("ALTER"):
+		return p.parseAlter()
+	case tok.is("DROP"):
+		return p.parseDrop()
+	case tok.is("RENAME"):
+		return p.parseRename()
+	case tok.is("TRUNCATE"):
+		p.accept("TABLE")
+		s, t, err := p.tableName()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []*DDL{{Type: DDL_TRUNCATE_TABLE, Schema: s, Table: t}}, nil
+	}
+	return nil, nil
+}
+
+func (p *ddlParser) parseCreate() ([]*DDL, error) {
+	p.accept("OR", "REPLACE")
+	if p.accept("DATABASE") || p.accept("SCHEMA") {
+		p.accept("IF", "NOT", "EXISTS")
+		name, err := p.ident()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []*DDL{{Type: DDL_CREATE_DATABASE, Schema: name}}, nil
+	}
+
+	if p.accept("UNIQUE", "INDEX") || p.accept("UNIQUE", "KEY") {
+		return p.parseCreateIndex()
+	}
+
+	if p.accept("TEMPORARY") {
+		// never in the rows events, and must not shadow the table of the same name
+		return nil, nil
+	}
+	if !p.accept("TABLE") {
+		// view, non unique index, trigger...
+		return nil, nil
+	}
+	p.accept("IF", "NOT", "EXISTS")
+
+	s, t, err := p.tableName()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ddl := &DDL{Type: DDL_CREATE_TABLE, Schema: s, Table: t}
+
+	if p.accept("LIKE") {
+		if ddl.NewSchema, ddl.NewTable, err = p.tableName(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []*DDL{ddl}, nil
+	}
+
+	if tok := p.peek(); tok.val != "(" || tok.quoted {
+		// CREATE TABLE ... SELECT
+		ddl.refetch = true
+		return []*DDL{ddl}, nil
+	}
+
+	start := p.pos
+	items, err := p.group()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(items) == 1 && len(items[0]) != 0 && items[0][0].is("LIKE") {
+		// CREATE TABLE a (LIKE b)
+		p.pos = start + 2
+		if ddl.NewSchema, ddl.NewTable, err = p.tableName(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []*DDL{ddl}, nil
+	}
+
+	for _, item := range items {
+		if len(item) == 0 {
+			continue
+		}
+		if isIndexDef(item[0]) {
+			key, ok, err := parseKeyDef(item)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if ok {
+				ddl.Keys = appendKey(ddl.Keys, key)
+			}
+			continue
+		}
+		field, err := parseColumnDef(item)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ddl.Columns = append(ddl.Columns, field)
+		if key, ok := columnKey(item); ok {
+			ddl.Keys = appendKey(ddl.Keys, key)
+		}
+	}
+
+	options := p.toks[p.pos:]
+	for !p.eof() {
+		if p.next().is("SELECT") {
+			// columns of the select part are added
+			ddl.refetch = true
+		}
+	}
+	ddl.Charset = findCharset(options)
+	return []*DDL{ddl}, nil
+}
+
+// parseCreateIndex parse: CREATE UNIQUE INDEX name [USING type] ON table (cols), as an ALTER TABLE
+func (p *ddlParser) parseCreateIndex() ([]*DDL, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if p.accept("USING") {
+		p.next()
+	}
+	if !p.accept("ON") {
+		return nil, errors.Errorf("expect ON after index %s", name)
+	}
+	s, t, err := p.tableName()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	items, err := p.group()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ddl := &DDL{Type: DDL_ALTER_TABLE, Schema: s, Table: t}
+	if cols := keyColumns(items); cols != nil {
+		key := event.KeyDef{Name: name, Columns: cols}
+		ddl.Alters = append(ddl.Alters, &alterSpec{op: ALTER_ADD_KEY, key: key})
+	}
+	return []*DDL{ddl}, nil
+}
+
+func isIndexDef(tok token) bool {
+	return tok.is("PRIMARY", "KEY", "INDEX", "UNIQUE", "FULLTEXT", "SPATIAL", "CONSTRAINT", "FOREIGN", "CHECK", "PERIOD")
+}
+
+// parseKeyDef parse: [CONSTRAINT [sym]] PRIMARY KEY | UNIQUE [KEY | INDEX] [name] [USING type] (cols),
+// ok is false for the other index definitions
+func parseKeyDef(toks []token) (event.KeyDef, bool, error) {
+	p := &ddlParser{toks: toks}
+	key := event.KeyDef{}
+
+	if p.accept("CONSTRAINT") && !p.peek().is("PRIMARY", "UNIQUE", "FOREIGN", "CHECK") {
+		// the constraint symbol names the unique key if no index name given
+		key.Name = p.next().val
+	}
+
+	switch {
+	case p.accept("PRIMARY", "KEY"):
+		key.Name = event.PRIMARY_KEY
+	case p.accept("UNIQUE"):
+		if !p.accept("KEY") {
+			p.accept("INDEX")
+		}
+		if tok := p.peek(); tok.quoted || tok.val != "(" && !tok.is("USING") {
+			key.Name = p.next().val
+		}
+	default:
+		return key, false, nil
+	}
+
+	if p.accept("USING") {
+		p.next()
+	}
+	items, err := p.group()
+	if err != nil {
+		return key, false, errors.Trace(err)
+	}
+	if key.Columns = keyColumns(items); key.Columns == nil {
+		return key, false, nil
+	}
+	if len(key.Name) == 0 {
+		// named after the first column by mysql
+		key.Name = key.Columns[0]
+	}
+	return key, true, nil
+}
+
+// keyColumns of the key parts: col [(length)] [ASC | DESC],
+// nil if any part is an expression, which can not identify a row by columns
+func keyColumns(items [][]token) []string {
+	cols := make([]string, 0, len(items))
+	for _, item := range items {
+		if len(item) == 0 || item[0].val == "(" && !item[0].quoted {
+			return nil
+		}
+		cols = append(cols, item[0].val)
+	}
+	if len(cols) == 0 {
+		return nil
+	}
+	return cols
+}
+
+// columnKey the key defined inline by the column attributes: [UNIQUE [KEY]] [[PRIMARY] KEY]
+func columnKey(toks []token) (event.KeyDef, bool) {
+	name := toks[0].val
+	for _, tok := range toks[2:] {
+		switch {
+		case tok.is("UNIQUE"):
+			return event.KeyDef{Name: name, Columns: []string{name}}, true
+		case tok.is("PRIMARY", "KEY"):
+			return event.KeyDef{Name: event.PRIMARY_KEY, Columns: []string{name}}, true
+		}
+	}
+	return event.KeyDef{}, false
+}
+
+// parseColumnDef parse: name type[(args)] [UNSIGNED] [ZEROFILL] attributes...
+func parseColumnDef(toks []token) (*Field, error) {
+	if len(toks) < 2 {
+		return nil, errors.Errorf("invalid column definition: %s", joinTokens(toks))
+	}
+
+	field := &Field{fieldName: toks[0].val}
+	fieldType := strings.ToLower(toks[1].val)
+
+	pos := 2
+	if pos < len(toks) && toks[pos].val == "(" && !toks[pos].quoted {
+		end := pos
+		for end < len(toks) && (toks[end].val != ")" || toks[end].quoted) {
+			end++
+		}
+		if end == len(toks) {
+			return nil, errors.Errorf("invalid column definition: %s", joinTokens(toks))
+		}
+		fieldType += "(" + joinTokens(toks[pos+1:end]) + ")"
+		pos = end + 1
+	}
+
+	for ; pos < len(toks) && toks[pos].is("UNSIGNED", "SIGNED", "ZEROFILL"); pos++ {
+		if !toks[pos].is("SIGNED") {
+			fieldType += " " + strings.ToLower(toks[pos].val)
+		}
+	}
+
+	field.fieldType = fieldType
+	field.unsigned = strings.Contains(fieldType, "unsigned")
+	if field.charset = findCharset(toks[pos:]); len(field.charset) == 0 {
+		field.charset = event.CharsetOfType(fieldType)
+	}
+	return field, nil
+}
+
+// findCharset the charset given by [DEFAULT] CHARACTER SET | CHARSET [=] name, or by COLLATE [=] name,
+// "" if neither
+func findCharset(toks []token) string {
+	value := func(i int) string {
+		if i < len(toks) && toks[i].val == "=" && !toks[i].quoted {
+			i++
+		}
+		if i < len(toks) {
+			return strings.ToLower(toks[i].val)
+		}
+		return ""
+	}
+
+	collation := ""
+	for i, tok := range toks {
+		switch {
+		case tok.is("CHARSET"):
+			return value(i + 1)
+		case tok.is("CHARACTER") && i+1 < len(toks) && toks[i+1].is("SET"):
+			return value(i + 2)
+		case tok.is("COLLATE") && len(collation) == 0:
+			collation = value(i + 1)
+		}
+	}
+	if idx := strings.IndexByte(collation, '_'); idx > 0 {
+		// charset is the prefix of collation, such as utf8mb4_bin
+		return collation[:idx]
+	}
+	return collation
+}
+
+func joinTokens(toks []token) string {
+	vals := make([]string, 0, len(toks))
+	for _, tok := range toks {
+		vals = append(vals, tok.val)
+	}
+	return strings.Join(vals, "")
+}
+
+// columnPos strip the trailing FIRST / AFTER col of a column definition
+func columnPos(toks []token) ([]token, bool, string) {
+	n := len(toks)
+	if n > 0 && toks[n-1].is("FIRST") {
+		return toks[:n-1], true, ""
+	}
+	if n > 1 && toks[n-2].is("AFTER") {
+		return toks[:n-2], false, toks[n-1].val
+	}
+	return toks, false, ""
+}
+
+func (p *ddlParser) parseAlter() ([]*DDL, error) {
+	p.accept("ONLINE")
+	p.accept("IGNORE")
+	if !p.accept("TABLE") {
+		// alter database, view...
+		return nil, nil
+	}
+
+	s, t, err := p.tableName()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ddl := &DDL{Type: DDL_ALTER_TABLE, Schema: s, Table: t}
+
+	for _, item := range p.splitTop() {
+		sub := &ddlParser{toks: item, schema: s}
+		if err = sub.parseAlterSpec(ddl); err != nil {
+			return nil, errors.Annotatef(err, "alter table %s.%s", s, t)
+		}
+	}
+	return []*DDL{ddl}, nil
+}
+
+func (p *ddlParser) parseAlterSpec(ddl *DDL) error {
+	switch {
+	case p.accept("ADD"):
+		if p.peek().is("PARTITION") {
+			return nil
+		}
+		if isIndexDef(p.peek()) {
+			return ddl.addKeyDef(p.toks[p.pos:])
+		}
+		p.accept("COLUMN")
+		if tok := p.peek(); tok.val == "(" && !tok.quoted {
+			items, err := p.group()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			for _, item := range items {
+				if len(item) == 0 {
+					continue
+				}
+				if isIndexDef(item[0]) {
+					if err = ddl.addKeyDef(item); err != nil {
+						return errors.Trace(err)
+					}
+					continue
+				}
+				field, err := parseColumnDef(item)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				ddl.addColumnSpec(&alterSpec{op: ALTER_ADD_COLUMN, column: field.fieldName, field: field}, item)
+			}
+			return nil
+		}
+
+		def, first, after := columnPos(p.toks[p.pos:])
+		field, err := parseColumnDef(def)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ddl.addColumnSpec(&alterSpec{op: ALTER_ADD_COLUMN, column: field.fieldName, field: field, first: first, after: after}, def)
+
+	case p.accept("DROP"):
+		if p.accept("PRIMARY", "KEY") {
+			ddl.Alters = append(ddl.Alters, &alterSpec{op: ALTER_DROP_KEY, key: event.KeyDef{Name: event.PRIMARY_KEY}})
+			return nil
+		}
+		if p.accept("INDEX") || p.accept("KEY") || p.accept("CONSTRAINT") {
+			p.accept("IF", "EXISTS")
+			name, err := p.ident()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			ddl.Alters = append(ddl.Alters, &alterSpec{op: ALTER_DROP_KEY, key: event.KeyDef{Name: name}})
+			return nil
+		}
+		if isIndexDef(p.peek()) || p.peek().is("PARTITION") {
+			return nil
+		}
+		p.accept("COLUMN")
+		p.accept("IF", "EXISTS")
+		name, err := p.ident()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ddl.Alters = append(ddl.Alters, &alterSpec{op: ALTER_DROP_COLUMN, column: name})
+
+	case p.accept("CHANGE"):
+		p.accept("COLUMN")
+		p.accept("IF", "EXISTS")
+		old, err := p.ident()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		def, first, after := columnPos(p.toks[p.pos:])
+		field, err := parseColumnDef(def)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ddl.addColumnSpec(&alterSpec{op: ALTER_CHANGE_COLUMN, column: old, field: field, first: first, after: after}, def)
+
+	case p.accept("MODIFY"):
+		p.accept("COLUMN")
+		p.accept("IF", "EXISTS")
+		def, first, after := columnPos(p.toks[p.pos:])
+		field, err := parseColumnDef(def)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ddl.addColumnSpec(&alterSpec{op: ALTER_CHANGE_COLUMN, column: field.fieldName, field: field, first: first, after: after}, def)
+
+	case p.accept("RENAME"):
+		if p.accept("COLUMN") {
+			old, err := p.ident()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			p.accept("TO")
+			name, err := p.ident()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			ddl.Alters = append(ddl.Alters, &alterSpec{op: ALTER_RENAME_COLUMN, column: old, field: &Field{fieldName: name}})
+			return nil
+		}
+		if p.accept("INDEX") || p.accept("KEY") {
+			old, err := p.ident()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			p.accept("TO")
+			name, err := p.ident()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			ddl.Alters = append(ddl.Alters, &alterSpec{op: ALTER_RENAME_KEY, column: old, key: event.KeyDef{Name: name}})
+			return nil
+		}
+		if !p.accept("TO") {
+			p.accept("AS")
+		}
+		s, t, err := p.tableName()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ddl.NewSchema, ddl.NewTable = s, t
+
+	case p.accept("CONVERT", "TO"):
+		ddl.Alters = append(ddl.Alters, &alterSpec{op: ALTER_CONVERT_CHARSET, charset: findCharset(p.toks[p.pos:])})
+
+	default:
+		// table options: [DEFAULT] CHARACTER SET = name
+		if charset := findCharset(p.toks[p.pos:]); len(charset) != 0 {
+			ddl.Charset = charset
+		}
+	}
+
+	// ALTER COLUMN SET DEFAULT, ENGINE=, ALGORITHM=... do not change columns
+	return nil
+}
+
+// addKeyDef add the key defined by ALTER TABLE ADD, non unique ones are ignored
+func (ddl *DDL) addKeyDef(toks []token) error {
+	key, ok, err := parseKeyDef(toks)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if ok {
+		ddl.Alters = append(ddl.Alters, &alterSpec{op: ALTER_ADD_KEY, key: key})
+	}
+	return nil
+}
+
+// addColumnSpec add the column spec with the key defined inline by def
+func (ddl *DDL) addColumnSpec(spec *alterSpec, def []token) {
+	if key, ok := columnKey(def); ok {
+		spec.key = key
+	}
+	ddl.Alters = append(ddl.Alters, spec)
+}
+
+func (p *ddlParser) parseDrop() ([]*DDL, error) {
+	if p.accept("DATABASE") || p.accept("SCHEMA") {
+		p.accept("IF", "EXISTS")
+		name, err := p.ident()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []*DDL{{Type: DDL_DROP_DATABASE, Schema: name}}, nil
+	}
+
+	if p.accept("INDEX") {
+		// DROP INDEX name ON table, as an ALTER TABLE
+		name, err := p.ident()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if !p.accept("ON") {
+			return nil, errors.Errorf("expect ON after index %s", name)
+		}
+		s, t, err := p.tableName()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		spec := &alterSpec{op: ALTER_DROP_KEY, key: event.KeyDef{Name: name}}
+		return []*DDL{{Type: DDL_ALTER_TABLE, Schema: s, Table: t, Alters: []*alterSpec{spec}}}, nil
+	}
+
+	if p.accept("TEMPORARY") || !p.accept("TABLE") {
+		// the temporary table is not tracked, see parseCreate
+		return nil, nil
+	}
+	p.accept("IF", "EXISTS")
+
+	ddls := []*DDL{}
+	for {
+		s, t, err := p.tableName()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ddls = append(ddls, &DDL{Type: DDL_DROP_TABLE, Schema: s, Table: t})
+
+		if tok := p.peek(); tok.val != "," || tok.quoted {
+			return ddls, nil
+		}
+		p.next()
+	}
+}
+
+func (p *ddlParser) parseRename() ([]*DDL, error) {
+	if !p.accept("TABLE") {
+		// rename user
+		return nil, nil
+	}
+
+	ddls := []*DDL{}
+	for {
+		s, t, err := p.tableName()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if !p.accept("TO") {
+			return nil, errors.Errorf("expect TO after %s.%s", s, t)
+		}
+		ns, nt, err := p.tableName()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ddls = append(ddls, &DDL{Type: DDL_RENAME_TABLE, Schema: s, Table: t, NewSchema: ns, NewTable: nt})
+
+		if tok := p.peek(); tok.val != "," || tok.quoted {
+			return ddls, nil
+		}
+		p.next()
+	}
+}
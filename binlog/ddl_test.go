@@ -0,0 +1,190 @@
+/**
+ *  author: lim
+ *  data  : 18-8-12 下午5:10
+ */
+
+package binlog
+
+import (
+	"strings"
+	"testing"
+)
+
+func fieldsOf(table *Table) string {
+	defs := make([]string, 0, len(table.fields))
+	for _, field := range table.fields {
+		defs = append(defs, field.fieldName+" "+field.fieldType)
+	}
+	return strings.Join(defs, ", ")
+}
+
+func TestParseDDL(t *testing.T) {
+	ddls, err := ParseDDL("test", "/* comment */ DROP TABLE IF EXISTS `a`, db2.`b` /* generated by server */")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ddls) != 2 || ddls[0].Schema != "test" || ddls[0].Table != "a" ||
+		ddls[1].Schema != "db2" || ddls[1].Table != "b" || ddls[1].Type != DDL_DROP_TABLE {
+		t.Errorf("unexpect drop table: %+v %+v", ddls[0], ddls[1])
+	}
+
+	ddls, err = ParseDDL("test", "rename table a to b, test.c to db2.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ddls) != 2 || ddls[1].NewSchema != "db2" || ddls[1].NewTable != "c" {
+		t.Errorf("unexpect rename table: %+v", ddls)
+	}
+
+	ddls, err = ParseDDL("test", "create table if not exists `t``1` ("+
+		"id int(11) unsigned NOT NULL AUTO_INCREMENT, "+
+		"name varchar(32) DEFAULT 'a,b', "+
+		"kind enum('x','y'), "+
+		"PRIMARY KEY (`id`), KEY idx_name (name(4))) ENGINE=InnoDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ddls) != 1 || ddls[0].Table != "t`1" || len(ddls[0].Columns) != 3 {
+		t.Fatalf("unexpect create table: %+v", ddls)
+	}
+	tb := &Table{fields: ddls[0].Columns}
+	if fieldsOf(tb) != "id int(11) unsigned, name varchar(32), kind enum('x','y')" || !tb.fields[0].unsigned {
+		t.Errorf("unexpect columns: %s", fieldsOf(tb))
+	}
+
+	for _, query := range []string{"BEGIN", "COMMIT", "create index idx on t(a)", "create view v as select 1", "insert into t values(1)",
+		"create temporary table t (id bigint)", "drop temporary table if exists t"} {
+		if ddls, err = ParseDDL("test", query); err != nil || ddls != nil {
+			t.Errorf("%s should not be a table ddl: %v %v", query, ddls, err)
+		}
+	}
+}
+
+func TestApplyDDL(t *testing.T) {
+	meta := NewInformationSchema(nil)
+
+	steps := []struct {
+		schema string
+		query  string
+		table  string
+		expect string
+	}{
+		{"test", "create table t (id int, a int, b int)", "test.t", "id int, a int, b int"},
+		{"test", "alter table t add column c varchar(8) after id, drop b", "test.t", "id int, c varchar(8), a int"},
+		{"test", "alter table t change a a2 bigint unsigned first, add (d int, e int)", "test.t", "a2 bigint unsigned, id int, c varchar(8), d int, e int"},
+		{"test", "alter table t modify `c` text, rename column d to d2, add index idx(e)", "test.t", "a2 bigint unsigned, id int, c text, d2 int, e int"},
+		{"", "create table test.t2 like test.t", "test.t2", "a2 bigint unsigned, id int, c text, d2 int, e int"},
+		{"test", "alter table t2 drop column e, rename to db2.t3", "db2.t3", "a2 bigint unsigned, id int, c text, d2 int"},
+		{"test", "rename table t to t4", "test.t4", "a2 bigint unsigned, id int, c text, d2 int, e int"},
+		{"test", "truncate t4", "test.t4", "a2 bigint unsigned, id int, c text, d2 int, e int"},
+	}
+
+	for _, step := range steps {
+		if err := meta.applyDDL(step.schema, step.query); err != nil {
+			t.Fatalf("%s: %v", step.query, err)
+		}
+		tb, ok := meta.GetTable(step.table)
+		if !ok {
+			t.Fatalf("%s: %s not found", step.query, step.table)
+		}
+		if fieldsOf(tb) != step.expect {
+			t.Errorf("%s: got %s, expect %s", step.query, fieldsOf(tb), step.expect)
+		}
+	}
+
+	for _, gone := range []string{"test.t", "test.t2"} {
+		if _, ok := meta.GetTable(gone); ok {
+			t.Errorf("%s should be renamed", gone)
+		}
+	}
+
+	if err := meta.applyDDL("test", "drop table if exists t4, t5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.applyDDL("", "drop database if exists db2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.tbs) != 0 {
+		t.Errorf("all tables should be dropped: %v", meta.tbs)
+	}
+
+	// no master to fetch the unknown table from
+	if err := meta.applyDDL("test", "alter table unknown add column a int"); err == nil {
+		t.Error("alter unknown table should fail")
+	}
+}
+
+func keysOf(table *Table) string {
+	keys := make([]string, 0, len(table.keys))
+	for _, key := range table.keys {
+		keys = append(keys, key.Name+"("+strings.Join(key.Columns, ",")+")")
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestApplyKeys(t *testing.T) {
+	meta := NewInformationSchema(nil)
+
+	steps := []struct {
+		query  string
+		expect string
+		rowKey string
+	}{
+		{"create table t (id int, a int unique, b int, c int, key idx_b(b), unique key uk_bc (b, c(4)) using btree)",
+			"a(a) uk_bc(b,c)", "a"},
+		{"alter table t add primary key (id), drop index a", "PRIMARY(id) uk_bc(b,c)", "id"},
+		{"alter table t change c c2 int, rename index uk_bc to uk_bc2", "PRIMARY(id) uk_bc2(b,c2)", "id"},
+		{"alter table t drop primary key, drop column b", "uk_bc2(c2)", "c2"},
+		{"create unique index `uk_a` on test.t (a desc)", "uk_bc2(c2) uk_a(a)", "c2"},
+		{"drop index uk_bc2 on t", "uk_a(a)", "a"},
+		{"alter table t add column d int primary key first, add constraint uk_d unique (d, a)", "PRIMARY(d) uk_a(a) uk_d(d,a)", "d"},
+		{"create index idx_a on t(a)", "PRIMARY(d) uk_a(a) uk_d(d,a)", "d"},
+	}
+
+	for _, step := range steps {
+		if err := meta.applyDDL("test", step.query); err != nil {
+			t.Fatalf("%s: %v", step.query, err)
+		}
+		tb, _ := meta.GetTable("test.t")
+		if keysOf(tb) != step.expect {
+			t.Errorf("%s: got keys %s, expect %s", step.query, keysOf(tb), step.expect)
+		}
+		if rowKey := strings.Join(tb.RowKey(), ","); rowKey != step.rowKey {
+			t.Errorf("%s: got row key %s, expect %s", step.query, rowKey, step.rowKey)
+		}
+	}
+
+	if err := meta.applyDDL("test", "create table t2 like t"); err != nil {
+		t.Fatal(err)
+	}
+	tb, _ := meta.GetTable("test.t2")
+	if keysOf(tb) != "PRIMARY(d) uk_a(a) uk_d(d,a)" {
+		t.Errorf("keys should be copied by create table like, got %s", keysOf(tb))
+	}
+}
+
+func TestApplyCharset(t *testing.T) {
+	meta := NewInformationSchema(nil)
+
+	steps := []struct {
+		query  string
+		expect string
+	}{
+		{"create table t (a varchar(8), b char(2) character set gbk, c blob, d int, e text collate utf8mb4_bin) default charset=latin1",
+			"latin1 gbk binary  utf8mb4"},
+		{"alter table t add column f varbinary(4), add g enum('x') charset = ascii, add h tinytext", "latin1 gbk binary  utf8mb4 binary ascii latin1"},
+		{"alter table t drop f, drop g, drop h, default character set gbk", "latin1 gbk binary  utf8mb4"},
+		{"alter table t modify a varchar(16)", "gbk gbk binary  utf8mb4"},
+		{"alter table t convert to character set utf8mb4 collate utf8mb4_unicode_ci", "utf8mb4 utf8mb4 binary  utf8mb4"},
+	}
+
+	for _, step := range steps {
+		if err := meta.applyDDL("test", step.query); err != nil {
+			t.Fatalf("%s: %v", step.query, err)
+		}
+		tb, _ := meta.GetTable("test.t")
+		if got := strings.Join(tb.charsets(), " "); got != step.expect {
+			t.Errorf("%s: got charsets %s, expect %s", step.query, got, step.expect)
+		}
+	}
+}
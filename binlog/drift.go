@@ -0,0 +1,141 @@
+/**
+ *  author: lim
+ *  data  : 18-8-17 下午8:20
+ */
+
+package binlog
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/log"
+	"github.com/lemonwx/xsql/mysql"
+)
+
+// binlogTypes the column types in table map event of each column type in information_schema,
+// old temporal types come from tables created before mysql 5.6
+var binlogTypes = map[string][]byte{
+	"tinyint":    {mysql.MYSQL_TYPE_TINY},
+	"bool":       {mysql.MYSQL_TYPE_TINY},
+	"boolean":    {mysql.MYSQL_TYPE_TINY},
+	"smallint":   {mysql.MYSQL_TYPE_SHORT},
+	"mediumint":  {mysql.MYSQL_TYPE_INT24},
+	"int":        {mysql.MYSQL_TYPE_LONG},
+	"integer":    {mysql.MYSQL_TYPE_LONG},
+	"bigint":     {mysql.MYSQL_TYPE_LONGLONG},
+	"float":      {mysql.MYSQL_TYPE_FLOAT},
+	"double":     {mysql.MYSQL_TYPE_DOUBLE},
+	"real":       {mysql.MYSQL_TYPE_DOUBLE},
+	"decimal":    {mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_DECIMAL},
+	"numeric":    {mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_DECIMAL},
+	"date":       {mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_NEWDATE},
+	"datetime":   {mysql.MYSQL_TYPE_DATETIME2, mysql.MYSQL_TYPE_DATETIME},
+	"timestamp":  {mysql.MYSQL_TYPE_TIMESTAMP2, mysql.MYSQL_TYPE_TIMESTAMP},
+	"time":       {mysql.MYSQL_TYPE_TIME2, mysql.MYSQL_TYPE_TIME},
+	"year":       {mysql.MYSQL_TYPE_YEAR},
+	"bit":        {mysql.MYSQL_TYPE_BIT},
+	"char":       {mysql.MYSQL_TYPE_STRING},
+	"binary":     {mysql.MYSQL_TYPE_STRING},
+	"enum":       {mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_ENUM},
+	"set":        {mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_SET},
+	"varchar":    {mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING},
+	"varbinary":  {mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING},
+	"tinytext":   {mysql.MYSQL_TYPE_BLOB},
+	"text":       {mysql.MYSQL_TYPE_BLOB},
+	"mediumtext": {mysql.MYSQL_TYPE_BLOB},
+	"longtext":   {mysql.MYSQL_TYPE_BLOB},
+	"tinyblob":   {mysql.MYSQL_TYPE_BLOB},
+	"blob":       {mysql.MYSQL_TYPE_BLOB},
+	"mediumblob": {mysql.MYSQL_TYPE_BLOB},
+	"longblob":   {mysql.MYSQL_TYPE_BLOB},
+	"json":       {mysql.MYSQL_TYPE_JSON, mysql.MYSQL_TYPE_BLOB},
+}
+
+// typeMatch report whether the column of fieldType can be sent as colType,
+// the types unknown always match
+func typeMatch(fieldType string, colType byte) bool {
+	name := fieldType
+	if idx := strings.IndexAny(name, "( "); idx > 0 {
+		name = name[:idx]
+	}
+	types, ok := binlogTypes[strings.ToLower(name)]
+	if !ok {
+		// geometry, vector and the ones of newer versions
+		return true
+	}
+	for _, t := range types {
+		if t == colType {
+			return true
+		}
+	}
+	return false
+}
+
+// drift unresolved is fetched from master again at most once an interval
+const DRIFT_REFETCH_INTERVAL = time.Minute
+
+// checkDrift compare the columns in table map event with the tracked ones,
+// fetch the table from master if they disagree, ok is false if still disagree
+func (listener *Listener) checkDrift(header *event.EveHeader, tbl *event.TableMapEvent) bool {
+	if listener.meta == nil {
+		return false
+	}
+
+	schema, table := string(tbl.Schema), string(tbl.Table)
+	tb, ok := listener.meta.GetTable(tbl.FullName)
+	if !ok {
+		// syncBinlogAndIfSchema failed to fetch it, already logged
+		return false
+	}
+	err := tb.setupEncodedFieldType(tbl.ColTypes)
+	if err == nil {
+		delete(listener.drifts, tbl.FullName)
+		return true
+	}
+	if fetched, ok := listener.drifts[tbl.FullName]; ok && time.Since(fetched) < DRIFT_REFETCH_INTERVAL {
+		// already logged, wait for the ddl of the table
+		return false
+	}
+
+	listener.drifts[tbl.FullName] = time.Now()
+	log.Errorf("listener: [%v] %s drifts from binlog: %v, fetch from master", listener, tbl.FullName, err)
+	if err = listener.meta.refetch(schema, table); err == nil {
+		if tb, ok = listener.meta.GetTable(tbl.FullName); !ok {
+			err = errors.Errorf("%s not exists on master", tbl.FullName)
+		} else if err = tb.setupEncodedFieldType(tbl.ColTypes); err == nil {
+			delete(listener.drifts, tbl.FullName)
+			listener.emitSchema(header, schema, table)
+			return true
+		}
+	}
+
+	// the tracked one is kept if failed to fetch
+	schemaDrifts.WithLabelValues(listener.Name, tbl.FullName).Inc()
+	tracked := "not exists"
+	if tb != nil {
+		tracked = fieldsDesc(tb)
+	}
+	log.Errorf("listener: [%v] schema drift of %s unresolved: %v, tracked: (%s), binlog: (%s)",
+		listener, tbl.FullName, err, tracked, colTypesDesc(tbl.ColTypes))
+	return false
+}
+
+func fieldsDesc(tb *Table) string {
+	defs := make([]string, 0, len(tb.fields))
+	for _, field := range tb.fields {
+		defs = append(defs, field.fieldName+" "+field.fieldType)
+	}
+	return strings.Join(defs, ", ")
+}
+
+func colTypesDesc(types []byte) string {
+	descs := make([]string, 0, len(types))
+	for _, t := range types {
+		descs = append(descs, fmt.Sprintf("%d", t))
+	}
+	return strings.Join(descs, ", ")
+}
@@ -0,0 +1,89 @@
+/**
+ *  author: lim
+ *  data  : 18-8-17 下午9:05
+ */
+
+package binlog
+
+import (
+	"testing"
+
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/xsql/mysql"
+)
+
+func TestTypeMatch(t *testing.T) {
+	for fieldType, colType := range map[string]byte{
+		"int(11) unsigned": mysql.MYSQL_TYPE_LONG,
+		"varchar(32)":      mysql.MYSQL_TYPE_VARCHAR,
+		"enum('a','b')":    mysql.MYSQL_TYPE_STRING,
+		"datetime(3)":      mysql.MYSQL_TYPE_DATETIME2,
+		"longtext":         mysql.MYSQL_TYPE_BLOB,
+		"point":            mysql.MYSQL_TYPE_GEOMETRY,
+	} {
+		if !typeMatch(fieldType, colType) {
+			t.Errorf("%s should match %d", fieldType, colType)
+		}
+	}
+	if typeMatch("bigint(20)", mysql.MYSQL_TYPE_LONG) || typeMatch("char(4)", mysql.MYSQL_TYPE_VARCHAR) {
+		t.Error("different types should not match")
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	listener := NewBinlogListener("127.0.0.1", 3306, "root", "")
+	// no master to fetch the table from
+	listener.meta = NewInformationSchema(nil)
+	if err := listener.meta.applyDDL("test", "create table t (id int, name varchar(8))"); err != nil {
+		t.Fatal(err)
+	}
+
+	header := &event.EveHeader{EveType: event.TABLE_MAP_EVENT}
+	tbl := &event.TableMapEvent{Schema: []byte("test"), Table: []byte("t"), FullName: "test.t", FieldSize: 2,
+		ColTypes: []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR}}
+	if !listener.checkDrift(header, tbl) {
+		t.Fatal("table map event should match")
+	}
+	tb, _ := listener.meta.GetTable("test.t")
+	if tb.fields[1].encodedfieldType != mysql.MYSQL_TYPE_VARCHAR {
+		t.Errorf("encoded field type should be setup: %d", tb.fields[1].encodedfieldType)
+	}
+
+	for _, types := range [][]byte{
+		// column added by a ddl not seen
+		{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_LONG},
+		// table swapped by online schema change tool
+		{mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_VARCHAR},
+	} {
+		tbl.ColTypes, tbl.FieldSize = types, uint64(len(types))
+		if listener.checkDrift(header, tbl) {
+			t.Errorf("drift of %v should not be resolved", types)
+		}
+		if tb, ok := listener.meta.GetTable("test.t"); !ok || fieldsOf(tb) != "id int, name varchar(8)" {
+			t.Errorf("tracked table should be kept: %v", tb)
+		}
+	}
+
+	// fetched once an interval until the next ddl of the table
+	fetched, ok := listener.drifts["test.t"]
+	if !ok {
+		t.Fatal("drift unresolved should be remembered")
+	}
+	listener.drifts["test.t"] = fetched.Add(-DRIFT_REFETCH_INTERVAL / 2)
+	if listener.checkDrift(header, tbl) || listener.drifts["test.t"] != fetched.Add(-DRIFT_REFETCH_INTERVAL/2) {
+		t.Error("drift should not be fetched again in the interval")
+	}
+	listener.drifts["test.t"] = fetched.Add(-DRIFT_REFETCH_INTERVAL)
+	if listener.checkDrift(header, tbl) || !listener.drifts["test.t"].After(fetched) {
+		t.Error("drift should be fetched again after the interval")
+	}
+
+	query := &event.QueryEvent{Schema: "test", Query: "alter table t modify id bigint"}
+	listener.syncDDL(header, query)
+	if _, ok := listener.drifts["test.t"]; ok {
+		t.Error("drift should be forgotten after the ddl of the table")
+	}
+	if !listener.checkDrift(header, tbl) {
+		t.Error("table map event should match after the ddl")
+	}
+}
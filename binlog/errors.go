@@ -0,0 +1,90 @@
+/**
+ *  author: lim
+ *  data  : 18-8-7 下午9:05
+ */
+
+package binlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	ER_DBACCESS_DENIED_ERROR             = 1044
+	ER_ACCESS_DENIED_ERROR               = 1045
+	ER_SPECIFIC_ACCESS_DENIED_ERROR      = 1227
+	ER_MASTER_FATAL_ERROR_READING_BINLOG = 1236
+	ER_SLAVE_FATAL_ERROR                 = 1593
+)
+
+// policy when the binlog requested has been purged on master
+const (
+	PURGED_FAIL     = "fail"     // stop the listener
+	PURGED_EARLIEST = "earliest" // jump to the earliest binlog on master, mark the gap
+	PURGED_CURRENT  = "current"  // jump to the current position of master, mark the gap
+)
+
+// ReplicationError is an ERR packet master send in the binlog stream
+type ReplicationError struct {
+	Code    uint16
+	State   string
+	Message string
+}
+
+func (e *ReplicationError) Error() string {
+	return fmt.Sprintf("ERROR %d (%s): %s", e.Code, e.State, e.Message)
+}
+
+// IsFatal report whether retry on the same master makes no sense
+func (e *ReplicationError) IsFatal() bool {
+	switch e.Code {
+	case ER_DBACCESS_DENIED_ERROR, ER_ACCESS_DENIED_ERROR, ER_SPECIFIC_ACCESS_DENIED_ERROR,
+		ER_MASTER_FATAL_ERROR_READING_BINLOG, ER_SLAVE_FATAL_ERROR:
+		return true
+	}
+	return false
+}
+
+// IsPurged report whether the binlog requested not exists on master any more
+func (e *ReplicationError) IsPurged() bool {
+	if e.Code != ER_MASTER_FATAL_ERROR_READING_BINLOG {
+		return false
+	}
+
+	msg := strings.ToLower(e.Message)
+	return strings.Contains(msg, "purged") ||
+		strings.Contains(msg, "could not find first log file") ||
+		strings.Contains(msg, "could not find next log")
+}
+
+// parseErrPacket: 0xff, code(2), ['#', state(5)], message
+func parseErrPacket(pkt []byte) *ReplicationError {
+	e := &ReplicationError{State: "HY000"}
+	if len(pkt) < 3 {
+		e.Message = "malformed err packet"
+		return e
+	}
+
+	pos := 1
+	e.Code = binary.LittleEndian.Uint16(pkt[pos:])
+	pos += 2
+
+	if len(pkt) >= pos+6 && pkt[pos] == '#' {
+		e.State = string(pkt[pos+1 : pos+6])
+		pos += 6
+	}
+
+	e.Message = string(pkt[pos:])
+	return e
+}
+
+func checkPurgedPolicy(policy string) error {
+	switch policy {
+	case PURGED_FAIL, PURGED_EARLIEST, PURGED_CURRENT:
+		return nil
+	}
+	return fmt.Errorf("unknown purged policy: %s, must be one of %s/%s/%s",
+		policy, PURGED_FAIL, PURGED_EARLIEST, PURGED_CURRENT)
+}
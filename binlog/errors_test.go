@@ -0,0 +1,53 @@
+/**
+ *  author: lim
+ *  data  : 18-8-31 下午10:10
+ */
+
+package binlog
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// errPkt the ERR packet of code, with the sql state if any
+func errPkt(code uint16, state, msg string) []byte {
+	pkt := []byte{0xff, 0, 0}
+	binary.LittleEndian.PutUint16(pkt[1:], code)
+	if len(state) != 0 {
+		pkt = append(append(pkt, '#'), state...)
+	}
+	return append(pkt, msg...)
+}
+
+func TestParseErrPacket(t *testing.T) {
+	for _, c := range []struct {
+		pkt     []byte
+		code    uint16
+		state   string
+		message string
+		fatal   bool
+		purged  bool
+	}{
+		{errPkt(ER_MASTER_FATAL_ERROR_READING_BINLOG, "HY000",
+			"Could not find first log file name in binary log index file"),
+			ER_MASTER_FATAL_ERROR_READING_BINLOG, "HY000", "Could not find first log file name in binary log index file", true, true},
+		{errPkt(ER_MASTER_FATAL_ERROR_READING_BINLOG, "HY000",
+			"The slave is connecting using CHANGE MASTER TO MASTER_AUTO_POSITION = 1, but the master has purged binary logs"),
+			ER_MASTER_FATAL_ERROR_READING_BINLOG, "HY000", "The slave is connecting using CHANGE MASTER TO MASTER_AUTO_POSITION = 1, but the master has purged binary logs", true, true},
+		{errPkt(ER_MASTER_FATAL_ERROR_READING_BINLOG, "HY000", "A slave with the same server_uuid/server_id as this slave has connected"),
+			ER_MASTER_FATAL_ERROR_READING_BINLOG, "HY000", "A slave with the same server_uuid/server_id as this slave has connected", true, false},
+		{errPkt(ER_ACCESS_DENIED_ERROR, "28000", "Access denied"), ER_ACCESS_DENIED_ERROR, "28000", "Access denied", true, false},
+		// the protocol before 4.1 has no sql state
+		{errPkt(1040, "", "Too many connections"), 1040, "HY000", "Too many connections", false, false},
+		{[]byte{0xff, 1}, 0, "HY000", "malformed err packet", false, false},
+	} {
+		e := parseErrPacket(c.pkt)
+		if e.Code != c.code || e.State != c.state || e.Message != c.message {
+			t.Errorf("unexpect error parsed: %v", e)
+		}
+		if e.IsFatal() != c.fatal || e.IsPurged() != c.purged {
+			t.Errorf("%v: expect fatal %v, purged %v", e, c.fatal, c.purged)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/**
+ *  author: lim
+ *  data  : 18-8-11 下午9:02
+ */
+
+package binlog
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/log"
+	"github.com/lemonwx/xsql/mysql"
+	"github.com/lemonwx/xsql/node"
+)
+
+const (
+	COM_BINLOG_DUMP_GTID = 0x1e
+
+	// COM_BINLOG_DUMP_GTID flags, the gtid set follows the position
+	BINLOG_THROUGH_GTID = 0x04
+)
+
+// Candidate is a master the listener can dump binlog from
+type Candidate struct {
+	Host string
+	Port int
+}
+
+func (cand Candidate) String() string {
+	return net.JoinHostPort(cand.Host, strconv.Itoa(cand.Port))
+}
+
+// ParseCandidate parse host:port
+func ParseCandidate(addr string) (Candidate, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Candidate{}, errors.Trace(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Candidate{}, errors.Errorf("invalid port of candidate %s", addr)
+	}
+	return Candidate{Host: host, Port: port}, nil
+}
+
+// SetCandidates the masters to follow in order when the current one fails,
+// the master NewBinlogListener with is always the first.
+// failover dumps by gtid since binlog file names differ between masters, so it needs
+// the gtids dumped: set by SetGtidSet or SetMariadbGtid, or the ones before the
+// binlog file dumped from the start, see updateTrxState
+func (listener *Listener) SetCandidates(cands []Candidate) {
+	listener.candidates = append([]Candidate{{listener.host, listener.port}}, cands...)
+	listener.candIdx = 0
+}
+
+// SetGtidSet the mysql gtids already dumped, dump the others by COM_BINLOG_DUMP_GTID
+func (listener *Listener) SetGtidSet(gtids string) error {
+	set, err := event.ParseGtidSet(gtids)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	listener.gtids = set
+	return nil
+}
+
+// GtidMode report whether dump by mysql gtid, an empty set dumps by file:pos
+func (listener *Listener) GtidMode() bool {
+	return len(listener.gtids) != 0
+}
+
+// GtidSet the mysql gtids of the transactions send to ch
+func (listener *Listener) GtidSet() string {
+	return listener.gtids.String()
+}
+
+func (listener *Listener) dumpByGtid() bool {
+	return listener.GtidMode() && listener.Flavor == FLAVOR_MYSQL
+}
+
+func (listener *Listener) writeDumpGtidCmd() error {
+	gtidData := listener.gtids.Encode()
+	data := make([]byte, 4+1+2+4+4+8+4+len(gtidData))
+
+	pos := 4
+	data[pos] = COM_BINLOG_DUMP_GTID
+	pos++
+
+	binary.LittleEndian.PutUint16(data[pos:], BINLOG_THROUGH_GTID)
+	pos += 2
+
+	binary.LittleEndian.PutUint32(data[pos:], 123456789)
+	pos += 4
+
+	// no file name, master find the binlog by gtids
+	binary.LittleEndian.PutUint32(data[pos:], 0)
+	pos += 4
+
+	binary.LittleEndian.PutUint64(data[pos:], 4)
+	pos += 8
+
+	binary.LittleEndian.PutUint32(data[pos:], uint32(len(gtidData)))
+	pos += 4
+
+	copy(data[pos:], gtidData)
+
+	listener.SetPktSeq(0)
+	listener.WritePacket(data)
+
+	return nil
+}
+
+// checkGtidExecuted make sure master has all the gtids dumped,
+// otherwise some transactions will be lost or dumped twice
+func (listener *Listener) checkGtidExecuted() error {
+	if listener.Flavor != FLAVOR_MYSQL {
+		return errors.Errorf("dump by mysql gtid, but master is %s", listener.Flavor)
+	}
+
+	ret, err := listener.Execute(mysql.COM_QUERY, []byte("select @@global.gtid_executed"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if ret.Resultset == nil || len(ret.RowDatas) == 0 {
+		return errors.New("select @@global.gtid_executed returns no rows")
+	}
+
+	gtids, _, _, err := mysql.LengthEnodedString(ret.RowDatas[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	executed, err := event.ParseGtidSet(string(gtids))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if !executed.Contain(listener.gtids) {
+		return errors.Errorf("gtid_executed %s not contain the dumped %s", executed, listener.gtids)
+	}
+	return nil
+}
+
+// failover switch to the next candidate has all the gtids dumped,
+// the unfinished transaction is dropped, the new master will send it again
+func (listener *Listener) failover(cause error) error {
+	if len(listener.candidates) < 2 {
+		return errors.Trace(cause)
+	}
+	if !listener.GtidMode() && len(listener.mariadbGtids) == 0 {
+		// the binlog file names of another master tell nothing
+		return errors.Annotatef(cause, "no gtid dumped to failover by")
+	}
+
+	if err := listener.dropTrx(); err != nil {
+		return errors.Annotatef(cause, "%v", err)
+	}
+	for i := 1; i <= len(listener.candidates); i++ {
+		idx := (listener.candIdx + i) % len(listener.candidates)
+		if err := listener.switchTo(idx); err != nil {
+			log.Errorf("listener: [%v] switch to %v failed: %v", listener, listener.candidates[idx], err)
+			continue
+		}
+
+		failovers.WithLabelValues(listener.Name).Inc()
+		log.Errorf("listener: [%v] %v, failover to %v", listener, cause, listener.candidates[idx])
+		return nil
+	}
+	return errors.Annotatef(cause, "no candidate available")
+}
+
+func (listener *Listener) switchTo(idx int) error {
+	cand := listener.candidates[idx]
+
+	listener.nodeLock.Lock()
+	listener.Node.Close()
+	listener.Node = node.NewNode(cand.Host, cand.Port, listener.user, listener.password, DEFAULT_SCHEMA, 0)
+	listener.nodeLock.Unlock()
+
+	listener.candIdx = idx
+	// binlog files differ between masters, the fake rotate event tells where the dump starts
+	listener.CurPos, listener.trxPos = Pos{}, Pos{}
+	return errors.Trace(listener.connect())
+}
+
+// dropTrx discard the events of the unfinished transaction, the master will send it again,
+// fail if some of its events already send to ch
+func (listener *Listener) dropTrx() error {
+	if listener.sent != 0 {
+		return errors.Errorf("%d events of the unfinished transaction already send", listener.sent)
+	}
+	if len(listener.trx) != 0 {
+		log.Errorf("listener: [%v] drop %d events of the unfinished transaction", listener, len(listener.trx))
+	}
+	listener.trx = listener.trx[:0]
+	listener.schemaEve = listener.schemaEve[:0]
+	// SchemaEvents dropped will be send again, the syncer drops the duplicate ones
+	listener.versioned = map[string]bool{}
+	listener.curGtid = nil
+	listener.curMariadbGtid = nil
+	listener.inTrx, listener.explicit = false, false
+
+	// table id is only valid in the same connection
+	listener.tables = map[uint64]*event.TableMapEvent{}
+	listener.skipped = map[uint64]bool{}
+	listener.curTblEve = nil
+	return nil
+}
+
+// closeNode may be called by other goroutine while failover replacing the node
+func (listener *Listener) closeNode() {
+	listener.nodeLock.Lock()
+	defer listener.nodeLock.Unlock()
+	listener.Node.Close()
+}
@@ -0,0 +1,58 @@
+/**
+ *  author: lim
+ *  data  : 18-8-31 下午8:40
+ */
+
+package binlog
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lemonwx/go-canal/event"
+)
+
+func TestFailoverGtids(t *testing.T) {
+	listener := NewBinlogListener("127.0.0.1", 3306, "root", "")
+	listener.Flavor = FLAVOR_MYSQL
+	listener.SetCandidates([]Candidate{{"127.0.0.1", 3307}})
+	if listener.GtidMode() || listener.dumpByGtid() {
+		t.Error("candidates alone should dump by file:pos")
+	}
+
+	// nothing to find the position on another master by
+	cause := errors.New("read pkt failed")
+	if err := listener.failover(cause); err == nil || !strings.Contains(err.Error(), "no gtid dumped") {
+		t.Errorf("expect failover refused without gtids, got %v", err)
+	}
+
+	// dumped from the start of a binlog file, the gtids before it and the ones dumped
+	listener.updateTrxState(&event.PreGtidLogEvent{Gtids: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"})
+	data := make([]byte, 42)
+	sid, _ := hex.DecodeString("3e11fa4771ca11e19e33c80aa9429562")
+	copy(data[1:], sid)
+	binary.LittleEndian.PutUint64(data[17:], 6)
+	gtid := &event.GtidEvent{}
+	if err := gtid.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	listener.updateTrxState(gtid)
+	listener.updateTrxState(&event.XidEvnet{})
+	if !listener.dumpByGtid() || listener.GtidSet() != "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6" {
+		t.Errorf("unexpect gtids to failover by: %s", listener.GtidSet())
+	}
+
+	// part of a large transaction send, the new master would send it again
+	listener.sent = MAX_TRX_EVENTS
+	if err := listener.failover(cause); err == nil || !strings.Contains(err.Error(), "already send") {
+		t.Errorf("expect failover refused in a transaction partly send, got %v", err)
+	}
+	listener.sent = 0
+	listener.trx = []event.Event{gtid}
+	if err := listener.dropTrx(); err != nil || len(listener.trx) != 0 {
+		t.Errorf("expect the unfinished transaction dropped: %v", err)
+	}
+}
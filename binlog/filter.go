@@ -0,0 +1,114 @@
+/**
+ *  author: lim
+ *  data  : 18-8-4 下午8:15
+ */
+
+package binlog
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Filter decides which schema.table will be decoded by the listener.
+//
+// a rule can be:
+//
+//	db.tb        exact name
+//	db           every table in db
+//	db_*.tb_?    wildcards, * matches any chars, ? matches one char
+//	~^db\d+\.tb$ regexp on schema.table, must start with ~
+//
+// empty includes means include all, excludes always win
+type Filter struct {
+	includes []*regexp.Regexp
+	excludes []*regexp.Regexp
+
+	cache map[string]bool
+}
+
+func NewFilter(includes, excludes []string) (*Filter, error) {
+	filter := &Filter{cache: make(map[string]bool)}
+
+	var err error
+	if filter.includes, err = compileRules(includes); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if filter.excludes, err = compileRules(excludes); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return filter, nil
+}
+
+func compileRules(rules []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if len(rule) == 0 {
+			continue
+		}
+
+		expr := ""
+		if rule[0] == '~' {
+			expr = rule[1:]
+		} else {
+			if !strings.Contains(rule, ".") {
+				rule += ".*"
+			}
+			expr = wildcardToRegexp(rule)
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Errorf("invalid filter rule %s: %v", rule, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func wildcardToRegexp(rule string) string {
+	buf := make([]string, 0, len(rule))
+	for _, c := range rule {
+		switch c {
+		case '*':
+			buf = append(buf, ".*")
+		case '?':
+			buf = append(buf, ".")
+		default:
+			buf = append(buf, regexp.QuoteMeta(string(c)))
+		}
+	}
+	return "^" + strings.Join(buf, "") + "$"
+}
+
+func matchAny(rules []*regexp.Regexp, fullName string) bool {
+	for _, re := range rules {
+		if re.MatchString(fullName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match report whether schema.table should be decoded
+func (filter *Filter) Match(schema, table string) bool {
+	if filter == nil {
+		return true
+	}
+
+	fullName := schema + "." + table
+	if ok, hit := filter.cache[fullName]; hit {
+		return ok
+	}
+
+	ok := len(filter.includes) == 0 || matchAny(filter.includes, fullName)
+	if ok && matchAny(filter.excludes, fullName) {
+		ok = false
+	}
+
+	filter.cache[fullName] = ok
+	return ok
+}
@@ -0,0 +1,123 @@
+/**
+ *  author: lim
+ *  data  : 18-8-4 下午9:02
+ */
+
+package binlog
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lemonwx/go-canal/config"
+)
+
+func TestFilterMatch(t *testing.T) {
+	filter, err := NewFilter(
+		[]string{"db1", "db2.user_*", "db3.t?", `~^shard_\d+\.orders$`},
+		[]string{"db1.tmp", "db2.user_log"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		schema, table string
+		expect        bool
+	}{
+		{"db1", "t1", true},
+		{"db1", "tmp", false},
+		{"db2", "user_info", true},
+		{"db2", "user_log", false},
+		{"db2", "order", false},
+		{"db3", "t1", true},
+		{"db3", "t12", false},
+		{"shard_12", "orders", true},
+		{"shard_x", "orders", false},
+		{"db4", "t1", false},
+	}
+
+	for _, c := range cases {
+		if got := filter.Match(c.schema, c.table); got != c.expect {
+			t.Errorf("%s.%s: expect %v, got %v", c.schema, c.table, c.expect, got)
+		}
+	}
+}
+
+func TestFilterEmptyInclude(t *testing.T) {
+	filter, err := NewFilter(nil, []string{"mysql"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !filter.Match("db1", "t1") {
+		t.Error("empty include should match all tables")
+	}
+	if filter.Match("mysql", "user") {
+		t.Error("mysql.user should be excluded")
+	}
+
+	var nilFilter *Filter
+	if !nilFilter.Match("db1", "t1") {
+		t.Error("nil filter should match all tables")
+	}
+
+	if _, err := NewFilter([]string{"~(db"}, nil); err == nil {
+		t.Error("invalid regexp should fail")
+	}
+}
+
+func TestFilterFromConfig(t *testing.T) {
+	// the filter of the single master
+	cfg, err := config.ReadConfigFile("../config/t.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := cfg.GetSources()[0]
+	filter, err := NewFilter(src.Filter.Include, src.Filter.Exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Match("test", "t1") || filter.Match("test", "tmp_t1") || filter.Match("db1", "t1") {
+		t.Errorf("unexpect filter of the master: %+v", src.Filter)
+	}
+
+	// the filter of every source
+	f, err := ioutil.TempFile("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+sources:
+  - name: order
+    filter:
+      include: [order.*]
+  - name: user
+    filter:
+      exclude: [user.log]
+`)
+	f.Close()
+	if cfg, err = config.ReadConfigFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		schema, table string
+		expect        []bool
+	}{
+		{"order", "t1", []bool{true, true}},
+		{"user", "t1", []bool{false, true}},
+		{"user", "log", []bool{false, false}},
+	} {
+		for idx, src := range cfg.GetSources() {
+			filter, err := NewFilter(src.Filter.Include, src.Filter.Exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter.Match(c.schema, c.table); got != c.expect[idx] {
+				t.Errorf("%s %s.%s: expect %v, got %v", src.Name, c.schema, c.table, c.expect[idx], got)
+			}
+		}
+	}
+}
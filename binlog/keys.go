@@ -0,0 +1,158 @@
+/**
+ *  author: lim
+ *  data  : 18-8-15 下午8:45
+ */
+
+package binlog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/xsql/mysql"
+)
+
+// PrimaryKey columns, nil if the table has no primary key
+func (table *Table) PrimaryKey() []string {
+	if len(table.keys) != 0 && table.keys[0].Name == event.PRIMARY_KEY {
+		return table.keys[0].Columns
+	}
+	return nil
+}
+
+// UniqueKeys include the primary key
+func (table *Table) UniqueKeys() []event.KeyDef {
+	return table.keys
+}
+
+// RowKey columns identify a row, see event.RowKey
+func (table *Table) RowKey() []string {
+	return event.RowKey(table.keys)
+}
+
+func (table *Table) keyIdx(name string) int {
+	for idx, key := range table.keys {
+		if strings.EqualFold(key.Name, name) {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (table *Table) addKey(key event.KeyDef) {
+	table.keys = appendKey(table.keys, key)
+}
+
+// appendKey replace the key with the same name, the primary key is always the first
+func appendKey(keys []event.KeyDef, key event.KeyDef) []event.KeyDef {
+	for idx := range keys {
+		if strings.EqualFold(keys[idx].Name, key.Name) {
+			keys[idx] = key
+			return keys
+		}
+	}
+	if key.Name == event.PRIMARY_KEY {
+		return append([]event.KeyDef{key}, keys...)
+	}
+	return append(keys, key)
+}
+
+// dropKey the index not unique is never tracked, ignore it
+func (table *Table) dropKey(name string) {
+	if idx := table.keyIdx(name); idx >= 0 {
+		table.keys = append(table.keys[:idx], table.keys[idx+1:]...)
+	}
+}
+
+func (table *Table) renameKey(name, newName string) {
+	if idx := table.keyIdx(name); idx >= 0 {
+		table.keys[idx].Name = newName
+	}
+}
+
+// renameKeyColumn after the column renamed
+func (table *Table) renameKeyColumn(name, newName string) {
+	for _, key := range table.keys {
+		for idx, col := range key.Columns {
+			if strings.EqualFold(col, name) {
+				key.Columns[idx] = newName
+			}
+		}
+	}
+}
+
+// dropKeyColumn after the column dropped, the key without columns left is dropped too
+func (table *Table) dropKeyColumn(name string) {
+	keys := table.keys[:0]
+	for _, key := range table.keys {
+		cols := make([]string, 0, len(key.Columns))
+		for _, col := range key.Columns {
+			if !strings.EqualFold(col, name) {
+				cols = append(cols, col)
+			}
+		}
+		if len(cols) != 0 {
+			key.Columns = cols
+			keys = append(keys, key)
+		}
+	}
+	table.keys = keys
+}
+
+func copyKeys(keys []event.KeyDef) []event.KeyDef {
+	copied := make([]event.KeyDef, 0, len(keys))
+	for _, key := range keys {
+		copied = append(copied, event.KeyDef{Name: key.Name, Columns: append([]string(nil), key.Columns...)})
+	}
+	return copied
+}
+
+// parseKeys load the primary and unique keys of the tables already in meta
+func (meta *InformationSchema) parseKeys(exec executor, schema, table string) error {
+	sql := "select TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, COLUMN_NAME from information_schema.STATISTICS " +
+		"where NON_UNIQUE = 0 and table_schema not in('mysql', 'information_schema', 'performance_schema', 'sys')"
+
+	if len(schema) != 0 {
+		sql += fmt.Sprintf(" and TABLE_SCHEMA = %s", quote(schema))
+	}
+	if len(table) != 0 {
+		sql += fmt.Sprintf(" and TABLE_NAME = %s", quote(table))
+	}
+	sql += " order by TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX"
+	ret, err := exec.Execute(mysql.COM_QUERY, []byte(sql))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	seen := make(map[*Table]bool)
+	for _, row := range ret.RowDatas {
+		vals := make([]string, 0, 4)
+		pos := 0
+		for i := 0; i < 4; i++ {
+			val, _, size, err := mysql.LengthEnodedString(row[pos:])
+			if err != nil {
+				return errors.Trace(err)
+			}
+			vals = append(vals, string(val))
+			pos += size
+		}
+
+		tb, ok := meta.tbs[fullName(vals[0], vals[1])]
+		if !ok {
+			continue
+		}
+		if !seen[tb] {
+			// loaded again, drop the stale keys
+			seen[tb] = true
+			tb.keys = nil
+		}
+		if idx := tb.keyIdx(vals[2]); idx >= 0 {
+			tb.keys[idx].Columns = append(tb.keys[idx].Columns, vals[3])
+		} else {
+			tb.addKey(event.KeyDef{Name: vals[2], Columns: []string{vals[3]}})
+		}
+	}
+	return nil
+}
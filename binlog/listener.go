@@ -6,9 +6,14 @@
 package binlog
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
-
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/juju/errors"
 	"github.com/lemonwx/go-canal/event"
 	"github.com/lemonwx/log"
@@ -18,6 +23,17 @@ import (
 
 const (
 	DEFAULT_SCHEMA = "information_schema"
+
+	// max time Stop waits for the current transaction to finish
+	STOP_TIMEOUT = 10 * time.Second
+
+	// delay before reconnect, doubled after every failure until the max
+	RECONNECT_BACKOFF     = time.Second
+	MAX_RECONNECT_BACKOFF = time.Minute
+
+	// events of a transaction buffered at most, the ones of a larger transaction are send
+	// before it ends, and it can't be dropped then
+	MAX_TRX_EVENTS = 10000
 )
 
 type Pos struct {
@@ -27,10 +43,45 @@ type Pos struct {
 
 type Listener struct {
 	*node.Node
+	nodeLock  sync.Mutex
+	Name      string // source name, tagged on every event
 	meta      *InformationSchema
 	tables    map[uint64]*event.TableMapEvent
+	skipped   map[uint64]bool
 	curTblEve *event.TableMapEvent
+	filter    *Filter
 	CurPos    Pos
+
+	inTrx     bool // owned by the read loop of Start
+	explicit  bool // the transaction is begun by BEGIN, ends with COMMIT or XID only
+	idle      bool // the read loop reads between transactions, see closeIdle
+	idleLock  sync.Mutex
+	trx       []event.Event        // events of the current transaction, send to ch when it ends
+	trxPos    Pos                  // where the current transaction begins
+	sent      int                  // events of the current transaction already send, see MAX_TRX_EVENTS
+	versioned map[string]bool      // tables whose definition has been send by SchemaEvent
+	drifts    map[string]time.Time // tables drift unresolved until their next ddl, to when fetched last
+	schemaEve []event.Event        // SchemaEvents follow the current event
+	connected bool
+	cancel    context.CancelFunc // of the running Start
+	stopped   bool               // Stop called, Start returns at once if not running yet
+	stopLock  sync.Mutex
+
+	purgedPolicy string
+	pendingGap   *event.GapEvent
+
+	Flavor         string
+	mariadbGtids   MariadbGtidSet     // executed gtids, for mariadb only
+	curMariadbGtid *event.MariadbGtid // gtid of the transaction not finished
+
+	host       string
+	port       int
+	user       string
+	password   string
+	candidates []Candidate
+	candIdx    int
+	gtids      event.GtidSet    // executed gtids, for mysql gtid mode only
+	curGtid    *event.GtidEvent // gtid of the transaction not finished
 }
 
 func (listener *Listener) String() string {
@@ -39,14 +90,39 @@ func (listener *Listener) String() string {
 
 func NewBinlogListener(host string, port int, user, password string) *Listener {
 	node := node.NewNode(host, port, user, password, DEFAULT_SCHEMA, 0)
-	return &Listener{Node: node, tables: map[uint64]*event.TableMapEvent{}}
+	return &Listener{
+		Node:      node,
+		tables:    map[uint64]*event.TableMapEvent{},
+		skipped:   map[uint64]bool{},
+		versioned: map[string]bool{},
+		drifts:    map[string]time.Time{},
+
+		purgedPolicy: PURGED_FAIL,
+
+		host:     host,
+		port:     port,
+		user:     user,
+		password: password,
+	}
+}
+
+// SetFilter limit the tables whose rows will be decoded, nil means all tables
+func (listener *Listener) SetFilter(filter *Filter) {
+	listener.filter = filter
 }
 
 func (listener *Listener) getFileAndPos() (string, uint32, error) {
+	if listener.dumpByMariadbGtid() {
+		// master find the binlog by @slave_connect_state
+		return "", 4, nil
+	}
 	return listener.CurPos.FileName, listener.CurPos.Pos, nil
 }
 
 func (listener *Listener) writeDumpCmd() error {
+	if listener.dumpByGtid() {
+		return listener.writeDumpGtidCmd()
+	}
 
 	logName, logPos, err := listener.getFileAndPos()
 	if err != nil {
@@ -62,7 +138,7 @@ func (listener *Listener) writeDumpCmd() error {
 	binary.LittleEndian.PutUint32(data[pos:], logPos)
 	pos += 4
 
-	binary.LittleEndian.PutUint16(data[pos:], 0)
+	binary.LittleEndian.PutUint16(data[pos:], listener.dumpFlags())
 	pos += 2
 
 	binary.LittleEndian.PutUint32(data[pos:], 123456789)
@@ -77,63 +153,459 @@ func (listener *Listener) writeDumpCmd() error {
 }
 
 func (listener *Listener) Init(pos Pos) error {
-	listener.CurPos = pos
+	listener.CurPos, listener.trxPos = pos, pos
+
+	if err := listener.connect(); err != nil {
+		if err = listener.failover(err); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// 确定 dump 开始的文件和位置后, 全量同步一次 元数据
+	// 若在 show master status 之前元数据有变化, 则全量可以同步到
+	// 若在 show master statsu 之后元数据有变化, 则可以通过binlog 增量同步到
+	if listener.meta == nil {
+		meta := NewInformationSchema(listener)
+		meta.parseMeta(listener, "", "")
+		listener.meta = meta
+	}
 
+	if err := listener.writeDumpCmd(); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (listener *Listener) connect() error {
+	if listener.connected {
+		reconnects.WithLabelValues(listener.Name).Inc()
+	}
 	err := listener.Connect()
 	if err != nil {
 		return errors.Trace(err)
 	}
+	listener.connected = true
+
+	if err = listener.detectFlavor(); err != nil {
+		return errors.Trace(err)
+	}
 
 	_, err = listener.Execute(mysql.COM_QUERY, []byte("set @master_binlog_checksum= @@global.binlog_checksum"))
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	if listener.Flavor == FLAVOR_MARIADB {
+		if err = listener.mariadbHandshake(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if listener.GtidMode() {
+		if err = listener.checkGtidExecuted(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
 	_, err = listener.Execute(mysql.COM_QUERY, []byte("show master status"))
 	if err != nil {
 		return errors.Trace(err)
 	}
+	return nil
+}
 
-	// 确定 dump 开始的文件和位置后, 全量同步一次 元数据
-	// 若在 show master status 之前元数据有变化, 则全量可以同步到
-	// 若在 show master statsu 之后元数据有变化, 则可以通过binlog 增量同步到
-	meta := NewInformationSchema(listener)
-	meta.parseMeta("", "")
-	listener.meta = meta
+// reconnect dump again from the end of the last transaction complete, or the gtids in gtid mode,
+// retry with backoff until ctx done
+func (listener *Listener) reconnect(ctx context.Context) error {
+	// the unfinished transaction will be send again, table ids are only valid in the same connection
+	if err := listener.dropTrx(); err != nil {
+		return errors.Trace(err)
+	}
+	listener.CurPos = listener.trxPos
+
+	backoff := RECONNECT_BACKOFF
+	for {
+		listener.Close()
+		err := listener.connect()
+		if err == nil {
+			return errors.Trace(listener.writeDumpCmd())
+		}
+		log.Errorf("listener: [%v] reconnect failed: %v, retry after %v", listener, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return errors.Trace(err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > MAX_RECONNECT_BACKOFF {
+			backoff = MAX_RECONNECT_BACKOFF
+		}
+	}
+}
 
-	if err = listener.writeDumpCmd(); err != nil {
+// readFailed failover to another candidate, or reconnect the same master if it's the only one
+func (listener *Listener) readFailed(ctx context.Context, cause error) error {
+	if len(listener.candidates) < 2 {
+		return errors.Trace(listener.reconnect(ctx))
+	}
+	if err := listener.failover(cause); err != nil {
 		return errors.Trace(err)
 	}
+	return errors.Trace(listener.writeDumpCmd())
+}
+
+// SetPurgedPolicy decide what to do when the binlog requested has been purged, default PURGED_FAIL
+func (listener *Listener) SetPurgedPolicy(policy string) error {
+	if err := checkPurgedPolicy(policy); err != nil {
+		return errors.Trace(err)
+	}
+	listener.purgedPolicy = policy
 	return nil
 }
 
-func (listener *Listener) Start(ch chan event.Event) error {
+// skipPurged jump to the position decided by purgedPolicy,
+// a GapEvent will be send after the fake rotate event of the new binlog
+func (listener *Listener) skipPurged(cause *ReplicationError) error {
+	from := listener.CurPos
+
+	listener.Close()
+	if err := listener.connect(); err != nil {
+		return errors.Trace(err)
+	}
+
+	var to Pos
+	var err error
+	switch listener.purgedPolicy {
+	case PURGED_EARLIEST:
+		to, err = listener.queryPos("show binary logs", false)
+	case PURGED_CURRENT:
+		to, err = listener.queryPos("show master status", true)
+	default:
+		return errors.Trace(cause)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	log.Errorf("listener: [%v] %v, jump to %v by policy %s", listener, cause, to, listener.purgedPolicy)
+	listener.pendingGap = event.NewGapEvent(from.FileName, from.Pos, to.FileName, to.Pos, cause.Message)
+	listener.pendingGap.Header.Source = listener.Name
+	listener.CurPos, listener.trxPos = to, to
+	return errors.Trace(listener.writeDumpCmd())
+}
+
+// queryPos get binlog file name from the first column of the first row,
+// and position from the second column if withPos
+func (listener *Listener) queryPos(sql string, withPos bool) (Pos, error) {
+	ret, err := listener.Execute(mysql.COM_QUERY, []byte(sql))
+	if err != nil {
+		return Pos{}, errors.Trace(err)
+	}
+	if ret.Resultset == nil || len(ret.RowDatas) == 0 {
+		return Pos{}, errors.Errorf("%s returns no rows, is binlog enabled?", sql)
+	}
+
+	row := ret.RowDatas[0]
+	fileName, _, size, err := mysql.LengthEnodedString(row)
+	if err != nil {
+		return Pos{}, errors.Trace(err)
+	}
+
+	pos := Pos{FileName: string(fileName), Pos: 4}
+	if withPos {
+		posBin, _, _, err := mysql.LengthEnodedString(row[size:])
+		if err != nil {
+			return Pos{}, errors.Trace(err)
+		}
+		p, err := strconv.ParseUint(string(posBin), 10, 32)
+		if err != nil {
+			return Pos{}, errors.Trace(err)
+		}
+		pos.Pos = uint32(p)
+	}
+	return pos, nil
+}
+
+// Start read binlog events from master and send them to ch until ctx done or Stop called.
+// if stopped in the middle of a transaction, keep reading until the transaction ends.
+// a transaction is send to ch after it ends, so the unfinished one can be dropped
+// if failover to another candidate, the events between transactions are send one by one
+func (listener *Listener) Start(ctx context.Context, ch chan *event.Transaction) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	listener.stopLock.Lock()
+	listener.cancel = cancel
+	if listener.stopped {
+		cancel()
+	}
+	listener.stopLock.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		<-ctx.Done()
+		if listener.closeIdle() {
+			return
+		}
+		// the read loop returns when the transaction ends
+		select {
+		case <-done:
+		case <-time.After(STOP_TIMEOUT):
+			log.Errorf("listener: [%v] wait trx end timeout, force stop", listener)
+		}
+		// ReadPacket blocks, close the conn to wake it up
+		listener.closeNode()
+	}()
 
 	for {
-		pkt, err := listener.ReadPacket()
+		pkt, stopped, err := listener.readPacket(ctx)
+		if stopped {
+			log.Debugf("listener: [%v] stopped", listener)
+			return nil
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				// forced to stop in the middle of the transaction
+				listener.stopInTrx(ctx, ch, "stop timeout")
+				log.Debugf("listener: [%v] stopped", listener)
+				return nil
+			}
 			log.Errorf("listener: [%v] read pkt failed: %v", listener, err)
-			return errors.Trace(err)
-			break
+			if err = listener.readFailed(ctx, err); err != nil {
+				return errors.Trace(err)
+			}
+			continue
 		}
 
 		switch pkt[0] {
 		case mysql.ERR_HEADER:
-			log.Debug(string(pkt[1:]))
-		case mysql.OK_HEADER:
-			header := &event.EveHeader{}
-			header.Decode(pkt)
-			//log.Debug(header.Dump(), pkt)
+			rerr := parseErrPacket(pkt)
+			if rerr.IsPurged() && listener.purgedPolicy != PURGED_FAIL {
+				if err = listener.skipPurged(rerr); err != nil {
+					return errors.Trace(err)
+				}
+				continue
+			}
+
+			if rerr.IsFatal() {
+				log.Errorf("listener: [%v] recv fatal error: %v", listener, rerr)
+				if err = listener.failover(rerr); err != nil {
+					return errors.Trace(err)
+				}
+				if err = listener.writeDumpCmd(); err != nil {
+					return errors.Trace(err)
+				}
+				continue
+			}
 
-			event, err := listener.parseEvent(header, pkt[event.EventHeaderSize:])
+			log.Errorf("listener: [%v] recv error: %v, reconnect", listener, rerr)
+			if err = listener.reconnect(ctx); err != nil {
+				return errors.Trace(err)
+			}
+		case mysql.OK_HEADER:
+			header, eve, err := listener.decodeEvent(pkt)
 			if err != nil {
+				// skipping the event loses its rows, stop at the last transaction complete instead
+				decodeErrors.WithLabelValues(listener.Name).Inc()
+				listener.stopInTrx(ctx, ch, err.Error())
+				return errors.Annotatef(err, "stop at %v", listener.CurPos)
+			}
 
+			observeEvent(listener.Name, header, eve, len(pkt))
+			if len(listener.trx) == 0 && listener.sent == 0 {
+				listener.trxPos = listener.CurPos
+			}
+			listener.updatePos(header, eve)
+			observePos(listener.Name, listener.CurPos)
+			listener.updateTrxState(eve)
+			if eve != nil {
+				listener.trx = append(listener.trx, eve)
+			}
+			listener.trx = append(listener.trx, listener.schemaEve...)
+			listener.schemaEve = listener.schemaEve[:0]
+
+			if listener.pendingGap != nil && header.EveType == event.ROTATE_EVENT {
+				listener.trx = append(listener.trx, listener.pendingGap)
+				listener.pendingGap = nil
 			}
 
-			ch <- event
+			if !listener.inTrx && len(listener.trx) != 0 || len(listener.trx) >= MAX_TRX_EVENTS {
+				if !listener.send(ctx, ch, event.NewTransaction(listener.trxPos.FileName, listener.trx)) {
+					listener.stopInTrx(ctx, nil, "no syncer receives")
+					return errors.Errorf("no syncer receives the transaction, stop at %v", listener.CurPos)
+				}
+				// owned by the transaction send
+				if listener.inTrx {
+					listener.sent += len(listener.trx)
+				} else {
+					listener.sent = 0
+				}
+				listener.trx = nil
+			}
 		}
 	}
-	return nil
+}
+
+// Stop the running Start, it returns after the current transaction finished
+func (listener *Listener) Stop() {
+	listener.stopLock.Lock()
+	defer listener.stopLock.Unlock()
+	listener.stopped = true
+	if listener.cancel != nil {
+		listener.cancel()
+	}
+}
+
+// send trx to ch, the syncer may exit after ctx done, so waits for it at most STOP_TIMEOUT then
+func (listener *Listener) send(ctx context.Context, ch chan<- *event.Transaction, trx *event.Transaction) bool {
+	select {
+	case ch <- trx:
+		return true
+	case <-ctx.Done():
+	}
+	select {
+	case ch <- trx:
+		return true
+	case <-time.After(STOP_TIMEOUT):
+		return false
+	}
+}
+
+// stopInTrx drop the unfinished transaction and rewind to its begin, or if part of it already send,
+// keep CurPos and send the events read with a GapEvent marks the rest lost, unless ch is nil
+func (listener *Listener) stopInTrx(ctx context.Context, ch chan<- *event.Transaction, reason string) {
+	if listener.sent == 0 {
+		listener.trx = nil
+		listener.CurPos = listener.trxPos
+		return
+	}
+
+	pos := listener.CurPos
+	gap := event.NewGapEvent(pos.FileName, pos.Pos, pos.FileName, pos.Pos,
+		fmt.Sprintf("transaction from %v partly send, the rest lost: %s", listener.trxPos, reason))
+	gap.Header.Source = listener.Name
+	trx := event.NewTransaction(listener.trxPos.FileName, append(listener.trx, gap))
+	listener.trx = nil
+	if ch == nil || !listener.send(ctx, ch, trx) {
+		log.Errorf("listener: [%v] %s", listener, gap.Dump())
+	}
+}
+
+// readPacket checks ctx.Done before reading between transactions, stopped is true if done,
+// the one blocked there is woken up by closeIdle
+func (listener *Listener) readPacket(ctx context.Context) (pkt []byte, stopped bool, err error) {
+	listener.setIdle(!listener.inTrx)
+	defer listener.setIdle(false)
+
+	if !listener.inTrx {
+		select {
+		case <-ctx.Done():
+			return nil, true, nil
+		default:
+		}
+	}
+	pkt, err = listener.ReadPacket()
+	return pkt, !listener.inTrx && ctx.Err() != nil, err
+}
+
+func (listener *Listener) setIdle(idle bool) {
+	listener.idleLock.Lock()
+	defer listener.idleLock.Unlock()
+	listener.idle = idle
+}
+
+// closeIdle close the conn if the read loop reads between transactions, false if it's in one.
+// called after ctx done, the read loop never reads between transactions from then on
+func (listener *Listener) closeIdle() bool {
+	listener.idleLock.Lock()
+	defer listener.idleLock.Unlock()
+	if listener.idle {
+		listener.closeNode()
+	}
+	return listener.idle
+}
+
+func (listener *Listener) updateTrxState(eve event.Event) {
+	switch e := eve.(type) {
+	case *event.GtidEvent:
+		listener.inTrx, listener.explicit = true, false
+		listener.curGtid = e
+	case *event.PreGtidLogEvent:
+		// gtids executed in binlogs before, they will never be dumped,
+		// all the gtids dumped from then on if to failover by them
+		if listener.gtids == nil && len(listener.candidates) > 1 {
+			listener.gtids = make(event.GtidSet)
+		}
+		if listener.gtids != nil {
+			if set, err := event.ParseGtidSet(e.Gtids); err == nil {
+				listener.gtids.Merge(set)
+			}
+		}
+	case *event.MariadbGtidEvent:
+		listener.inTrx, listener.explicit = true, false
+		listener.curMariadbGtid = &e.Gtid
+	case *event.XidEvnet:
+		listener.endTrx()
+	case *event.QueryEvent:
+		switch {
+		case event.BeginsTransaction(e):
+			listener.inTrx, listener.explicit = true, true
+		case event.CommitsTransaction(e) || !listener.explicit:
+			// the ddl ends its own transaction, SAVEPOINT and ROLLBACK TO are in the one begun
+			listener.endTrx()
+		}
+	}
+}
+
+func (listener *Listener) endTrx() {
+	listener.inTrx, listener.explicit = false, false
+	if listener.curGtid != nil {
+		if listener.gtids != nil {
+			listener.gtids.Add(listener.curGtid.Sid(), listener.curGtid.Gno())
+		}
+		listener.curGtid = nil
+	}
+	if listener.curMariadbGtid != nil {
+		if listener.mariadbGtids == nil {
+			listener.mariadbGtids = make(MariadbGtidSet)
+		}
+		listener.mariadbGtids.Update(*listener.curMariadbGtid)
+		listener.curMariadbGtid = nil
+	}
+}
+
+// updatePos advance CurPos for every event, include the filtered ones
+func (listener *Listener) updatePos(header *event.EveHeader, eve event.Event) {
+	if rotate, ok := eve.(*event.RotateEvent); ok {
+		listener.CurPos = Pos{FileName: rotate.NextBinlog, Pos: uint32(rotate.Pos)}
+		return
+	}
+
+	if header.LogPos != 0 {
+		listener.CurPos.Pos = header.LogPos
+	}
+}
+
+// decodeEvent of the OK packet, a malformed one is an error, not a panic
+func (listener *Listener) decodeEvent(pkt []byte) (header *event.EveHeader, eve event.Event, err error) {
+	header = &event.EveHeader{Source: listener.Name}
+	if len(pkt) < event.EventHeaderSize+4 {
+		return nil, nil, errors.Errorf("event packet of %d bytes too short", len(pkt))
+	}
+	if err = header.Decode(pkt); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			eve, err = nil, errors.Errorf("decode %s: malformed event: %v", header.Dump(), r)
+		}
+	}()
+	if eve, err = listener.parseEvent(header, pkt[event.EventHeaderSize:]); err != nil {
+		return nil, nil, errors.Annotatef(err, "decode %s", header.Dump())
+	}
+	return header, eve, nil
 }
 
 func (listener *Listener) parseEvent(header *event.EveHeader, data []byte) (event.Event, error) {
@@ -150,9 +622,18 @@ func (listener *Listener) parseEvent(header *event.EveHeader, data []byte) (even
 		eve = &event.QueryEvent{Header: header}
 	case event.TABLE_MAP_EVENT:
 		eve = &event.TableMapEvent{Header: header}
-	case event.WRITE_ROWS_EVENT_V2, event.DELETE_ROWS_EVENT_V2:
-		log.Debug(listener.curTblEve)
-		eve = &event.RowsEvent{Header: header, Table: listener.curTblEve}
+	case event.WRITE_ROWS_EVENT_V1, event.UPDATE_ROWS_EVENT_V1, event.DELETE_ROWS_EVENT_V1,
+		event.WRITE_ROWS_EVENT_V2, event.UPDATE_ROWS_EVENT_V2, event.DELETE_ROWS_EVENT_V2:
+		tblId := event.ReadTblId(data)
+		if listener.skipped[tblId] {
+			// filtered table, skip decode rows
+			return nil, nil
+		}
+		table, ok := listener.tables[tblId]
+		if !ok {
+			table = listener.curTblEve
+		}
+		eve = &event.RowsEvent{Header: header, Table: table}
 	case event.XID_EVENT:
 		eve = &event.XidEvnet{Header: header}
 		log.Debug("xid event", data)
@@ -160,37 +641,177 @@ func (listener *Listener) parseEvent(header *event.EveHeader, data []byte) (even
 		eve = &event.RotateEvent{Header: header}
 	case event.STOP_EVENT:
 		eve = &event.StopEvent{Header: header}
+	case event.MARIADB_GTID_EVENT:
+		eve = &event.MariadbGtidEvent{Header: header}
+	case event.MARIADB_GTID_LIST_EVENT:
+		eve = &event.MariadbGtidListEvent{Header: header}
+	case event.MARIADB_ANNOTATE_ROWS_EVENT:
+		eve = &event.MariadbAnnotateRowsEvent{Header: header}
+	case event.MARIADB_BINLOG_CHECKPOINT_EVENT:
+		eve = &event.MariadbBinlogCheckpointEvent{Header: header}
 	default:
 		log.Debug(header.EveType)
 	}
 
 	if eve != nil {
-		eve.Decode(data)
+		if err := eve.Decode(data); err != nil {
+			return nil, errors.Trace(err)
+		}
 		log.Debug(eve.Dump())
 	}
 
+	if fde, ok := eve.(*event.FormatDescEvent); ok {
+		version := string(bytes.TrimRight(fde.SvrVersion, "\x00"))
+		if flavor := flavorOf(version); flavor != listener.Flavor {
+			log.Infof("listener: [%v] flavor is %s by server version %s", listener, flavor, version)
+			listener.Flavor = flavor
+		}
+	}
+
 	if tbl, ok := eve.(*event.TableMapEvent); ok {
+		if !listener.filter.Match(string(tbl.Schema), string(tbl.Table)) {
+			listener.skipped[tbl.TblId] = true
+			delete(listener.tables, tbl.TblId)
+			return nil, nil
+		}
+		delete(listener.skipped, tbl.TblId)
 		listener.tables[tbl.TblId] = tbl
 		listener.syncBinlogAndIfSchema(tbl)
+		if listener.checkDrift(header, tbl) {
+			listener.setupCharsets(tbl)
+		}
+		if !listener.versioned[fullName(string(tbl.Schema), string(tbl.Table))] {
+			listener.emitSchema(header, string(tbl.Schema), string(tbl.Table))
+		}
 		listener.curTblEve = tbl
 	}
 
-	if re, ok := eve.(*event.RowsEvent); ok {
-		table := listener.meta.tbs[re.Table.FullName]
-		fieldNames := make([]string, 0, len(table.fields))
-
-		for _, field := range table.fields {
-			fieldNames = append(fieldNames, field.fieldName)
-		}
+	if query, ok := eve.(*event.QueryEvent); ok && listener.meta != nil {
+		listener.syncDDL(header, query)
 	}
 
-	if _, ok := eve.(*event.QueryEvent); ok {
-		// create / drop / alter should sync with meta
+	return eve, nil
+}
+
+// syncDDL create / drop / alter with meta, the drifts of the tables changed are resolved by it
+func (listener *Listener) syncDDL(header *event.EveHeader, query *event.QueryEvent) {
+	if err := listener.meta.applyDDL(query.Schema, query.Query); err != nil {
+		log.Errorf("listener: [%v] sync meta failed: %v", listener, err)
+	}
+	for _, changed := range listener.meta.changed {
+		delete(listener.drifts, fullName(changed[0], changed[1]))
+		listener.emitSchema(header, changed[0], changed[1])
 	}
+}
 
-	return eve, nil
+// setupCharsets from meta if the table map event carries no charsets, before mysql 8.0
+// or binlog_row_metadata is MINIMAL, the columns must be checked by checkDrift
+func (listener *Listener) setupCharsets(tbl *event.TableMapEvent) {
+	if len(tbl.Charsets) != 0 {
+		return
+	}
+	if tb, ok := listener.meta.GetTable(tbl.FullName); ok {
+		tbl.Charsets = tb.charsets()
+	}
 }
 
+// syncBinlogAndIfSchema fetch the table not in meta, such as created by a ddl failed to parse
 func (listener *Listener) syncBinlogAndIfSchema(tbl *event.TableMapEvent) {
+	if listener.meta == nil {
+		return
+	}
+
+	schema, table := string(tbl.Schema), string(tbl.Table)
+	if _, ok := listener.meta.GetTable(fullName(schema, table)); ok {
+		return
+	}
+	if err := listener.meta.refetch(schema, table); err != nil {
+		log.Errorf("listener: [%v] fetch meta of %s.%s failed: %v", listener, schema, table, err)
+	}
+}
+
+// emitSchema send the definition of schema.table in effect from the position of header,
+// so the events stored can be decoded with the columns of their time
+func (listener *Listener) emitSchema(header *event.EveHeader, schema, table string) {
+	if !listener.filter.Match(schema, table) {
+		return
+	}
 
+	var cols []event.ColumnDef
+	var keys []event.KeyDef
+	if tb, ok := listener.meta.GetTable(fullName(schema, table)); ok {
+		cols, keys = tb.columnDefs(), copyKeys(tb.keys)
+	}
+
+	gtid := ""
+	if listener.curGtid != nil {
+		gtid = listener.curGtid.Gtid
+	} else if listener.curMariadbGtid != nil {
+		gtid = listener.curMariadbGtid.String()
+	}
+
+	eve := event.NewSchemaEvent(header, listener.CurPos.FileName, gtid, schema, table, cols, keys)
+	listener.schemaEve = append(listener.schemaEve, eve)
+	listener.versioned[fullName(schema, table)] = true
+}
+
+// LoadMeta load the tables tracked from the snapshot saved by SaveMeta instead of
+// scanning information_schema in Init, return the position of the snapshot
+func (listener *Listener) LoadMeta(path string) (Pos, bool, error) {
+	meta := NewInformationSchema(listener)
+	pos, ok, err := meta.parseFromLocal(path)
+	if err != nil || !ok {
+		return Pos{}, false, errors.Trace(err)
+	}
+	listener.meta = meta
+	log.Debugf("listener: [%v] load %d tables at %v from %s", listener, len(meta.tbs), pos, path)
+	return pos, true, nil
+}
+
+// ReplayDDL apply the ddl in events after pos to the tables loaded by LoadMeta at pos,
+// the tables loaded are dropped if failed, so fetched from master by Init
+func (listener *Listener) ReplayDDL(pos Pos, events []event.Event) error {
+	if listener.meta == nil {
+		return nil
+	}
+	file := pos.FileName
+	for _, eve := range events {
+		switch e := eve.(type) {
+		case *event.RotateEvent:
+			file = e.NextBinlog
+		case *event.QueryEvent:
+			if file < pos.FileName || file == pos.FileName && e.Header.LogPos <= pos.Pos {
+				// already in the snapshot
+				continue
+			}
+			if err := listener.meta.applyDDL(e.Schema, e.Query); err != nil {
+				listener.meta = nil
+				return errors.Annotatef(err, "replay ddl at %s:%d", file, e.Header.LogPos)
+			}
+		}
+	}
+	return nil
+}
+
+// SaveMeta save the tables tracked at CurPos, call it after Start returned
+func (listener *Listener) SaveMeta(path string) error {
+	if listener.meta == nil {
+		return nil
+	}
+	return errors.Trace(listener.meta.saveToLocal(path, listener.CurPos))
+}
+
+// metaConn is another connection to current master, the dump connection can't query
+func (listener *Listener) metaConn() (*node.Node, error) {
+	host, port := listener.host, listener.port
+	if len(listener.candidates) != 0 {
+		cand := listener.candidates[listener.candIdx]
+		host, port = cand.Host, cand.Port
+	}
+
+	conn := node.NewNode(host, port, listener.user, listener.password, DEFAULT_SCHEMA, 0)
+	if err := conn.Connect(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
 }
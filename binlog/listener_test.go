@@ -0,0 +1,170 @@
+/**
+ *  author: lim
+ *  data  : 18-8-31 下午9:30
+ */
+
+package binlog
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lemonwx/go-canal/event"
+)
+
+// eventPkt the OK packet of the event with body, and the checksum
+func eventPkt(eveType uint8, body []byte) []byte {
+	pkt := make([]byte, event.EventHeaderSize, event.EventHeaderSize+len(body)+4)
+	pkt[5] = eveType
+	binary.LittleEndian.PutUint32(pkt[6:], 1)
+	binary.LittleEndian.PutUint32(pkt[10:], uint32(event.EventHeaderSize-1+len(body)+4))
+	binary.LittleEndian.PutUint32(pkt[14:], 1000)
+	return append(append(pkt, body...), 0, 0, 0, 0)
+}
+
+func TestDecodeMalformedEvent(t *testing.T) {
+	listener := NewBinlogListener("127.0.0.1", 3306, "root", "")
+
+	xid := make([]byte, 8)
+	binary.LittleEndian.PutUint64(xid, 9)
+	header, eve, err := listener.decodeEvent(eventPkt(event.XID_EVENT, xid))
+	if err != nil || header.LogPos != 1000 || eve.(*event.XidEvnet).Xid != 9 {
+		t.Fatalf("unexpect xid event %v: %v", eve, err)
+	}
+
+	for name, pkt := range map[string][]byte{
+		"short packet":    eventPkt(event.XID_EVENT, nil)[:10],
+		"truncated xid":   eventPkt(event.XID_EVENT, xid[:3]),
+		"truncated query": eventPkt(event.QUERY_EVENT, []byte{1, 2, 3}),
+		"truncated gtid":  eventPkt(event.GTID_LOG_EVENT, []byte{1}),
+	} {
+		if _, eve, err := listener.decodeEvent(pkt); err == nil || eve != nil {
+			t.Errorf("%s: expect decode failed, got %v", name, eve)
+		}
+	}
+}
+
+func TestReconnectTrx(t *testing.T) {
+	listener := NewBinlogListener("127.0.0.1", 3306, "root", "")
+	listener.trxPos = Pos{FileName: "mysql-bin.000001", Pos: 500}
+	listener.CurPos = Pos{FileName: "mysql-bin.000001", Pos: 700}
+
+	// part of the transaction send, it can't be dumped again
+	listener.sent = MAX_TRX_EVENTS
+	if err := listener.reconnect(context.Background()); err == nil {
+		t.Error("expect reconnect refused in a transaction partly send")
+	}
+	if listener.CurPos.Pos != 700 {
+		t.Errorf("expect the position kept, got %v", listener.CurPos)
+	}
+
+	// the only master reconnected on read failed, not failover
+	if err := listener.readFailed(context.Background(), io.EOF); err == nil || !strings.Contains(err.Error(), "already send") {
+		t.Errorf("expect reconnect on read failed, got %v", err)
+	}
+}
+
+func TestStopAtTrxBoundary(t *testing.T) {
+	listener := NewBinlogListener("127.0.0.1", 3306, "root", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// never reads between transactions after stopped
+	if _, stopped, err := listener.readPacket(ctx); !stopped || err != nil {
+		t.Errorf("should stop between transactions: %v %v", stopped, err)
+	}
+	if listener.closeIdle() {
+		t.Error("conn should not be closed if not reading")
+	}
+
+	// the transaction read to its end
+	listener.inTrx = true
+	if _, stopped, err := listener.readPacket(ctx); stopped || err != nil {
+		t.Errorf("should not stop in the middle of the transaction: %v %v", stopped, err)
+	}
+	listener.updateTrxState(&event.XidEvnet{})
+	if _, stopped, _ := listener.readPacket(ctx); !stopped {
+		t.Error("should stop after the transaction ends")
+	}
+
+	// the transaction read after stopped is still send to the syncer running
+	ch := make(chan *event.Transaction, 1)
+	if !listener.send(ctx, ch, event.NewTransaction("mysql-bin.000001", nil)) || len(ch) != 1 {
+		t.Error("transaction should be send after stopped")
+	}
+
+	// stopped before started
+	listener = NewBinlogListener("127.0.0.1", 3306, "root", "")
+	listener.Stop()
+	if err := listener.Start(context.Background(), ch); err != nil {
+		t.Errorf("should return at once if stopped before started: %v", err)
+	}
+}
+
+func TestSavepointInTrx(t *testing.T) {
+	listener := NewBinlogListener("127.0.0.1", 3306, "root", "")
+	listener.gtids = make(event.GtidSet)
+	data := make([]byte, 42)
+	sid, _ := hex.DecodeString("3e11fa4771ca11e19e33c80aa9429562")
+	copy(data[1:], sid)
+	binary.LittleEndian.PutUint64(data[17:], 6)
+	gtid := &event.GtidEvent{}
+	if err := gtid.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// nested transaction of orm
+	for _, eve := range []event.Event{
+		gtid,
+		&event.QueryEvent{Query: "BEGIN"},
+		&event.QueryEvent{Query: "SAVEPOINT `s1`"},
+		&event.QueryEvent{Query: "ROLLBACK TO `s1`"},
+		&event.QueryEvent{Query: "insert into t values (1)"},
+	} {
+		listener.updateTrxState(eve)
+		if !listener.inTrx || listener.GtidSet() != "" {
+			t.Fatalf("%s should not end the transaction: %s", eve.Dump(), listener.GtidSet())
+		}
+	}
+	listener.updateTrxState(&event.XidEvnet{})
+	if listener.inTrx || listener.GtidSet() != "3e11fa47-71ca-11e1-9e33-c80aa9429562:6" {
+		t.Errorf("transaction should end with xid: %v %s", listener.inTrx, listener.GtidSet())
+	}
+
+	// the ddl ends its own transaction
+	listener.updateTrxState(gtid)
+	listener.updateTrxState(&event.QueryEvent{Query: "alter table t add column c int"})
+	if listener.inTrx {
+		t.Error("transaction should end with the ddl")
+	}
+}
+
+func TestStopInTrx(t *testing.T) {
+	listener := NewBinlogListener("127.0.0.1", 3306, "root", "")
+	listener.trxPos = Pos{FileName: "mysql-bin.000001", Pos: 500}
+	listener.CurPos = Pos{FileName: "mysql-bin.000001", Pos: 700}
+	listener.trx = []event.Event{&event.QueryEvent{Header: &event.EveHeader{LogPos: 600}, Query: "BEGIN"}}
+	ch := make(chan *event.Transaction, 1)
+
+	// nothing of the transaction send, dumped again from its begin
+	listener.stopInTrx(context.Background(), ch, "decode failed")
+	if len(listener.trx) != 0 || len(ch) != 0 || listener.CurPos.Pos != 500 {
+		t.Errorf("expect the transaction dropped and rewound, stop at %v", listener.CurPos)
+	}
+
+	// part of it send, never send again
+	listener.CurPos, listener.sent = Pos{FileName: "mysql-bin.000001", Pos: 700}, MAX_TRX_EVENTS
+	listener.trx = []event.Event{&event.TableMapEvent{Header: &event.EveHeader{LogPos: 650}}}
+	listener.stopInTrx(context.Background(), ch, "decode failed")
+	if listener.CurPos.Pos != 700 || len(ch) != 1 {
+		t.Fatalf("expect the events read send, stop at %v", listener.CurPos)
+	}
+	trx := <-ch
+	if gap, ok := trx.Events[len(trx.Events)-1].(*event.GapEvent); len(trx.Events) != 2 || !ok || gap.FromPos != 700 {
+		t.Errorf("expect the rest of the transaction marked lost: %v", trx.Events)
+	}
+}
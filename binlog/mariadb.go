@@ -0,0 +1,153 @@
+/**
+ *  author: lim
+ *  data  : 18-8-9 下午9:20
+ */
+
+package binlog
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/xsql/mysql"
+)
+
+const (
+	FLAVOR_MYSQL   = "mysql"
+	FLAVOR_MARIADB = "mariadb"
+
+	// MARIA_SLAVE_CAPABILITY_GTID, master sends gtid/annotate events instead of faking them for old slaves
+	MARIADB_SLAVE_CAPABILITY = 4
+
+	// COM_BINLOG_DUMP flags of mariadb, master sends the annotate rows events only if set
+	BINLOG_SEND_ANNOTATE_ROWS_EVENT = 0x02
+)
+
+func flavorOf(version string) string {
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		return FLAVOR_MARIADB
+	}
+	return FLAVOR_MYSQL
+}
+
+// dumpFlags of COM_BINLOG_DUMP, the query of the rows events comes with them for mariadb
+func (listener *Listener) dumpFlags() uint16 {
+	if listener.Flavor == FLAVOR_MARIADB {
+		return BINLOG_SEND_ANNOTATE_ROWS_EVENT
+	}
+	return 0
+}
+
+// MariadbGtidSet keeps the last gtid of every domain, like @@gtid_slave_pos
+type MariadbGtidSet map[uint32]event.MariadbGtid
+
+// ParseMariadbGtidSet parse "domain-server-seq,domain-server-seq"
+func ParseMariadbGtidSet(str string) (MariadbGtidSet, error) {
+	set := make(MariadbGtidSet)
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+
+		parts := strings.Split(s, "-")
+		if len(parts) != 3 {
+			return nil, errors.Errorf("invalid mariadb gtid: %s", s)
+		}
+
+		vals := make([]uint64, 3)
+		for idx, part := range parts {
+			val, err := strconv.ParseUint(part, 10, 64)
+			if err != nil {
+				return nil, errors.Errorf("invalid mariadb gtid: %s", s)
+			}
+			vals[idx] = val
+		}
+
+		if vals[0] > 0xffffffff || vals[1] > 0xffffffff {
+			return nil, errors.Errorf("invalid mariadb gtid: %s", s)
+		}
+		set.Update(event.MariadbGtid{DomainId: uint32(vals[0]), ServerId: uint32(vals[1]), SeqNo: vals[2]})
+	}
+	return set, nil
+}
+
+func (set MariadbGtidSet) Update(gtid event.MariadbGtid) {
+	set[gtid.DomainId] = gtid
+}
+
+func (set MariadbGtidSet) String() string {
+	domains := make([]int, 0, len(set))
+	for domain := range set {
+		domains = append(domains, int(domain))
+	}
+	sort.Ints(domains)
+
+	gtids := make([]string, 0, len(set))
+	for _, domain := range domains {
+		gtids = append(gtids, set[uint32(domain)].String())
+	}
+	return strings.Join(gtids, ",")
+}
+
+// detectFlavor by select version(), the FormatDescEvent will confirm it
+func (listener *Listener) detectFlavor() error {
+	ret, err := listener.Execute(mysql.COM_QUERY, []byte("select version()"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if ret.Resultset == nil || len(ret.RowDatas) == 0 {
+		return errors.New("select version() returns no rows")
+	}
+
+	version, _, _, err := mysql.LengthEnodedString(ret.RowDatas[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	listener.Flavor = flavorOf(string(version))
+	return nil
+}
+
+// mariadbHandshake tell master we can handle the mariadb events,
+// and the gtid position to start from if any
+func (listener *Listener) mariadbHandshake() error {
+	sqls := []string{
+		fmt.Sprintf("set @mariadb_slave_capability=%d", MARIADB_SLAVE_CAPABILITY),
+	}
+
+	if listener.dumpByMariadbGtid() {
+		sqls = append(sqls,
+			fmt.Sprintf("set @slave_connect_state='%s'", listener.mariadbGtids),
+			"set @slave_gtid_strict_mode=0",
+			"set @slave_gtid_ignore_duplicates=0",
+		)
+	}
+
+	for _, sql := range sqls {
+		if _, err := listener.Execute(mysql.COM_QUERY, []byte(sql)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// dumpByMariadbGtid only when no file:pos known, after the first rotate event,
+// file:pos is more accurate to continue than gtid
+func (listener *Listener) dumpByMariadbGtid() bool {
+	return listener.Flavor == FLAVOR_MARIADB && len(listener.CurPos.FileName) == 0 && len(listener.mariadbGtids) != 0
+}
+
+// SetMariadbGtid dump from the gtid position instead of file:pos, only for mariadb,
+// Init with an empty Pos to use it
+func (listener *Listener) SetMariadbGtid(gtids string) error {
+	set, err := ParseMariadbGtidSet(gtids)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	listener.mariadbGtids = set
+	return nil
+}
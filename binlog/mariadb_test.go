@@ -0,0 +1,50 @@
+/**
+ *  author: lim
+ *  data  : 18-8-9 下午10:41
+ */
+
+package binlog
+
+import (
+	"testing"
+
+	"github.com/lemonwx/go-canal/event"
+)
+
+func TestParseMariadbGtidSet(t *testing.T) {
+	set, err := ParseMariadbGtidSet("1-101-20, 0-100-15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.String() != "0-100-15,1-101-20" {
+		t.Errorf("unexpect gtid set: %s", set)
+	}
+
+	set.Update(event.MariadbGtid{DomainId: 0, ServerId: 102, SeqNo: 16})
+	if set.String() != "0-102-16,1-101-20" {
+		t.Errorf("unexpect gtid set after update: %s", set)
+	}
+
+	for _, invalid := range []string{"0-1", "a-1-2", "4294967296-1-1"} {
+		if _, err := ParseMariadbGtidSet(invalid); err == nil {
+			t.Errorf("%s should be invalid", invalid)
+		}
+	}
+}
+
+func TestFlavorOf(t *testing.T) {
+	if flavorOf("10.3.8-MariaDB-log") != FLAVOR_MARIADB {
+		t.Error("10.3.8-MariaDB-log should be mariadb")
+	}
+	if flavorOf("5.7.21-0ubuntu0.16.04.1-log") != FLAVOR_MYSQL {
+		t.Error("5.7.21 should be mysql")
+	}
+
+	listener := NewBinlogListener("127.0.0.1", 3306, "root", "")
+	if listener.Flavor = FLAVOR_MYSQL; listener.dumpFlags() != 0 {
+		t.Errorf("unexpect dump flags of mysql: %d", listener.dumpFlags())
+	}
+	if listener.Flavor = FLAVOR_MARIADB; listener.dumpFlags() != BINLOG_SEND_ANNOTATE_ROWS_EVENT {
+		t.Errorf("annotate rows events should be asked from mariadb: %d", listener.dumpFlags())
+	}
+}
@@ -6,19 +6,38 @@
 package binlog
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
 	"github.com/lemonwx/log"
 	"github.com/lemonwx/xsql/mysql"
-	"strings"
 )
 
+type executor interface {
+	Execute(cmd byte, data []byte) (*mysql.Result, error)
+}
+
+func fullName(schema, table string) string {
+	return fmt.Sprintf("%s.%s", schema, table)
+}
+
+func quote(str string) string {
+	return "'" + strings.Replace(strings.Replace(str, "\\", "\\\\", -1), "'", "''", -1) + "'"
+}
+
 type Field struct {
 	fieldName        string
 	fieldType        string
 	encodedfieldType uint8
 	unsigned         bool
+	charset          string // event.BINARY_CHARSET for binary strings, "" if default or not a string
 	encoded          []uint8
 }
 
@@ -34,9 +53,18 @@ func (f *Field) Decode() {
 	}
 	pos += size
 	f.fieldName = string(fNameBin)
-	fTypeBIn, _, _, err := mysql.LengthEnodedString(f.encoded[pos:])
+	fTypeBIn, _, size, err := mysql.LengthEnodedString(f.encoded[pos:])
+	pos += size
 	f.fieldType = string(fTypeBIn)
 	f.unsigned = strings.Contains(f.fieldType, "unsigned")
+	f.charset = event.CharsetOfType(f.fieldType)
+	if pos < len(f.encoded) {
+		// NULL for the columns not string or binary string
+		charset, isNull, _, _ := mysql.LengthEnodedString(f.encoded[pos:])
+		if !isNull {
+			f.charset = string(charset)
+		}
+	}
 }
 
 type Table struct {
@@ -45,13 +73,22 @@ type Table struct {
 	tableId  uint64   `json:"tableId"`
 	fields   []*Field `json:"fields"`
 	complete bool
+
+	keys    []event.KeyDef // primary key first, then the unique ones
+	charset string         // default charset for the string columns added, "" if unknown
 }
 
+// setupEncodedFieldType check the column types in table map event against the fields
 func (table *Table) setupEncodedFieldType(types []byte) error {
 	if len(table.fields) != len(types) {
-		return errors.New("len(table.fields) != len(types)")
+		return errors.Errorf("%d columns tracked, but %d in binlog", len(table.fields), len(types))
 	}
 
+	for idx, field := range table.fields {
+		if !typeMatch(field.fieldType, types[idx]) {
+			return errors.Errorf("column %s is %s, but type %d in binlog", field.fieldName, field.fieldType, types[idx])
+		}
+	}
 	for idx, field := range table.fields {
 		field.encodedfieldType = types[idx]
 	}
@@ -61,6 +98,8 @@ func (table *Table) setupEncodedFieldType(types []byte) error {
 type InformationSchema struct {
 	tbs    map[string]*Table
 	dumper *Listener
+
+	changed [][2]string // schema, table changed by the last ddl
 }
 
 func NewInformationSchema(dumper *Listener) *InformationSchema {
@@ -75,21 +114,101 @@ func (meta *InformationSchema) GetTable(tbName string) (*Table, bool) {
 	return table, ok
 }
 
-func (meta *InformationSchema) parseFromLocal() {
+// MetaSnapshot is the tables tracked at Pos, saved in the data dir
+// so the full scan of information_schema is only needed once
+type MetaSnapshot struct {
+	Pos    Pos
+	Tables []TableSnapshot
+}
 
+type TableSnapshot struct {
+	Schema  string
+	Table   string
+	Columns []event.ColumnDef
+	Keys    []event.KeyDef
+	Charset string `json:",omitempty"`
 }
 
-func (meta *InformationSchema) parseMeta(schema, table string) error {
-	sql := "select TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, COLUMN_TYPE from information_schema.COLUMNS " +
-		"where table_schema not in('mysql', 'information_schema', 'performance_schema', 'sys');"
+// ReadMetaSnapshot return nil if path not exists
+func ReadMetaSnapshot(path string) (*MetaSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	snapshot := &MetaSnapshot{}
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		return nil, errors.Annotatef(err, "parse %s", path)
+	}
+	return snapshot, nil
+}
+
+// parseFromLocal load the tables from the snapshot at path, report the position of it,
+// ok is false if no snapshot saved
+func (meta *InformationSchema) parseFromLocal(path string) (pos Pos, ok bool, err error) {
+	snapshot, err := ReadMetaSnapshot(path)
+	if err != nil || snapshot == nil {
+		return Pos{}, false, errors.Trace(err)
+	}
+
+	meta.tbs = make(map[string]*Table, len(snapshot.Tables))
+	for _, tb := range snapshot.Tables {
+		fields := make([]*Field, 0, len(tb.Columns))
+		for _, col := range tb.Columns {
+			fields = append(fields, &Field{
+				fieldName: col.Name,
+				fieldType: col.Type,
+				unsigned:  strings.Contains(col.Type, "unsigned"),
+				charset:   col.Charset,
+			})
+		}
+		meta.tbs[fullName(tb.Schema, tb.Table)] = &Table{schema: tb.Schema, table: tb.Table, fields: fields, keys: tb.Keys, charset: tb.Charset}
+	}
+	return snapshot.Pos, true, nil
+}
+
+// saveToLocal write the tables tracked at pos to path
+func (meta *InformationSchema) saveToLocal(path string, pos Pos) error {
+	snapshot := &MetaSnapshot{Pos: pos, Tables: make([]TableSnapshot, 0, len(meta.tbs))}
+	for _, tb := range meta.tbs {
+		snapshot.Tables = append(snapshot.Tables, TableSnapshot{Schema: tb.schema, Table: tb.table, Columns: tb.columnDefs(), Keys: tb.keys, Charset: tb.charset})
+	}
+	sort.Slice(snapshot.Tables, func(i, j int) bool {
+		return fullName(snapshot.Tables[i].Schema, snapshot.Tables[i].Table) <
+			fullName(snapshot.Tables[j].Schema, snapshot.Tables[j].Table)
+	})
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// write to a temp file first, a crash never leaves a broken snapshot
+	if err = os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return errors.Trace(err)
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0664); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, path))
+}
+
+func (meta *InformationSchema) parseMeta(exec executor, schema, table string) error {
+	sql := "select TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, COLUMN_TYPE, CHARACTER_SET_NAME from information_schema.COLUMNS " +
+		"where table_schema not in('mysql', 'information_schema', 'performance_schema', 'sys')"
 
 	if len(schema) != 0 {
-		sql += fmt.Sprintf(" and TABLE_SCHEMA = %s", schema)
+		sql += fmt.Sprintf(" and TABLE_SCHEMA = %s", quote(schema))
 	}
 	if len(table) != 0 {
-		sql += fmt.Sprintf(" and TABLE_NAME = %s", table)
+		sql += fmt.Sprintf(" and TABLE_NAME = %s", quote(table))
 	}
-	ret, err := meta.dumper.Execute(mysql.COM_QUERY, []byte(sql))
+	sql += " order by TABLE_SCHEMA, TABLE_NAME, ORDINAL_POSITION"
+	ret, err := exec.Execute(mysql.COM_QUERY, []byte(sql))
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -103,7 +222,7 @@ func (meta *InformationSchema) parseMeta(schema, table string) error {
 
 		field := &Field{encoded: row[pos:]}
 		field.Decode()
-		fullTbName := fmt.Sprintf("%s.%s", schema, table)
+		fullTbName := fullName(string(schema), string(table))
 		if tb, ok := meta.tbs[fullTbName]; ok {
 			tb.fields = append(tb.fields, field)
 		} else {
@@ -117,6 +236,10 @@ func (meta *InformationSchema) parseMeta(schema, table string) error {
 		}
 	}
 
+	if err = meta.parseKeys(exec, schema, table); err != nil {
+		return errors.Trace(err)
+	}
+
 	for tbname, table := range meta.tbs {
 		log.Debugf("%v: %v", tbname, table)
 	}
@@ -124,3 +247,253 @@ func (meta *InformationSchema) parseMeta(schema, table string) error {
 	//log.Debug(meta)
 	return nil
 }
+
+// refetch load the table from master, it's the newest structure
+// instead of the one at current binlog position, only when ddl can't tell
+func (meta *InformationSchema) refetch(schema, table string) error {
+	if meta.dumper == nil {
+		return errors.Errorf("no master to fetch %s.%s from", schema, table)
+	}
+
+	// the dump connection can't query
+	conn, err := meta.dumper.metaConn()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	meta.touch(schema, table)
+	delete(meta.tbs, fullName(schema, table))
+	return errors.Trace(meta.parseMeta(conn, schema, table))
+}
+
+func (meta *InformationSchema) touch(schema, table string) {
+	meta.changed = append(meta.changed, [2]string{schema, table})
+}
+
+func (table *Table) columnDefs() []event.ColumnDef {
+	cols := make([]event.ColumnDef, 0, len(table.fields))
+	for _, field := range table.fields {
+		cols = append(cols, event.ColumnDef{Name: field.fieldName, Type: field.fieldType, Charset: field.charset})
+	}
+	return cols
+}
+
+// charsets of the columns in order, for the table map event without them
+func (table *Table) charsets() []string {
+	charsets := make([]string, 0, len(table.fields))
+	for _, field := range table.fields {
+		charsets = append(charsets, field.charset)
+	}
+	return charsets
+}
+
+// applyDDL keep tbs in sync with the ddl query at its binlog position
+// the tables changed are in meta.changed
+func (meta *InformationSchema) applyDDL(schema, query string) error {
+	meta.changed = meta.changed[:0]
+	ddls, err := ParseDDL(schema, query)
+	if err != nil {
+		return errors.Annotatef(err, "parse ddl %s", query)
+	}
+
+	for _, ddl := range ddls {
+		if err = meta.apply(ddl); err != nil {
+			return errors.Annotatef(err, "apply ddl %s", query)
+		}
+		log.Debugf("meta synced by ddl: %s", query)
+	}
+	return nil
+}
+
+func (meta *InformationSchema) apply(ddl *DDL) error {
+	key := fullName(ddl.Schema, ddl.Table)
+	switch ddl.Type {
+	case DDL_CREATE_DATABASE, DDL_TRUNCATE_TABLE:
+		// no columns changed
+
+	case DDL_DROP_DATABASE:
+		for name, tb := range meta.tbs {
+			if tb.schema == ddl.Schema {
+				meta.touch(tb.schema, tb.table)
+				delete(meta.tbs, name)
+			}
+		}
+
+	case DDL_DROP_TABLE:
+		if _, ok := meta.tbs[key]; ok {
+			meta.touch(ddl.Schema, ddl.Table)
+			delete(meta.tbs, key)
+		}
+
+	case DDL_CREATE_TABLE:
+		if ddl.refetch {
+			return meta.refetch(ddl.Schema, ddl.Table)
+		}
+
+		fields, keys, charset := ddl.Columns, ddl.Keys, ddl.Charset
+		if len(ddl.NewTable) != 0 {
+			// CREATE TABLE LIKE
+			src, ok := meta.tbs[fullName(ddl.NewSchema, ddl.NewTable)]
+			if !ok {
+				return meta.refetch(ddl.Schema, ddl.Table)
+			}
+			fields = make([]*Field, 0, len(src.fields))
+			for _, field := range src.fields {
+				f := *field
+				fields = append(fields, &f)
+			}
+			keys = copyKeys(src.keys)
+			charset = src.charset
+		}
+		tb := &Table{schema: ddl.Schema, table: ddl.Table, fields: fields, keys: keys, charset: charset}
+		for _, field := range fields {
+			tb.setupCharset(field)
+		}
+		meta.touch(ddl.Schema, ddl.Table)
+		meta.tbs[key] = tb
+
+	case DDL_RENAME_TABLE:
+		return meta.rename(ddl.Schema, ddl.Table, ddl.NewSchema, ddl.NewTable)
+
+	case DDL_ALTER_TABLE:
+		tb, ok := meta.tbs[key]
+		if ok {
+			meta.touch(ddl.Schema, ddl.Table)
+			if len(ddl.Charset) != 0 {
+				tb.charset = ddl.Charset
+			}
+			for _, spec := range ddl.Alters {
+				if err := tb.alter(spec); err != nil {
+					log.Errorf("alter %s failed: %v, fetch from master", key, err)
+					ok = false
+					break
+				}
+			}
+		}
+
+		schema, table := ddl.Schema, ddl.Table
+		if len(ddl.NewTable) != 0 {
+			if err := meta.rename(schema, table, ddl.NewSchema, ddl.NewTable); err != nil {
+				return errors.Trace(err)
+			}
+			schema, table = ddl.NewSchema, ddl.NewTable
+		}
+		if !ok {
+			return meta.refetch(schema, table)
+		}
+	}
+	return nil
+}
+
+func (meta *InformationSchema) rename(schema, table, newSchema, newTable string) error {
+	tb, ok := meta.tbs[fullName(schema, table)]
+	if !ok {
+		return meta.refetch(newSchema, newTable)
+	}
+
+	meta.touch(schema, table)
+	meta.touch(newSchema, newTable)
+	delete(meta.tbs, fullName(schema, table))
+	tb.schema, tb.table = newSchema, newTable
+	meta.tbs[fullName(newSchema, newTable)] = tb
+	return nil
+}
+
+// fieldIdx column names are case insensitive
+func (table *Table) fieldIdx(name string) int {
+	for idx, field := range table.fields {
+		if strings.EqualFold(field.fieldName, name) {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (table *Table) alter(spec *alterSpec) error {
+	switch spec.op {
+	case ALTER_ADD_KEY:
+		table.addKey(spec.key)
+		return nil
+	case ALTER_DROP_KEY:
+		table.dropKey(spec.key.Name)
+		return nil
+	case ALTER_RENAME_KEY:
+		table.renameKey(spec.column, spec.key.Name)
+		return nil
+	case ALTER_CONVERT_CHARSET:
+		table.charset = spec.charset
+		for _, field := range table.fields {
+			if isTextType(field.fieldType) {
+				field.charset = spec.charset
+			}
+		}
+		return nil
+	}
+
+	idx := table.fieldIdx(spec.column)
+	if idx < 0 && spec.op != ALTER_ADD_COLUMN {
+		return errors.Errorf("column %s not exists", spec.column)
+	}
+
+	switch spec.op {
+	case ALTER_ADD_COLUMN:
+		if idx >= 0 {
+			return errors.Errorf("column %s already exists", spec.column)
+		}
+		if len(spec.key.Name) != 0 {
+			table.addKey(spec.key)
+		}
+		return table.insert(spec.field, len(table.fields), spec)
+	case ALTER_DROP_COLUMN:
+		table.fields = append(table.fields[:idx], table.fields[idx+1:]...)
+		table.dropKeyColumn(spec.column)
+	case ALTER_CHANGE_COLUMN:
+		table.fields = append(table.fields[:idx], table.fields[idx+1:]...)
+		table.renameKeyColumn(spec.column, spec.field.fieldName)
+		if len(spec.key.Name) != 0 {
+			table.addKey(spec.key)
+		}
+		return table.insert(spec.field, idx, spec)
+	case ALTER_RENAME_COLUMN:
+		table.fields[idx].fieldName = spec.field.fieldName
+		table.renameKeyColumn(spec.column, spec.field.fieldName)
+	}
+	return nil
+}
+
+// insert field at FIRST / AFTER of spec, or at idx if not specified
+func (table *Table) insert(field *Field, idx int, spec *alterSpec) error {
+	switch {
+	case spec.first:
+		idx = 0
+	case len(spec.after) != 0:
+		after := table.fieldIdx(spec.after)
+		if after < 0 {
+			return errors.Errorf("column %s not exists", spec.after)
+		}
+		idx = after + 1
+	}
+
+	table.setupCharset(field)
+	table.fields = append(table.fields, nil)
+	copy(table.fields[idx+1:], table.fields[idx:])
+	table.fields[idx] = field
+	return nil
+}
+
+// setupCharset the string column defined without charset is in the default one of table
+func (table *Table) setupCharset(field *Field) {
+	if len(field.charset) == 0 && isTextType(field.fieldType) {
+		field.charset = table.charset
+	}
+}
+
+func isTextType(fieldType string) bool {
+	for _, prefix := range []string{"char", "varchar", "tinytext", "text", "mediumtext", "longtext", "enum", "set"} {
+		if strings.HasPrefix(fieldType, prefix) {
+			return true
+		}
+	}
+	return false
+}
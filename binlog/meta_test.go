@@ -0,0 +1,93 @@
+/**
+ *  author: lim
+ *  data  : 18-8-14 下午9:40
+ */
+
+package binlog
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lemonwx/go-canal/event"
+)
+
+func TestMetaSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/.meta.json"
+
+	meta := NewInformationSchema(nil)
+	if _, ok, err := meta.parseFromLocal(path); ok || err != nil {
+		t.Fatalf("no snapshot should be found: %v", err)
+	}
+
+	for _, query := range []string{
+		"create table test.a (id bigint unsigned primary key, name varchar(8))",
+		"create table test.b (id int)",
+	} {
+		if err = meta.applyDDL("", query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pos := Pos{FileName: "mysql-bin.000003", Pos: 1024}
+	if err = meta.saveToLocal(path, pos); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewInformationSchema(nil)
+	got, ok, err := loaded.parseFromLocal(path)
+	if err != nil || !ok || got != pos {
+		t.Fatalf("load snapshot failed: %v %v %v", got, ok, err)
+	}
+
+	tb, ok := loaded.GetTable("test.a")
+	if !ok || fieldsOf(tb) != "id bigint unsigned, name varchar(8)" || !tb.fields[0].unsigned || keysOf(tb) != "PRIMARY(id)" {
+		t.Fatalf("unexpect table loaded: %v", tb)
+	}
+
+	// ddl after the snapshot applied offline
+	if err = loaded.applyDDL("test", "alter table b add column c int first"); err != nil {
+		t.Fatal(err)
+	}
+	if tb, _ = loaded.GetTable("test.b"); fieldsOf(tb) != "c int, id int" {
+		t.Errorf("unexpect table after ddl: %s", fieldsOf(tb))
+	}
+}
+
+func TestReplayDDL(t *testing.T) {
+	listener := NewBinlogListener("127.0.0.1", 3306, "root", "")
+	// no master to fetch the table from
+	listener.meta = NewInformationSchema(nil)
+	if err := listener.meta.applyDDL("test", "create table b (id int)"); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(file string, logPos uint32, sql string) []event.Event {
+		return []event.Event{
+			&event.RotateEvent{Header: &event.EveHeader{}, NextBinlog: file},
+			&event.QueryEvent{Header: &event.EveHeader{LogPos: logPos}, Schema: "test", Query: sql},
+		}
+	}
+	pos := Pos{FileName: "mysql-bin.000003", Pos: 1024}
+	events := query("mysql-bin.000002", 2048, "alter table b add column x int")
+	events = append(events, query("mysql-bin.000003", 1024, "alter table b add column y int")...)
+	events = append(events, query("mysql-bin.000003", 2048, "alter table b add column c int first")...)
+	if err := listener.ReplayDDL(pos, events); err != nil {
+		t.Fatal(err)
+	}
+	if tb, _ := listener.meta.GetTable("test.b"); fieldsOf(tb) != "c int, id int" {
+		t.Errorf("only the ddl after the snapshot should be replayed: %s", fieldsOf(tb))
+	}
+
+	// the columns can't be known offline
+	events = query("mysql-bin.000004", 4, "create table t select * from b")
+	if err := listener.ReplayDDL(pos, events); err == nil || listener.meta != nil {
+		t.Errorf("tables loaded should be dropped if failed to replay: %v", err)
+	}
+}
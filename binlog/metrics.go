@@ -0,0 +1,131 @@
+/**
+ *  author: lim
+ *  data  : 18-8-6 下午9:40
+ */
+
+package binlog
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lemonwx/go-canal/event"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	eventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "events_total",
+		Help:      "Binlog events received from master by type.",
+	}, []string{"source", "type"})
+
+	rowsDecoded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "rows_decoded_total",
+		Help:      "Rows decoded from rows events by table.",
+	}, []string{"source", "table"})
+
+	bytesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "read_bytes_total",
+		Help:      "Bytes read from the binlog stream.",
+	}, []string{"source"})
+
+	decodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "decode_errors_total",
+		Help:      "Binlog events failed to decode.",
+	}, []string{"source"})
+
+	binlogFileSeq = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "binlog_file_seq",
+		Help:      "Sequence number of the current binlog file, mysql-bin.000012 is 12.",
+	}, []string{"source"})
+
+	binlogPos = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "binlog_pos",
+		Help:      "Position in the current binlog file.",
+	}, []string{"source"})
+
+	secondsBehind = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "seconds_behind_source",
+		Help:      "Seconds between now and the timestamp of the last received event.",
+	}, []string{"source"})
+
+	reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "reconnects_total",
+		Help:      "Times the listener connected to master again.",
+	}, []string{"source"})
+
+	failovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "failovers_total",
+		Help:      "Times the listener switched to another candidate master.",
+	}, []string{"source"})
+
+	schemaDrifts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "listener",
+		Name:      "schema_drifts_total",
+		Help:      "Table map events disagree with the tracked table even after fetched from master.",
+	}, []string{"source", "table"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		eventsReceived,
+		rowsDecoded,
+		bytesRead,
+		decodeErrors,
+		binlogFileSeq,
+		binlogPos,
+		secondsBehind,
+		reconnects,
+		failovers,
+		schemaDrifts,
+	)
+}
+
+func eventTypeName(eveType uint8) string {
+	if name, ok := event.EventName[eveType]; ok {
+		return name
+	}
+	return strconv.Itoa(int(eveType))
+}
+
+func observeEvent(source string, header *event.EveHeader, eve event.Event, size int) {
+	bytesRead.WithLabelValues(source).Add(float64(size))
+	eventsReceived.WithLabelValues(source, eventTypeName(header.EveType)).Inc()
+
+	// fake and artificial events carry no real time
+	if header.Ts != 0 && header.LogPos != 0 {
+		secondsBehind.WithLabelValues(source).Set(float64(time.Now().Unix() - int64(header.Ts)))
+	}
+
+	if re, ok := eve.(*event.RowsEvent); ok && re.Table != nil {
+		rowsDecoded.WithLabelValues(source, re.Table.FullName).Add(float64(len(re.Rows)))
+	}
+}
+
+func observePos(source string, pos Pos) {
+	idx := strings.LastIndex(pos.FileName, ".")
+	if seq, err := strconv.ParseUint(pos.FileName[idx+1:], 10, 64); err == nil {
+		binlogFileSeq.WithLabelValues(source).Set(float64(seq))
+	}
+	binlogPos.WithLabelValues(source).Set(float64(pos.Pos))
+}
@@ -6,84 +6,354 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/config"
 	"github.com/lemonwx/go-canal/event"
 	"github.com/lemonwx/go-canal/server"
 	"github.com/lemonwx/go-canal/syncer"
 	"github.com/lemonwx/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	host     string = "172.17.0.2"
-	port     int    = 5518
-	user     string = "root"
-	password string = "root"
+	cfgPath = flag.String("config", "t.yaml", "config file path")
 
-	svrHost = "localhost"
-	svrPort = 1236
-
-	syncFlag = true
+	defaultMetricsAddr = "localhost:9236"
 )
 
 var (
-	eveBufSize uint32           = 100
-	ch         chan event.Event = make(chan event.Event, eveBufSize)
-	pos        binlog.Pos       = binlog.Pos{"mysql-bin.000001", 4}
-	s          syncer.Syncer
+	trxBufSize uint32 = 100
+	startFile         = "mysql-bin.000001"
+
+	cfg       *config.Config
+	archive   *syncer.S3Archive // shared by the sources, nil if not archived
+	pipelines []*pipeline
+	svr       *server.Server
 )
 
-func setupJsonSyncer() {
+// pipeline dump binlog from one source: listener -> ch of transactions -> syncer
+type pipeline struct {
+	name     string
+	ch       chan *event.Transaction
+	pos      binlog.Pos
+	metaPath string // snapshot of the tables tracked by listener
+	dumper   *binlog.Listener
+	syncer   *syncer.JsonSyncer
+	done     chan struct{}
+}
 
-	jsonSyncer, err := syncer.NewJsonSyncerFromLocalFile("mysql-bin.000001")
+func dataDir(src config.Source) string {
+	// the single master keeps the layout before sources supported
+	if cfg.LegacySource() {
+		return event.BASE_BINLOG_PATH
+	}
+	return event.BASE_BINLOG_PATH + src.Name + "/"
+}
+
+// metaPath is sorted before the binlog files, so never loaded or removed as one
+func metaPath(src config.Source) string {
+	return dataDir(src) + ".meta.json"
+}
+
+func setupJsonSyncer(p *pipeline, src config.Source) {
+	backend := cfg.Sync.Storage
+	if len(backend) == 0 {
+		backend = syncer.STORAGE_JSON
+	}
+	jsonSyncer, err := syncer.NewSyncer(backend, dataDir(src), startFile)
 	if err != nil {
-		log.Errorf("load binlog from json failed: %v", errors.ErrorStack(err))
+		log.Errorf("[%s] load binlog from %s storage failed: %v", src.Name, backend, errors.ErrorStack(err))
 		panic(err)
 	}
 
-	jsonSyncer.SetupChan(ch)
-	pos = jsonSyncer.CurPos
+	snapshot, err := binlog.ReadMetaSnapshot(p.metaPath)
+	if err != nil {
+		log.Errorf("[%s] read meta snapshot failed: %v", src.Name, err)
+	} else if snapshot != nil {
+		jsonSyncer.SetMetaSnapshot(snapshot)
+	}
 
-	if err = jsonSyncer.RemoveBinlogGtNow(pos.FileName); err != nil {
-		log.Errorf("rm binlog gt now failed: %v", errors.ErrorStack(err))
+	policy := cfg.Sync.Policy
+	if len(policy) == 0 {
+		policy = syncer.SYNC_TRX
+		if !cfg.Sync.SyncFlag {
+			policy = syncer.SYNC_NONE
+		}
+	}
+	err = jsonSyncer.SetSyncPolicy(policy, cfg.Sync.SyncCount, time.Duration(cfg.Sync.SyncTime)*time.Second)
+	if err != nil {
+		log.Errorf("[%s] Set sync policy failed: %v", src.Name, err)
 		panic(err)
 	}
 
-	jsonSyncer.Host = host
-	jsonSyncer.User = user
-	jsonSyncer.Password = password
-	jsonSyncer.Port = port
+	if len(cfg.Sync.Format) != 0 {
+		if err = jsonSyncer.SetFormat(cfg.Sync.Format); err != nil {
+			log.Errorf("[%s] Set storage format failed: %v", src.Name, err)
+			panic(err)
+		}
+	}
+	if len(cfg.Sync.Compress) != 0 {
+		if err = jsonSyncer.SetCompress(cfg.Sync.Compress); err != nil {
+			log.Errorf("[%s] Set segment compression failed: %v", src.Name, err)
+			panic(err)
+		}
+	}
+	jsonSyncer.SetRotation(int64(cfg.Sync.SegmentSize)<<20, time.Duration(cfg.Sync.SegmentAge)*time.Minute)
+	jsonSyncer.SetRetention(int64(cfg.Sync.MaxSize)<<20, time.Duration(cfg.Sync.MaxAge)*time.Hour, cfg.Sync.MinFiles)
+	jsonSyncer.SetCacheSize(cfg.Sync.Cache)
+	if archive != nil {
+		if err = jsonSyncer.SetArchive(archive, cfg.Archive.Prefix+src.Name+"/"); err != nil {
+			log.Errorf("[%s] Set archive failed: %v", src.Name, err)
+			panic(err)
+		}
+	}
+
+	jsonSyncer.SetupChan(p.ch)
+	jsonSyncer.Source = src.Name
+	p.pos = jsonSyncer.CurPos
+
+	jsonSyncer.Host = src.Host
+	jsonSyncer.User = src.User
+	jsonSyncer.Password = src.Password
+	jsonSyncer.Port = src.Port
+	p.syncer = jsonSyncer
+}
+
+func setupBinlogLis(p *pipeline, src config.Source) {
+	dumper := binlog.NewBinlogListener(src.Host, src.Port, src.User, src.Password)
+	dumper.Name = src.Name
+
+	filter, err := binlog.NewFilter(src.Filter.Include, src.Filter.Exclude)
+	if err != nil {
+		log.Errorf("[%s] New filter failed: %v", src.Name, err)
+		panic(err)
+	}
+	dumper.SetFilter(filter)
+
+	if len(src.Purged) != 0 {
+		if err = dumper.SetPurgedPolicy(src.Purged); err != nil {
+			log.Errorf("[%s] Set purged policy failed: %v", src.Name, err)
+			panic(err)
+		}
+	}
+
+	if len(src.Candidates) != 0 {
+		cands := make([]binlog.Candidate, 0, len(src.Candidates))
+		for _, addr := range src.Candidates {
+			cand, err := binlog.ParseCandidate(addr)
+			if err != nil {
+				log.Errorf("[%s] Parse candidate failed: %v", src.Name, err)
+				panic(err)
+			}
+			cands = append(cands, cand)
+		}
+		dumper.SetCandidates(cands)
+	}
+
+	switch {
+	case !p.syncer.Empty() && len(src.Candidates) != 0:
+		// continue after the transactions stored, by the gtids if any to failover by them
+		gtids, err := p.syncer.ExecutedGtids()
+		if err == nil {
+			err = dumper.SetGtidSet(gtids.String())
+		}
+		if err != nil {
+			log.Errorf("[%s] Set gtid failed: %v", src.Name, err)
+			panic(err)
+		}
+	case len(src.Gtid) != 0 && p.syncer.Empty():
+		if strings.Contains(src.Gtid, ":") {
+			err = dumper.SetGtidSet(src.Gtid)
+		} else {
+			err = dumper.SetMariadbGtid(src.Gtid)
+			p.pos = binlog.Pos{}
+		}
+		if err != nil {
+			log.Errorf("[%s] Set gtid failed: %v", src.Name, err)
+			panic(err)
+		}
+	}
+
+	pos, ok, err := dumper.LoadMeta(p.metaPath)
+	if err != nil {
+		log.Errorf("[%s] Load meta failed: %v, fetch from master", src.Name, err)
+	} else if ok {
+		events, err := p.syncer.EventsSince(pos)
+		if err != nil {
+			log.Errorf("[%s] Read events since %v failed: %v", src.Name, pos, errors.ErrorStack(err))
+			panic(err)
+		}
+		if err = dumper.ReplayDDL(pos, events); err != nil {
+			log.Errorf("[%s] Replay ddl since %v failed: %v, fetch from master", src.Name, pos, errors.ErrorStack(err))
+		}
+	}
 
-	go jsonSyncer.Start()
-	s = jsonSyncer
+	if err := dumper.Init(p.pos); err != nil {
+		// the events stored are still served
+		log.Errorf("[%s] Init binlog dumper failed: %v, not dumped", src.Name, errors.ErrorStack(err))
+		return
+	}
+	p.dumper = dumper
+}
 
+func setupArchive() {
+	if len(cfg.Archive.Endpoint) == 0 {
+		return
+	}
+	var err error
+	archive, err = syncer.NewS3Archive(cfg.Archive.Endpoint, cfg.Archive.AccessKey, cfg.Archive.SecretKey,
+		cfg.Archive.Bucket, cfg.Archive.Secure)
+	if err != nil {
+		log.Errorf("Setup archive failed: %v", errors.ErrorStack(err))
+		panic(err)
+	}
 }
 
-func setupBinlogLis() {
-	dumper := binlog.NewBinlogListener(host, port, user, password)
-	if err := dumper.Init(pos); err != nil {
-		log.Errorf("Init binlog dumer failed: %v", err)
+func setupPipelines() {
+	for _, src := range cfg.GetSources() {
+		p := &pipeline{
+			name:     src.Name,
+			ch:       make(chan *event.Transaction, trxBufSize),
+			metaPath: metaPath(src),
+			done:     make(chan struct{}),
+		}
+		setupJsonSyncer(p, src)
+		setupBinlogLis(p, src)
+		pipelines = append(pipelines, p)
 	}
-	go dumper.Start(ch)
 }
 
 func setupSvr() {
-	svr, err := server.NewServer(svrHost, svrPort, s)
+	syncers := make(map[string]syncer.Syncer, len(pipelines))
+	for _, p := range pipelines {
+		syncers[p.name] = p.syncer
+	}
+
+	var err error
+	svr, err = server.NewServer(cfg.Bind.Host, cfg.Bind.Port, syncers)
 	if err != nil {
 		log.Errorf("New Server failed:%v", err)
 		panic(err)
 	}
+}
 
-	svr.Serve()
+func setupMetrics() {
+	addr := cfg.Metrics.Addr
+	if len(addr) == 0 {
+		addr = defaultMetricsAddr
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("metrics server stopped: %v", err)
+		}
+	}()
+}
+
+// run: listener stopped -> close ch -> syncer drain ch and close the json file.
+// one source failed does not affect the others
+func (p *pipeline) run(ctx context.Context) {
+	if p.dumper == nil {
+		<-ctx.Done()
+		if err := p.syncer.Close(); err != nil {
+			log.Errorf("[%s] close syncer failed: %v", p.name, errors.ErrorStack(err))
+		}
+		close(p.done)
+		return
+	}
+
+	defer close(p.done)
+
+	// the listener stops if the syncer failed, and dumps the transaction failed again after restart
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	syncDone := make(chan struct{})
+	var syncErr error
+	go func() {
+		if syncErr = p.syncer.Start(ctx); syncErr != nil {
+			log.Errorf("[%s] syncer stopped: %v", p.name, errors.ErrorStack(syncErr))
+			cancel()
+		}
+		close(syncDone)
+	}()
+
+	if err := p.dumper.Start(ctx, p.ch); err != nil {
+		log.Errorf("[%s] listener stopped: %v", p.name, errors.ErrorStack(err))
+	}
+	close(p.ch)
+	<-syncDone
+	if syncErr != nil {
+		// the events before CurPos are not all stored, the meta saved last is kept
+		return
+	}
+
+	// all the events before CurPos are stored now
+	if err := p.dumper.SaveMeta(p.metaPath); err != nil {
+		log.Errorf("[%s] save meta failed: %v", p.name, errors.ErrorStack(err))
+	}
+}
+
+// run start all the components, and stop them in order when SIGINT/SIGTERM received:
+// server -> listeners -> syncers, so the syncers can drain the events and close the json files
+func run() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	for _, p := range pipelines {
+		go p.run(ctx)
+	}
+
+	go func() {
+		if err := svr.Serve(ctx); err != nil {
+			log.Errorf("server stopped: %v", err)
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Debugf("recv signal: %v, shutdown", sig)
+
+	cancel()
+	var wg sync.WaitGroup
+	for _, p := range pipelines {
+		wg.Add(1)
+		go func(p *pipeline) {
+			<-p.done
+			wg.Done()
+		}(p)
+	}
+	wg.Wait()
+	log.Debug("shutdown finished")
 }
 
 func main() {
+	flag.Parse()
+
 	log.NewDefaultLogger(os.Stdout)
 	log.SetLevel(log.DEBUG)
 
-	setupJsonSyncer()
-	setupBinlogLis()
+	var err error
+	if cfg, err = config.ReadConfigFile(*cfgPath); err != nil {
+		log.Errorf("read config failed: %v", errors.ErrorStack(err))
+		panic(err)
+	}
+
+	setupArchive()
+	setupPipelines()
 	setupSvr()
+	setupMetrics()
+	run()
 }
@@ -7,11 +7,16 @@ package config
 
 import (
 	"io/ioutil"
+	"strings"
 
 	"github.com/go-yaml/yaml"
 	"github.com/juju/errors"
 )
 
+const (
+	DEFAULT_SOURCE = "default"
+)
+
 type bind struct {
 	Host string `yaml:"host"`
 	Port int    `yaml:"port"`
@@ -22,24 +27,93 @@ type master struct {
 	Port     int    `yaml:"port"`
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
+
+	// what to do when the binlog requested has been purged: fail, earliest or current
+	Purged string `yaml:"purged"`
+
+	// start from this gtid position if no binlog dumped before,
+	// mysql: uuid:1-5,uuid:1-3, the gtids already executed. mariadb: domain-server-seq,...
+	Gtid string `yaml:"gtid"`
+
+	// masters to follow in order after failover, host:port, mysql gtid mode required
+	Candidates []string `yaml:"candidates"`
 }
 
 type sync struct {
-	SyncFlag  bool `yaml:"sync"`
-	SyncTime  int  `yaml:"synctime"`
-	SyncCount int  `yaml:"syncount"`
+	SyncFlag bool `yaml:"sync"` // false is policy none
+
+	// when the json files are fsynced: trx (default), count, time or none
+	Policy    string `yaml:"policy"`
+	SyncTime  int    `yaml:"synctime"`  // seconds, for policy time
+	SyncCount int    `yaml:"synccount"` // events, for policy count
+
+	// format of the new json files: json (default) or ndjson
+	Format string `yaml:"format"`
+
+	// rotate the segment at the end of a transaction after segmentsize MB or
+	// segmentage minutes, besides the binlog rotation, 0 never
+	SegmentSize int `yaml:"segmentsize"`
+	SegmentAge  int `yaml:"segmentage"`
+	// codec of the closed segments: gzip, zstd or none (default)
+	Compress string `yaml:"compress"`
+
+	// purge the oldest closed segments once they take more than maxsize MB
+	// or closed maxage hours ago, keep minfiles at least, 0 unlimited
+	MaxSize  int `yaml:"maxsize"`
+	MaxAge   int `yaml:"maxage"`
+	MinFiles int `yaml:"minfiles"`
+
+	// where the events kept: json files (default) or bolt, an embedded key-value file
+	Storage string `yaml:"storage"`
+
+	// events of the closed segments kept in memory after read, 65536 by default
+	Cache int `yaml:"cache"`
+}
+
+type filter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// archive the closed segments to a bucket of S3 or MinIO, not archived if endpoint empty
+type archive struct {
+	Endpoint  string `yaml:"endpoint"` // host:port
+	AccessKey string `yaml:"accesskey"`
+	SecretKey string `yaml:"secretkey"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"` // of the objects, followed by the source name
+	Secure    bool   `yaml:"secure"` // https
+}
+
+type metrics struct {
+	Addr string `yaml:"addr"`
+}
+
+// Source is a mysql master to dump binlog from
+type Source struct {
+	Name   string `yaml:"name"`
+	master `yaml:",inline"`
+	Filter filter `yaml:"filter"`
 }
 
 type Config struct {
-	Bind   bind   `yaml:"bind"`
-	Master master `yaml:"master"`
-	Sync   sync   `yaml:"sync"`
+	Bind    bind     `yaml:"bind"`
+	Master  master   `yaml:"master"`
+	Sync    sync     `yaml:"sync"`
+	Filter  filter   `yaml:"filter"`
+	Archive archive  `yaml:"archive"`
+	Metrics metrics  `yaml:"metrics"`
+	Sources []Source `yaml:"sources"`
 }
 
 func ReadConfig() (*Config, error) {
+	return ReadConfigFile("t.yaml")
+}
+
+func ReadConfigFile(path string) (*Config, error) {
 	cfg := &Config{}
 
-	cfgEncode, err := ioutil.ReadFile("t.yaml")
+	cfgEncode, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -49,5 +123,39 @@ func ReadConfig() (*Config, error) {
 		return nil, errors.Trace(err)
 	}
 
+	if err = cfg.checkSources(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	return cfg, nil
 }
+
+func (cfg *Config) checkSources() error {
+	names := make(map[string]bool, len(cfg.Sources))
+	for _, src := range cfg.Sources {
+		if len(src.Name) == 0 {
+			return errors.Errorf("source %s:%d without name", src.Host, src.Port)
+		}
+		if strings.ContainsAny(src.Name, "/\\. ") {
+			return errors.Errorf("invalid source name: %s", src.Name)
+		}
+		if names[src.Name] {
+			return errors.Errorf("duplicate source name: %s", src.Name)
+		}
+		names[src.Name] = true
+	}
+	return nil
+}
+
+// LegacySource report whether only the single master configured, without sources
+func (cfg *Config) LegacySource() bool {
+	return len(cfg.Sources) == 0
+}
+
+// GetSources returns all the sources, the single master is named DEFAULT_SOURCE
+func (cfg *Config) GetSources() []Source {
+	if cfg.LegacySource() {
+		return []Source{{Name: DEFAULT_SOURCE, master: cfg.Master, Filter: cfg.Filter}}
+	}
+	return cfg.Sources
+}
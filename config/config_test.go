@@ -14,3 +14,45 @@ func TestReadConfig(t *testing.T) {
 	}
 	t.Log(cfg)
 }
+
+func TestGetSources(t *testing.T) {
+	cfg, err := ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name        string
+		got, expect interface{}
+	}{
+		{"policy", cfg.Sync.Policy, "trx"},
+		{"synccount", cfg.Sync.SyncCount, 3},
+		{"synctime", cfg.Sync.SyncTime, 5},
+		{"format", cfg.Sync.Format, "ndjson"},
+		{"compress", cfg.Sync.Compress, "zstd"},
+		{"segmentsize", cfg.Sync.SegmentSize, 64},
+		{"minfiles", cfg.Sync.MinFiles, 3},
+		{"cache", cfg.Sync.Cache, 65536},
+		{"storage", cfg.Sync.Storage, "json"},
+	} {
+		if c.got != c.expect {
+			t.Errorf("sync %s: expect %v, got %v", c.name, c.expect, c.got)
+		}
+	}
+
+	srcs := cfg.GetSources()
+	if len(srcs) != 1 {
+		t.Fatalf("single master should be the only source, got: %v", srcs)
+	}
+	if srcs[0].Name != DEFAULT_SOURCE {
+		t.Errorf("expect the source named %s, got %s", DEFAULT_SOURCE, srcs[0].Name)
+	}
+	if srcs[0].Host != cfg.Master.Host {
+		t.Errorf("expect the source of master %s, got %s", cfg.Master.Host, srcs[0].Host)
+	}
+
+	cfg.Sources = []Source{{Name: "s1"}, {Name: "s1"}}
+	if err = cfg.checkSources(); err == nil {
+		t.Error("duplicate source name should fail")
+	}
+}
@@ -25,17 +25,17 @@ var bitCountInByte []uint8 = []uint8{
 }
 
 // Calculate totol bit counts in a bitmap
-func BitCount(bitmap []uint8) uint8 {
-	n := uint8(0)
+func BitCount(bitmap []uint8) int {
+	n := 0
 	for i := 0; i < len(bitmap); i++ {
 		bit := bitmap[i]
-		n += bitCountInByte[bit]
+		n += int(bitCountInByte[bit])
 	}
 	return n
 }
 
 // Get the bit set at offset position in bitmap
-func BitGet(bitmap []uint8, position uint8) bool {
-	bit := bitmap[int(position>>3)]
-	return bit&(1<<(position&7)) > 0
+func BitGet(bitmap []uint8, position int) bool {
+	bit := bitmap[position>>3]
+	return bit&(1<<uint(position&7)) > 0
 }
@@ -0,0 +1,132 @@
+/**
+ *  author: lim
+ *  data  : 18-8-16 下午8:10
+ */
+
+package event
+
+import (
+	"strings"
+
+	"github.com/lemonwx/log"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/encoding/unicode/utf32"
+)
+
+// BINARY_CHARSET columns: BINARY, VARBINARY and BLOB, their values are kept as []byte
+const BINARY_CHARSET = "binary"
+
+// encodings of the charsets not compatible with utf8, mysql latin1 is cp1252 indeed
+var encodings = map[string]encoding.Encoding{
+	"latin1":   charmap.Windows1252,
+	"latin2":   charmap.ISO8859_2,
+	"cp1250":   charmap.Windows1250,
+	"cp1251":   charmap.Windows1251,
+	"cp1256":   charmap.Windows1256,
+	"cp1257":   charmap.Windows1257,
+	"koi8r":    charmap.KOI8R,
+	"koi8u":    charmap.KOI8U,
+	"greek":    charmap.ISO8859_7,
+	"hebrew":   charmap.ISO8859_8,
+	"latin5":   charmap.ISO8859_9,
+	"latin7":   charmap.ISO8859_13,
+	"cp850":    charmap.CodePage850,
+	"cp852":    charmap.CodePage852,
+	"cp866":    charmap.CodePage866,
+	"macroman": charmap.Macintosh,
+	"tis620":   charmap.Windows874,
+	"ucs2":     unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"utf16":    unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"utf16le":  unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf32":    utf32.UTF32(utf32.BigEndian, utf32.IgnoreBOM),
+	"gbk":      simplifiedchinese.GBK,
+	"gb2312":   simplifiedchinese.GBK,
+	"gb18030":  simplifiedchinese.GB18030,
+	"big5":     traditionalchinese.Big5,
+	"sjis":     japanese.ShiftJIS,
+	"cp932":    japanese.ShiftJIS,
+	"ujis":     japanese.EUCJP,
+	"eucjpms":  japanese.EUCJP,
+	"euckr":    korean.EUCKR,
+}
+
+// collations of the charsets above, utf8 and binary, by id sent in table map event
+var collations = map[uint64]string{
+	1: "big5", 84: "big5",
+	5: "latin1", 8: "latin1", 15: "latin1", 31: "latin1", 47: "latin1", 48: "latin1", 49: "latin1", 94: "latin1",
+	2: "latin2", 9: "latin2", 21: "latin2", 27: "latin2", 77: "latin2",
+	7: "koi8r", 74: "koi8r", 22: "koi8u", 75: "koi8u",
+	11: "ascii", 65: "ascii",
+	12: "ujis", 91: "ujis", 97: "eucjpms", 98: "eucjpms",
+	13: "sjis", 88: "sjis", 95: "cp932", 96: "cp932",
+	16: "hebrew", 71: "hebrew", 25: "greek", 70: "greek",
+	19: "euckr", 85: "euckr",
+	24: "gb2312", 86: "gb2312", 28: "gbk", 87: "gbk", 248: "gb18030", 249: "gb18030", 250: "gb18030",
+	26: "cp1250", 34: "cp1250", 44: "cp1250", 66: "cp1250", 99: "cp1250",
+	14: "cp1251", 23: "cp1251", 50: "cp1251", 51: "cp1251", 52: "cp1251",
+	57: "cp1256", 67: "cp1256", 29: "cp1257", 58: "cp1257", 59: "cp1257",
+	30: "latin5", 78: "latin5", 20: "latin7", 41: "latin7", 42: "latin7", 79: "latin7",
+	4: "cp850", 80: "cp850", 40: "cp852", 81: "cp852", 36: "cp866", 68: "cp866",
+	39: "macroman", 53: "macroman", 18: "tis620", 89: "tis620",
+	35: "ucs2", 90: "ucs2", 54: "utf16", 55: "utf16", 56: "utf16le", 62: "utf16le", 60: "utf32", 61: "utf32",
+	33: "utf8", 83: "utf8", 45: "utf8mb4", 46: "utf8mb4", 255: "utf8mb4",
+	63: BINARY_CHARSET,
+}
+
+// CharsetOfCollation the charset name of collation id, utf8 for the unknown ones
+func CharsetOfCollation(id uint64) string {
+	if charset, ok := collations[id]; ok {
+		return charset
+	}
+	switch {
+	case id >= 101 && id <= 124:
+		return "utf16"
+	case id >= 128 && id <= 151:
+		return "ucs2"
+	case id >= 160 && id <= 183:
+		return "utf32"
+	case id >= 192 && id <= 215:
+		return "utf8"
+	case id >= 224 && id <= 247, id >= 255 && id <= 323:
+		return "utf8mb4"
+	}
+	return "utf8"
+}
+
+// CharsetOfType the charset of the column type defined without explicit charset,
+// BINARY_CHARSET for binary strings, "" for the default one
+func CharsetOfType(fieldType string) string {
+	for _, prefix := range []string{"binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob"} {
+		if strings.HasPrefix(fieldType, prefix) {
+			return BINARY_CHARSET
+		}
+	}
+	return ""
+}
+
+// DecodeText the string value in charset as utf8, binary ones are copied as []byte
+func DecodeText(bin []byte, charset string) interface{} {
+	if charset == BINARY_CHARSET {
+		val := make([]byte, len(bin))
+		copy(val, bin)
+		return val
+	}
+
+	enc, ok := encodings[charset]
+	if !ok {
+		// utf8, utf8mb4, ascii or unknown
+		return string(bin)
+	}
+	val, err := enc.NewDecoder().Bytes(bin)
+	if err != nil {
+		log.Errorf("decode %s value %v failed: %v", charset, bin, err)
+		return string(bin)
+	}
+	return string(val)
+}
@@ -0,0 +1,653 @@
+/**
+ *  author: lim
+ *  data  : 18-8-27 下午8:10
+ */
+
+package event
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strconv"
+
+	"github.com/juju/errors"
+)
+
+// CODEC_VERSION of the events encoded, the ones of other versions are rejected,
+// 0 is the json of the event structs before the codec, see CodecVersion
+const CODEC_VERSION = 1
+
+// envelope is an event encoded: its header, the body decoded as the fields of its type,
+// and the raw bytes of the body from binlog so the event can be decoded again
+type envelope struct {
+	Version int             `json:"version"`
+	Type    uint8           `json:"type"`
+	Header  *headerData     `json:"header"`
+	Raw     []byte          `json:"raw,omitempty"` // nil for the events not from binlog
+	Body    json.RawMessage `json:"body"`
+}
+
+type headerData struct {
+	Ts      uint32 `json:"ts"`
+	SvrId   uint32 `json:"server_id"`
+	EveSize uint32 `json:"event_size"`
+	LogPos  uint32 `json:"log_pos"`
+	Flags   uint16 `json:"flags"`
+	Source  string `json:"source,omitempty"`
+	Raw     []byte `json:"raw,omitempty"`
+}
+
+type gtidData struct {
+	CommitFlag    bool   `json:"commit_flag"`
+	Sid           []byte `json:"sid"`
+	Gno           uint64 `json:"gno"`
+	LastCommitted uint64 `json:"last_committed"`
+	SeqNum        uint64 `json:"seq_num"`
+	Gtid          string `json:"gtid"`
+}
+
+type xidData struct {
+	Xid uint64 `json:"xid"`
+}
+
+type queryData struct {
+	Schema string `json:"schema"`
+	Query  string `json:"query"`
+}
+
+type tableMapData struct {
+	TblId     uint64      `json:"table_id"`
+	Schema    []byte      `json:"schema"`
+	Table     []byte      `json:"table"`
+	FullName  string      `json:"full_name"`
+	FieldSize uint64      `json:"field_size"`
+	ColTypes  []byte      `json:"col_types"`
+	ColMeta   []uint16    `json:"col_meta"`
+	Charsets  []string    `json:"charsets"`
+	Raw       []byte      `json:"raw,omitempty"` // when embedded in a rows event
+	Header    *headerData `json:"header,omitempty"`
+}
+
+type rowsData struct {
+	TblId        uint64                `json:"table_id"`
+	Flags        uint16                `json:"flags"`
+	ExtraDataLen uint16                `json:"extra_data_len"`
+	ExtraData    []byte                `json:"extra_data"`
+	FieldSize    uint64                `json:"field_size"`
+	Bitmap       []byte                `json:"bitmap"`
+	BitmapAfter  []byte                `json:"bitmap_after,omitempty"` // of update events only
+	Rows         []map[int]columnValue `json:"rows"`
+
+	// the table map event encoded before in the same stream, by its id, or a copy of
+	// it if not, nil if the rows event has none
+	TableRef *uint64       `json:"table_ref,omitempty"`
+	Table    *tableMapData `json:"table,omitempty"`
+}
+
+type formatDescData struct {
+	BinlogVersion uint16 `json:"binlog_version"`
+	SvrVersion    []byte `json:"server_version"`
+	CreateTime    uint32 `json:"create_time"`
+}
+
+type rotateData struct {
+	Pos        uint64 `json:"pos"`
+	NextBinlog string `json:"next_binlog"`
+}
+
+type preGtidData struct {
+	Gtids string `json:"gtids"`
+}
+
+type gapData struct {
+	FromFile string `json:"from_file"`
+	FromPos  uint32 `json:"from_pos"`
+	ToFile   string `json:"to_file"`
+	ToPos    uint32 `json:"to_pos"`
+	Reason   string `json:"reason"`
+}
+
+type schemaData struct {
+	FileName string      `json:"file_name"`
+	Gtid     string      `json:"gtid"`
+	Schema   string      `json:"schema"`
+	Table    string      `json:"table"`
+	Columns  []ColumnDef `json:"columns"`
+	Keys     []KeyDef    `json:"keys"`
+	Dropped  bool        `json:"dropped"`
+}
+
+type mariadbGtidData struct {
+	Gtid     MariadbGtid `json:"gtid"`
+	Flags    uint8       `json:"flags"`
+	CommitId uint64      `json:"commit_id"`
+}
+
+type mariadbGtidListData struct {
+	Gtids []MariadbGtid `json:"gtids"`
+}
+
+type checkpointData struct {
+	FileName string `json:"file_name"`
+}
+
+type stopData struct{}
+
+// kinds of the column values, json alone turns the numbers to float64 and []byte to string
+const (
+	valueNull   = "null"
+	valueInt    = "int"
+	valueInt64  = "i64"
+	valueInt32  = "i32"
+	valueUint64 = "u64"
+	valueUint32 = "u32"
+	valueUint16 = "u16"
+	valueUint8  = "u8"
+	valueFloat  = "f64"
+	valueBool   = "bool"
+	valueString = "str"
+	valueBytes  = "bin"
+)
+
+// columnValue is a value of a row with its go type, numbers in decimal, bytes in base64
+type columnValue struct {
+	Kind  string `json:"k"`
+	Value string `json:"v,omitempty"`
+}
+
+func encodeValue(val interface{}) (columnValue, error) {
+	switch v := val.(type) {
+	case nil:
+		return columnValue{Kind: valueNull}, nil
+	case int:
+		return columnValue{valueInt, strconv.FormatInt(int64(v), 10)}, nil
+	case int64:
+		return columnValue{valueInt64, strconv.FormatInt(v, 10)}, nil
+	case int32:
+		return columnValue{valueInt32, strconv.FormatInt(int64(v), 10)}, nil
+	case uint64:
+		return columnValue{valueUint64, strconv.FormatUint(v, 10)}, nil
+	case uint32:
+		return columnValue{valueUint32, strconv.FormatUint(uint64(v), 10)}, nil
+	case uint16:
+		return columnValue{valueUint16, strconv.FormatUint(uint64(v), 10)}, nil
+	case uint8:
+		return columnValue{valueUint8, strconv.FormatUint(uint64(v), 10)}, nil
+	case float64:
+		return columnValue{valueFloat, strconv.FormatFloat(v, 'g', -1, 64)}, nil
+	case bool:
+		return columnValue{valueBool, strconv.FormatBool(v)}, nil
+	case string:
+		return columnValue{valueString, v}, nil
+	case []byte:
+		return columnValue{valueBytes, base64.StdEncoding.EncodeToString(v)}, nil
+	}
+	return columnValue{}, errors.Errorf("unsupported column value %T: %v", val, val)
+}
+
+func decodeValue(val columnValue) (interface{}, error) {
+	var (
+		res interface{}
+		err error
+	)
+	switch val.Kind {
+	case valueNull:
+		return nil, nil
+	case valueInt:
+		var v int64
+		v, err = strconv.ParseInt(val.Value, 10, 0)
+		res = int(v)
+	case valueInt64:
+		res, err = strconv.ParseInt(val.Value, 10, 64)
+	case valueInt32:
+		var v int64
+		v, err = strconv.ParseInt(val.Value, 10, 32)
+		res = int32(v)
+	case valueUint64:
+		res, err = strconv.ParseUint(val.Value, 10, 64)
+	case valueUint32:
+		var v uint64
+		v, err = strconv.ParseUint(val.Value, 10, 32)
+		res = uint32(v)
+	case valueUint16:
+		var v uint64
+		v, err = strconv.ParseUint(val.Value, 10, 16)
+		res = uint16(v)
+	case valueUint8:
+		var v uint64
+		v, err = strconv.ParseUint(val.Value, 10, 8)
+		res = uint8(v)
+	case valueFloat:
+		res, err = strconv.ParseFloat(val.Value, 64)
+	case valueBool:
+		res, err = strconv.ParseBool(val.Value)
+	case valueString:
+		res = val.Value
+	case valueBytes:
+		res, err = base64.StdEncoding.DecodeString(val.Value)
+	default:
+		return nil, errors.Errorf("unknown kind of column value: %s", val.Kind)
+	}
+	return res, errors.Annotatef(err, "%s value %q", val.Kind, val.Value)
+}
+
+// NewEvent of eveType with header, to be decoded
+func NewEvent(eveType uint8, header *EveHeader) (Event, error) {
+	switch eveType {
+	case ROTATE_EVENT:
+		return &RotateEvent{Header: header}, nil
+	case FORMAT_DESCRIPTION_EVENT:
+		return &FormatDescEvent{Header: header}, nil
+	case QUERY_EVENT:
+		return &QueryEvent{Header: header}, nil
+	case WRITE_ROWS_EVENT_V1, UPDATE_ROWS_EVENT_V1, DELETE_ROWS_EVENT_V1,
+		WRITE_ROWS_EVENT_V2, UPDATE_ROWS_EVENT_V2, DELETE_ROWS_EVENT_V2:
+		return &RowsEvent{Header: header}, nil
+	case TABLE_MAP_EVENT:
+		return &TableMapEvent{Header: header}, nil
+	case GTID_LOG_EVENT:
+		return &GtidEvent{Header: header}, nil
+	case PREVIOUS_GTIDS_LOG_EVENT:
+		return &PreGtidLogEvent{Header: header}, nil
+	case XID_EVENT:
+		return &XidEvnet{Header: header}, nil
+	case STOP_EVENT:
+		return &StopEvent{Header: header}, nil
+	case GAP_EVENT:
+		return &GapEvent{Header: header}, nil
+	case SCHEMA_EVENT:
+		return &SchemaEvent{Header: header}, nil
+	case MARIADB_GTID_EVENT:
+		return &MariadbGtidEvent{Header: header}, nil
+	case MARIADB_GTID_LIST_EVENT:
+		return &MariadbGtidListEvent{Header: header}, nil
+	case MARIADB_ANNOTATE_ROWS_EVENT:
+		return &MariadbAnnotateRowsEvent{Header: header}, nil
+	case MARIADB_BINLOG_CHECKPOINT_EVENT:
+		return &MariadbBinlogCheckpointEvent{Header: header}, nil
+	}
+	return nil, errors.Errorf("unknown event type %d", eveType)
+}
+
+// Encoder encodes the events of a stream, a rows event refers to the table map event
+// of its transaction encoded before instead of a copy
+type Encoder struct {
+	tables map[uint64]*TableMapEvent // of current transaction, nil if not a stream
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{tables: make(map[uint64]*TableMapEvent)}
+}
+
+// Marshal eve alone, a rows event with a copy of its table map event
+func Marshal(eve Event) ([]byte, error) {
+	return (&Encoder{}).Encode(eve)
+}
+
+// Encode eve in CODEC_VERSION
+func (enc *Encoder) Encode(eve Event) ([]byte, error) {
+	header := GetEventHeader(eve)
+	if header == nil {
+		return nil, errors.Errorf("unsupported event %T", eve)
+	}
+	expect, err := NewEvent(header.EveType, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if reflect.TypeOf(expect) != reflect.TypeOf(eve) {
+		return nil, errors.Errorf("event %T of type %d, expect %T", eve, header.EveType, expect)
+	}
+
+	env := &envelope{Version: CODEC_VERSION, Type: header.EveType, Header: encodeHeader(header)}
+	var body interface{}
+	switch e := eve.(type) {
+	case *GtidEvent:
+		enc.reset()
+		env.Raw = e.encode
+		body = &gtidData{CommitFlag: e.commitFlag, Sid: e.sig, Gno: e.gno,
+			LastCommitted: e.LastCommitted, SeqNum: e.SeqNum, Gtid: e.Gtid}
+	case *XidEvnet:
+		enc.reset()
+		env.Raw = e.Encoded
+		body = &xidData{Xid: e.Xid}
+	case *QueryEvent:
+		enc.reset()
+		env.Raw = e.encode
+		body = &queryData{Schema: e.Schema, Query: e.Query}
+	case *TableMapEvent:
+		if enc.tables != nil {
+			enc.tables[e.TblId] = e
+		}
+		env.Raw = e.encode
+		body = encodeTableMap(e, false)
+	case *RowsEvent:
+		env.Raw = e.encode
+		if body, err = enc.encodeRows(e); err != nil {
+			return nil, errors.Trace(err)
+		}
+	case *FormatDescEvent:
+		env.Raw = e.Encoded
+		body = &formatDescData{BinlogVersion: e.BinlogVersion, SvrVersion: e.SvrVersion, CreateTime: e.CreateTime}
+	case *RotateEvent:
+		env.Raw = e.Encoded
+		body = &rotateData{Pos: e.Pos, NextBinlog: e.NextBinlog}
+	case *StopEvent:
+		env.Raw = e.Encoded
+		body = &stopData{}
+	case *PreGtidLogEvent:
+		env.Raw = e.Encoded
+		body = &preGtidData{Gtids: e.Gtids}
+	case *GapEvent:
+		body = &gapData{FromFile: e.FromFile, FromPos: e.FromPos, ToFile: e.ToFile, ToPos: e.ToPos, Reason: e.Reason}
+	case *SchemaEvent:
+		body = &schemaData{FileName: e.FileName, Gtid: e.Gtid, Schema: e.Schema, Table: e.Table,
+			Columns: e.Columns, Keys: e.Keys, Dropped: e.Dropped}
+	case *MariadbGtidEvent:
+		enc.reset()
+		env.Raw = e.Encoded
+		body = &mariadbGtidData{Gtid: e.Gtid, Flags: e.Flags, CommitId: e.CommitId}
+	case *MariadbGtidListEvent:
+		env.Raw = e.Encoded
+		body = &mariadbGtidListData{Gtids: e.Gtids}
+	case *MariadbAnnotateRowsEvent:
+		env.Raw = e.encode
+		body = &queryData{Query: e.Query}
+	case *MariadbBinlogCheckpointEvent:
+		env.Raw = e.encode
+		body = &checkpointData{FileName: e.FileName}
+	}
+
+	if env.Body, err = json.Marshal(body); err != nil {
+		return nil, errors.Trace(err)
+	}
+	data, err := json.Marshal(env)
+	return data, errors.Trace(err)
+}
+
+// reset the table map events at the transaction boundaries
+func (enc *Encoder) reset() {
+	if len(enc.tables) != 0 {
+		enc.tables = make(map[uint64]*TableMapEvent)
+	}
+}
+
+func (enc *Encoder) encodeRows(re *RowsEvent) (*rowsData, error) {
+	data := &rowsData{TblId: re.TblId, Flags: re.flags, ExtraDataLen: re.extraDataLen, ExtraData: re.extraData,
+		FieldSize: re.fieldSize, Bitmap: re.bitmap, BitmapAfter: re.bitmapAfter, Rows: make([]map[int]columnValue, 0, len(re.Rows))}
+	for _, row := range re.Rows {
+		encoded := make(map[int]columnValue, len(row))
+		for idx, val := range row {
+			v, err := encodeValue(val)
+			if err != nil {
+				return nil, errors.Annotatef(err, "column %d", idx)
+			}
+			encoded[idx] = v
+		}
+		data.Rows = append(data.Rows, encoded)
+	}
+
+	if tbl := re.Table; tbl != nil {
+		if enc.tables[tbl.TblId] == tbl {
+			id := tbl.TblId
+			data.TableRef = &id
+		} else {
+			data.Table = encodeTableMap(tbl, true)
+		}
+	}
+	return data, nil
+}
+
+// encodeTableMap with its header and raw bytes if embedded in a rows event
+func encodeTableMap(tbl *TableMapEvent, embedded bool) *tableMapData {
+	data := &tableMapData{TblId: tbl.TblId, Schema: tbl.Schema, Table: tbl.Table, FullName: tbl.FullName,
+		FieldSize: tbl.FieldSize, ColTypes: tbl.ColTypes, ColMeta: tbl.ColMeta, Charsets: tbl.Charsets}
+	if embedded {
+		data.Raw = tbl.encode
+		if tbl.Header != nil {
+			data.Header = encodeHeader(tbl.Header)
+		}
+	}
+	return data
+}
+
+func encodeHeader(header *EveHeader) *headerData {
+	return &headerData{Ts: header.Ts, SvrId: header.SvrId, EveSize: header.EveSize, LogPos: header.LogPos,
+		Flags: header.Flags, Source: header.Source, Raw: header.encode}
+}
+
+// Decoder decodes the events of a stream encoded by an Encoder
+type Decoder struct {
+	tables map[uint64]*TableMapEvent
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{tables: make(map[uint64]*TableMapEvent)}
+}
+
+// Unmarshal an event encoded alone
+func Unmarshal(data []byte) (Event, error) {
+	return NewDecoder().Decode(data)
+}
+
+// CodecVersion of the event encoded, 0 if it's the json of the event struct
+func CodecVersion(data []byte) (int, error) {
+	env := &struct {
+		Version int `json:"version"`
+	}{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return env.Version, nil
+}
+
+// Decode an event encoded in CODEC_VERSION, the other versions rejected
+func (dec *Decoder) Decode(data []byte) (Event, error) {
+	env := &envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if env.Version != CODEC_VERSION {
+		return nil, errors.Errorf("unsupported codec version %d of event type %d, expect %d",
+			env.Version, env.Type, CODEC_VERSION)
+	}
+	if env.Header == nil {
+		return nil, errors.Errorf("event of type %d without header", env.Type)
+	}
+
+	header := decodeHeader(env.Header, env.Type)
+	eve, err := NewEvent(env.Type, header)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	unmarshal := func(v interface{}) error {
+		return errors.Annotatef(json.Unmarshal(env.Body, v), "body of %s", EventName[env.Type])
+	}
+
+	switch e := eve.(type) {
+	case *GtidEvent:
+		data := &gtidData{}
+		if err = unmarshal(data); err == nil {
+			e.commitFlag, e.sig, e.gno = data.CommitFlag, data.Sid, data.Gno
+			e.LastCommitted, e.SeqNum, e.Gtid, e.encode = data.LastCommitted, data.SeqNum, data.Gtid, env.Raw
+		}
+	case *XidEvnet:
+		data := &xidData{}
+		if err = unmarshal(data); err == nil {
+			e.Xid, e.Encoded = data.Xid, env.Raw
+		}
+	case *QueryEvent:
+		data := &queryData{}
+		if err = unmarshal(data); err == nil {
+			e.Schema, e.Query, e.encode = data.Schema, data.Query, env.Raw
+		}
+	case *TableMapEvent:
+		data := &tableMapData{}
+		if err = unmarshal(data); err == nil {
+			decodeTableMap(e, data)
+			e.encode = env.Raw
+			dec.tables[e.TblId] = e
+		}
+	case *RowsEvent:
+		data := &rowsData{}
+		if err = unmarshal(data); err == nil {
+			err = dec.decodeRows(e, data)
+			e.encode = env.Raw
+		}
+	case *FormatDescEvent:
+		data := &formatDescData{}
+		if err = unmarshal(data); err == nil {
+			e.BinlogVersion, e.SvrVersion, e.CreateTime, e.Encoded = data.BinlogVersion, data.SvrVersion, data.CreateTime, env.Raw
+		}
+	case *RotateEvent:
+		data := &rotateData{}
+		if err = unmarshal(data); err == nil {
+			e.Pos, e.NextBinlog, e.Encoded = data.Pos, data.NextBinlog, env.Raw
+		}
+	case *StopEvent:
+		if err = unmarshal(&stopData{}); err == nil {
+			e.Encoded = env.Raw
+		}
+	case *PreGtidLogEvent:
+		data := &preGtidData{}
+		if err = unmarshal(data); err == nil {
+			e.Gtids, e.Encoded = data.Gtids, env.Raw
+		}
+	case *GapEvent:
+		data := &gapData{}
+		if err = unmarshal(data); err == nil {
+			e.FromFile, e.FromPos, e.ToFile, e.ToPos, e.Reason = data.FromFile, data.FromPos, data.ToFile, data.ToPos, data.Reason
+		}
+	case *SchemaEvent:
+		data := &schemaData{}
+		if err = unmarshal(data); err == nil {
+			e.FileName, e.Gtid, e.Schema, e.Table = data.FileName, data.Gtid, data.Schema, data.Table
+			e.Columns, e.Keys, e.Dropped = data.Columns, data.Keys, data.Dropped
+		}
+	case *MariadbGtidEvent:
+		data := &mariadbGtidData{}
+		if err = unmarshal(data); err == nil {
+			e.Gtid, e.Flags, e.CommitId, e.Encoded = data.Gtid, data.Flags, data.CommitId, env.Raw
+		}
+	case *MariadbGtidListEvent:
+		data := &mariadbGtidListData{}
+		if err = unmarshal(data); err == nil {
+			e.Gtids, e.Encoded = data.Gtids, env.Raw
+		}
+	case *MariadbAnnotateRowsEvent:
+		data := &queryData{}
+		if err = unmarshal(data); err == nil {
+			e.Query, e.encode = data.Query, env.Raw
+		}
+	case *MariadbBinlogCheckpointEvent:
+		data := &checkpointData{}
+		if err = unmarshal(data); err == nil {
+			e.FileName, e.encode = data.FileName, env.Raw
+		}
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return eve, nil
+}
+
+func (dec *Decoder) decodeRows(re *RowsEvent, data *rowsData) error {
+	re.TblId, re.flags, re.extraDataLen, re.extraData = data.TblId, data.Flags, data.ExtraDataLen, data.ExtraData
+	re.fieldSize, re.bitmap, re.bitmapAfter = data.FieldSize, data.Bitmap, data.BitmapAfter
+	re.Rows = make([]map[int]interface{}, 0, len(data.Rows))
+	for _, encoded := range data.Rows {
+		row := make(map[int]interface{}, len(encoded))
+		for idx, val := range encoded {
+			v, err := decodeValue(val)
+			if err != nil {
+				return errors.Annotatef(err, "column %d", idx)
+			}
+			row[idx] = v
+		}
+		re.Rows = append(re.Rows, row)
+	}
+
+	switch {
+	case data.TableRef != nil:
+		tbl, ok := dec.tables[*data.TableRef]
+		if !ok {
+			return errors.Errorf("table map event %d of the rows event not decoded before", *data.TableRef)
+		}
+		re.Table = tbl
+	case data.Table != nil:
+		re.Table = &TableMapEvent{}
+		decodeTableMap(re.Table, data.Table)
+		re.Table.encode = data.Table.Raw
+		if data.Table.Header != nil {
+			re.Table.Header = decodeHeader(data.Table.Header, TABLE_MAP_EVENT)
+		}
+	}
+	return nil
+}
+
+func decodeTableMap(tbl *TableMapEvent, data *tableMapData) {
+	tbl.TblId, tbl.Schema, tbl.Table, tbl.FullName = data.TblId, data.Schema, data.Table, data.FullName
+	tbl.FieldSize, tbl.ColTypes, tbl.ColMeta, tbl.Charsets = data.FieldSize, data.ColTypes, data.ColMeta, data.Charsets
+}
+
+func decodeHeader(data *headerData, eveType uint8) *EveHeader {
+	return &EveHeader{Ts: data.Ts, EveType: eveType, SvrId: data.SvrId, EveSize: data.EveSize, LogPos: data.LogPos,
+		Flags: data.Flags, Source: data.Source, encode: data.Raw}
+}
+
+// Redecode eve from the raw bytes of binlog it's decoded from, a rows event with its
+// table map event, false if eve is not from binlog or its bytes unknown
+func Redecode(eve Event) (Event, bool, error) {
+	header := GetEventHeader(eve)
+	if header == nil {
+		return nil, false, nil
+	}
+	var raw []byte
+	switch e := eve.(type) {
+	case *GtidEvent:
+		raw = e.encode
+	case *XidEvnet:
+		raw = e.Encoded
+	case *QueryEvent:
+		raw = e.encode
+	case *TableMapEvent:
+		raw = e.encode
+	case *RowsEvent:
+		raw = e.encode
+	case *FormatDescEvent:
+		raw = e.Encoded
+	case *RotateEvent:
+		raw = e.Encoded
+	case *StopEvent:
+		raw = e.Encoded
+	case *PreGtidLogEvent:
+		raw = e.Encoded
+	case *MariadbGtidEvent:
+		raw = e.Encoded
+	case *MariadbGtidListEvent:
+		raw = e.Encoded
+	case *MariadbAnnotateRowsEvent:
+		raw = e.encode
+	case *MariadbBinlogCheckpointEvent:
+		raw = e.encode
+	}
+	if raw == nil {
+		return nil, false, nil
+	}
+
+	copied := *header
+	decoded, err := NewEvent(header.EveType, &copied)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	if re, ok := eve.(*RowsEvent); ok {
+		if re.Table == nil {
+			return nil, false, nil
+		}
+		decoded.(*RowsEvent).Table = re.Table
+	}
+	if err = decoded.Decode(raw); err != nil {
+		return nil, false, errors.Annotatef(err, "decode %s again", EventName[header.EveType])
+	}
+	return decoded, true, nil
+}
@@ -0,0 +1,168 @@
+/**
+ *  author: lim
+ *  data  : 18-8-27 下午10:20
+ */
+
+package event
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lemonwx/xsql/mysql"
+)
+
+// binlogEvent decode body as an event of eveType from binlog, with its header
+func binlogEvent(t *testing.T, eveType uint8, logPos uint32, body []byte, table *TableMapEvent) Event {
+	pkt := make([]byte, EventHeaderSize)
+	binary.LittleEndian.PutUint32(pkt[1:], 1534000000)
+	pkt[5] = eveType
+	binary.LittleEndian.PutUint32(pkt[6:], 1)
+	binary.LittleEndian.PutUint32(pkt[10:], uint32(EventHeaderSize+len(body)))
+	binary.LittleEndian.PutUint32(pkt[14:], logPos)
+	header := &EveHeader{Source: "order"}
+	if err := header.Decode(pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	eve, err := NewEvent(eveType, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re, ok := eve.(*RowsEvent); ok {
+		re.Table = table
+	}
+	if err = eve.Decode(body); err != nil {
+		t.Fatal(err)
+	}
+	return eve
+}
+
+func codecEvents(t *testing.T) []Event {
+	gtid := append([]byte{1}, bytes.Repeat([]byte{0xab}, 16)...)
+	gtid = append(gtid, 7, 0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0)
+	query := []byte{9, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0}
+	query = append(append(query, "test"...), append([]byte{0}, "BEGIN"...)...)
+	tblData := []byte{1, 0, 0, 0, 0, 0, 0, 0, 4, 't', 'e', 's', 't', 0, 1, 't', 0, 4,
+		mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_LONGLONG,
+		// metadata: varchar(40), char(10), blob, then the null bitmap
+		5, 40, 0, mysql.MYSQL_TYPE_STRING, 10, 2, 0,
+		TABLE_MAP_COLUMN_CHARSET, 3, 8, 28, 63,
+	}
+	rows := []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0x0f,
+		0, 4, 'c', 'a', 'f', 0xe9, 2, 0xc4, 0xe3, 4, 0, 0, 1, 2, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		// the char column null
+		0x02, 1, 'a', 1, 0, 'b', 1, 0, 0, 0, 0, 0, 0, 0}
+	rotate := append([]byte{4, 0, 0, 0, 0, 0, 0, 0}, "mysql-bin.000002"...)
+
+	tbl := binlogEvent(t, TABLE_MAP_EVENT, 300, tblData, nil).(*TableMapEvent)
+	cols := []ColumnDef{{Name: "name", Type: "varchar(40)", Charset: "latin1"}, {Name: "id", Type: "bigint"}}
+	return []Event{
+		binlogEvent(t, GTID_LOG_EVENT, 200, gtid, nil),
+		binlogEvent(t, QUERY_EVENT, 250, query, nil),
+		tbl,
+		binlogEvent(t, WRITE_ROWS_EVENT_V2, 400, rows, tbl),
+		binlogEvent(t, XID_EVENT, 450, []byte{9, 0, 0, 0, 0, 0, 0, 0}, nil),
+		NewSchemaEvent(tbl.Header, "mysql-bin.000001", "", "test", "t", cols,
+			[]KeyDef{{Name: PRIMARY_KEY, Columns: []string{"id"}}}),
+		binlogEvent(t, MARIADB_GTID_EVENT, 500, []byte{5, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}, nil),
+		binlogEvent(t, ROTATE_EVENT, 550, rotate, nil),
+		NewGapEvent("mysql-bin.000002", 4, "mysql-bin.000003", 4, "purged"),
+		binlogEvent(t, STOP_EVENT, 600, nil, nil),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	events := codecEvents(t)
+	re := events[3].(*RowsEvent)
+	if len(re.Rows) != 2 || re.Rows[1][1] != nil {
+		t.Fatalf("unexpect rows decoded: %v", re.Rows)
+	}
+
+	enc, dec := NewEncoder(), NewDecoder()
+	for _, eve := range events {
+		data, err := enc.Encode(eve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := eve.(*RowsEvent); ok && (!strings.Contains(string(data), `"table_ref"`) || strings.Contains(string(data), `"table"`)) {
+			t.Errorf("expect the rows event refer to its table map event: %s", data)
+		}
+
+		decoded, err := dec.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(eve, decoded) {
+			t.Errorf("%s not round-tripped:\n%#v\n%#v", EventName[GetEventType(eve)], eve, decoded)
+		}
+	}
+
+	// alone, with a copy of its table map event
+	data, err := Marshal(re)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil || !reflect.DeepEqual(decoded, re) {
+		t.Errorf("rows event alone not round-tripped: %v", err)
+	}
+
+	// decoded again from the bytes of binlog kept
+	again, ok, err := Redecode(decoded)
+	if err != nil || !ok || !reflect.DeepEqual(again, re) {
+		t.Errorf("rows event not decoded again: %v %v", ok, err)
+	}
+	if _, ok, err = Redecode(events[5]); ok || err != nil {
+		t.Errorf("schema event is not from binlog: %v", err)
+	}
+}
+
+func TestCodecReject(t *testing.T) {
+	events := codecEvents(t)
+	enc := NewEncoder()
+	data := [][]byte{}
+	for _, eve := range events[:4] {
+		encoded, err := enc.Encode(eve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, encoded)
+	}
+	if _, err := Unmarshal(data[3]); err == nil {
+		t.Error("expect failed to decode a rows event without its table map event")
+	}
+
+	env := map[string]interface{}{}
+	if err := json.Unmarshal(data[0], &env); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		key string
+		val interface{}
+	}{
+		{"version", CODEC_VERSION + 1},
+		{"version", 0},
+		{"type", UNKNOWN_EVENT},
+	} {
+		old := env[c.key]
+		env[c.key] = c.val
+		modified, _ := json.Marshal(env)
+		if _, err := Unmarshal(modified); err == nil {
+			t.Errorf("expect %s %v rejected", c.key, c.val)
+		}
+		env[c.key] = old
+	}
+
+	if _, err := Marshal(&QueryEvent{Header: &EveHeader{EveType: XID_EVENT}}); err == nil {
+		t.Error("expect a query event of xid type rejected")
+	}
+	unknown := &RowsEvent{Header: &EveHeader{EveType: WRITE_ROWS_EVENT_V2}, Rows: []map[int]interface{}{{0: struct{}{}}}}
+	if _, err := Marshal(unknown); err == nil {
+		t.Error("expect an unknown column value rejected")
+	}
+}
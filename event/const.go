@@ -47,6 +47,24 @@ const (
 	GTID_LOG_EVENT           = 0x21
 	ANONYMOUS_GTID_LOG_EVENT = 0x22
 	PREVIOUS_GTIDS_LOG_EVENT = 0x23
+
+	MARIADB_ANNOTATE_ROWS_EVENT     = 0xa0
+	MARIADB_BINLOG_CHECKPOINT_EVENT = 0xa1
+	MARIADB_GTID_EVENT              = 0xa2
+	MARIADB_GTID_LIST_EVENT         = 0xa3
+	MARIADB_START_ENCRYPTION_EVENT  = 0xa4
+
+	// not mysql events, generated by go-canal
+	// SCHEMA_EVENT: table definition changed or first used, GAP_EVENT: some binlog skipped
+	SCHEMA_EVENT = 0xfe
+	GAP_EVENT    = 0xff
+)
+
+// optional metadata types of table map event
+const (
+	TABLE_MAP_SIGNEDNESS      = 0x01
+	TABLE_MAP_DEFAULT_CHARSET = 0x02
+	TABLE_MAP_COLUMN_CHARSET  = 0x03
 )
 
 const (
@@ -91,5 +109,12 @@ var (
 		0x21: "GTID_LOG_EVENT",
 		0x22: "ANONYMOUS_GTID_LOG_EVENT",
 		0x23: "PREVIOUS_GTIDS_LOG_EVENT",
+		0xa0: "MARIADB_ANNOTATE_ROWS_EVENT",
+		0xa1: "MARIADB_BINLOG_CHECKPOINT_EVENT",
+		0xa2: "MARIADB_GTID_EVENT",
+		0xa3: "MARIADB_GTID_LIST_EVENT",
+		0xa4: "MARIADB_START_ENCRYPTION_EVENT",
+		0xfe: "SCHEMA_EVENT",
+		0xff: "GAP_EVENT",
 	}
 )
@@ -22,6 +22,9 @@ type EveHeader struct {
 	LogPos  uint32 `json:"log_pos"`
 	Flags   uint16 `json:"flag"`
 
+	// name of the master the event comes from, not a part of mysql binlog
+	Source string `json:"source,omitempty"`
+
 	encode []byte
 }
 
@@ -73,52 +76,59 @@ type Event interface {
 	Dump() string
 }
 
-func GetEventType(eve Event) uint8 {
+func GetEventHeader(eve Event) *EveHeader {
 	switch e := eve.(type) {
 	case *GtidEvent:
-		return e.Header.EveType
+		return e.Header
 	case *XidEvnet:
-		return e.Header.EveType
+		return e.Header
 	case *QueryEvent:
-		return e.Header.EveType
+		return e.Header
 	case *FormatDescEvent:
-		return e.Header.EveType
+		return e.Header
 	case *PreGtidLogEvent:
-		return e.Header.EveType
+		return e.Header
 	case *RotateEvent:
-		return e.Header.EveType
+		return e.Header
 	case *RowsEvent:
-		return e.Header.EveType
+		return e.Header
 	case *TableMapEvent:
-		return e.Header.EveType
+		return e.Header
 	case *StopEvent:
-		return e.Header.EveType
+		return e.Header
+	case *GapEvent:
+		return e.Header
+	case *SchemaEvent:
+		return e.Header
+	case *MariadbGtidEvent:
+		return e.Header
+	case *MariadbGtidListEvent:
+		return e.Header
+	case *MariadbAnnotateRowsEvent:
+		return e.Header
+	case *MariadbBinlogCheckpointEvent:
+		return e.Header
+	}
+	return nil
+}
+
+func GetEventType(eve Event) uint8 {
+	if header := GetEventHeader(eve); header != nil {
+		return header.EveType
 	}
 	return 0
 }
 
 func GetEventTime(eve Event) time.Time {
 	var ts uint32
-	switch e := eve.(type) {
-	case *GtidEvent:
-		ts = e.Header.Ts
-	case *XidEvnet:
-		ts = e.Header.Ts
-	case *QueryEvent:
-		ts = e.Header.Ts
-	case *FormatDescEvent:
-		ts = e.Header.Ts
-	case *PreGtidLogEvent:
-		ts = e.Header.Ts
-	case *RotateEvent:
-		ts = e.Header.Ts
-	case *RowsEvent:
-		ts = e.Header.Ts
-	case *TableMapEvent:
-		ts = e.Header.Ts
-	case *StopEvent:
-		ts = e.Header.Ts
+	if header := GetEventHeader(eve); header != nil {
+		ts = header.Ts
 	}
+	return EventTime(ts)
+}
+
+// EventTime of the timestamp in event header
+func EventTime(ts uint32) time.Time {
 	return time.Unix(int64(ts), 0).UTC().Add(time.Hour * 8)
 }
 
@@ -130,6 +140,7 @@ type GtidEvent struct {
 
 	LastCommitted uint64
 	SeqNum        uint64
+	Gtid          string // sid:gno
 
 	encode []byte
 }
@@ -146,6 +157,7 @@ func (gtidEve *GtidEvent) Decode(data []byte) error {
 	gtidEve.gno = binary.LittleEndian.Uint64(data[pos : pos+8])
 	pos += 8
 	pos += 1
+	gtidEve.Gtid = fmt.Sprintf("%s:%d", gtidEve.Sid(), gtidEve.gno)
 
 	gtidEve.LastCommitted = binary.LittleEndian.Uint64(data[pos : pos+8])
 	pos += 8
@@ -155,8 +167,18 @@ func (gtidEve *GtidEvent) Decode(data []byte) error {
 	return nil
 }
 
+// Sid is the server uuid of the transaction
+func (gtidEve *GtidEvent) Sid() string {
+	return formatSid(gtidEve.sig)
+}
+
+func (gtidEve *GtidEvent) Gno() int64 {
+	return int64(gtidEve.gno)
+}
+
 func (gtidEve *GtidEvent) Dump() string {
-	return fmt.Sprintf("GtidEvent last commited: %d, seq num: %d",
+	return fmt.Sprintf("GtidEvent gtid: %s, last commited: %d, seq num: %d",
+		gtidEve.Gtid,
 		gtidEve.LastCommitted,
 		gtidEve.SeqNum,
 	)
@@ -223,10 +245,15 @@ type TableMapEvent struct {
 	FullName  string
 	FieldSize uint64
 	ColTypes  []byte
+	ColMeta   []uint16
+	Charsets  []string // charset of each string column, "" for the others or unknown
+
+	encode []byte
 }
 
 func (tbl *TableMapEvent) Decode(data []byte) error {
-	tbl.TblId = readTblId(data)
+	tbl.encode = data
+	tbl.TblId = ReadTblId(data)
 	pos := 6
 
 	_ = binary.LittleEndian.Uint16(data[pos:])
@@ -259,11 +286,151 @@ func (tbl *TableMapEvent) Decode(data []byte) error {
 	tbl.ColTypes = data[pos : pos+int(tbl.FieldSize)]
 	pos += int(tbl.FieldSize)
 
-	mysql.LengthEnodedString(data[pos:])
+	meta, _, n, err := mysql.LengthEnodedString(data[pos:])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	pos += n
+	if err = tbl.decodeMeta(meta); err != nil {
+		return errors.Trace(err)
+	}
+
+	// null bitmap
+	pos += int((tbl.FieldSize + 7) / 8)
+	if pos < len(data) {
+		// optional metadata, binlog_row_metadata of mysql 8.0
+		return errors.Trace(tbl.decodeOptionalMeta(data[pos:]))
+	}
+	return nil
+}
+
+// decodeMeta the metadata of each column by type
+func (tbl *TableMapEvent) decodeMeta(data []byte) error {
+	tbl.ColMeta = make([]uint16, len(tbl.ColTypes))
+	pos := 0
+	for idx, colType := range tbl.ColTypes {
+		size := 0
+		switch colType {
+		case mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_DOUBLE, mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_GEOMETRY,
+			mysql.MYSQL_TYPE_JSON, mysql.MYSQL_TYPE_TIMESTAMP2, mysql.MYSQL_TYPE_DATETIME2, mysql.MYSQL_TYPE_TIME2:
+			size = 1
+		case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_BIT,
+			mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_ENUM, mysql.MYSQL_TYPE_SET:
+			size = 2
+		case mysql.MYSQL_TYPE_STRING:
+			// real type, length, keep the order
+			size = 2
+		}
+		if pos+size > len(data) {
+			return errors.Errorf("metadata of column %d out of range", idx)
+		}
+
+		switch {
+		case size == 1:
+			tbl.ColMeta[idx] = uint16(data[pos])
+		case colType == mysql.MYSQL_TYPE_STRING:
+			tbl.ColMeta[idx] = uint16(data[pos])<<8 | uint16(data[pos+1])
+		case size == 2:
+			tbl.ColMeta[idx] = binary.LittleEndian.Uint16(data[pos:])
+		}
+		pos += size
+	}
+	return nil
+}
 
+// decodeOptionalMeta take the charsets only
+func (tbl *TableMapEvent) decodeOptionalMeta(data []byte) error {
+	for pos := 0; pos < len(data); {
+		fieldType := data[pos]
+		pos++
+		length, _, n := mysql.LengthEncodedInt(data[pos:])
+		pos += n
+		if pos+int(length) > len(data) {
+			return errors.Errorf("optional metadata %d out of range", fieldType)
+		}
+		value := data[pos : pos+int(length)]
+		pos += int(length)
+
+		switch fieldType {
+		case TABLE_MAP_DEFAULT_CHARSET:
+			tbl.decodeDefaultCharset(value)
+		case TABLE_MAP_COLUMN_CHARSET:
+			tbl.decodeColumnCharset(value)
+		}
+	}
 	return nil
 }
 
+// textColumns indexes of the columns with charset, in the order of the optional metadata
+func (tbl *TableMapEvent) textColumns() []int {
+	idxs := []int{}
+	for idx, colType := range tbl.ColTypes {
+		switch colType {
+		case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_BLOB:
+			idxs = append(idxs, idx)
+		case mysql.MYSQL_TYPE_STRING:
+			if realType, _ := tbl.stringMeta(idx); realType == mysql.MYSQL_TYPE_STRING {
+				idxs = append(idxs, idx)
+			}
+		}
+	}
+	return idxs
+}
+
+// decodeDefaultCharset: default collation, then (column, collation) of the others
+func (tbl *TableMapEvent) decodeDefaultCharset(data []byte) {
+	cols := tbl.textColumns()
+	tbl.Charsets = make([]string, len(tbl.ColTypes))
+
+	collation, _, pos := mysql.LengthEncodedInt(data)
+	for _, idx := range cols {
+		tbl.Charsets[idx] = CharsetOfCollation(collation)
+	}
+	for pos < len(data) {
+		col, _, n := mysql.LengthEncodedInt(data[pos:])
+		pos += n
+		collation, _, n = mysql.LengthEncodedInt(data[pos:])
+		pos += n
+		if int(col) < len(cols) {
+			tbl.Charsets[cols[col]] = CharsetOfCollation(collation)
+		}
+	}
+}
+
+// decodeColumnCharset: collation of each column
+func (tbl *TableMapEvent) decodeColumnCharset(data []byte) {
+	tbl.Charsets = make([]string, len(tbl.ColTypes))
+	pos := 0
+	for _, idx := range tbl.textColumns() {
+		if pos >= len(data) {
+			return
+		}
+		collation, _, n := mysql.LengthEncodedInt(data[pos:])
+		pos += n
+		tbl.Charsets[idx] = CharsetOfCollation(collation)
+	}
+}
+
+// stringMeta the real type and length of a MYSQL_TYPE_STRING column: CHAR, BINARY, ENUM or SET
+func (tbl *TableMapEvent) stringMeta(idx int) (byte, int) {
+	meta := tbl.ColMeta[idx]
+	realType, length := byte(meta>>8), int(meta&0xff)
+	if realType&0x30 != 0x30 {
+		// length over 255 borrows the bits of real type
+		length |= int((realType&0x30)^0x30) << 4
+		realType |= 0x30
+	}
+	return realType, length
+}
+
+// charset of column idx, "" if unknown
+func (tbl *TableMapEvent) charset(idx int) string {
+	if idx < len(tbl.Charsets) {
+		return tbl.Charsets[idx]
+	}
+	return ""
+}
+
 func (tbl *TableMapEvent) Dump() string {
 	return fmt.Sprintf("TableMapEvent id:%d, schema: %s, table: %s", tbl.TblId, tbl.Schema, tbl.Table)
 }
@@ -333,19 +500,61 @@ func (stop *StopEvent) Dump() string {
 	return fmt.Sprintf("StopEvent")
 }
 
+// PreGtidLogEvent is written at the beginning of every binlog file,
+// the gtids executed in binlogs before
 type PreGtidLogEvent struct {
 	Header *EveHeader
 
+	Gtids string
+
 	Encoded []byte
 }
 
 func (preGtid *PreGtidLogEvent) Decode(data []byte) error {
 	preGtid.Encoded = data
-	pos := 0
-	pos += 8
+	set, err := DecodeGtidSet(data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	preGtid.Gtids = set.String()
 	return nil
 }
 
 func (preGtid *PreGtidLogEvent) Dump() string {
-	return "PreviousGtidLogEvent"
+	return fmt.Sprintf("PreviousGtidLogEvent gtids: %s", preGtid.Gtids)
+}
+
+// GapEvent marks the binlog between From and To is lost
+type GapEvent struct {
+	Header *EveHeader
+
+	FromFile string
+	FromPos  uint32
+	ToFile   string
+	ToPos    uint32
+	Reason   string
+}
+
+func NewGapEvent(fromFile string, fromPos uint32, toFile string, toPos uint32, reason string) *GapEvent {
+	return &GapEvent{
+		Header: &EveHeader{
+			Ts:      uint32(time.Now().Unix()),
+			EveType: GAP_EVENT,
+			LogPos:  toPos,
+		},
+		FromFile: fromFile,
+		FromPos:  fromPos,
+		ToFile:   toFile,
+		ToPos:    toPos,
+		Reason:   reason,
+	}
+}
+
+func (gap *GapEvent) Decode(data []byte) error {
+	return nil
+}
+
+func (gap *GapEvent) Dump() string {
+	return fmt.Sprintf("GapEvent %s:%d - %s:%d lost, reason: %s",
+		gap.FromFile, gap.FromPos, gap.ToFile, gap.ToPos, gap.Reason)
 }
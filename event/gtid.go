@@ -0,0 +1,225 @@
+/**
+ *  author: lim
+ *  data  : 18-8-11 下午8:10
+ */
+
+package event
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Interval of gno: [Start, Stop)
+type Interval struct {
+	Start int64
+	Stop  int64
+}
+
+func (interval Interval) String() string {
+	if interval.Stop == interval.Start+1 {
+		return strconv.FormatInt(interval.Start, 10)
+	}
+	return fmt.Sprintf("%d-%d", interval.Start, interval.Stop-1)
+}
+
+// GtidSet is a mysql gtid set, server uuid -> sorted and merged intervals
+type GtidSet map[string][]Interval
+
+// ParseGtidSet parse "uuid:1-5:7,uuid2:1-3"
+func ParseGtidSet(str string) (GtidSet, error) {
+	set := make(GtidSet)
+	str = strings.Replace(str, "\n", "", -1)
+	for _, sidStr := range strings.Split(str, ",") {
+		sidStr = strings.TrimSpace(sidStr)
+		if len(sidStr) == 0 {
+			continue
+		}
+
+		parts := strings.Split(sidStr, ":")
+		if len(parts) < 2 {
+			return nil, errors.Errorf("invalid gtid: %s", sidStr)
+		}
+
+		sid, err := normalizeSid(parts[0])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for _, part := range parts[1:] {
+			interval, err := parseInterval(part)
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid gtid: %s", sidStr)
+			}
+			set.addInterval(sid, interval)
+		}
+	}
+	return set, nil
+}
+
+func normalizeSid(sid string) (string, error) {
+	raw, err := hex.DecodeString(strings.Replace(strings.TrimSpace(sid), "-", "", -1))
+	if err != nil || len(raw) != 16 {
+		return "", errors.Errorf("invalid server uuid: %s", sid)
+	}
+	return formatSid(raw), nil
+}
+
+func formatSid(raw []byte) string {
+	s := hex.EncodeToString(raw)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", s[0:8], s[8:12], s[12:16], s[16:20], s[20:32])
+}
+
+func parseInterval(str string) (Interval, error) {
+	bounds := strings.Split(strings.TrimSpace(str), "-")
+	if len(bounds) > 2 {
+		return Interval{}, errors.Errorf("invalid interval: %s", str)
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return Interval{}, errors.Trace(err)
+	}
+	stop := start
+	if len(bounds) == 2 {
+		if stop, err = strconv.ParseInt(bounds[1], 10, 64); err != nil {
+			return Interval{}, errors.Trace(err)
+		}
+	}
+
+	if start <= 0 || stop < start {
+		return Interval{}, errors.Errorf("invalid interval: %s", str)
+	}
+	return Interval{Start: start, Stop: stop + 1}, nil
+}
+
+func (set GtidSet) addInterval(sid string, interval Interval) {
+	intervals := append(set[sid], interval)
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].Start < intervals[j].Start
+	})
+
+	merged := intervals[:1]
+	for _, cur := range intervals[1:] {
+		last := &merged[len(merged)-1]
+		if cur.Start <= last.Stop {
+			if cur.Stop > last.Stop {
+				last.Stop = cur.Stop
+			}
+		} else {
+			merged = append(merged, cur)
+		}
+	}
+	set[sid] = merged
+}
+
+// Add a gtid sid:gno to the set
+func (set GtidSet) Add(sid string, gno int64) {
+	set.addInterval(sid, Interval{Start: gno, Stop: gno + 1})
+}
+
+func (set GtidSet) containInterval(sid string, interval Interval) bool {
+	for _, cur := range set[sid] {
+		if cur.Start <= interval.Start && interval.Stop <= cur.Stop {
+			return true
+		}
+	}
+	return false
+}
+
+// Contain report whether every gtid in other is in set
+func (set GtidSet) Contain(other GtidSet) bool {
+	for sid, intervals := range other {
+		for _, interval := range intervals {
+			if !set.containInterval(sid, interval) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Merge add all the gtids in other to set
+func (set GtidSet) Merge(other GtidSet) {
+	for sid, intervals := range other {
+		for _, interval := range intervals {
+			set.addInterval(sid, interval)
+		}
+	}
+}
+
+func (set GtidSet) sids() []string {
+	sids := make([]string, 0, len(set))
+	for sid := range set {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+	return sids
+}
+
+func (set GtidSet) String() string {
+	strs := make([]string, 0, len(set))
+	for _, sid := range set.sids() {
+		parts := []string{sid}
+		for _, interval := range set[sid] {
+			parts = append(parts, interval.String())
+		}
+		strs = append(strs, strings.Join(parts, ":"))
+	}
+	return strings.Join(strs, ",")
+}
+
+// Encode in the format of PREVIOUS_GTIDS_LOG_EVENT and COM_BINLOG_DUMP_GTID:
+// n_sids(8), [sid(16), n_intervals(8), [start(8), stop(8)]...]...
+func (set GtidSet) Encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint64(len(set)))
+	for _, sid := range set.sids() {
+		raw, _ := hex.DecodeString(strings.Replace(sid, "-", "", -1))
+		buf.Write(raw)
+		binary.Write(buf, binary.LittleEndian, uint64(len(set[sid])))
+		for _, interval := range set[sid] {
+			binary.Write(buf, binary.LittleEndian, interval.Start)
+			binary.Write(buf, binary.LittleEndian, interval.Stop)
+		}
+	}
+	return buf.Bytes()
+}
+
+func DecodeGtidSet(data []byte) (GtidSet, error) {
+	set := make(GtidSet)
+	if len(data) < 8 {
+		return nil, errors.Errorf("gtid set too short: %d", len(data))
+	}
+
+	pos := 0
+	nSids := binary.LittleEndian.Uint64(data[pos:])
+	pos += 8
+	for i := uint64(0); i < nSids; i++ {
+		if len(data) < pos+24 {
+			return nil, errors.New("gtid set truncated")
+		}
+		sid := formatSid(data[pos : pos+16])
+		pos += 16
+		nIntervals := binary.LittleEndian.Uint64(data[pos:])
+		pos += 8
+
+		for j := uint64(0); j < nIntervals; j++ {
+			if len(data) < pos+16 {
+				return nil, errors.New("gtid set truncated")
+			}
+			start := int64(binary.LittleEndian.Uint64(data[pos:]))
+			stop := int64(binary.LittleEndian.Uint64(data[pos+8:]))
+			pos += 16
+			set.addInterval(sid, Interval{Start: start, Stop: stop})
+		}
+	}
+	return set, nil
+}
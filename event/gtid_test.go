@@ -0,0 +1,72 @@
+/**
+ *  author: lim
+ *  data  : 18-8-11 下午10:20
+ */
+
+package event
+
+import (
+	"testing"
+)
+
+const (
+	sidA = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	sidB = "5bbdf1f7-9a48-11e8-8c4f-0242ac110002"
+)
+
+func TestParseGtidSet(t *testing.T) {
+	set, err := ParseGtidSet(sidB + ":1-3:5, " + sidA + ":1-5:6:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.String() != sidA+":1-6:9,"+sidB+":1-3:5" {
+		t.Errorf("unexpect gtid set: %s", set)
+	}
+
+	set.Add(sidB, 4)
+	if set.String() != sidA+":1-6:9,"+sidB+":1-5" {
+		t.Errorf("unexpect gtid set after add: %s", set)
+	}
+
+	for _, invalid := range []string{sidA, "abc:1-2", sidA + ":3-1", sidA + ":0"} {
+		if _, err := ParseGtidSet(invalid); err == nil {
+			t.Errorf("%s should be invalid", invalid)
+		}
+	}
+}
+
+func TestGtidSetContain(t *testing.T) {
+	executed, _ := ParseGtidSet(sidA + ":1-100," + sidB + ":1-10:20-30")
+
+	for str, expect := range map[string]bool{
+		"":                                       true,
+		sidA + ":1-100":                          true,
+		sidA + ":50," + sidB + ":25":             true,
+		sidA + ":1-101":                          false,
+		sidB + ":5-20":                           false,
+		"8cfb0d6e-9a48-11e8-8c4f-0242ac110002:1": false,
+	} {
+		set, err := ParseGtidSet(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if executed.Contain(set) != expect {
+			t.Errorf("%s contain %s should be %v", executed, set, expect)
+		}
+	}
+}
+
+func TestGtidSetEncode(t *testing.T) {
+	set, _ := ParseGtidSet(sidA + ":1-5:9," + sidB + ":7")
+	decoded, err := DecodeGtidSet(set.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.String() != set.String() {
+		t.Errorf("decoded %s, expect %s", decoded, set)
+	}
+
+	if _, err = DecodeGtidSet(set.Encode()[:30]); err == nil {
+		t.Error("truncated gtid set should fail")
+	}
+}
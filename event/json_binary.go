@@ -0,0 +1,284 @@
+/**
+ *  author: lim
+ *  data  : 18-8-30 下午10:25
+ */
+
+package event
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/xsql/mysql"
+)
+
+// types of the values in the binary json of mysql
+const (
+	JSONB_SMALL_OBJECT = 0x00
+	JSONB_LARGE_OBJECT = 0x01
+	JSONB_SMALL_ARRAY  = 0x02
+	JSONB_LARGE_ARRAY  = 0x03
+	JSONB_LITERAL      = 0x04
+	JSONB_INT16        = 0x05
+	JSONB_UINT16       = 0x06
+	JSONB_INT32        = 0x07
+	JSONB_UINT32       = 0x08
+	JSONB_INT64        = 0x09
+	JSONB_UINT64       = 0x0a
+	JSONB_DOUBLE       = 0x0b
+	JSONB_STRING       = 0x0c
+	JSONB_OPAQUE       = 0x0f
+)
+
+// literals of JSONB_LITERAL
+const (
+	JSONB_NULL  = 0x00
+	JSONB_TRUE  = 0x01
+	JSONB_FALSE = 0x02
+)
+
+// DecodeJson the binary json of a json column as its text, "null" for empty
+func DecodeJson(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "null", nil
+	}
+	d := &jsonDecoder{buf: bytes.NewBuffer(make([]byte, 0, len(data)*2))}
+	if err := d.value(data[0], data[1:]); err != nil {
+		return "", errors.Annotate(err, "binary json")
+	}
+	return d.buf.String(), nil
+}
+
+type jsonDecoder struct {
+	buf *bytes.Buffer
+}
+
+func (d *jsonDecoder) value(jsonType byte, data []byte) error {
+	switch jsonType {
+	case JSONB_SMALL_OBJECT:
+		return d.composite(data, true, false)
+	case JSONB_LARGE_OBJECT:
+		return d.composite(data, true, true)
+	case JSONB_SMALL_ARRAY:
+		return d.composite(data, false, false)
+	case JSONB_LARGE_ARRAY:
+		return d.composite(data, false, true)
+	case JSONB_LITERAL:
+		if len(data) < 1 {
+			return errOutOfRange
+		}
+		return d.literal(data[0])
+	case JSONB_INT16:
+		val, err := readUint(data, 2)
+		d.buf.WriteString(strconv.FormatInt(int64(int16(val)), 10))
+		return err
+	case JSONB_UINT16:
+		val, err := readUint(data, 2)
+		d.buf.WriteString(strconv.FormatUint(val, 10))
+		return err
+	case JSONB_INT32:
+		val, err := readUint(data, 4)
+		d.buf.WriteString(strconv.FormatInt(int64(int32(val)), 10))
+		return err
+	case JSONB_UINT32:
+		val, err := readUint(data, 4)
+		d.buf.WriteString(strconv.FormatUint(val, 10))
+		return err
+	case JSONB_INT64:
+		val, err := readUint(data, 8)
+		d.buf.WriteString(strconv.FormatInt(int64(val), 10))
+		return err
+	case JSONB_UINT64:
+		val, err := readUint(data, 8)
+		d.buf.WriteString(strconv.FormatUint(val, 10))
+		return err
+	case JSONB_DOUBLE:
+		val, err := readUint(data, 8)
+		d.buf.WriteString(strconv.FormatFloat(math.Float64frombits(val), 'g', -1, 64))
+		return err
+	case JSONB_STRING:
+		str, err := readVarBytes(data)
+		if err != nil {
+			return err
+		}
+		return d.str(string(str))
+	case JSONB_OPAQUE:
+		if len(data) < 1 {
+			return errOutOfRange
+		}
+		bin, err := readVarBytes(data[1:])
+		if err != nil {
+			return err
+		}
+		return d.opaque(data[0], bin)
+	}
+	return errors.Errorf("unknown type %d", jsonType)
+}
+
+// composite of the object or array, offsets of the values are from the start of data
+func (d *jsonDecoder) composite(data []byte, isObject, large bool) error {
+	offsetSize := 2
+	if large {
+		offsetSize = 4
+	}
+	count, err := readUint(data, offsetSize)
+	if err != nil {
+		return err
+	}
+	size, err := readUint(data[offsetSize:], offsetSize)
+	if err != nil || size > uint64(len(data)) {
+		return errOutOfRange
+	}
+	data = data[:size]
+
+	// the key entries of offset and length, then the value entries of type and offset or inlined value
+	keyEntrySize, valueEntrySize := offsetSize+2, 1+offsetSize
+	pos := 2 * offsetSize
+	keysPos := pos
+	if isObject {
+		pos += int(count) * keyEntrySize
+	}
+	if uint64(pos)+count*uint64(valueEntrySize) > size {
+		return errOutOfRange
+	}
+
+	open, close := byte('['), byte(']')
+	if isObject {
+		open, close = '{', '}'
+	}
+	d.buf.WriteByte(open)
+	for i := 0; i < int(count); i++ {
+		if i > 0 {
+			d.buf.WriteString(", ")
+		}
+		if isObject {
+			entry := data[keysPos+i*keyEntrySize:]
+			keyOffset, _ := readUint(entry, offsetSize)
+			keyLen, _ := readUint(entry[offsetSize:], 2)
+			if keyOffset+keyLen > size {
+				return errOutOfRange
+			}
+			if err = d.str(string(data[keyOffset : keyOffset+keyLen])); err != nil {
+				return err
+			}
+			d.buf.WriteString(": ")
+		}
+
+		entry := data[pos+i*valueEntrySize:]
+		valueType := entry[0]
+		if inlined(valueType, large) {
+			if err = d.value(valueType, entry[1:valueEntrySize]); err != nil {
+				return err
+			}
+			continue
+		}
+		offset, _ := readUint(entry[1:], offsetSize)
+		if offset >= size {
+			return errOutOfRange
+		}
+		if err = d.value(valueType, data[offset:]); err != nil {
+			return err
+		}
+	}
+	d.buf.WriteByte(close)
+	return nil
+}
+
+// inlined report whether the value of jsonType is in its entry
+func inlined(jsonType byte, large bool) bool {
+	switch jsonType {
+	case JSONB_LITERAL, JSONB_INT16, JSONB_UINT16:
+		return true
+	case JSONB_INT32, JSONB_UINT32:
+		return large
+	}
+	return false
+}
+
+func (d *jsonDecoder) literal(val byte) error {
+	switch val {
+	case JSONB_NULL:
+		d.buf.WriteString("null")
+	case JSONB_TRUE:
+		d.buf.WriteString("true")
+	case JSONB_FALSE:
+		d.buf.WriteString("false")
+	default:
+		return errors.Errorf("unknown literal %d", val)
+	}
+	return nil
+}
+
+func (d *jsonDecoder) str(val string) error {
+	quoted, err := json.Marshal(val)
+	d.buf.Write(quoted)
+	return errors.Trace(err)
+}
+
+// opaque value of a mysql type, the decimals and time types as string, others base64 encoded
+func (d *jsonDecoder) opaque(colType byte, data []byte) error {
+	switch colType {
+	case mysql.MYSQL_TYPE_NEWDECIMAL:
+		// precision and scale, then the binary decimal
+		if len(data) < 2 {
+			return errOutOfRange
+		}
+		val, _, err := readDecimal(data[2:], int(data[0]), int(data[1]))
+		if err != nil {
+			return err
+		}
+		d.buf.WriteString(val.(string))
+		return nil
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_TIMESTAMP, mysql.MYSQL_TYPE_TIME:
+		if len(data) < 8 {
+			return errOutOfRange
+		}
+		return d.str(packedTime(colType, int64(binary.LittleEndian.Uint64(data))))
+	}
+	return d.str("base64:type" + strconv.Itoa(int(colType)) + ":" + base64.StdEncoding.EncodeToString(data))
+}
+
+// packedTime format the time packed in int64: the integer part << 24 | microseconds,
+// the integer part of datetime is (year*13+month)<<22 | day<<17 | hour<<12 | minute<<6 | second
+func packedTime(colType byte, packed int64) string {
+	sign := ""
+	if packed < 0 {
+		sign, packed = "-", -packed
+	}
+	intg, usec := packed>>24, packed&(1<<24-1)
+	frac := ""
+	if usec != 0 {
+		frac = formatFrac(usec, 6)
+	}
+
+	if colType == mysql.MYSQL_TYPE_TIME {
+		return fmt.Sprintf("%s%02d:%02d:%02d%s", sign, intg>>12&(1<<10-1), intg>>6&63, intg&63, frac)
+	}
+	ymd, hms := intg>>17, intg&(1<<17-1)
+	ym := ymd >> 5
+	if colType == mysql.MYSQL_TYPE_DATE {
+		return fmt.Sprintf("%04d-%02d-%02d", ym/13, ym%13, ymd&31)
+	}
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d%s", ym/13, ym%13, ymd&31, hms>>12, hms>>6&63, hms&63, frac)
+}
+
+// readVarBytes prefixed by its length in 7 bits a byte, little endian, the highest bit set if more
+func readVarBytes(data []byte) ([]byte, error) {
+	var length uint64
+	for pos := 0; pos < len(data) && pos < 5; pos++ {
+		length |= uint64(data[pos]&0x7f) << uint(7*pos)
+		if data[pos]&0x80 == 0 {
+			if length > uint64(len(data)-pos-1) {
+				return nil, errOutOfRange
+			}
+			return data[pos+1 : pos+1+int(length)], nil
+		}
+	}
+	return nil, errOutOfRange
+}
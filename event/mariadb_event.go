@@ -0,0 +1,161 @@
+/**
+ *  author: lim
+ *  data  : 18-8-9 下午8:32
+ */
+
+package event
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// MariadbGtidEvent.Flags
+	MARIADB_FL_STANDALONE      = 0x01
+	MARIADB_FL_GROUP_COMMIT_ID = 0x02
+)
+
+type MariadbGtid struct {
+	DomainId uint32
+	ServerId uint32
+	SeqNo    uint64
+}
+
+func (gtid MariadbGtid) String() string {
+	return fmt.Sprintf("%d-%d-%d", gtid.DomainId, gtid.ServerId, gtid.SeqNo)
+}
+
+// MariadbGtidEvent starts a transaction, or a standalone ddl
+type MariadbGtidEvent struct {
+	Header *EveHeader
+
+	Gtid     MariadbGtid
+	Flags    uint8
+	CommitId uint64
+
+	Encoded []byte
+}
+
+func (gtidEve *MariadbGtidEvent) Decode(data []byte) error {
+	if len(data) < 13 {
+		return errors.Errorf("mariadb gtid event too short: %d", len(data))
+	}
+	gtidEve.Encoded = data
+
+	pos := 0
+	gtidEve.Gtid.SeqNo = binary.LittleEndian.Uint64(data[pos:])
+	pos += 8
+	gtidEve.Gtid.DomainId = binary.LittleEndian.Uint32(data[pos:])
+	pos += 4
+	gtidEve.Gtid.ServerId = gtidEve.Header.SvrId
+	gtidEve.Flags = data[pos]
+	pos += 1
+
+	if gtidEve.Flags&MARIADB_FL_GROUP_COMMIT_ID > 0 && len(data) >= pos+8 {
+		gtidEve.CommitId = binary.LittleEndian.Uint64(data[pos:])
+		pos += 8
+	}
+	return nil
+}
+
+func (gtidEve *MariadbGtidEvent) Standalone() bool {
+	return gtidEve.Flags&MARIADB_FL_STANDALONE > 0
+}
+
+func (gtidEve *MariadbGtidEvent) Dump() string {
+	return fmt.Sprintf("MariadbGtidEvent gtid: %s, flags: %d", gtidEve.Gtid, gtidEve.Flags)
+}
+
+// MariadbGtidListEvent is written at the beginning of every binlog file,
+// the last gtid of every domain in binlogs before
+type MariadbGtidListEvent struct {
+	Header *EveHeader
+
+	Gtids []MariadbGtid
+
+	Encoded []byte
+}
+
+func (listEve *MariadbGtidListEvent) Decode(data []byte) error {
+	if len(data) < 4 {
+		return errors.Errorf("mariadb gtid list event too short: %d", len(data))
+	}
+	listEve.Encoded = data
+
+	pos := 0
+	count := binary.LittleEndian.Uint32(data[pos:]) & 0x0fffffff
+	pos += 4
+
+	if len(data) < pos+int(count)*16 {
+		return errors.Errorf("mariadb gtid list event: %d gtids, but only %d bytes", count, len(data))
+	}
+
+	listEve.Gtids = make([]MariadbGtid, 0, count)
+	for i := uint32(0); i < count; i++ {
+		gtid := MariadbGtid{}
+		gtid.DomainId = binary.LittleEndian.Uint32(data[pos:])
+		pos += 4
+		gtid.ServerId = binary.LittleEndian.Uint32(data[pos:])
+		pos += 4
+		gtid.SeqNo = binary.LittleEndian.Uint64(data[pos:])
+		pos += 8
+		listEve.Gtids = append(listEve.Gtids, gtid)
+	}
+	return nil
+}
+
+func (listEve *MariadbGtidListEvent) Dump() string {
+	gtids := make([]string, 0, len(listEve.Gtids))
+	for _, gtid := range listEve.Gtids {
+		gtids = append(gtids, gtid.String())
+	}
+	return fmt.Sprintf("MariadbGtidListEvent gtids: %s", strings.Join(gtids, ","))
+}
+
+// MariadbAnnotateRowsEvent carry the sql generate the following rows events
+type MariadbAnnotateRowsEvent struct {
+	Header *EveHeader
+
+	Query string
+
+	encode []byte
+}
+
+func (annotate *MariadbAnnotateRowsEvent) Decode(data []byte) error {
+	annotate.encode = data
+	annotate.Query = string(data)
+	return nil
+}
+
+func (annotate *MariadbAnnotateRowsEvent) Dump() string {
+	return fmt.Sprintf("MariadbAnnotateRowsEvent query: %s", annotate.Query)
+}
+
+type MariadbBinlogCheckpointEvent struct {
+	Header *EveHeader
+
+	FileName string
+
+	encode []byte
+}
+
+func (checkpoint *MariadbBinlogCheckpointEvent) Decode(data []byte) error {
+	if len(data) < 4 {
+		return errors.Errorf("mariadb binlog checkpoint event too short: %d", len(data))
+	}
+	size := binary.LittleEndian.Uint32(data)
+	if len(data) < 4+int(size) {
+		return errors.Errorf("mariadb binlog checkpoint event: file name size %d, but only %d bytes", size, len(data))
+	}
+	checkpoint.FileName = string(data[4 : 4+size])
+	checkpoint.encode = data
+	return nil
+}
+
+func (checkpoint *MariadbBinlogCheckpointEvent) Dump() string {
+	return fmt.Sprintf("MariadbBinlogCheckpointEvent file: %s", checkpoint.FileName)
+}
@@ -0,0 +1,132 @@
+/**
+ *  author: lim
+ *  data  : 18-8-29 下午8:50
+ */
+
+package event
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// operations of RowChange
+const (
+	OP_INSERT = "insert"
+	OP_UPDATE = "update"
+	OP_DELETE = "delete"
+)
+
+// RowChange is a row changed by a rows event, readable without the table map event:
+// the values are keyed by the column names and typed by the column definitions
+type RowChange struct {
+	Schema string                 `json:"schema"`
+	Table  string                 `json:"table"`
+	Op     string                 `json:"op"`
+	Key    map[string]interface{} `json:"key"`              // of the primary or first unique key, all the columns if neither
+	Before map[string]interface{} `json:"before,omitempty"` // nil for insert
+	After  map[string]interface{} `json:"after,omitempty"`  // nil for delete
+	Types  map[string]string      `json:"types"`            // the column types of the definition
+	Gtid   string                 `json:"gtid,omitempty"`
+	File   string                 `json:"file,omitempty"`
+	Pos    uint32                 `json:"pos"` // where the rows event ends
+	Ts     uint32                 `json:"ts"`
+}
+
+// NewRowChanges of the rows of re, cols and keys are the definition of its table in effect
+// when re written, such as a SchemaEvent tracked
+func NewRowChanges(re *RowsEvent, cols []ColumnDef, keys []KeyDef, gtid, file string) ([]*RowChange, error) {
+	if re.Table == nil {
+		return nil, errors.Errorf("rows event at %d without table map event", re.Header.LogPos)
+	}
+	if uint64(len(cols)) < re.fieldSize {
+		return nil, errors.Errorf("%s has %d columns, but %d in binlog", re.Table.FullName, len(cols), re.fieldSize)
+	}
+
+	names := make([]string, 0, len(cols))
+	types := make(map[string]string, len(cols))
+	for _, col := range cols {
+		names = append(names, col.Name)
+		types[col.Name] = col.Type
+	}
+	idxs := keyIdxs(names, RowKey(keys))
+
+	op, step := OP_INSERT, 1
+	switch re.Header.EveType {
+	case UPDATE_ROWS_EVENT_V1, UPDATE_ROWS_EVENT_V2:
+		op, step = OP_UPDATE, 2
+	case DELETE_ROWS_EVENT_V1, DELETE_ROWS_EVENT_V2:
+		op = OP_DELETE
+	}
+
+	changes := make([]*RowChange, 0, len(re.Rows)/step)
+	for n := 0; n+step <= len(re.Rows); n += step {
+		change := &RowChange{Schema: string(re.Table.Schema), Table: string(re.Table.Table), Op: op,
+			Types: types, Gtid: gtid, File: file, Pos: re.Header.LogPos, Ts: re.Header.Ts}
+		image := typedRow(cols, re.Rows[n])
+		switch op {
+		case OP_INSERT:
+			change.After = image
+		case OP_DELETE:
+			change.Before = image
+		case OP_UPDATE:
+			change.Before, change.After = image, typedRow(cols, re.Rows[n+1])
+		}
+
+		// the row as it was, or as inserted
+		change.Key = make(map[string]interface{}, len(idxs))
+		for _, idx := range idxs {
+			if val, ok := re.Rows[n][idx]; ok {
+				change.Key[cols[idx].Name] = typedValue(cols[idx], val)
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// typedRow the image of a row keyed by the column names
+func typedRow(cols []ColumnDef, row map[int]interface{}) map[string]interface{} {
+	image := make(map[string]interface{}, len(row))
+	for idx, val := range row {
+		if idx < len(cols) {
+			image[cols[idx].Name] = typedValue(cols[idx], val)
+		}
+	}
+	return image
+}
+
+// typedValue of the value decoded as the type of col, the integers are read unsigned
+// from binlog, text is kept a string and binary []byte
+func typedValue(col ColumnDef, val interface{}) interface{} {
+	colType := strings.ToLower(col.Type)
+	if strings.Contains(colType, "unsigned") || !isInteger(colType) {
+		return val
+	}
+	switch v := val.(type) {
+	case uint64:
+		return int64(v)
+	case uint32:
+		if strings.HasPrefix(colType, "mediumint") && v&0x800000 != 0 {
+			// sign of 24 bits
+			return int32(v | 0xff000000)
+		}
+		return int32(v)
+	case uint16:
+		return int16(v)
+	case uint8:
+		return int8(v)
+	}
+	return val
+}
+
+// isInteger report whether colType is of the integer types
+func isInteger(colType string) bool {
+	for _, prefix := range []string{"tinyint", "smallint", "mediumint", "int", "bigint"} {
+		if strings.HasPrefix(colType, prefix) {
+			return true
+		}
+	}
+	return false
+}
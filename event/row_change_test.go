@@ -0,0 +1,102 @@
+/**
+ *  author: lim
+ *  data  : 18-8-29 下午10:15
+ */
+
+package event
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewRowChanges(t *testing.T) {
+	tbl := &TableMapEvent{Schema: []byte("test"), Table: []byte("t"), FullName: "test.t"}
+	cols := []ColumnDef{{Name: "id", Type: "bigint(20)"}, {Name: "name", Type: "varchar(8)"}, {Name: "n", Type: "int(10) unsigned"}}
+	keys := []KeyDef{{Name: "uk", Columns: []string{"name"}}, {Name: PRIMARY_KEY, Columns: []string{"id"}}}
+	update := &RowsEvent{Header: &EveHeader{Ts: 10, EveType: UPDATE_ROWS_EVENT_V2, LogPos: 400}, fieldSize: 3, Table: tbl,
+		Rows: []map[int]interface{}{
+			{0: uint64(1<<64 - 1), 1: "a", 2: uint32(1<<32 - 1)}, {0: uint64(1<<64 - 1), 1: "b", 2: nil},
+			{0: uint64(2), 1: "c", 2: uint32(3)}, {0: uint64(2), 1: "d", 2: uint32(3)},
+		}}
+
+	changes, err := NewRowChanges(update, cols, keys, "3e11fa47-71ca-11e1-9e33-c80aa9429562:7", "mysql-bin.000001")
+	if err != nil || len(changes) != 2 {
+		t.Fatalf("expect 2 rows updated, got %d: %v", len(changes), err)
+	}
+	change := changes[0]
+	if change.Op != OP_UPDATE || change.Schema != "test" || change.Table != "t" || change.Pos != 400 || change.Ts != 10 ||
+		change.Gtid != "3e11fa47-71ca-11e1-9e33-c80aa9429562:7" || change.File != "mysql-bin.000001" {
+		t.Errorf("unexpect change: %+v", change)
+	}
+	// signed by the column type
+	if change.Key["id"] != int64(-1) || len(change.Key) != 1 || change.Before["n"] != uint32(1<<32-1) ||
+		change.Before["name"] != "a" || change.After["name"] != "b" || change.After["n"] != nil {
+		t.Errorf("unexpect values: %+v", change)
+	}
+
+	data, err := json.Marshal(changes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"schema":"test","table":"t","op":"update","key":{"id":2},"before":{"id":2,"n":3,"name":"c"},` +
+		`"after":{"id":2,"n":3,"name":"d"},"types":{"id":"bigint(20)","n":"int(10) unsigned","name":"varchar(8)"},` +
+		`"gtid":"3e11fa47-71ca-11e1-9e33-c80aa9429562:7","file":"mysql-bin.000001","pos":400,"ts":10}`
+	if string(data) != expect {
+		t.Errorf("unexpect record:\n%s\n%s", data, expect)
+	}
+
+	for _, c := range []struct {
+		eveType uint8
+		op      string
+	}{
+		{WRITE_ROWS_EVENT_V2, OP_INSERT},
+		{DELETE_ROWS_EVENT_V1, OP_DELETE},
+	} {
+		re := &RowsEvent{Header: &EveHeader{EveType: c.eveType}, fieldSize: 3, Table: tbl, Rows: update.Rows}
+		changes, err := NewRowChanges(re, cols, keys, "", "")
+		if err != nil || len(changes) != 4 || changes[0].Op != c.op {
+			t.Fatalf("expect 4 rows of %s, got %d: %v", c.op, len(changes), err)
+		}
+		row := changes[2]
+		if c.op == OP_INSERT && (row.Before != nil || row.After["name"] != "c") ||
+			c.op == OP_DELETE && (row.After != nil || row.Before["name"] != "c") {
+			t.Errorf("unexpect images of %s: %+v", c.op, row)
+		}
+	}
+
+	// the columns dropped since
+	if _, err = NewRowChanges(update, cols[:2], keys, "", ""); err == nil {
+		t.Error("expect the definition not matched rejected")
+	}
+}
+
+func TestTypedValue(t *testing.T) {
+	for _, c := range []struct {
+		colType string
+		val     interface{}
+		expect  interface{}
+	}{
+		{"tinyint(4)", uint8(0xff), int8(-1)},
+		{"tinyint(3) unsigned", uint8(0xff), uint8(0xff)},
+		{"smallint(6)", uint16(0x8000), int16(-1 << 15)},
+		{"smallint(5) unsigned", uint16(0x8000), uint16(0x8000)},
+		{"mediumint(9)", uint32(0xffffff), int32(-1)},
+		{"mediumint(9)", uint32(0x7fffff), int32(0x7fffff)},
+		{"mediumint(8) unsigned", uint32(0xffffff), uint32(0xffffff)},
+		{"int(11)", uint32(1<<32 - 2), int32(-2)},
+		{"INT(10) UNSIGNED", uint32(1<<32 - 2), uint32(1<<32 - 2)},
+		{"bigint(20)", uint64(1<<64 - 3), int64(-3)},
+		{"bigint(20) unsigned", uint64(1<<64 - 3), uint64(1<<64 - 3)},
+		// not of the integer types
+		{"year(4)", uint16(2018), uint16(2018)},
+		{"set('a','b')", uint64(3), uint64(3)},
+		{"enum('a','b')", uint16(2), uint16(2)},
+		{"decimal(10,2)", "-1.50", "-1.50"},
+		{"int(11)", nil, nil},
+	} {
+		if val := typedValue(ColumnDef{Name: "c", Type: c.colType}, c.val); val != c.expect {
+			t.Errorf("%s: expect %#v, got %#v", c.colType, c.expect, val)
+		}
+	}
+}
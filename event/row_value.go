@@ -0,0 +1,314 @@
+/**
+ *  author: lim
+ *  data  : 18-8-30 下午9:10
+ */
+
+package event
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/xsql/mysql"
+)
+
+var errOutOfRange = errors.New("value out of range")
+
+// readValue read the value of column idx not null, the integers are read unsigned, the decimals
+// and the time types as string, binary as []byte, failed on the type not supported
+func (tbl *TableMapEvent) readValue(idx int, data []byte) (interface{}, int, error) {
+	var meta uint16
+	if idx < len(tbl.ColMeta) {
+		meta = tbl.ColMeta[idx]
+	}
+
+	switch colType := tbl.ColTypes[idx]; colType {
+	case mysql.MYSQL_TYPE_TINY:
+		val, err := readUint(data, 1)
+		return uint8(val), 1, err
+	case mysql.MYSQL_TYPE_SHORT:
+		val, err := readUint(data, 2)
+		return uint16(val), 2, err
+	case mysql.MYSQL_TYPE_INT24:
+		val, err := readUint(data, 3)
+		return uint32(val), 3, err
+	case mysql.MYSQL_TYPE_LONG:
+		val, err := readUint(data, 4)
+		return uint32(val), 4, err
+	case mysql.MYSQL_TYPE_LONGLONG:
+		val, err := readUint(data, 8)
+		return val, 8, err
+	case mysql.MYSQL_TYPE_YEAR:
+		val, err := readUint(data, 1)
+		if val != 0 {
+			val += 1900
+		}
+		return uint16(val), 1, err
+	case mysql.MYSQL_TYPE_FLOAT:
+		val, err := readUint(data, 4)
+		return float64(math.Float32frombits(uint32(val))), 4, err
+	case mysql.MYSQL_TYPE_DOUBLE:
+		val, err := readUint(data, 8)
+		return math.Float64frombits(val), 8, err
+	case mysql.MYSQL_TYPE_BIT:
+		// meta is the bits of the last byte and the bytes
+		size := int(meta>>8) + int((meta&0xff+7)/8)
+		val, err := readUintBE(data, size)
+		return val, size, err
+	case mysql.MYSQL_TYPE_NEWDECIMAL:
+		// meta is the precision and scale
+		return readDecimal(data, int(meta&0xff), int(meta>>8))
+	case mysql.MYSQL_TYPE_DATE:
+		val, err := readUint(data, 3)
+		if err != nil || val == 0 {
+			return nil, 3, err
+		}
+		return fmt.Sprintf("%04d-%02d-%02d", val/(16*32), val/32%16, val%32), 3, nil
+	case mysql.MYSQL_TYPE_TIME:
+		val, err := readUint(data, 3)
+		return fmt.Sprintf("%02d:%02d:%02d", val/10000, val/100%100, val%100), 3, err
+	case mysql.MYSQL_TYPE_DATETIME:
+		val, err := readUint(data, 8)
+		date, clock := val/1000000, val%1000000
+		return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", date/10000, date/100%100, date%100,
+			clock/10000, clock/100%100, clock%100), 8, err
+	case mysql.MYSQL_TYPE_TIMESTAMP:
+		val, err := readUint(data, 4)
+		return formatTimestamp(int64(val), "", 0), 4, err
+	case mysql.MYSQL_TYPE_DATETIME2:
+		return readDatetime2(data, int(meta))
+	case mysql.MYSQL_TYPE_TIMESTAMP2:
+		return readTimestamp2(data, int(meta))
+	case mysql.MYSQL_TYPE_TIME2:
+		return readTime2(data, int(meta))
+	case mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_BLOB:
+		return tbl.readString(idx, data)
+	case mysql.MYSQL_TYPE_GEOMETRY:
+		return readBytes(data, int(meta))
+	case mysql.MYSQL_TYPE_JSON:
+		bin, size, err := readBytes(data, int(meta))
+		if err != nil {
+			return nil, 0, err
+		}
+		text, err := DecodeJson(bin)
+		return text, size, errors.Trace(err)
+	default:
+		return nil, 0, errors.Errorf("unsupported type %d", colType)
+	}
+}
+
+// readUint of size bytes in little endian
+func readUint(data []byte, size int) (uint64, error) {
+	if size > 8 || size > len(data) {
+		return 0, errOutOfRange
+	}
+	var val uint64
+	for i := size - 1; i >= 0; i-- {
+		val = val<<8 | uint64(data[i])
+	}
+	return val, nil
+}
+
+// readUintBE of size bytes in big endian
+func readUintBE(data []byte, size int) (uint64, error) {
+	if size > 8 || size > len(data) {
+		return 0, errOutOfRange
+	}
+	var val uint64
+	for i := 0; i < size; i++ {
+		val = val<<8 | uint64(data[i])
+	}
+	return val, nil
+}
+
+// readBytes prefixed by its length of lenSize bytes, return them and the size read
+func readBytes(data []byte, lenSize int) ([]byte, int, error) {
+	if lenSize > 4 {
+		return nil, 0, errors.Errorf("length of %d bytes", lenSize)
+	}
+	length, err := readUint(data, lenSize)
+	if err != nil || uint64(len(data)-lenSize) < length {
+		return nil, 0, errOutOfRange
+	}
+	end := lenSize + int(length)
+	return data[lenSize:end], end, nil
+}
+
+// digits in the bytes of a decimal, 9 digits in each 4 bytes
+var dig2bytes = []int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+const digitsPerInt = 9
+
+// decimalSize the bytes of a decimal(precision, scale)
+func decimalSize(precision, scale int) int {
+	intg, frac := precision-scale, scale
+	return intg/digitsPerInt*4 + dig2bytes[intg%digitsPerInt] + frac/digitsPerInt*4 + dig2bytes[frac%digitsPerInt]
+}
+
+// readDecimal of decimal(precision, scale) as string, the groups of digits in big endian,
+// the sign in the highest bit, and all bits flipped for negative
+func readDecimal(data []byte, precision, scale int) (interface{}, int, error) {
+	if scale > precision || precision-scale > 65 || scale > 30 {
+		return nil, 0, errors.Errorf("decimal(%d, %d)", precision, scale)
+	}
+	size := decimalSize(precision, scale)
+	if size > len(data) {
+		return nil, 0, errOutOfRange
+	}
+	bin := make([]byte, size)
+	copy(bin, data)
+	negative := bin[0]&0x80 == 0
+	bin[0] ^= 0x80
+	if negative {
+		for i := range bin {
+			bin[i] ^= 0xff
+		}
+	}
+
+	pos := 0
+	group := func(digits int) uint64 {
+		n := dig2bytes[digits]
+		val, _ := readUintBE(bin[pos:], n)
+		pos += n
+		return val
+	}
+
+	intg, frac := precision-scale, scale
+	buf := bytes.Buffer{}
+	if negative {
+		buf.WriteByte('-')
+	}
+	digits := ""
+	if lead := intg % digitsPerInt; lead > 0 {
+		digits = fmt.Sprintf("%d", group(lead))
+	}
+	for i := 0; i < intg/digitsPerInt; i++ {
+		digits += fmt.Sprintf("%09d", group(digitsPerInt))
+	}
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		digits = "0"
+	}
+	buf.WriteString(digits)
+
+	if frac > 0 {
+		buf.WriteByte('.')
+		for i := 0; i < frac/digitsPerInt; i++ {
+			fmt.Fprintf(&buf, "%09d", group(digitsPerInt))
+		}
+		if tail := frac % digitsPerInt; tail > 0 {
+			fmt.Fprintf(&buf, "%0*d", tail, group(tail))
+		}
+	}
+	return buf.String(), size, nil
+}
+
+// readFrac the fractional seconds of fsp digits, in (fsp+1)/2 bytes big endian, as microseconds
+func readFrac(data []byte, fsp int) (int64, int, error) {
+	if fsp < 0 || fsp > 6 {
+		return 0, 0, errors.Errorf("fractional seconds precision %d", fsp)
+	}
+	size := (fsp + 1) / 2
+	val, err := readUintBE(data, size)
+	switch size {
+	case 1:
+		val *= 10000
+	case 2:
+		val *= 100
+	}
+	return int64(val), size, err
+}
+
+// formatFrac the microseconds in fsp digits, empty if fsp is 0
+func formatFrac(usec int64, fsp int) string {
+	if fsp == 0 {
+		return ""
+	}
+	return "." + fmt.Sprintf("%06d", usec)[:fsp]
+}
+
+// readDatetime2 of 5 bytes big endian then the fractional seconds:
+// sign 1 bit, year*13+month 17 bits, day 5 bits, hour 5 bits, minute 6 bits, second 6 bits
+func readDatetime2(data []byte, fsp int) (interface{}, int, error) {
+	val, err := readUintBE(data, 5)
+	if err != nil {
+		return nil, 0, err
+	}
+	usec, size, err := readFrac(data[5:], fsp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	packed := int64(val) - 0x8000000000
+	ymd, hms := packed>>17, packed&(1<<17-1)
+	ym := ymd >> 5
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d%s", ym/13, ym%13, ymd&31,
+		hms>>12, hms>>6&63, hms&63, formatFrac(usec, fsp)), 5 + size, nil
+}
+
+// readTimestamp2 of the seconds in 4 bytes big endian then the fractional seconds
+func readTimestamp2(data []byte, fsp int) (interface{}, int, error) {
+	sec, err := readUintBE(data, 4)
+	if err != nil {
+		return nil, 0, err
+	}
+	usec, size, err := readFrac(data[4:], fsp)
+	if err != nil {
+		return nil, 0, err
+	}
+	return formatTimestamp(int64(sec), formatFrac(usec, fsp), fsp), 4 + size, nil
+}
+
+// formatTimestamp of the seconds since epoch in local time, all zero for 0
+func formatTimestamp(sec int64, frac string, fsp int) string {
+	if sec == 0 {
+		return "0000-00-00 00:00:00" + formatFrac(0, fsp)
+	}
+	return time.Unix(sec, 0).Format("2006-01-02 15:04:05") + frac
+}
+
+// readTime2 of 3 bytes big endian then the fractional seconds:
+// sign 1 bit, hour 10 bits, minute 6 bits, second 6 bits, negative stored as its complement
+func readTime2(data []byte, fsp int) (interface{}, int, error) {
+	if fsp < 0 || fsp > 6 {
+		return nil, 0, errors.Errorf("fractional seconds precision %d", fsp)
+	}
+	size := 3 + (fsp+1)/2
+	val, err := readUintBE(data, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the packed value: hms << 24 | microseconds
+	var packed int64
+	switch size - 3 {
+	case 0:
+		packed = (int64(val) - 0x800000) << 24
+	case 1:
+		intg, frac := int64(val>>8)-0x800000, int64(int8(val))
+		if intg < 0 && frac != 0 {
+			intg, frac = intg+1, frac-0x100
+		}
+		packed = intg<<24 + frac*10000
+	case 2:
+		intg, frac := int64(val>>16)-0x800000, int64(int16(val))
+		if intg < 0 && frac != 0 {
+			intg, frac = intg+1, frac-0x10000
+		}
+		packed = intg<<24 + frac*100
+	case 3:
+		packed = int64(val) - 0x800000000000
+	}
+
+	sign := ""
+	if packed < 0 {
+		sign, packed = "-", -packed
+	}
+	hms, usec := packed>>24, packed&(1<<24-1)
+	return fmt.Sprintf("%s%02d:%02d:%02d%s", sign, hms>>12&(1<<10-1), hms>>6&63, hms&63,
+		formatFrac(usec, fsp)), size, nil
+}
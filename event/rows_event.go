@@ -6,14 +6,13 @@
 package event
 
 import (
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"strings"
-	"time"
 
 	"bytes"
 	"github.com/juju/errors"
-	"github.com/lemonwx/log"
 	"github.com/lemonwx/xsql/mysql"
 )
 
@@ -25,24 +24,29 @@ type RowsEvent struct {
 	extraData    []byte
 	fieldSize    uint64
 	bitmap       []byte
+	bitmapAfter  []byte // columns of the after images, for update events only
 	encode       []byte
-	Rows         []map[int]interface{}
+	Rows         []map[int]interface{} // pairs of the before and after images for update events
 	Table        *TableMapEvent
 }
 
 func (re *RowsEvent) Decode(data []byte) error {
 	re.encode = data
 
-	re.TblId = readTblId(data)
+	re.TblId = ReadTblId(data)
 	pos := 6
 
 	re.flags = binary.LittleEndian.Uint16(data[pos : pos+2])
 	pos += 2
-	re.extraDataLen = binary.LittleEndian.Uint16(data[pos : pos+2])
-	pos += 2
 
-	re.extraData = data[pos : pos+int(re.extraDataLen/8)]
-	pos += int(re.extraDataLen / 8)
+	// v1 rows event (mariadb default) has no extra data
+	if re.Header.EveType >= WRITE_ROWS_EVENT_V2 {
+		re.extraDataLen = binary.LittleEndian.Uint16(data[pos : pos+2])
+		pos += 2
+
+		re.extraData = data[pos : pos+int(re.extraDataLen/8)]
+		pos += int(re.extraDataLen / 8)
+	}
 
 	var size int
 	re.fieldSize, _, size = mysql.LengthEncodedInt(data[pos:])
@@ -51,19 +55,23 @@ func (re *RowsEvent) Decode(data []byte) error {
 	size = int((re.fieldSize + 7) / 8)
 	re.bitmap = data[pos : pos+size]
 	pos += size
+	if re.IsUpdate() {
+		re.bitmapAfter = data[pos : pos+size]
+		pos += size
+	}
 
-	re.ReadRows(data[pos:])
-
-	return nil
+	return errors.Trace(re.ReadRows(data[pos:]))
 }
 
 func (re *RowsEvent) Dump() string {
 	eveType := ""
 	switch re.Header.EveType {
-	case WRITE_ROWS_EVENT_V2:
+	case WRITE_ROWS_EVENT_V1, WRITE_ROWS_EVENT_V2:
 		eveType = "WriteRowsEvent"
-	case DELETE_ROWS_EVENT_V2:
+	case DELETE_ROWS_EVENT_V1, DELETE_ROWS_EVENT_V2:
 		eveType = "DeleteRowsEvent"
+	case UPDATE_ROWS_EVENT_V1, UPDATE_ROWS_EVENT_V2:
+		eveType = "UpdateRowsEvent"
 	}
 
 	return fmt.Sprintf("%s Table: %d, field_size: %d, rows: %v",
@@ -74,103 +82,211 @@ func (re *RowsEvent) Dump() string {
 
 func (re *RowsEvent) DumpRows() string {
 	buf := bytes.NewBuffer(make([]byte, 0, 128))
-	switch re.Header.EveType {
-	case WRITE_ROWS_EVENT_V2, DELETE_ROWS_EVENT_V2:
-		for _, row := range re.Rows {
-			fmt.Fprintf(buf, "[ ")
-			for i := 0; i < len(row); i += 1 {
-				if i == len(row)-1 {
-					fmt.Fprintf(buf, "@%d=%v", i, row[i])
-				} else {
-					fmt.Fprintf(buf, "@%d=%v, ", i, row[i])
-				}
+	for n, row := range re.Rows {
+		if re.IsUpdate() && n%2 == 1 {
+			fmt.Fprintf(buf, " =>")
+		}
+		fmt.Fprintf(buf, "[ ")
+		for i := 0; i < len(row); i += 1 {
+			if i == len(row)-1 {
+				fmt.Fprintf(buf, "@%d=%v", i, row[i])
+			} else {
+				fmt.Fprintf(buf, "@%d=%v, ", i, row[i])
 			}
-			fmt.Fprintf(buf, " ]")
 		}
-	case UPDATE_ROWS_EVENT_V2:
-	default:
-
+		fmt.Fprintf(buf, " ]")
 	}
 
 	return buf.String()
 }
 
-func readTblId(data []byte) uint64 {
+// IsUpdate report whether its rows are pairs of the before and after images
+func (re *RowsEvent) IsUpdate() bool {
+	switch re.Header.EveType {
+	case UPDATE_ROWS_EVENT_V1, UPDATE_ROWS_EVENT_V2:
+		return true
+	}
+	return false
+}
+
+func ReadTblId(data []byte) uint64 {
 	tblEncode := make([]byte, 8)
 	copy(tblEncode, data[:6])
 	tblId := binary.LittleEndian.Uint64(tblEncode)
 	return tblId
 }
 
-func (re *RowsEvent) ReadRows(data []byte) {
-	fieldTypes := re.Table.ColTypes
+// ReadRows decode the images of the rows, failed on the column type not supported
+func (re *RowsEvent) ReadRows(data []byte) error {
 	re.Rows = make([]map[int]interface{}, 0)
 	pos := 0
 
 	for pos < len(data) {
-		row := make(map[int]interface{})
-		nullMaskSize := int((BitCount(re.bitmap) + 7) >> 3)
-		nullMask := data[pos : pos+nullMaskSize]
-		pos += nullMaskSize
-
-		nullbitIndex := 0
-		for idx := 0; idx < int(re.fieldSize); idx += 1 {
-			if BitGet(re.bitmap, uint8(idx)) {
-				row[int(idx)] = nil
+		bitmap := re.bitmap
+		if re.IsUpdate() && len(re.Rows)%2 == 1 {
+			bitmap = re.bitmapAfter
+		}
+		row, size, err := re.readRow(bitmap, data[pos:])
+		if err != nil {
+			return errors.Annotatef(err, "row %d", len(re.Rows))
+		}
+		pos += size
+		re.Rows = append(re.Rows, row)
+	}
+	return nil
+}
+
+// readRow the image of the columns in bitmap, the columns not in it are left out
+func (re *RowsEvent) readRow(bitmap []byte, data []byte) (map[int]interface{}, int, error) {
+	if re.Table == nil {
+		return nil, 0, errors.Errorf("rows of table %d without table map event", re.TblId)
+	}
+	if uint64(len(re.Table.ColTypes)) < re.fieldSize {
+		return nil, 0, errors.Errorf("%d columns in table map event, but %d in rows event", len(re.Table.ColTypes), re.fieldSize)
+	}
+	row := make(map[int]interface{})
+	nullMaskSize := (BitCount(bitmap) + 7) >> 3
+	if nullMaskSize > len(data) {
+		return nil, 0, errors.New("null bitmap out of range")
+	}
+	nullMask := data[:nullMaskSize]
+	pos := nullMaskSize
+
+	nullbitIndex := 0
+	for idx := 0; idx < int(re.fieldSize); idx += 1 {
+		if !BitGet(bitmap, idx) {
+			continue
+		}
+
+		if (uint32(nullMask[nullbitIndex/8])>>uint32(nullbitIndex%8))&0x01 > 0 {
+			row[int(idx)] = nil
+		} else {
+			val, size, err := re.Table.readValue(idx, data[pos:])
+			if err != nil {
+				return nil, 0, errors.Annotatef(err, "column %d of %s", idx, re.Table.FullName)
 			}
+			row[idx] = val
+			pos += size
+		}
+		nullbitIndex += 1
+	}
+	return row, pos, nil
+}
 
-			if (uint32(nullMask[nullbitIndex/8])>>uint32(nullbitIndex%8))&0x01 > 0 {
-				row[int(idx)] = nil
-			} else {
-				fieldType := fieldTypes[idx]
-				//log.Debug(fieldType)
-				switch fieldType {
-				case mysql.MYSQL_TYPE_LONGLONG:
-					row[idx] = binary.LittleEndian.Uint64(data[pos : pos+8])
-					pos += 8
-				case mysql.MYSQL_TYPE_LONG:
-					row[idx] = binary.LittleEndian.Uint32(data[pos : pos+4])
-					pos += 4
-				case mysql.MYSQL_TYPE_STRING:
-					bin, _, size, _ := mysql.LengthEnodedString(data[pos:])
-					row[idx] = string(bin)
-					pos += size
-				case mysql.MYSQL_TYPE_TIMESTAMP2:
-					dateBinary := binary.BigEndian.Uint32(data[pos : pos+4])
-					date := time.Unix(int64(dateBinary), 0).Format("2006-01-02 15:04:05")
-					pos = pos + 4
-					misSec := BigEndianUint24(data[pos : pos+3])
-					pos += 3
-					row[idx] = fmt.Sprintf("%s.%d", date, misSec)
-				case mysql.MYSQL_TYPE_DATE:
-					dateBin := LittleEndianUint24(data[pos : pos+3])
-					if dateBin == 0 {
-						row[idx] = nil
-					} else {
-						row[idx] = fmt.Sprintf("%04d-%02d-%02d", dateBin/(16*32), dateBin/32%16, dateBin%32)
-					}
-					pos += 3
-				default:
-					log.Debug(fieldType)
-				}
+// keyIdxs the indexes of the key columns in fields, all of fields if no key or any column of it missing
+func keyIdxs(fields, key []string) []int {
+	idxs := make([]int, 0, len(fields))
+	for _, col := range key {
+		found := false
+		for idx, fieldName := range fields {
+			if strings.EqualFold(fieldName, col) {
+				idxs = append(idxs, idx)
+				found = true
+				break
 			}
-			nullbitIndex += 1
 		}
-		re.Rows = append(re.Rows, row)
+		if !found {
+			idxs = idxs[:0]
+			break
+		}
+	}
+
+	if len(idxs) == 0 {
+		for idx := range fields {
+			idxs = append(idxs, idx)
+		}
+	}
+	return idxs
+}
+
+// columnNames the names of cols in order
+func columnNames(cols []ColumnDef) []string {
+	names := make([]string, 0, len(cols))
+	for _, col := range cols {
+		names = append(names, col.Name)
+	}
+	return names
+}
+
+// readString read the value of string column idx, text is decoded by its charset as utf8, binary is kept as []byte
+func (tbl *TableMapEvent) readString(idx int, data []byte) (interface{}, int, error) {
+	if len(tbl.ColMeta) == 0 {
+		// no metadata decoded, take it as a length encoded string
+		bin, _, size, err := mysql.LengthEnodedString(data)
+		if err != nil {
+			return nil, 0, errOutOfRange
+		}
+		return DecodeText(bin, tbl.charset(idx)), size, nil
+	}
+
+	meta := int(tbl.ColMeta[idx])
+	size := 0
+	switch tbl.ColTypes[idx] {
+	case mysql.MYSQL_TYPE_STRING:
+		realType, maxLen := tbl.stringMeta(idx)
+		switch realType {
+		case mysql.MYSQL_TYPE_ENUM:
+			// index of the value, 1 or 2 bytes
+			val, err := readUint(data, maxLen)
+			return uint16(val), maxLen, err
+		case mysql.MYSQL_TYPE_SET:
+			// bitmap of the values
+			val, err := readUint(data, maxLen)
+			return val, maxLen, err
+		}
+		size = 1
+		if maxLen > 255 {
+			size = 2
+		}
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING:
+		size = 1
+		if meta > 255 {
+			size = 2
+		}
+	case mysql.MYSQL_TYPE_BLOB:
+		// meta is the bytes of length
+		size = meta
 	}
+	bin, size, err := readBytes(data, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return DecodeText(bin, tbl.charset(idx)), size, nil
+}
+
+// RestoreBinary turn the binary values loaded from json back to []byte, they are base64 encoded by json
+func (re *RowsEvent) RestoreBinary() error {
+	if re.Table == nil {
+		return nil
+	}
+	for _, row := range re.Rows {
+		for idx, val := range row {
+			str, ok := val.(string)
+			if !ok || re.Table.charset(idx) != BINARY_CHARSET {
+				continue
+			}
+			bin, err := base64.StdEncoding.DecodeString(str)
+			if err != nil {
+				return errors.Annotatef(err, "column %d of %s", idx, re.Table.FullName)
+			}
+			row[idx] = bin
+		}
+	}
+	return nil
 }
 
-func (re *RowsEvent) rollbackForIst(fields []string) (string, [][]interface{}, error) {
+func (re *RowsEvent) rollbackForIst(cols []ColumnDef, key []string) (string, [][]interface{}, error) {
 	vals := [][]interface{}{}
 	rbSql := ""
+	idxs := keyIdxs(columnNames(cols), key)
 
 	for _, row := range re.Rows {
 		wheres := []string{}
 
 		fieldVals := []interface{}{}
-		for idx, fieldName := range fields {
-			fieldVals = append(fieldVals, row[idx])
-			wheres = append(wheres, fmt.Sprintf("%s=?", fieldName))
+		for _, idx := range idxs {
+			fieldVals = append(fieldVals, typedValue(cols[idx], row[idx]))
+			wheres = append(wheres, fmt.Sprintf("%s=?", cols[idx].Name))
 		}
 		if rbSql == "" {
 			rbSql = fmt.Sprintf("delete from %s where %s", re.Table.FullName, strings.Join(wheres, " and "))
@@ -181,7 +297,7 @@ func (re *RowsEvent) rollbackForIst(fields []string) (string, [][]interface{}, e
 	return rbSql, vals, nil
 }
 
-func (re *RowsEvent) rollbackForDel(fields []string) (string, [][]interface{}, error) {
+func (re *RowsEvent) rollbackForDel(cols []ColumnDef) (string, [][]interface{}, error) {
 	rbSql := ""
 	vals := [][]interface{}{}
 	for _, row := range re.Rows {
@@ -189,9 +305,9 @@ func (re *RowsEvent) rollbackForDel(fields []string) (string, [][]interface{}, e
 		fieldNames := []string{}
 		valspace := []string{}
 
-		for idx, fieldName := range fields {
-			values = append(values, row[idx])
-			fieldNames = append(fieldNames, fieldName)
+		for idx, col := range cols {
+			values = append(values, typedValue(col, row[idx]))
+			fieldNames = append(fieldNames, col.Name)
 			valspace = append(valspace, "?")
 		}
 		vals = append(vals, values)
@@ -206,19 +322,64 @@ func (re *RowsEvent) rollbackForDel(fields []string) (string, [][]interface{}, e
 	return rbSql, vals, nil
 }
 
-func (re *RowsEvent) rollbackForUpdate() (string, [][]interface{}, error) {
-	return "", nil, nil
+// rollbackForUpdate set the columns of the before images back, the images may be minimal,
+// the rows are located by the key in the after images, or in the before images if not there
+func (re *RowsEvent) rollbackForUpdate(cols []ColumnDef, key []string) (string, [][]interface{}, error) {
+	rbSql := ""
+	vals := [][]interface{}{}
+	idxs := keyIdxs(columnNames(cols), key)
+	for n := 0; n+1 < len(re.Rows); n += 2 {
+		before, after := re.Rows[n], re.Rows[n+1]
+		values := []interface{}{}
+		sets := []string{}
+		for idx, col := range cols {
+			if val, ok := before[idx]; ok {
+				values = append(values, typedValue(col, val))
+				sets = append(sets, fmt.Sprintf("%s=?", col.Name))
+			}
+		}
+		if len(sets) == 0 {
+			return "", nil, errors.Errorf("no column of %s in the before image", re.Table.FullName)
+		}
+
+		wheres := []string{}
+		for _, idx := range idxs {
+			val, ok := after[idx]
+			if !ok {
+				val, ok = before[idx]
+			}
+			if ok {
+				values = append(values, typedValue(cols[idx], val))
+				wheres = append(wheres, fmt.Sprintf("%s=?", cols[idx].Name))
+			}
+		}
+		if len(wheres) == 0 {
+			return "", nil, errors.Errorf("no key column of %s in the images", re.Table.FullName)
+		}
+		vals = append(vals, values)
+
+		// the images of an event are of the same columns
+		if rbSql == "" {
+			rbSql = fmt.Sprintf("update %s set %s where %s", re.Table.FullName,
+				strings.Join(sets, ", "), strings.Join(wheres, " and "))
+		}
+	}
+	return rbSql, vals, nil
 }
 
-func (re *RowsEvent) RollBack(fields []string) (string, [][]interface{}, error) {
-	if uint64(len(fields)) > re.fieldSize {
-		return "", nil, errors.New("params fields size must <= event.FieldSize")
+// RollBack generate the sql to undo the rows changed, cols are the columns of the table, the integers
+// signed by their types, key is the primary or unique key to locate the rows inserted, all cols used if nil
+func (re *RowsEvent) RollBack(cols []ColumnDef, key []string) (string, [][]interface{}, error) {
+	if uint64(len(cols)) > re.fieldSize {
+		return "", nil, errors.New("params cols size must <= event.FieldSize")
 	}
 	switch re.Header.EveType {
-	case WRITE_ROWS_EVENT_V2:
-		return re.rollbackForIst(fields)
-	case DELETE_ROWS_EVENT_V2:
-		return re.rollbackForDel(fields)
+	case WRITE_ROWS_EVENT_V1, WRITE_ROWS_EVENT_V2:
+		return re.rollbackForIst(cols, key)
+	case DELETE_ROWS_EVENT_V1, DELETE_ROWS_EVENT_V2:
+		return re.rollbackForDel(cols)
+	case UPDATE_ROWS_EVENT_V1, UPDATE_ROWS_EVENT_V2:
+		return re.rollbackForUpdate(cols, key)
 	default:
 		return "", nil, errors.New("UNSUPPORTED ROLLBACK BINLOG EVENT")
 	}
@@ -0,0 +1,290 @@
+/**
+ *  author: lim
+ *  data  : 18-8-15 下午9:30
+ */
+
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/lemonwx/xsql/mysql"
+)
+
+func TestRollBackInsertByKey(t *testing.T) {
+	re := &RowsEvent{
+		Header:    &EveHeader{EveType: WRITE_ROWS_EVENT_V2},
+		fieldSize: 3,
+		Rows:      []map[int]interface{}{{0: 1, 1: "a", 2: 10}, {0: 2, 1: "b", 2: 20}},
+		Table:     &TableMapEvent{FullName: "test.t"},
+	}
+
+	for _, c := range []struct {
+		key   []string
+		sql   string
+		first []interface{}
+	}{
+		{[]string{"ID"}, "delete from test.t where id=?", []interface{}{1}},
+		{[]string{"c", "name"}, "delete from test.t where c=? and name=?", []interface{}{10, "a"}},
+		{nil, "delete from test.t where id=? and name=? and c=?", []interface{}{1, "a", 10}},
+		// key not in the columns known, use all of them
+		{[]string{"gone"}, "delete from test.t where id=? and name=? and c=?", []interface{}{1, "a", 10}},
+	} {
+		sql, vals, err := re.RollBack([]ColumnDef{{Name: "id"}, {Name: "name"}, {Name: "c"}}, c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sql != c.sql || len(vals) != 2 || len(vals[0]) != len(c.first) {
+			t.Fatalf("key %v: unexpect rollback %s %v", c.key, sql, vals)
+		}
+		for idx, val := range c.first {
+			if vals[0][idx] != val {
+				t.Errorf("key %v: unexpect value %v at %d, expect %v", c.key, vals[0][idx], idx, val)
+			}
+		}
+	}
+}
+
+func TestReadRowsCharset(t *testing.T) {
+	tblData := []byte{1, 0, 0, 0, 0, 0, 0, 0, 4, 't', 'e', 's', 't', 0, 1, 't', 0, 4,
+		mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_STRING,
+		// metadata: varchar(40), char(10), blob, enum
+		7, 40, 0, mysql.MYSQL_TYPE_STRING, 10, 2, mysql.MYSQL_TYPE_ENUM, 1,
+		// null bitmap
+		0,
+		// column charset: latin1_swedish_ci, gbk_chinese_ci, binary
+		TABLE_MAP_COLUMN_CHARSET, 3, 8, 28, 63,
+	}
+	tbl := &TableMapEvent{}
+	if err := tbl.Decode(tblData); err != nil {
+		t.Fatal(err)
+	}
+	if len(tbl.Charsets) != 4 || tbl.Charsets[0] != "latin1" || tbl.Charsets[1] != "gbk" ||
+		tbl.Charsets[2] != BINARY_CHARSET || tbl.Charsets[3] != "" {
+		t.Fatalf("unexpect charsets: %v", tbl.Charsets)
+	}
+
+	re := &RowsEvent{Header: &EveHeader{EveType: WRITE_ROWS_EVENT_V2}, fieldSize: 4, bitmap: []byte{0x0f}, Table: tbl}
+	err := re.ReadRows([]byte{0,
+		4, 'c', 'a', 'f', 0xe9,
+		4, 0xc4, 0xe3, 0xba, 0xc3,
+		4, 0, 0, 1, 2, 0xff,
+		2,
+	})
+	if err != nil || len(re.Rows) != 1 {
+		t.Fatalf("expect 1 row, got %d: %v", len(re.Rows), err)
+	}
+	row := re.Rows[0]
+	if row[0] != "café" || row[1] != "你好" || row[3] != uint16(2) {
+		t.Errorf("unexpect row: %v", row)
+	}
+	if bin, ok := row[2].([]byte); !ok || !bytes.Equal(bin, []byte{0, 1, 2, 0xff}) {
+		t.Errorf("binary should be kept as []byte: %#v", row[2])
+	}
+
+	// binary is base64 encoded by json
+	data, err := json.Marshal(re)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &RowsEvent{}
+	if err = json.Unmarshal(data, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err = loaded.RestoreBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if bin, ok := loaded.Rows[0][2].([]byte); !ok || !bytes.Equal(bin, []byte{0, 1, 2, 0xff}) || loaded.Rows[0][1] != "你好" {
+		t.Errorf("unexpect row loaded: %#v", loaded.Rows[0])
+	}
+}
+
+func TestReadUpdateRows(t *testing.T) {
+	tbl := &TableMapEvent{}
+	err := tbl.Decode([]byte{1, 0, 0, 0, 0, 0, 0, 0, 4, 't', 'e', 's', 't', 0, 1, 't', 0, 2,
+		mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_VARCHAR,
+		// metadata: varchar(40), then the null bitmap
+		2, 40, 0, 0x02,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the after image of the name only
+	re := &RowsEvent{Header: &EveHeader{EveType: UPDATE_ROWS_EVENT_V2}, Table: tbl}
+	if err = re.Decode([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0x03, 0x02,
+		0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 'a',
+		0, 1, 'b',
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(re.Rows) != 2 || re.Rows[0][0] != uint64(1) || re.Rows[0][1] != "a" || len(re.Rows[1]) != 1 || re.Rows[1][1] != "b" {
+		t.Fatalf("unexpect images: %v", re.Rows)
+	}
+
+	re = &RowsEvent{Header: &EveHeader{EveType: UPDATE_ROWS_EVENT_V2}, Table: tbl}
+	if err = re.Decode([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0x03, 0x03,
+		0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 'a',
+		0x02, 2, 0, 0, 0, 0, 0, 0, 0,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(re.Rows) != 2 || re.Rows[1][0] != uint64(2) || re.Rows[1][1] != nil {
+		t.Fatalf("unexpect images: %v", re.Rows)
+	}
+	sql, vals, err := re.RollBack([]ColumnDef{{Name: "id", Type: "bigint(20) unsigned"}, {Name: "name", Type: "varchar(40)"}}, []string{"id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql != "update test.t set id=?, name=? where id=?" || len(vals) != 1 ||
+		vals[0][0] != uint64(1) || vals[0][1] != "a" || vals[0][2] != uint64(2) {
+		t.Errorf("unexpect rollback %s %v", sql, vals)
+	}
+}
+
+func TestRollBackMinimalUpdate(t *testing.T) {
+	cols := []ColumnDef{{Name: "id"}, {Name: "name"}, {Name: "c"}}
+	for _, c := range []struct {
+		rows []map[int]interface{}
+		sql  string
+		vals []interface{}
+	}{
+		// the before image of the key and the column changed, the after image of the column changed
+		{[]map[int]interface{}{{0: 1, 1: "a"}, {1: "b"}}, "update test.t set id=?, name=? where id=?", []interface{}{1, "a", 1}},
+		// the key changed, located by the key in the after image
+		{[]map[int]interface{}{{0: 1}, {0: 2}}, "update test.t set id=? where id=?", []interface{}{1, 2}},
+		{[]map[int]interface{}{{0: 1, 1: nil, 2: 10}, {0: 1, 1: "b", 2: 10}}, "update test.t set id=?, name=?, c=? where id=?", []interface{}{1, nil, 10, 1}},
+	} {
+		re := &RowsEvent{Header: &EveHeader{EveType: UPDATE_ROWS_EVENT_V2}, fieldSize: 3, Rows: c.rows, Table: &TableMapEvent{FullName: "test.t"}}
+		sql, vals, err := re.RollBack(cols, []string{"id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sql != c.sql || len(vals) != 1 || len(vals[0]) != len(c.vals) {
+			t.Fatalf("unexpect rollback %s %v", sql, vals)
+		}
+		for idx, val := range c.vals {
+			if vals[0][idx] != val {
+				t.Errorf("%s: unexpect value %v at %d, expect %v", sql, vals[0][idx], idx, val)
+			}
+		}
+	}
+
+	// no key column in either image
+	re := &RowsEvent{Header: &EveHeader{EveType: UPDATE_ROWS_EVENT_V2}, fieldSize: 3,
+		Rows: []map[int]interface{}{{1: "a"}, {1: "b"}}, Table: &TableMapEvent{FullName: "test.t"}}
+	if _, _, err := re.RollBack(cols, []string{"id"}); err == nil {
+		t.Error("expect the row without key column rejected")
+	}
+}
+
+func TestReadRowsTypes(t *testing.T) {
+	tbl := &TableMapEvent{FullName: "test.t",
+		ColTypes: []byte{mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_DOUBLE,
+			mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_DATETIME2,
+			mysql.MYSQL_TYPE_DATETIME2, mysql.MYSQL_TYPE_TIME2, mysql.MYSQL_TYPE_YEAR, mysql.MYSQL_TYPE_BIT,
+			mysql.MYSQL_TYPE_TIMESTAMP2, mysql.MYSQL_TYPE_JSON, mysql.MYSQL_TYPE_DATETIME},
+		// decimal(10, 2), datetime(3), bit(10), json of 4 bytes length
+		ColMeta: []uint16{0, 0, 0, 8, 4, 10 | 2<<8, 10 | 2<<8, 0, 3, 0, 0, 2 | 1<<8, 0, 4, 0},
+	}
+	data := []byte{0, 0,
+		0xff,
+		0x34, 0x12,
+		0xff, 0xff, 0xff,
+		0, 0, 0, 0, 0, 0, 0xf8, 0x3f,
+		0, 0, 0, 0x3f,
+		0x80, 0, 0x04, 0xd2, 0x38,
+		0x7f, 0xff, 0xfb, 0x2d, 0xc7,
+		0x99, 0xa0, 0xbd, 0x52, 0x85,
+		0x99, 0xa0, 0xbd, 0x52, 0x85, 0x04, 0xce,
+		0x7f, 0xef, 0x7d,
+		118,
+		0x03, 0xff,
+		0, 0, 0, 0,
+		// {"a": [1, true, "x"]}
+		28, 0, 0, 0, JSONB_SMALL_OBJECT, 1, 0, 27, 0, 11, 0, 1, 0, JSONB_SMALL_ARRAY, 12, 0, 'a',
+		3, 0, 15, 0, JSONB_INT16, 1, 0, JSONB_LITERAL, JSONB_TRUE, 0, JSONB_STRING, 13, 0, 1, 'x',
+		0xbd, 0x4b, 0x37, 0xb7, 0x5a, 0x12, 0, 0,
+	}
+	re := &RowsEvent{Header: &EveHeader{EveType: WRITE_ROWS_EVENT_V2}, fieldSize: 15, bitmap: []byte{0xff, 0x7f}, Table: tbl}
+	if err := re.ReadRows(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(re.Rows) != 1 {
+		t.Fatalf("expect 1 row, got %d", len(re.Rows))
+	}
+	for idx, expect := range []interface{}{uint8(0xff), uint16(0x1234), uint32(0xffffff), 1.5, 0.5, "1234.56", "-1234.56",
+		"2018-08-30 21:10:05", "2018-08-30 21:10:05.123", "-01:02:03", uint16(2018), uint64(1023),
+		"0000-00-00 00:00:00", `{"a": [1, true, "x"]}`, "2018-08-30 21:10:05"} {
+		if val := re.Rows[0][idx]; val != expect {
+			t.Errorf("column %d: expect %#v, got %#v", idx, expect, val)
+		}
+	}
+
+	// truncated, or of the type not supported
+	if err := re.ReadRows(data[:len(data)-1]); err == nil {
+		t.Error("expect the row truncated rejected")
+	}
+	tbl.ColTypes[0] = mysql.MYSQL_TYPE_DECIMAL
+	if err := re.ReadRows(data); err == nil {
+		t.Error("expect the old decimal rejected")
+	}
+}
+
+func TestReadRowsWideTable(t *testing.T) {
+	const cols = 300
+	tbl := &TableMapEvent{FullName: "test.t", ColTypes: bytes.Repeat([]byte{mysql.MYSQL_TYPE_TINY}, cols)}
+	bitmap := bytes.Repeat([]byte{0xff}, (cols+7)/8)
+	bitmap[len(bitmap)-1] = 0x0f
+	if n := BitCount(bitmap); n != cols {
+		t.Fatalf("expect %d bits, got %d", cols, n)
+	}
+
+	// the last column null
+	data := make([]byte, (cols+7)/8, (cols+7)/8+cols)
+	data[len(data)-1] = 0x08
+	for idx := 0; idx < cols-1; idx++ {
+		data = append(data, byte(idx))
+	}
+	re := &RowsEvent{Header: &EveHeader{EveType: WRITE_ROWS_EVENT_V2}, fieldSize: cols, bitmap: bitmap, Table: tbl}
+	if err := re.ReadRows(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(re.Rows) != 1 || len(re.Rows[0]) != cols {
+		t.Fatalf("expect 1 row of %d columns, got %v", cols, re.Rows)
+	}
+	for _, idx := range []int{0, 255, 256, 298} {
+		if val := re.Rows[0][idx]; val != uint8(idx) {
+			t.Errorf("column %d: expect %d, got %#v", idx, uint8(idx), val)
+		}
+	}
+	if val, ok := re.Rows[0][cols-1]; !ok || val != nil {
+		t.Errorf("expect the last column null, got %#v", val)
+	}
+}
+
+func TestRollBackSigned(t *testing.T) {
+	cols := []ColumnDef{{Name: "id", Type: "int(11)"}, {Name: "n", Type: "int(10) unsigned"}, {Name: "m", Type: "mediumint(9)"}}
+	rows := []map[int]interface{}{{0: uint32(0xffffffff), 1: uint32(0xffffffff), 2: uint32(0xfffffe)}, {0: uint32(1), 1: uint32(1), 2: uint32(1)}}
+	for eveType, expect := range map[uint8][]interface{}{
+		WRITE_ROWS_EVENT_V2:  {int32(-1)},
+		DELETE_ROWS_EVENT_V2: {int32(-1), uint32(0xffffffff), int32(-2)},
+		UPDATE_ROWS_EVENT_V2: {int32(-1), uint32(0xffffffff), int32(-2), int32(1)},
+	} {
+		re := &RowsEvent{Header: &EveHeader{EveType: eveType}, fieldSize: 3, Rows: rows, Table: &TableMapEvent{FullName: "test.t"}}
+		sql, vals, err := re.RollBack(cols, []string{"id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vals) == 0 || len(vals[0]) != len(expect) {
+			t.Fatalf("unexpect rollback %s %v", sql, vals)
+		}
+		for idx, val := range expect {
+			if vals[0][idx] != val {
+				t.Errorf("%s: expect %#v at %d, got %#v", sql, val, idx, vals[0][idx])
+			}
+		}
+	}
+}
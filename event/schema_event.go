@@ -0,0 +1,122 @@
+/**
+ *  author: lim
+ *  data  : 18-8-13 下午8:05
+ */
+
+package event
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ColumnDef struct {
+	Name    string
+	Type    string
+	Charset string `json:",omitempty"`
+}
+
+const PRIMARY_KEY = "PRIMARY"
+
+// KeyDef is a primary or unique key
+type KeyDef struct {
+	Name    string
+	Columns []string
+}
+
+func (key KeyDef) same(other KeyDef) bool {
+	if key.Name != other.Name || len(key.Columns) != len(other.Columns) {
+		return false
+	}
+	for idx, col := range key.Columns {
+		if col != other.Columns[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// RowKey the columns identify a row: primary key, or the first unique key, nil if none
+func RowKey(keys []KeyDef) []string {
+	for _, key := range keys {
+		if key.Name == PRIMARY_KEY {
+			return key.Columns
+		}
+	}
+	if len(keys) != 0 {
+		return keys[0].Columns
+	}
+	return nil
+}
+
+// SchemaEvent is the table definition in effect from its position,
+// the binlog events after it should be decoded with these columns
+type SchemaEvent struct {
+	Header *EveHeader
+
+	FileName string
+	Gtid     string // gtid of the ddl if any
+
+	Schema  string
+	Table   string
+	Columns []ColumnDef
+	Keys    []KeyDef
+	Dropped bool
+}
+
+// NewSchemaEvent take effect at the position of the event cause it, a ddl or the first table map event
+func NewSchemaEvent(cause *EveHeader, fileName, gtid, schema, table string, columns []ColumnDef, keys []KeyDef) *SchemaEvent {
+	return &SchemaEvent{
+		Header: &EveHeader{
+			Ts:      cause.Ts,
+			EveType: SCHEMA_EVENT,
+			SvrId:   cause.SvrId,
+			LogPos:  cause.LogPos,
+			Source:  cause.Source,
+		},
+		FileName: fileName,
+		Gtid:     gtid,
+		Schema:   schema,
+		Table:    table,
+		Columns:  columns,
+		Keys:     keys,
+		Dropped:  columns == nil,
+	}
+}
+
+func (schemaEve *SchemaEvent) Decode(data []byte) error {
+	return nil
+}
+
+func (schemaEve *SchemaEvent) ColumnNames() []string {
+	return columnNames(schemaEve.Columns)
+}
+
+// Same report whether other defines the same table
+func (schemaEve *SchemaEvent) Same(other *SchemaEvent) bool {
+	if schemaEve.Schema != other.Schema || schemaEve.Table != other.Table ||
+		schemaEve.Dropped != other.Dropped || len(schemaEve.Columns) != len(other.Columns) ||
+		len(schemaEve.Keys) != len(other.Keys) {
+		return false
+	}
+	for idx, col := range schemaEve.Columns {
+		if col != other.Columns[idx] {
+			return false
+		}
+	}
+	for idx, key := range schemaEve.Keys {
+		if !key.same(other.Keys[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (schemaEve *SchemaEvent) Dump() string {
+	if schemaEve.Dropped {
+		return fmt.Sprintf("SchemaEvent %s.%s dropped at %s:%d", schemaEve.Schema, schemaEve.Table,
+			schemaEve.FileName, schemaEve.Header.LogPos)
+	}
+	return fmt.Sprintf("SchemaEvent %s.%s (%s) at %s:%d", schemaEve.Schema, schemaEve.Table,
+		strings.Join(schemaEve.ColumnNames(), ", "), schemaEve.FileName, schemaEve.Header.LogPos)
+}
@@ -0,0 +1,148 @@
+/**
+ *  author: lim
+ *  data  : 18-8-28 下午8:40
+ */
+
+package event
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TableChange the rows of a table changed by a transaction
+type TableChange struct {
+	Schema string
+	Table  string
+	Rows   []*RowsEvent // in the order of binlog
+}
+
+// Transaction is the events of an atomic change in the order of binlog, from its GtidEvent
+// or BEGIN to its XidEvent or COMMIT, a ddl is one alone. the events between transactions,
+// such as rotate or format description, make one neither begun nor committed
+type Transaction struct {
+	Gtid       string // empty if gtid mode off
+	File       string // the binlog file it begins in, empty if not known
+	BeginPos   uint32 // where its first event starts
+	CommitPos  uint32 // where the event after its commit starts
+	CommitTs   uint32
+	Xid        uint64
+	Statements []string       // queries except BEGIN/COMMIT, the ddl or the dml of statement format
+	Tables     []*TableChange // in the order first changed
+	Events     []Event
+
+	begun     bool
+	explicit  bool // begun by BEGIN, ends with COMMIT or XID
+	committed bool
+}
+
+// NewTransaction of the events read from file
+func NewTransaction(file string, events []Event) *Transaction {
+	trx := &Transaction{File: file, Events: events}
+	for _, eve := range events {
+		trx.add(eve)
+	}
+	return trx
+}
+
+// Add the event read after the ones of trx
+func (trx *Transaction) Add(eve Event) {
+	trx.Events = append(trx.Events, eve)
+	trx.add(eve)
+}
+
+func (trx *Transaction) add(eve Event) {
+	header := GetEventHeader(eve)
+	if header != nil && header.LogPos != 0 {
+		if trx.BeginPos == 0 && header.LogPos >= header.EveSize {
+			trx.BeginPos = header.LogPos - header.EveSize
+		}
+		trx.CommitPos = header.LogPos
+	}
+
+	switch e := eve.(type) {
+	case *GtidEvent:
+		trx.Gtid, trx.begun = e.Gtid, true
+	case *MariadbGtidEvent:
+		trx.Gtid, trx.begun = e.Gtid.String(), true
+	case *XidEvnet:
+		trx.Xid, trx.committed = e.Xid, true
+		trx.CommitTs = header.Ts
+	case *QueryEvent:
+		switch strings.ToUpper(strings.TrimSpace(e.Query)) {
+		case "BEGIN":
+			trx.begun, trx.explicit = true, true
+		case "COMMIT":
+			trx.committed, trx.CommitTs = true, header.Ts
+		default:
+			trx.Statements = append(trx.Statements, e.Query)
+			if !trx.explicit {
+				// ddl ends its own transaction
+				trx.begun, trx.committed, trx.CommitTs = true, true, header.Ts
+			}
+		}
+	case *MariadbAnnotateRowsEvent:
+		trx.Statements = append(trx.Statements, e.Query)
+	case *RowsEvent:
+		if e.Table == nil {
+			return
+		}
+		schema, table := string(e.Table.Schema), string(e.Table.Table)
+		change := trx.Changes(schema, table)
+		if change == nil {
+			change = &TableChange{Schema: schema, Table: table}
+			trx.Tables = append(trx.Tables, change)
+		}
+		change.Rows = append(change.Rows, e)
+	}
+}
+
+// BeginsTransaction report whether eve begins a transaction, a gtid event or BEGIN,
+// BEGIN follows the gtid event of mysql
+func BeginsTransaction(eve Event) bool {
+	switch e := eve.(type) {
+	case *GtidEvent, *MariadbGtidEvent:
+		return true
+	case *QueryEvent:
+		return strings.ToUpper(strings.TrimSpace(e.Query)) == "BEGIN"
+	}
+	return false
+}
+
+// CommitsTransaction report whether eve commits a transaction begun, a xid event or COMMIT,
+// the ddl commits implicitly is not told alone
+func CommitsTransaction(eve Event) bool {
+	switch e := eve.(type) {
+	case *XidEvnet:
+		return true
+	case *QueryEvent:
+		return strings.ToUpper(strings.TrimSpace(e.Query)) == "COMMIT"
+	}
+	return false
+}
+
+// Complete report whether it's begun and committed in the events
+func (trx *Transaction) Complete() bool {
+	return trx.begun && trx.committed
+}
+
+// CommitTime of the commit event
+func (trx *Transaction) CommitTime() time.Time {
+	return EventTime(trx.CommitTs)
+}
+
+// Changes of schema.table, nil if its rows not changed
+func (trx *Transaction) Changes(schema, table string) *TableChange {
+	for _, change := range trx.Tables {
+		if change.Schema == schema && change.Table == table {
+			return change
+		}
+	}
+	return nil
+}
+
+func (trx *Transaction) Dump() string {
+	return fmt.Sprintf("Transaction gtid: %s, file: %s, pos: [%d, %d), xid: %d, %d events",
+		trx.Gtid, trx.File, trx.BeginPos, trx.CommitPos, trx.Xid, len(trx.Events))
+}
@@ -0,0 +1,62 @@
+/**
+ *  author: lim
+ *  data  : 18-8-28 下午10:05
+ */
+
+package event
+
+import (
+	"testing"
+)
+
+func TestNewTransaction(t *testing.T) {
+	at := func(eveType uint8, pos uint32) *EveHeader {
+		return &EveHeader{Ts: 10, EveType: eveType, LogPos: pos, EveSize: 50}
+	}
+	orders := &TableMapEvent{Header: at(TABLE_MAP_EVENT, 350), Schema: []byte("test"), Table: []byte("orders")}
+	items := &TableMapEvent{Header: at(TABLE_MAP_EVENT, 450), Schema: []byte("test"), Table: []byte("items")}
+	trx := NewTransaction("mysql-bin.000001", []Event{
+		&GtidEvent{Header: at(GTID_LOG_EVENT, 250), Gtid: "3e11fa47-71ca-11e1-9e33-c80aa9429562:7"},
+		&QueryEvent{Header: at(QUERY_EVENT, 300), Query: "BEGIN"},
+		orders,
+		&RowsEvent{Header: at(WRITE_ROWS_EVENT_V2, 400), Table: orders},
+		items,
+		&RowsEvent{Header: at(WRITE_ROWS_EVENT_V2, 500), Table: items},
+		&RowsEvent{Header: at(UPDATE_ROWS_EVENT_V2, 550), Table: orders},
+		&XidEvnet{Header: &EveHeader{Ts: 11, EveType: XID_EVENT, LogPos: 600, EveSize: 50}, Xid: 42},
+	})
+	if !trx.Complete() || trx.Gtid != "3e11fa47-71ca-11e1-9e33-c80aa9429562:7" || trx.Xid != 42 {
+		t.Errorf("unexpect transaction: %s", trx.Dump())
+	}
+	if trx.BeginPos != 200 || trx.CommitPos != 600 || trx.CommitTs != 11 || !trx.CommitTime().Equal(EventTime(11)) {
+		t.Errorf("unexpect positions or time of the transaction: %s", trx.Dump())
+	}
+	if len(trx.Tables) != 2 || trx.Tables[0].Table != "orders" || len(trx.Changes("test", "orders").Rows) != 2 ||
+		len(trx.Changes("test", "items").Rows) != 1 || trx.Changes("test", "users") != nil {
+		t.Errorf("unexpect tables changed: %v", trx.Tables)
+	}
+
+	cases := []struct {
+		events     []Event
+		complete   bool
+		statements int
+	}{
+		// ddl alone, with or without gtid
+		{[]Event{&GtidEvent{Header: at(GTID_LOG_EVENT, 250)}, &QueryEvent{Header: at(QUERY_EVENT, 300), Query: "create table t(id int)"}}, true, 1},
+		{[]Event{&QueryEvent{Header: at(QUERY_EVENT, 300), Query: "drop table t"}}, true, 1},
+		// statement format, ends with COMMIT
+		{[]Event{&QueryEvent{Header: at(QUERY_EVENT, 300), Query: "BEGIN"},
+			&QueryEvent{Header: at(QUERY_EVENT, 350), Query: "delete from t"},
+			&QueryEvent{Header: at(QUERY_EVENT, 400), Query: "COMMIT"}}, true, 1},
+		// between transactions
+		{[]Event{&RotateEvent{Header: at(ROTATE_EVENT, 300), NextBinlog: "mysql-bin.000002"}}, false, 0},
+		// not finished
+		{[]Event{&GtidEvent{Header: at(GTID_LOG_EVENT, 250)}, &QueryEvent{Header: at(QUERY_EVENT, 300), Query: "BEGIN"}}, false, 0},
+	}
+	for _, c := range cases {
+		trx := NewTransaction("mysql-bin.000001", c.events)
+		if trx.Complete() != c.complete || len(trx.Statements) != c.statements {
+			t.Errorf("expect complete %v with %d statements, got %v %v", c.complete, c.statements, trx.Complete(), trx.Statements)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+/**
+ *  author: lim
+ *  data  : 18-8-6 下午10:30
+ */
+
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	commandsServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "server",
+		Name:      "commands_total",
+		Help:      "RESP commands served by command and result.",
+	}, []string{"command", "result"})
+
+	commandLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "go_canal",
+		Subsystem: "server",
+		Name:      "command_seconds",
+		Help:      "Latency of RESP commands by command.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"command"})
+)
+
+func init() {
+	prometheus.MustRegister(commandsServed, commandLatency)
+}
+
+func observeCommand(command string, reply Reply, start time.Time) {
+	switch command {
+	case "GET", "CHANGES", "ROLLBACK":
+	default:
+		command = "OTHER"
+	}
+
+	result := "ok"
+	if _, ok := reply.(*ErrorReply); ok {
+		result = "error"
+	}
+
+	commandsServed.WithLabelValues(command, result).Inc()
+	commandLatency.WithLabelValues(command).Observe(time.Since(start).Seconds())
+}
@@ -7,11 +7,16 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/lemonwx/go-canal/event"
 	"github.com/lemonwx/go-canal/syncer"
 )
 
@@ -21,14 +26,16 @@ type Server struct {
 	listener net.Listener
 	sync.RWMutex
 	running bool
-	syncer  syncer.Syncer
+	syncers map[string]syncer.Syncer // source name -> syncer
+	conns   map[net.Conn]struct{}
 }
 
-func NewServer(host string, port int, syncer syncer.Syncer) (*Server, error) {
+func NewServer(host string, port int, syncers map[string]syncer.Syncer) (*Server, error) {
 	s := new(Server)
 	s.host = host
 	s.port = port
-	s.syncer = syncer
+	s.syncers = syncers
+	s.conns = make(map[net.Conn]struct{})
 
 	var err error
 	s.listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", s.host, s.port))
@@ -39,35 +46,100 @@ func NewServer(host string, port int, syncer syncer.Syncer) (*Server, error) {
 	return s, nil
 }
 
-func (s *Server) Serve() error {
+// Serve accept and handle client conns until ctx done or Stop called
+func (s *Server) Serve(ctx context.Context) error {
+	s.Lock()
 	s.running = true
-	for s.running {
+	s.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-done:
+		}
+	}()
+
+	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if !s.isRunning() {
+				return nil
+			}
 			fmt.Println(err)
 			continue
 		}
 
+		if !s.addConn(conn) {
+			conn.Close()
+			return nil
+		}
 		go s.onConn(conn)
 	}
-	return nil
+}
+
+func (s *Server) isRunning() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.running
+}
+
+func (s *Server) addConn(conn net.Conn) bool {
+	s.Lock()
+	defer s.Unlock()
+	if !s.running {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) removeConn(conn net.Conn) {
+	s.Lock()
+	delete(s.conns, conn)
+	s.Unlock()
+}
+
+// Stop close the listener and all the client conns
+func (s *Server) Stop() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.running {
+		return nil
+	}
+	s.running = false
+
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = make(map[net.Conn]struct{})
+	return err
 }
 
 func (s *Server) onConn(conn net.Conn) error {
+	defer func() {
+		s.removeConn(conn)
+		conn.Close()
+	}()
+
 	for {
 		request, err := NewRequest(conn)
 		if err != nil {
 			return err
 		}
 
+		start := time.Now()
 		reply := s.handleRequest(request)
+		observeCommand(request.Command, reply, start)
 
 		if _, err := reply.WriteTo(conn); err != nil {
 			return err
 		}
-
 	}
-	return nil
 }
 
 func (s *Server) chkArgs(args [][]byte) (*syncer.RollbackArg, error) {
@@ -117,19 +189,55 @@ func (s *Server) chkArgs(args [][]byte) (*syncer.RollbackArg, error) {
 	return arg, nil
 }
 
+// route find the syncer by source name, the source name can be omitted if only one source.
+//
+//	GET [source] schema.table field=val field=val ts te
+//	CHANGES [source] schema.table field=val field=val ts te
+func (s *Server) route(args [][]byte) (syncer.Syncer, [][]byte, error) {
+	if len(args) == 6 {
+		name := string(args[0])
+		sy, ok := s.syncers[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown source: %s", name)
+		}
+		return sy, args[1:], nil
+	}
+
+	if len(s.syncers) == 1 {
+		for _, sy := range s.syncers {
+			return sy, args, nil
+		}
+	}
+
+	names := make([]string, 0, len(s.syncers))
+	for name := range s.syncers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, nil, fmt.Errorf("first arg must be source name, one of: %s", strings.Join(names, ", "))
+}
+
 func (s *Server) handleRequest(request *Request) Reply {
 	var err error
 	var arg *syncer.RollbackArg
-	arg, err = s.chkArgs(request.Arguments)
+
+	sy, args, err := s.route(request.Arguments)
+	if err != nil {
+		return &ErrorReply{message: err.Error()}
+	}
+
+	arg, err = s.chkArgs(args)
 	if err != nil {
 		return &ErrorReply{message: err.Error()}
 	}
 
 	switch request.Command {
 	case "GET":
-		s.syncer.Get(arg)
+		sy.Get(arg)
+	case "CHANGES":
+		return changesReply(sy.Changes(arg))
 	case "ROLLBACK":
-		err = s.syncer.Rollback(arg)
+		err = sy.Rollback(arg)
 	default:
 		return &ErrorReply{message: "unsupported command"}
 	}
@@ -141,3 +249,19 @@ func (s *Server) handleRequest(request *Request) Reply {
 		code: "OK",
 	}
 }
+
+// changesReply the row changes as json, one for a row
+func changesReply(changes []*event.RowChange, err error) Reply {
+	if err != nil {
+		return &ErrorReply{message: err.Error()}
+	}
+	values := make([][]byte, 0, len(changes))
+	for _, change := range changes {
+		data, err := json.Marshal(change)
+		if err != nil {
+			return &ErrorReply{message: err.Error()}
+		}
+		values = append(values, data)
+	}
+	return &MultiBulkReply{values: values}
+}
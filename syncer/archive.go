@@ -0,0 +1,437 @@
+/**
+ *  author: lim
+ *  data  : 18-8-26 下午8:30
+ */
+
+package syncer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	bsync "sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/log"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// the manifest of the segments uploaded, in the data dir and next to the segments archived
+const (
+	archiveManifestFile = ".archive.json"
+	archiveManifestKey  = "manifest.json"
+)
+
+// ObjectStore keeps the sealed segments archived, by the S3 API
+type ObjectStore interface {
+	// Upload the file at path as key, the object appears only when complete
+	Upload(key, path string) error
+	// Download key to the file at path
+	Download(key, path string) error
+}
+
+// S3Archive is an ObjectStore in a bucket of S3 or MinIO
+type S3Archive struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3Archive of the bucket at endpoint, host:port without the scheme
+func NewS3Archive(endpoint, accessKey, secretKey, bucket string, secure bool) (*S3Archive, error) {
+	client, err := minio.New(endpoint, accessKey, secretKey, secure)
+	if err != nil {
+		return nil, errors.Annotatef(err, "connect %s", endpoint)
+	}
+	ok, err := client.BucketExists(bucket)
+	if err != nil {
+		return nil, errors.Annotatef(err, "check bucket %s", bucket)
+	}
+	if !ok {
+		return nil, errors.Errorf("bucket %s not exists on %s", bucket, endpoint)
+	}
+	return &S3Archive{client: client, bucket: bucket}, nil
+}
+
+func (archive *S3Archive) Upload(key, path string) error {
+	_, err := archive.client.FPutObject(archive.bucket, key, path, minio.PutObjectOptions{})
+	return errors.Annotatef(err, "upload %s to %s/%s", path, archive.bucket, key)
+}
+
+func (archive *S3Archive) Download(key, path string) error {
+	err := archive.client.FGetObject(archive.bucket, key, path, minio.GetObjectOptions{})
+	return errors.Annotatef(err, "download %s/%s", archive.bucket, key)
+}
+
+// archivedSegment is a segment uploaded with its index file
+type archivedSegment struct {
+	Name     string    `json:"name"` // the binlog file
+	Seq      int       `json:"seq"`
+	Ext      string    `json:"ext"`
+	Size     int64     `json:"size"`
+	Events   int       `json:"events"`
+	FirstTs  uint32    `json:"first_ts"`
+	LastTs   uint32    `json:"last_ts"`
+	Gtids    string    `json:"gtids"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// archiveManifest of the segments uploaded, in dump order
+type archiveManifest struct {
+	Segments []archivedSegment `json:"segments"`
+}
+
+// has the segment seq of the binlog file name
+func (manifest *archiveManifest) has(name string, seq int) bool {
+	for _, archived := range manifest.Segments {
+		if archived.Name == name && archived.Seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// delay before the upload failed retried, doubled after every failure until the max
+const (
+	archiveBackoff    = time.Second
+	maxArchiveBackoff = 5 * time.Minute
+)
+
+// archiver uploads the sealed segments queued in order, in background of the writes
+type archiver struct {
+	queue  []fileRange // copies of the segments to upload
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	bsync.Mutex
+}
+
+func newArchiver() *archiver {
+	return &archiver{notify: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// push the sealed segment to upload
+func (worker *archiver) push(seg fileRange) {
+	worker.Lock()
+	worker.queue = append(worker.queue, seg)
+	worker.Unlock()
+	select {
+	case worker.notify <- struct{}{}:
+	default:
+	}
+}
+
+// head the segment to upload next, false if none
+func (worker *archiver) head() (fileRange, bool) {
+	worker.Lock()
+	defer worker.Unlock()
+	if len(worker.queue) == 0 {
+		return fileRange{}, false
+	}
+	return worker.queue[0], true
+}
+
+func (worker *archiver) pop() {
+	worker.Lock()
+	defer worker.Unlock()
+	worker.queue = worker.queue[1:]
+}
+
+// loadArchiveManifest in dir, empty if nothing archived
+func loadArchiveManifest(dir string) (*archiveManifest, error) {
+	manifest := &archiveManifest{}
+	data, err := ioutil.ReadFile(dir + archiveManifestFile)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, errors.Annotatef(err, "broken manifest %s", dir+archiveManifestFile)
+	}
+	return manifest, nil
+}
+
+// withArchived mark the segments uploaded, and add the ones only in the archive
+// since their local copies purged
+func withArchived(segs []fileRange, manifest *archiveManifest, startFile string) []fileRange {
+	local := make(map[string]int, len(segs))
+	for idx, seg := range segs {
+		local[segmentName(seg.name, seg.seq)] = idx
+	}
+	for _, archived := range manifest.Segments {
+		if archived.Name < startFile {
+			continue
+		}
+		if idx, ok := local[segmentName(archived.Name, archived.Seq)]; ok {
+			segs[idx].archived = true
+			continue
+		}
+		segs = append(segs, fileRange{name: archived.Name, seq: archived.Seq, ext: archived.Ext, sealed: true,
+			archived: true, remote: true, size: archived.Size, modTime: archived.Uploaded})
+	}
+	sortSegments(segs)
+	return segs
+}
+
+// SetArchive upload the sealed segments to store under prefix in background, the local
+// copies are purged by the retention only after uploaded, and read from store since
+func (syncer *JsonSyncer) SetArchive(store ObjectStore, prefix string) error {
+	if syncer.store != nil {
+		return errors.Errorf("archive is of the json files, not the %T storage", syncer.store)
+	}
+	if syncer.archiver != nil {
+		return errors.New("archive already set")
+	}
+	syncer.archive, syncer.archivePrefix = store, prefix
+	syncer.archiver = newArchiver()
+
+	syncer.streamer.RLock()
+	for _, seg := range syncer.streamer.files {
+		if seg.sealed && !seg.archived && !seg.remote {
+			syncer.archiver.push(seg)
+		}
+	}
+	syncer.streamer.RUnlock()
+	go syncer.runArchiver(syncer.archiver)
+	return nil
+}
+
+// queueArchive the segment sealed, compressed already
+func (syncer *JsonSyncer) queueArchive(seg *fileRange) {
+	if syncer.archiver == nil {
+		return
+	}
+	syncer.streamer.RLock()
+	syncer.archiver.push(*seg)
+	syncer.streamer.RUnlock()
+}
+
+// runArchiver upload the segments queued until stopped, a failed one retried with backoff,
+// or as soon as another segment sealed
+func (syncer *JsonSyncer) runArchiver(worker *archiver) {
+	defer close(worker.done)
+
+	backoff := time.Duration(0)
+	for {
+		var retry <-chan time.Time
+		if backoff != 0 {
+			retry = time.After(backoff)
+		}
+		select {
+		case <-worker.stop:
+			// the last try for the ones sealed before stopped
+			if err := syncer.archiveQueued(worker); err != nil {
+				archiveErrors.WithLabelValues(syncer.Source).Inc()
+				log.Errorf("archive failed, retry after restarted: %v", errors.ErrorStack(err))
+			}
+			return
+		case <-worker.notify:
+		case <-retry:
+		}
+
+		if err := syncer.archiveQueued(worker); err != nil {
+			if backoff *= 2; backoff == 0 {
+				backoff = archiveBackoff
+			} else if backoff > maxArchiveBackoff {
+				backoff = maxArchiveBackoff
+			}
+			archiveErrors.WithLabelValues(syncer.Source).Inc()
+			log.Errorf("archive failed, retry after %v: %v", backoff, errors.ErrorStack(err))
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// archiveQueued upload the segments queued in order, stop at the one failed
+func (syncer *JsonSyncer) archiveQueued(worker *archiver) error {
+	for {
+		seg, ok := worker.head()
+		if !ok {
+			return nil
+		}
+		if err := syncer.archiveSegment(seg); err != nil {
+			return errors.Annotatef(err, "archive %s", seg.path())
+		}
+		worker.pop()
+	}
+}
+
+// stopArchiver after the segments queued uploaded or failed once
+func (syncer *JsonSyncer) stopArchiver() {
+	if syncer.archiver == nil {
+		return
+	}
+	close(syncer.archiver.stop)
+	<-syncer.archiver.done
+	syncer.archiver = nil
+}
+
+// archiveSegment upload the segment and its index file, then record it in the manifest,
+// the segment is archived only after the manifest saved and uploaded
+func (syncer *JsonSyncer) archiveSegment(seg fileRange) error {
+	start := time.Now()
+	if err := syncer.archive.Upload(syncer.archivePrefix+seg.path(), syncer.dir+seg.path()); err != nil {
+		return errors.Trace(err)
+	}
+	if err := syncer.archive.Upload(syncer.archivePrefix+seg.indexPath(), syncer.dir+seg.indexPath()); err != nil {
+		return errors.Trace(err)
+	}
+
+	syncer.manifestLock.Lock()
+	manifest := &archiveManifest{}
+	if syncer.manifest != nil {
+		manifest.Segments = append(manifest.Segments, syncer.manifest.Segments...)
+	}
+	if !manifest.has(seg.name, seg.seq) {
+		manifest.Segments = append(manifest.Segments, archivedSegment{
+			Name: seg.name, Seq: seg.seq, Ext: seg.ext, Size: seg.size, Events: seg.count,
+			FirstTs: seg.firstTs, LastTs: seg.lastTs, Gtids: seg.gtids.String(), Uploaded: time.Now()})
+	}
+	err := syncer.saveManifest(manifest)
+	if err == nil {
+		syncer.manifest = manifest
+	}
+	syncer.manifestLock.Unlock()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	syncer.streamer.Lock()
+	for idx := range syncer.streamer.files {
+		if f := &syncer.streamer.files[idx]; f.name == seg.name && f.seq == seg.seq {
+			f.archived = true
+		}
+	}
+	syncer.streamer.Unlock()
+	archiveUploads.WithLabelValues(syncer.Source).Observe(time.Since(start).Seconds())
+	log.Debugf("archive %s: %d events, %d bytes", seg.path(), seg.count, seg.size)
+	return nil
+}
+
+// saveManifest in the data dir, then upload it so the archive is usable alone
+func (syncer *JsonSyncer) saveManifest(manifest *archiveManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	path := syncer.dir + archiveManifestFile
+	if err = ioutil.WriteFile(path+tmpExt, data, 0664); err != nil {
+		return errors.Trace(err)
+	}
+	if err = os.Rename(path+tmpExt, path); err != nil {
+		return errors.Trace(err)
+	}
+	if syncer.archive == nil {
+		return nil
+	}
+	return errors.Trace(syncer.archive.Upload(syncer.archivePrefix+archiveManifestKey, path))
+}
+
+// unarchive the segments purged for good from the manifest, the objects are left
+// to the lifecycle of the bucket
+func (syncer *JsonSyncer) unarchive(segs []fileRange) error {
+	syncer.manifestLock.Lock()
+	defer syncer.manifestLock.Unlock()
+	if syncer.manifest == nil || len(syncer.manifest.Segments) == 0 {
+		return nil
+	}
+	purged := make(map[string]bool, len(segs))
+	for _, seg := range segs {
+		purged[segmentName(seg.name, seg.seq)] = true
+	}
+	kept := syncer.manifest.Segments[:0]
+	for _, archived := range syncer.manifest.Segments {
+		if !purged[segmentName(archived.Name, archived.Seq)] {
+			kept = append(kept, archived)
+		}
+	}
+	if len(kept) == len(syncer.manifest.Segments) {
+		return nil
+	}
+	syncer.manifest.Segments = kept
+	return errors.Trace(syncer.saveManifest(syncer.manifest))
+}
+
+// purgeLocal remove the local copies of the oldest segments beyond the retention,
+// a segment not in the manifest uploaded yet is kept until it is
+func (syncer *JsonSyncer) purgeLocal() error {
+	syncer.manifestLock.Lock()
+	defer syncer.manifestLock.Unlock()
+
+	files := syncer.streamer.files
+	total, local := int64(0), 0
+	for idx, seg := range files {
+		if seg.remote {
+			continue
+		}
+		if idx == len(files)-1 && syncer.curFile != nil {
+			// still written
+			seg.size = syncer.written
+		}
+		total += seg.size
+		local++
+	}
+
+	for idx := 0; idx < len(files)-1 && local > syncer.minFiles; idx++ {
+		seg := &files[idx]
+		if seg.remote {
+			continue
+		}
+		oversize := syncer.maxSize > 0 && total > syncer.maxSize
+		expired := syncer.maxAge > 0 && time.Since(seg.modTime) > syncer.maxAge
+		syncer.streamer.RLock()
+		archived := seg.archived && syncer.manifest != nil && syncer.manifest.has(seg.name, seg.seq)
+		syncer.streamer.RUnlock()
+		if !seg.sealed || !archived || !oversize && !expired {
+			break
+		}
+
+		log.Debugf("purge local %s: %d bytes, archived", seg.path(), seg.size)
+		if err := os.Remove(syncer.dir + seg.path()); err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		syncer.streamer.Lock()
+		seg.remote = true
+		syncer.streamer.Unlock()
+		total -= seg.size
+		local--
+		purgedSegments.WithLabelValues(syncer.Source).Inc()
+	}
+	return nil
+}
+
+// fetchArchived the events of the segment purged locally, downloaded from the archive
+func (syncer *JsonSyncer) fetchArchived(seg *fileRange) (*jsonFile, error) {
+	if syncer.archive == nil {
+		return nil, errors.Errorf("%s only in the archive, but no archive set", seg.path())
+	}
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// keep the name for the compression
+	path := tmp + "/" + seg.path()
+	if err = syncer.archive.Download(syncer.archivePrefix+seg.path(), path); err != nil {
+		return nil, errors.Trace(err)
+	}
+	archiveFetches.WithLabelValues(syncer.Source).Inc()
+	return loadJsonFile(path)
+}
+
+// sortSegments in dump order, the compressed one first of a segment left both
+func sortSegments(segs []fileRange) {
+	sort.Slice(segs, func(i, j int) bool {
+		if segs[i].name != segs[j].name {
+			return segs[i].name < segs[j].name
+		}
+		if segs[i].seq != segs[j].seq {
+			return segs[i].seq < segs[j].seq
+		}
+		return len(segs[i].ext) > len(segs[j].ext)
+	})
+}
@@ -0,0 +1,183 @@
+/**
+ *  author: lim
+ *  data  : 18-8-26 下午10:10
+ */
+
+package syncer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	bsync "sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+)
+
+// dirArchive is a local fake of the bucket, the objects are files in dir
+type dirArchive struct {
+	dir       string
+	fail      bool
+	uploads   int
+	downloads int
+	bsync.Mutex
+}
+
+func (archive *dirArchive) setFail(fail bool) {
+	archive.Lock()
+	defer archive.Unlock()
+	archive.fail = fail
+}
+
+func (archive *dirArchive) uploaded() int {
+	archive.Lock()
+	defer archive.Unlock()
+	return archive.uploads
+}
+
+func (archive *dirArchive) Upload(key, path string) error {
+	archive.Lock()
+	defer archive.Unlock()
+	if archive.fail {
+		return errors.New("bucket unavailable")
+	}
+	archive.uploads++
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	dst := filepath.Join(archive.dir, key)
+	if err = os.MkdirAll(filepath.Dir(dst), 0775); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(dst, data, 0664))
+}
+
+func (archive *dirArchive) Download(key, path string) error {
+	archive.Lock()
+	defer archive.Unlock()
+	data, err := ioutil.ReadFile(filepath.Join(archive.dir, key))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	archive.downloads++
+	return errors.Trace(ioutil.WriteFile(path, data, 0664))
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bucket := &dirArchive{dir: dir + "/bucket"}
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/data/"
+	if err = os.MkdirAll(syncer.dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err = syncer.SetCompress(COMPRESS_GZIP); err != nil {
+		t.Fatal(err)
+	}
+	// a segment for every transaction, only the one written kept locally
+	syncer.SetRotation(1, 0)
+	syncer.SetRetention(1, 0, 1)
+	syncer.SetCacheSize(1)
+	if err = syncer.SetArchive(bucket, "src/"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := storageEvents()
+	// the bucket down for the first transactions
+	bucket.setFail(true)
+	for _, eve := range events[:12] {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// uploaded in background, the writes not blocked by the bucket
+	time.Sleep(10 * time.Millisecond)
+	syncer.streamer.RLock()
+	for _, seg := range syncer.streamer.files {
+		if seg.archived || seg.remote {
+			t.Errorf("%s purged locally before uploaded", seg.path())
+		}
+	}
+	syncer.streamer.RUnlock()
+	bucket.setFail(false)
+	for _, eve := range events[12:] {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// retried once another segment sealed
+	for n := 0; n < 100 && bucket.uploaded() == 0; n++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bucket.uploaded() == 0 {
+		t.Error("expect the segments failed uploaded again")
+	}
+	// the segments queued uploaded before closed
+	if err = syncer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = syncer.purge(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := syncer.streamer.files
+	for _, seg := range files[:len(files)-1] {
+		if !seg.archived || !seg.remote {
+			t.Errorf("%s should be archived and purged locally, got %v %v", seg.path(), seg.archived, seg.remote)
+		}
+		if _, err = os.Stat(syncer.dir + seg.path()); !os.IsNotExist(err) {
+			t.Errorf("local copy of %s not purged: %v", seg.path(), err)
+		}
+		if _, err = os.Stat(syncer.dir + seg.indexPath()); err != nil {
+			t.Errorf("index of %s should be kept locally: %v", seg.path(), err)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(bucket.dir, "src", archiveManifestKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &archiveManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil || len(manifest.Segments) != len(files)-1 {
+		t.Fatalf("expect %d segments in the manifest, got %d: %v", len(files)-1, len(manifest.Segments), err)
+	}
+
+	arg := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "id", Val: "1"}},
+		Ts: event.EventTime(0), Te: event.EventTime(60)}
+	if versions, err := syncer.Get(arg); err != nil || len(versions) != 6 {
+		t.Errorf("expect 6 versions from the archive, got %d: %v", len(versions), err)
+	}
+	if bucket.downloads == 0 {
+		t.Error("expect the segments downloaded from the archive")
+	}
+
+	// restarted, the segments only in the archive known by the manifest
+	loaded := mustLoad(t, dir+"/data")
+	if len(loaded.streamer.files) != len(files) || loaded.CurPos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 2000}) {
+		t.Fatalf("expect %d segments continue from 2000, got %d from %v", len(files), len(loaded.streamer.files), loaded.CurPos)
+	}
+	if _, err = loaded.Get(arg); err == nil {
+		t.Error("expect failed to read the archived segments without the archive set")
+	}
+	if err = loaded.SetArchive(bucket, "src/"); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	since, err := loaded.EventsSinceTime(event.EventTime(20))
+	if err != nil || len(since) != 25 {
+		t.Errorf("expect 5 transactions since 20, got %d events: %v", len(since), err)
+	}
+	if versions, err := loaded.Get(arg); err != nil || len(versions) != 6 {
+		t.Errorf("expect 6 versions after restarted, got %d: %v", len(versions), err)
+	}
+}
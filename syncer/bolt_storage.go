@@ -0,0 +1,640 @@
+/**
+ *  author: lim
+ *  data  : 18-8-25 下午9:30
+ */
+
+package syncer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	bsync "sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// the events by position: binlog file index, log pos and index in dump order,
+	// the value is the same record as a line of FORMAT_NDJSON file
+	eventsBucket = []byte("events")
+	// index in dump order -> key in eventsBucket
+	orderBucket = []byte("order")
+	// timestamp of the first transaction of every second -> index in dump order
+	timesBucket = []byte("times")
+	// length of the row key, the row key and index in dump order -> the first event of its transaction and timestamp,
+	// the versions of the rows, see RowIndex
+	rowsBucket = []byte("rows")
+	// index in dump order of the schema events -> nothing
+	schemasBucket = []byte("schemas")
+	// boltMeta as json
+	metaBucket = []byte("meta")
+	metaKey    = []byte("meta")
+)
+
+// events appended at most before committed, even in the middle of a transaction
+const boltBatch = 4096
+
+// boltIndexVersion changes with the entries of rowsBucket and schemasBucket, rebuilt if not the same
+const boltIndexVersion = 1
+
+// boltMeta is the state at the end of the last transaction committed, the events
+// after End are of a transaction not complete and dropped when opened
+type boltMeta struct {
+	Base    int        `json:"base"`
+	End     int        `json:"end"`
+	Next    binlog.Pos `json:"next"` // where to continue dumping
+	File    string     `json:"file"` // binlog file appended in
+	LastPos uint32     `json:"last_pos"`
+	Gtids   string     `json:"gtids"`
+	Index   int        `json:"index"` // version of the indexes, 0 if to rebuild
+}
+
+// boltEvent is an event appended not committed yet
+type boltEvent struct {
+	eve  event.Event
+	file string
+	key  []byte
+	data []byte
+}
+
+type boltTime struct {
+	ts  uint32
+	idx int
+}
+
+// boltRow is a version of a row indexed not committed yet
+type boltRow struct {
+	key string
+	p   posting
+}
+
+// BoltStorage keeps the events in a bbolt file, keyed by their binlog positions,
+// the appended ones committed at Checkpoint
+type BoltStorage struct {
+	db        *bolt.DB
+	meta      boltMeta // committed
+	committed int      // index the first pending event appended at
+	pending   []boltEvent
+	times     []boltTime // of the pending events
+	rows      []boltRow  // the versions indexed not committed
+	schemas   []int      // the schema events not committed
+
+	// of the events appended
+	file    string
+	lastPos uint32
+	resumed bool
+	lastTs  uint32
+	gtids   event.GtidSet
+	trx     trxState
+	mark    boltMeta // at the end of the last transaction appended
+	bsync.RWMutex
+}
+
+// OpenBoltStorage at path, dump from startFile if nothing stored
+func OpenBoltStorage(path, startFile string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0664, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Annotatef(err, "open %s", path)
+	}
+
+	store := &BoltStorage{db: db, gtids: make(event.GtidSet)}
+	store.meta.Next = binlog.Pos{FileName: startFile, Pos: 4}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{eventsBucket, orderBucket, timesBucket, rowsBucket, schemasBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if data := tx.Bucket(metaBucket).Get(metaKey); data != nil {
+			if err := json.Unmarshal(data, &store.meta); err != nil {
+				return errors.Annotatef(err, "broken meta of %s", path)
+			}
+		} else {
+			// nothing to index
+			store.meta.Index = boltIndexVersion
+		}
+		return store.truncate(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Trace(err)
+	}
+
+	if len(store.meta.Gtids) != 0 {
+		if store.gtids, err = event.ParseGtidSet(store.meta.Gtids); err != nil {
+			db.Close()
+			return nil, errors.Annotatef(err, "broken gtids of %s", path)
+		}
+	}
+	store.committed = store.meta.End
+	store.file, store.lastPos = store.meta.File, store.meta.LastPos
+	store.mark = store.meta
+	return store, nil
+}
+
+// truncate the events of the transaction not complete, committed by a batch full
+func (store *BoltStorage) truncate(tx *bolt.Tx) error {
+	end := store.meta.End
+	dropped, err := deleteEvents(tx, func(idx int) bool { return idx >= end })
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if dropped != 0 {
+		log.Errorf("drop %d events of the transaction not complete", dropped)
+	}
+	if k, _ := tx.Bucket(timesBucket).Cursor().Last(); k != nil {
+		store.lastTs = binary.BigEndian.Uint32(k)
+	}
+	return nil
+}
+
+// deleteEvents the events and the entries of the indexes matched
+func deleteEvents(tx *bolt.Tx, match func(idx int) bool) (int, error) {
+	order, events, times := tx.Bucket(orderBucket), tx.Bucket(eventsBucket), tx.Bucket(timesBucket)
+
+	// a cursor may skip the next one after deleted, so delete after iterated
+	idxs, keys := [][]byte{}, [][]byte{}
+	order.ForEach(func(k, v []byte) error {
+		if match(int(binary.BigEndian.Uint64(k))) {
+			idxs, keys = append(idxs, k), append(keys, v)
+		}
+		return nil
+	})
+	tss := [][]byte{}
+	times.ForEach(func(k, v []byte) error {
+		if match(int(binary.BigEndian.Uint64(v))) {
+			tss = append(tss, k)
+		}
+		return nil
+	})
+
+	for n := range idxs {
+		if err := events.Delete(keys[n]); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if err := order.Delete(idxs[n]); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	for _, k := range tss {
+		if err := times.Delete(k); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	for _, bucket := range []*bolt.Bucket{tx.Bucket(rowsBucket), tx.Bucket(schemasBucket)} {
+		keys := [][]byte{}
+		bucket.ForEach(func(k, v []byte) error {
+			if match(int(binary.BigEndian.Uint64(k[len(k)-8:]))) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+	}
+	return len(idxs), nil
+}
+
+// Append eve, skipped if dumped again from the middle of the binlog file
+func (store *BoltStorage) Append(eve event.Event) error {
+	header := event.GetEventHeader(eve)
+	if header == nil {
+		return errors.Errorf("unsupported event: %v", eve)
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	rotate, isRotate := eve.(*event.RotateEvent)
+	if isRotate && header.Ts == 0 {
+		// fake rotate event, master send it first when dump start
+		if rotate.NextBinlog == store.file && store.lastPos != 0 {
+			store.resumed = true
+			return nil
+		}
+		store.file, store.lastPos, store.resumed = rotate.NextBinlog, 0, false
+	} else if store.resumed && header.EveType != event.SCHEMA_EVENT && header.LogPos <= store.lastPos {
+		return nil
+	}
+
+	encoded, err := event.Marshal(eve)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data, err := encodeRecord(store.file, header.LogPos, event.GetEventType(eve), encoded)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	idx := store.committed + len(store.pending)
+	if !store.trx.inTrx && header.Ts > store.lastTs {
+		store.times = append(store.times, boltTime{ts: header.Ts, idx: idx})
+		store.lastTs = header.Ts
+	}
+	store.pending = append(store.pending, boltEvent{
+		eve: eve, file: store.file, key: posKey(store.file, header.LogPos, idx), data: data})
+	if _, ok := eve.(*event.SchemaEvent); ok {
+		store.schemas = append(store.schemas, idx)
+	}
+
+	file := store.file
+	if header.LogPos != 0 {
+		store.lastPos = header.LogPos
+	}
+	if isRotate && header.Ts != 0 {
+		store.file, store.lastPos = rotate.NextBinlog, 0
+	}
+	gtids, err := gtidsOf([]event.Event{eve})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store.gtids.Merge(gtids)
+
+	store.trx.update(eve)
+	if !store.trx.inTrx {
+		next, err := continueFrom(file, eve)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		store.mark = boltMeta{Base: store.meta.Base, End: idx + 1, Next: next,
+			File: store.file, LastPos: store.lastPos, Gtids: store.gtids.String()}
+	}
+
+	if len(store.pending) >= boltBatch {
+		return errors.Trace(store.commit())
+	}
+	return nil
+}
+
+// commit the pending events with their indexes, the store must be locked
+func (store *BoltStorage) commit() error {
+	meta := store.mark
+	meta.Base, meta.Index = store.meta.Base, store.meta.Index
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		order, events, times := tx.Bucket(orderBucket), tx.Bucket(eventsBucket), tx.Bucket(timesBucket)
+		for n, pending := range store.pending {
+			if err := events.Put(pending.key, pending.data); err != nil {
+				return errors.Trace(err)
+			}
+			if err := order.Put(idxKey(store.committed+n), pending.key); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		for _, t := range store.times {
+			if err := times.Put(tsKey(t.ts), idxKey(t.idx)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		rows, schemas := tx.Bucket(rowsBucket), tx.Bucket(schemasBucket)
+		for _, row := range store.rows {
+			if err := rows.Put(rowEntryKey(row.key, row.p.idx), rowEntry(row.p)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		for _, idx := range store.schemas {
+			if err := schemas.Put(idxKey(idx), []byte{}); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		data, err := json.Marshal(&meta)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(tx.Bucket(metaBucket).Put(metaKey, data))
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	store.meta = meta
+	store.committed += len(store.pending)
+	store.pending, store.times = store.pending[:0], store.times[:0]
+	store.rows, store.schemas = store.rows[:0], store.schemas[:0]
+	return nil
+}
+
+// Bounds of the events stored, the pending ones included
+func (store *BoltStorage) Bounds() (int, int) {
+	store.RLock()
+	defer store.RUnlock()
+	return store.meta.Base, store.committed + len(store.pending)
+}
+
+// Range of the events, the committed ones read from the bolt file
+func (store *BoltStorage) Range(start, end int) ([]event.Event, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	if last := store.committed + len(store.pending); start < store.meta.Base || end > last {
+		return nil, errors.Errorf("events [%d, %d) not stored, retained [%d, %d)", start, end, store.meta.Base, last)
+	}
+	events := make([]event.Event, 0, end-start)
+	if start < store.committed {
+		err := store.db.View(func(tx *bolt.Tx) error {
+			order, stored := tx.Bucket(orderBucket), tx.Bucket(eventsBucket)
+			c := order.Cursor()
+			for k, v := c.Seek(idxKey(start)); k != nil && len(events) < minInt(end, store.committed)-start; k, v = c.Next() {
+				eve, err := decodeBoltEvent(stored.Get(v))
+				if err != nil {
+					return errors.Annotatef(err, "event %d", binary.BigEndian.Uint64(k))
+				}
+				events = append(events, eve)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	for idx := maxInt(start, store.committed); idx < end; idx++ {
+		events = append(events, store.pending[idx-store.committed].eve)
+	}
+	if len(events) != end-start {
+		return nil, errors.Errorf("events [%d, %d) missing, got %d", start, end, len(events))
+	}
+	return events, nil
+}
+
+// SeekPos by the keys of the events
+func (store *BoltStorage) SeekPos(pos binlog.Pos) (int, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	target := posKey(pos.FileName, pos.Pos+1, 0)
+	idx, found := 0, false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(eventsBucket).Cursor().Seek(target); k != nil {
+			idx, found = int(binary.BigEndian.Uint64(k[12:])), true
+		}
+		return nil
+	})
+	if err != nil || found {
+		return idx, errors.Trace(err)
+	}
+	for n, pending := range store.pending {
+		if string(pending.key) >= string(target) {
+			return store.committed + n, nil
+		}
+	}
+	return store.committed + len(store.pending), nil
+}
+
+// SeekTime by the timestamps of the first transaction of every second
+func (store *BoltStorage) SeekTime(t time.Time) (int, binlog.Pos, bool, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	ts := timestamp(t)
+	var data []byte
+	idx, found := 0, false
+	err := store.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(timesBucket).Cursor().Seek(tsKey(ts))
+		if k == nil {
+			return nil
+		}
+		idx, found = int(binary.BigEndian.Uint64(v)), true
+		if key := tx.Bucket(orderBucket).Get(v); key != nil {
+			data = append(data, tx.Bucket(eventsBucket).Get(key)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, binlog.Pos{}, false, errors.Trace(err)
+	}
+
+	if found {
+		record := &ndjsonRecord{}
+		if err = json.Unmarshal(data, record); err != nil {
+			return 0, binlog.Pos{}, false, errors.Annotatef(err, "event %d", idx)
+		}
+		eve, err := decodeBoltEvent(data)
+		if err != nil {
+			return 0, binlog.Pos{}, false, errors.Annotatef(err, "event %d", idx)
+		}
+		return idx, startOf(record.File, eve), true, nil
+	}
+	for _, entry := range store.times {
+		if entry.ts >= ts {
+			pending := store.pending[entry.idx-store.committed]
+			return entry.idx, startOf(pending.file, pending.eve), true, nil
+		}
+	}
+	return 0, binlog.Pos{}, false, nil
+}
+
+// Checkpoint commit the pending events
+func (store *BoltStorage) Checkpoint() (binlog.Pos, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if len(store.pending) != 0 || len(store.rows) != 0 {
+		if err := store.commit(); err != nil {
+			return binlog.Pos{}, errors.Trace(err)
+		}
+	}
+	return store.meta.Next, nil
+}
+
+// addRow the version of the row key, committed with the events
+func (store *BoltStorage) addRow(key string, p posting) {
+	store.Lock()
+	defer store.Unlock()
+	store.rows = append(store.rows, boltRow{key: key, p: p})
+}
+
+// span of all the events stored, the versions of the rows in the bolt file
+func (store *BoltStorage) span() (int, int, uint32, uint32) {
+	store.RLock()
+	defer store.RUnlock()
+	return store.meta.Base, math.MaxInt32, 0, math.MaxUint32
+}
+
+// postings of key, the committed ones read from the bolt file, O(log n)
+func (store *BoltStorage) postings(key string) ([]posting, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	postings := []posting{}
+	prefix := rowEntryKey(key, 0)
+	prefix = prefix[:len(prefix)-8]
+	err := store.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(rowsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if len(v) != 12 {
+				return errors.Errorf("broken version of %q", k)
+			}
+			idx := int(binary.BigEndian.Uint64(k[len(k)-8:]))
+			postings = append(postings, posting{idx: idx, begin: int(binary.BigEndian.Uint64(v)), ts: binary.BigEndian.Uint32(v[8:])})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, row := range store.rows {
+		if row.key == key {
+			postings = append(postings, row.p)
+		}
+	}
+	return postings, nil
+}
+
+func (store *BoltStorage) release() {}
+
+// indexed report whether the indexes are of all the events stored, false if they're to rebuild
+func (store *BoltStorage) indexed() bool {
+	store.RLock()
+	defer store.RUnlock()
+	return store.meta.Index == boltIndexVersion
+}
+
+// markIndexed the indexes rebuilt, the versions added and the schema events at schemas committed
+func (store *BoltStorage) markIndexed(schemas []int) error {
+	store.Lock()
+	defer store.Unlock()
+	store.schemas = append(store.schemas, schemas...)
+	store.meta.Index = boltIndexVersion
+	return errors.Trace(store.commit())
+}
+
+// schemaIdxs the indexes of the schema events stored
+func (store *BoltStorage) schemaIdxs() ([]int, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	idxs := []int{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(schemasBucket).ForEach(func(k, v []byte) error {
+			idxs = append(idxs, int(binary.BigEndian.Uint64(k)))
+			return nil
+		})
+	})
+	for _, idx := range store.schemas {
+		idxs = append(idxs, idx)
+	}
+	return idxs, errors.Trace(err)
+}
+
+// Purge the events committed before idx
+func (store *BoltStorage) Purge(idx int) error {
+	store.Lock()
+	defer store.Unlock()
+
+	// the transaction not complete kept
+	idx = minInt(idx, store.meta.End)
+	if idx <= store.meta.Base {
+		return nil
+	}
+	meta := store.meta
+	meta.Base = idx
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		if _, err := deleteEvents(tx, func(n int) bool { return n < idx }); err != nil {
+			return errors.Trace(err)
+		}
+		data, err := json.Marshal(&meta)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(tx.Bucket(metaBucket).Put(metaKey, data))
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store.meta = meta
+	store.mark.Base = idx
+	return nil
+}
+
+// ExecutedGtids of the transactions committed
+func (store *BoltStorage) ExecutedGtids() (event.GtidSet, error) {
+	store.RLock()
+	defer store.RUnlock()
+	if len(store.meta.Gtids) == 0 {
+		return make(event.GtidSet), nil
+	}
+	return event.ParseGtidSet(store.meta.Gtids)
+}
+
+// Close commit the pending events and close the bolt file
+func (store *BoltStorage) Close() error {
+	if _, err := store.Checkpoint(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(store.db.Close())
+}
+
+func decodeBoltEvent(data []byte) (event.Event, error) {
+	if data == nil {
+		return nil, errors.New("event not found")
+	}
+	entry, err := decodeRecord(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return DecodeFromJson(entry)
+}
+
+// posKey orders the events by binlog file, log pos and then the dump order
+func posKey(file string, pos uint32, idx int) []byte {
+	key := make([]byte, 20)
+	binary.BigEndian.PutUint64(key, binlogIndex(file))
+	binary.BigEndian.PutUint32(key[8:], pos)
+	binary.BigEndian.PutUint64(key[12:], uint64(idx))
+	return key
+}
+
+// binlogIndex the index of the binlog file, 0 if not a binlog file
+func binlogIndex(file string) uint64 {
+	n, err := strconv.ParseUint(file[strings.LastIndex(file, ".")+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func idxKey(idx int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(idx))
+	return key
+}
+
+// rowEntryKey the length of the row key, the row key and then idx, so a row key is not the prefix of another
+func rowEntryKey(key string, idx int) []byte {
+	entry := make([]byte, 2, 2+len(key)+8)
+	binary.BigEndian.PutUint16(entry, uint16(len(key)))
+	return append(append(entry, key...), idxKey(idx)...)
+}
+
+// rowEntry the first event of the transaction and the timestamp of the version
+func rowEntry(p posting) []byte {
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint64(entry, uint64(p.begin))
+	binary.BigEndian.PutUint32(entry[8:], p.ts)
+	return entry
+}
+
+func tsKey(ts uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, ts)
+	return key
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,150 @@
+/**
+ *  author: lim
+ *  data  : 18-8-25 下午11:20
+ */
+
+package syncer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+)
+
+func TestBoltStorageTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/" + boltFile
+
+	store, err := OpenBoltStorage(path, "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := append([]event.Event{fakeRotate(4, "mysql-bin.000001")},
+		rowsTrx(300, 10, event.WRITE_ROWS_EVENT_V2, map[int]interface{}{0: "a", 1: int64(1)})...)
+	// half of the second transaction
+	events = append(events, rowsTrx(600, 20, event.WRITE_ROWS_EVENT_V2, map[int]interface{}{0: "b", 1: int64(2)})[:2]...)
+	for _, eve := range events {
+		if err = store.Append(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// committed as a batch full, then crashed
+	store.Lock()
+	err = store.commit()
+	store.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.db.Close()
+
+	loaded, err := OpenBoltStorage(path, "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start, end := loaded.Bounds(); start != 0 || end != 6 {
+		t.Errorf("expect the transaction not complete dropped, got [%d, %d)", start, end)
+	}
+	pos, err := loaded.Checkpoint()
+	if err != nil || pos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 500}) {
+		t.Errorf("unexpect position to continue: %v %v", pos, err)
+	}
+	if _, _, ok, err := loaded.SeekTime(event.EventTime(15)); ok || err != nil {
+		t.Errorf("expect the time of the transaction dropped not indexed: %v", err)
+	}
+
+	// dumped again from the first transaction, the events stored skipped
+	events = append([]event.Event{fakeRotate(300, "mysql-bin.000001")},
+		rowsTrx(300, 10, event.WRITE_ROWS_EVENT_V2, map[int]interface{}{0: "a", 1: int64(1)})...)
+	events = append(events, rowsTrx(600, 20, event.WRITE_ROWS_EVENT_V2, map[int]interface{}{0: "b", 1: int64(2)})...)
+	for _, eve := range events {
+		if err = loaded.Append(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, end := loaded.Bounds(); end != 11 {
+		t.Errorf("expect the second transaction appended only, got %d events", end)
+	}
+	if pos, err = loaded.Checkpoint(); err != nil || pos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 800}) {
+		t.Errorf("unexpect position to continue: %v %v", pos, err)
+	}
+	idx, _, ok, err := loaded.SeekTime(event.EventTime(15))
+	if err != nil || !ok || idx != 6 {
+		t.Errorf("expect the second transaction at 15: %d %v %v", idx, ok, err)
+	}
+	if err = loaded.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStorageIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer, err := NewSyncer(STORAGE_BOLT, dir, "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, eve := range storageEvents() {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = syncer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	arg := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "id", Val: "1"}},
+		Ts: event.EventTime(0), Te: event.EventTime(60)}
+	for _, rebuilt := range []bool{false, true} {
+		loaded, err := NewSyncer(STORAGE_BOLT, dir, "mysql-bin.000001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := loaded.store.(*BoltStorage)
+		if len(loaded.index.rows) != 0 || !store.indexed() {
+			t.Errorf("rebuilt %v: expect the versions kept by the bolt file only", rebuilt)
+		}
+		if versions, err := loaded.Get(arg); err != nil || len(versions) != 6 {
+			t.Errorf("rebuilt %v: expect 6 versions, got %d: %v", rebuilt, len(versions), err)
+		}
+		if idxs, err := store.schemaIdxs(); err != nil || len(idxs) != 1 || idxs[0] != 1 {
+			t.Errorf("rebuilt %v: unexpect schema events %v: %v", rebuilt, idxs, err)
+		}
+
+		// the indexes of an old bolt file rebuilt when opened
+		store.Lock()
+		store.meta.Index = 0
+		err = store.commit()
+		store.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = loaded.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := NewSyncer(STORAGE_BOLT, dir, "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	// the versions of the events purged deleted with them
+	if err = loaded.store.Purge(17); err != nil {
+		t.Fatal(err)
+	}
+	if postings, err := loaded.store.(*BoltStorage).postings(rowKey("test", "t", []string{"1"})); err != nil ||
+		len(postings) != 3 || postings[0].idx != 20 || postings[0].begin != 17 {
+		t.Errorf("expect 3 versions retained, got %v: %v", postings, err)
+	}
+}
@@ -0,0 +1,109 @@
+/**
+ *  author: lim
+ *  data  : 18-8-19 下午8:15
+ */
+
+package syncer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+)
+
+// durability policies of the json files, the events not synced are dumped again after crash,
+// see loadJsonFile
+const (
+	SYNC_TRX   = "trx"   // fsync after every transaction
+	SYNC_COUNT = "count" // fsync every N events
+	SYNC_TIME  = "time"  // fsync every T seconds
+	SYNC_NONE  = "none"  // flush to the os after every transaction, never fsync until the file closed
+
+	DEFAULT_SYNC_COUNT = 100
+	DEFAULT_SYNC_TIME  = time.Second
+
+	writeBufSize = 64 * 1024
+)
+
+func checkSyncPolicy(policy string) error {
+	switch policy {
+	case SYNC_TRX, SYNC_COUNT, SYNC_TIME, SYNC_NONE:
+		return nil
+	}
+	return fmt.Errorf("unknown sync policy: %s, must be one of %s/%s/%s/%s",
+		policy, SYNC_TRX, SYNC_COUNT, SYNC_TIME, SYNC_NONE)
+}
+
+// SetSyncPolicy decide when the events written are flushed and fsynced, default SYNC_TRX,
+// count is for SYNC_COUNT and interval for SYNC_TIME, defaults are used if not positive
+func (syncer *JsonSyncer) SetSyncPolicy(policy string, count int, interval time.Duration) error {
+	if err := checkSyncPolicy(policy); err != nil {
+		return errors.Trace(err)
+	}
+	if count <= 0 {
+		count = DEFAULT_SYNC_COUNT
+	}
+	if interval <= 0 {
+		interval = DEFAULT_SYNC_TIME
+	}
+	syncer.policy, syncer.syncCounts, syncer.syncTimes = policy, count, interval
+	return nil
+}
+
+// afterWrite flush and fsync if eve written reaches the point of policy
+func (syncer *JsonSyncer) afterWrite(eve event.Event) error {
+	syncer.unsynced++
+	syncer.trx.update(eve)
+
+	switch syncer.policy {
+	case SYNC_TRX:
+		if !syncer.trx.inTrx {
+			return syncer.fsync()
+		}
+	case SYNC_COUNT:
+		if syncer.unsynced >= syncer.syncCounts {
+			return syncer.fsync()
+		}
+	case SYNC_NONE:
+		// readers of the file see the transaction, lost only if the os crashed
+		if !syncer.trx.inTrx && syncer.curFile != nil {
+			return errors.Trace(syncer.writer.Flush())
+		}
+	}
+	return nil
+}
+
+// fsync flush the buffered writes of current file and sync it to disk
+func (syncer *JsonSyncer) fsync() error {
+	if syncer.curFile == nil || syncer.unsynced == 0 {
+		return nil
+	}
+	if err := syncer.writer.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+
+	start := time.Now()
+	if err := syncer.curFile.Sync(); err != nil {
+		return errors.Trace(err)
+	}
+	fsyncLatency.WithLabelValues(syncer.Source).Observe(time.Since(start).Seconds())
+	syncer.unsynced = 0
+	return nil
+}
+
+// ticker for SYNC_TIME, nil channel never fires for the other policies
+func (syncer *JsonSyncer) ticker() (<-chan time.Time, func()) {
+	if syncer.policy != SYNC_TIME {
+		return nil, func() {}
+	}
+	t := time.NewTicker(syncer.syncTimes)
+	return t.C, t.Stop
+}
+
+func newWriter(f io.Writer) *bufio.Writer {
+	return bufio.NewWriterSize(f, writeBufSize)
+}
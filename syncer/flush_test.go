@@ -0,0 +1,68 @@
+/**
+ *  author: lim
+ *  data  : 18-8-19 下午9:10
+ */
+
+package syncer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lemonwx/go-canal/event"
+)
+
+func TestSyncPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = NewJsonSyncer(nil).SetSyncPolicy("always", 0, 0); err == nil {
+		t.Error("unknown policy should fail")
+	}
+
+	for _, c := range []struct {
+		policy string
+		count  int
+		// entries on disk after each event of the transaction written, the fake rotate first
+		expect []int
+	}{
+		{SYNC_TRX, 0, []int{1, 1, 1, 5}},
+		{SYNC_COUNT, 2, []int{2, 2, 4, 4}},
+		{SYNC_NONE, 0, []int{1, 1, 1, 5}},
+	} {
+		syncer := NewJsonSyncer(nil)
+		syncer.dir = dir + "/" + c.policy + "/"
+		if err = syncer.SetSyncPolicy(c.policy, c.count, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		rotate := &event.RotateEvent{Header: &event.EveHeader{EveType: event.ROTATE_EVENT, SvrId: 1}, Pos: 4, NextBinlog: "mysql-bin.000001"}
+		if err = syncer.Sync(rotate); err != nil {
+			t.Fatal(err)
+		}
+		for idx, eve := range trxEvents(200) {
+			if err = syncer.Sync(eve); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(syncer.dir + "mysql-bin.000001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(string(data), "EventName"); n != c.expect[idx] {
+				t.Errorf("%s: expect %d entries on disk after event %d, got %d", c.policy, c.expect[idx], idx, n)
+			}
+		}
+
+		if err = syncer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n := mustLoad(t, syncer.dir).streamer.count(); n != 5 {
+			t.Errorf("%s: expect 5 events after closed, got %d", c.policy, n)
+		}
+	}
+}
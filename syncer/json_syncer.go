@@ -6,12 +6,13 @@
 package syncer
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"strconv"
 	"strings"
 	bsync "sync"
 	"time"
@@ -22,17 +23,6 @@ import (
 	"github.com/lemonwx/log"
 )
 
-type BinlogStreamer struct {
-	Events []event.Event
-	bsync.RWMutex
-}
-
-func (streamer *BinlogStreamer) append(eve event.Event) {
-	streamer.Lock()
-	streamer.Events = append(streamer.Events, eve)
-	streamer.Unlock()
-}
-
 type JsonEntry struct {
 	EventName string
 	EventType uint8
@@ -42,13 +32,48 @@ type JsonEntry struct {
 
 type JsonSyncer struct {
 	streamer   *BinlogStreamer
-	ch         chan event.Event
-	syncFlag   bool
+	schemas    *SchemaHistory
+	index      *RowIndex
+	times      *TimeIndex
+	store      Storage                          // nil if the events kept in the json files of the syncer
+	snapshot   map[string]*binlog.TableSnapshot // tables in the meta snapshot
+	ch         chan *event.Transaction
+	format     string // FORMAT_JSON or FORMAT_NDJSON of the new files
+	policy     string // SYNC_TRX, SYNC_COUNT, SYNC_TIME or SYNC_NONE
 	syncTimes  time.Duration
 	syncCounts int
-
-	curWriter io.Writer
-	CurPos    binlog.Pos
+	compress   string        // codec of the sealed segments
+	segSize    int64         // rotate the segment after the bytes written
+	segAge     time.Duration // rotate the segment after opened for long
+	maxSize    int64         // retention of the segments
+	maxAge     time.Duration
+	minFiles   int
+	purged     event.GtidSet // gtids of the segments purged
+
+	archive       ObjectStore // where the sealed segments uploaded, nil if not archived
+	archivePrefix string
+	manifest      *archiveManifest
+	manifestLock  bsync.Mutex // of manifest, saved by the archiver too
+	archiver      *archiver   // uploads the segments in background, nil if not archived
+	fetchLock     bsync.Mutex // one segment downloaded from the archive at a time
+
+	curFile  *os.File
+	writer   *bufio.Writer  // buffered writes of curFile
+	encoder  *event.Encoder // of curFile, the table map events referred within it
+	unsynced int            // events written but not fsynced
+	trx      trxState       // whether the events written end with a complete transaction
+	fileFmt  string         // format of curFile
+	entries  int            // entries written to curFile
+	written  int64          // bytes of curFile
+	opened   time.Time      // when curFile opened
+	resumed  bool           // curFile is reopened to continue a graceful stopped sync
+	lastFile string         // name of the file written last
+	lastPos  uint32         // LogPos of the last event written to curFile
+	svrId    uint32         // server id of the master curFile dumped from
+	cancel   context.CancelFunc
+	dir      string // where the json files stored
+	CurPos   binlog.Pos
+	Source   string
 
 	Host     string
 	Port     int
@@ -56,97 +81,516 @@ type JsonSyncer struct {
 	Password string
 }
 
-func NewFileWriter(fileName string) (io.Writer, error) {
-	return os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0664)
-}
-
-func NewJsonSyncer(ch chan event.Event) *JsonSyncer {
+func NewJsonSyncer(ch chan *event.Transaction) *JsonSyncer {
 	syncer := &JsonSyncer{
-		ch: ch,
-		streamer: &BinlogStreamer{
-			Events: make([]event.Event, 0, 1024),
-		},
-		syncFlag: true,
+		ch:         ch,
+		dir:        event.BASE_BINLOG_PATH,
+		streamer:   NewBinlogStreamer(),
+		schemas:    NewSchemaHistory(),
+		index:      NewRowIndex(),
+		times:      NewTimeIndex(),
+		format:     FORMAT_JSON,
+		compress:   COMPRESS_NONE,
+		policy:     SYNC_TRX,
+		syncTimes:  DEFAULT_SYNC_TIME,
+		syncCounts: DEFAULT_SYNC_COUNT,
 	}
 	return syncer
 }
 
-func (syncer *JsonSyncer) SetupChan(ch chan event.Event) {
+func (syncer *JsonSyncer) SetupChan(ch chan *event.Transaction) {
 	syncer.ch = ch
 }
 
+// Empty report whether no binlog dumped before
+func (syncer *JsonSyncer) Empty() bool {
+	_, end := syncer.storage().Bounds()
+	return end == 0
+}
+
 func (syncer *JsonSyncer) Sync(eve event.Event) error {
-	encoded, err := json.Marshal(eve)
+	if event.GetEventHeader(eve) == nil {
+		return errors.Errorf("unsupported event: %v", eve)
+	}
+	if schemaEve, ok := eve.(*event.SchemaEvent); ok {
+		// listener sends the definition again after restart or reconnect
+		latest := syncer.schemas.latest(schemaEve.Schema, schemaEve.Table)
+		if latest == nil && schemaEve.Dropped || latest != nil && latest.Same(schemaEve) {
+			return nil
+		}
+	}
+
+	if syncer.store != nil {
+		return syncer.appendTo(eve)
+	}
+	return syncer.Append(eve)
+}
+
+// SyncTrx the events of trx in order, the ones after an event failed are not synced
+func (syncer *JsonSyncer) SyncTrx(trx *event.Transaction) error {
+	for _, eve := range trx.Events {
+		if err := syncer.Sync(eve); err != nil {
+			return errors.Annotatef(err, "sync %s", eve.Dump())
+		}
+	}
+	return nil
+}
+
+// Append eve to current json file, the json files as Storage
+func (syncer *JsonSyncer) Append(eve event.Event) error {
+	header := event.GetEventHeader(eve)
+	if header == nil {
+		return errors.Errorf("unsupported event: %v", eve)
+	}
+
+	if rotate, ok := eve.(*event.RotateEvent); ok && header.Ts == 0 {
+		// fake rotate event, master send it first when dump start
+		resumed, err := syncer.openFile(rotate.NextBinlog, header.SvrId)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if resumed {
+			return nil
+		}
+	} else if syncer.resumed && header.EveType != event.SCHEMA_EVENT && header.LogPos <= syncer.lastPos {
+		// artificial event master send when dump from the middle of a binlog file,
+		// or events before the position resumed from, already written in the resumed file
+		return nil
+	}
+
+	if syncer.curFile == nil {
+		return errors.Errorf("no binlog file opened to write: %s", eve.Dump())
+	}
+
+	data, err := syncer.encodeEntry(eve, header)
 	if err != nil {
 		log.Error(err)
 		return errors.Trace(err)
 	}
 
+	offset, start := syncer.written, time.Now()
+	if _, err = syncer.writer.Write(data); err != nil {
+		return errors.Trace(err)
+	}
+	writeLatency.WithLabelValues(syncer.Source).Observe(time.Since(start).Seconds())
+	syncer.entries += 1
+	syncer.written += int64(len(data))
+	if header.LogPos != 0 {
+		syncer.lastPos = header.LogPos
+	}
+	syncer.appendEvent(eve, offset)
+	if err = syncer.afterWrite(eve); err != nil {
+		return errors.Trace(err)
+	}
+
+	if Type := event.GetEventType(eve); Type == event.STOP_EVENT || Type == event.ROTATE_EVENT && header.Ts != 0 {
+		return syncer.sealFile()
+	}
+	return syncer.rotateSegment()
+}
+
+// encodeEntry the bytes appended to current file for eve, in the format of the file
+func (syncer *JsonSyncer) encodeEntry(eve event.Event, header *event.EveHeader) ([]byte, error) {
+	encoded, err := syncer.encoder.Encode(eve)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	Type := event.GetEventType(eve)
-	entry := JsonEntry{event.EventName[Type], Type, encoded}
-	data, err := json.Marshal(&entry)
+	if syncer.fileFmt == FORMAT_NDJSON {
+		return encodeRecord(syncer.lastFile, header.LogPos, Type, encoded)
+	}
+
+	data, err := json.Marshal(&JsonEntry{event.EventName[Type], Type, encoded})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// write the separator before entry, so the file can be terminated with "]" any time
+	prefix := ",\n\n\t"
+	if syncer.entries == 0 {
+		prefix = "[\n\t"
+	}
+	return append([]byte(prefix), data...), nil
+}
+
+// appendEvent keep eve written at offset of current segment in memory, and the table
+// definition if it's a SchemaEvent, or the versions of the rows if it's a RowsEvent
+func (syncer *JsonSyncer) appendEvent(eve event.Event, offset int64) {
+	idx := syncer.streamer.append(eve)
+	syncer.times.add(idx, eve, offset)
+	syncer.indexEvent(idx, eve)
+}
+
+// indexEvent the definition of the table if eve is a SchemaEvent, or the versions
+// of the rows if it's a RowsEvent
+func (syncer *JsonSyncer) indexEvent(idx int, eve event.Event) {
+	if schemaEve, ok := eve.(*event.SchemaEvent); ok {
+		syncer.schemas.add(idx, schemaEve)
+	}
+	syncer.indexRows(idx, eve)
+}
+
+// openFile open binlog file of master svrId to write, report whether it's a resumed file
+func (syncer *JsonSyncer) openFile(fileName string, svrId uint32) (bool, error) {
+	switched := syncer.svrId != 0 && syncer.svrId != svrId
+	syncer.svrId = svrId
+
+	if switched && len(syncer.lastFile) != 0 {
+		// listener failover to another master, whose binlog files are named independently,
+		// the events of it are in its own files, which must sort after the ones written
+		// to keep the dump order
+		if fileName <= syncer.lastFile {
+			// nothing written until the files sorted again
+			if err := syncer.sealFile(); err != nil {
+				return false, errors.Trace(err)
+			}
+			return false, errors.Errorf("master switched to server %d, its binlog %s not after %s written",
+				svrId, fileName, syncer.lastFile)
+		}
+		log.Errorf("master switched to server %d, continue with its binlog %s after %s", svrId, fileName, syncer.lastFile)
+		if err := syncer.reopen(fileName); err != nil {
+			return false, errors.Trace(err)
+		}
+		return false, nil
+	}
+
+	if !switched && syncer.curFile != nil && syncer.lastFile == fileName {
+		// listener reconnected, continue with current file
+		syncer.resumed = true
+		return true, nil
+	}
+
+	if err := syncer.reopen(fileName); err != nil {
+		return false, errors.Trace(err)
+	}
+	return syncer.resumed && !switched, nil
+}
+
+// reopen make the last segment of fileName the current file, the entries already in it are kept,
+// a new segment if the last one sealed
+func (syncer *JsonSyncer) reopen(fileName string) error {
+	seq := 0
+	for idx := len(syncer.streamer.files) - 1; idx >= 0; idx-- {
+		if seg := syncer.streamer.files[idx]; seg.name == fileName {
+			seq = seg.seq
+			if seg.sealed {
+				seq++
+			}
+			break
+		}
+	}
+
+	path := syncer.dir + segmentName(fileName, seq)
+	if syncer.curFile != nil {
+		if syncer.curFile.Name() == path {
+			return nil
+		}
+		if err := syncer.sealFile(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := os.MkdirAll(syncer.dir, 0775); err != nil {
+		return errors.Trace(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0664)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	writeFmt := ""
 
-	switch entry.EventType {
-	case event.FORMAT_DESCRIPTION_EVENT:
-		writeFmt = "\n\t%s,\n"
-	case event.ROTATE_EVENT:
-		rotate := eve.(*event.RotateEvent)
-		if rotate.Header.Ts == 0 {
-			if syncer.curWriter, err = NewFileWriter(event.BASE_BINLOG_PATH + rotate.NextBinlog); err != nil {
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+
+	syncer.entries = 0
+	syncer.resumed = false
+	syncer.lastPos = 0
+	syncer.opened = time.Now()
+	syncer.fileFmt = syncer.format
+	size := info.Size()
+	if size > 0 {
+		format, err := detectFormat(bufio.NewReader(f))
+		if err != nil {
+			f.Close()
+			return errors.Trace(err)
+		}
+		if len(format) == 0 {
+			// blanks only, a new file in the format configured
+			if err = f.Truncate(0); err != nil {
+				f.Close()
 				return errors.Trace(err)
 			}
-		}
-		if rotate.Header.Ts == 0 {
-			writeFmt = "[\n\t%s,\n"
+			size = 0
 		} else {
-			writeFmt = "\n\t%s\n]"
+			syncer.fileFmt = format
+		}
+	}
+	if size > 0 {
+		// keep writing an existing file in its own format
+		syncer.entries = 1
+		if syncer.fileFmt == FORMAT_JSON {
+			size, err := truncateTerminator(f, size)
+			if err != nil {
+				f.Close()
+				return errors.Trace(err)
+			}
+			if size <= 1 {
+				// "[]" of a file without entries, start the array again
+				if err = f.Truncate(0); err != nil {
+					f.Close()
+					return errors.Trace(err)
+				}
+				syncer.entries = 0
+			}
 		}
-	case event.STOP_EVENT:
-		writeFmt = "\n\t%s\n]"
-	default:
-		writeFmt = "\n\t%s,\n"
+		syncer.resumed = true
+		if fileName == syncer.CurPos.FileName {
+			syncer.lastPos = syncer.CurPos.Pos
+		}
+		log.Debugf("resume binlog file %s", path)
+	}
+
+	if syncer.written, err = f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+
+	syncer.curFile = f
+	syncer.writer = newWriter(f)
+	syncer.encoder = event.NewEncoder()
+	syncer.lastFile = fileName
+	syncer.addFileRange(fileRange{name: fileName, seq: seq, size: syncer.written, modTime: time.Now()})
+	return nil
+}
+
+// addFileRange of the segment to write or load, return the one in effect
+func (syncer *JsonSyncer) addFileRange(seg fileRange) *fileRange {
+	streamer := syncer.streamer
+	streamer.Lock()
+	defer streamer.Unlock()
+
+	n := len(streamer.files)
+	if n != 0 && streamer.files[n-1].name == seg.name && streamer.files[n-1].seq == seg.seq {
+		return &streamer.files[n-1]
+	}
+	seg.start = streamer.end()
+	streamer.files = append(streamer.files, seg)
+	syncer.index.newSegment()
+	return &streamer.files[n]
+}
+
+// EventsSince the events stored after pos
+func (syncer *JsonSyncer) EventsSince(pos binlog.Pos) ([]event.Event, error) {
+	store := syncer.storage()
+	idx, err := store.SeekPos(pos)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	_, end := store.Bounds()
+	return store.Range(idx, end)
+}
+
+// SetMetaSnapshot the columns of the tables never stored by SchemaEvent come from it,
+// instead of querying master
+func (syncer *JsonSyncer) SetMetaSnapshot(snapshot *binlog.MetaSnapshot) {
+	syncer.snapshot = make(map[string]*binlog.TableSnapshot, len(snapshot.Tables))
+	for idx := range snapshot.Tables {
+		tb := &snapshot.Tables[idx]
+		syncer.snapshot[historyKey(tb.Schema, tb.Table)] = tb
+	}
+}
+
+// truncateTerminator remove the "\n]" at the end of a graceful closed file, return the size left
+func truncateTerminator(f *os.File, size int64) (int64, error) {
+	tailSize := int64(64)
+	if size < tailSize {
+		tailSize = size
+	}
+
+	tail := make([]byte, tailSize)
+	if _, err := f.ReadAt(tail, size-tailSize); err != nil {
+		return 0, errors.Trace(err)
 	}
 
-	_, err = fmt.Fprintf(syncer.curWriter, writeFmt, data)
-	return err
+	trimed := bytes.TrimRight(tail, " \t\r\n")
+	if len(trimed) == 0 || trimed[len(trimed)-1] != ']' {
+		return 0, errors.Errorf("%s is not a complete json file", f.Name())
+	}
+
+	trimed = bytes.TrimRight(trimed[:len(trimed)-1], " \t\r\n")
+	size = size - tailSize + int64(len(trimed))
+	return size, errors.Trace(f.Truncate(size))
 }
 
-func (syncer *JsonSyncer) Start() {
+// closeFile terminate the json array and close current file
+func (syncer *JsonSyncer) closeFile() error {
+	if syncer.curFile == nil {
+		return nil
+	}
+
+	terminator := "\n]"
+	if syncer.entries == 0 {
+		terminator = "[]"
+	}
+	if syncer.fileFmt == FORMAT_NDJSON {
+		// every record ends with its line
+		terminator = ""
+	}
+
+	_, err := syncer.writer.WriteString(terminator)
+	if err == nil {
+		err = syncer.writer.Flush()
+	}
+	if err == nil {
+		err = syncer.curFile.Sync()
+	}
+	if cerr := syncer.curFile.Close(); err == nil {
+		err = cerr
+	}
+
+	syncer.curFile = nil
+	syncer.writer = nil
+	syncer.entries = 0
+	syncer.written = 0
+	syncer.unsynced = 0
+	syncer.resumed = false
+	return errors.Trace(err)
+}
+
+// drainTimeout is how long Start waits for ch closed after ctx done,
+// longer than the listener waits for the transaction to end
+const drainTimeout = 30 * time.Second
+
+// Start write the transactions from ch until ch closed or ctx done, after ctx done
+// the ones left are drained until the listener stopped closes ch
+func (syncer *JsonSyncer) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	syncer.cancel = cancel
+	defer cancel()
+
+	tick, stop := syncer.ticker()
+	defer stop()
+	maintainTick := time.NewTicker(maintainInterval)
+	defer maintainTick.Stop()
+
 	log.Debug("Syncer start")
 	for {
-		eve := <-syncer.ch
-		syncer.streamer.append(eve)
-		syncer.Sync(eve)
+		select {
+		case trx, ok := <-syncer.ch:
+			if !ok {
+				return syncer.Close()
+			}
+			if err := syncer.handle(trx); err != nil {
+				return errors.Trace(err)
+			}
+		case <-tick:
+			if err := syncer.fsync(); err != nil {
+				writeErrors.WithLabelValues(syncer.Source).Inc()
+				log.Errorf("fsync %s failed: %v", syncer.lastFile, errors.ErrorStack(err))
+			}
+		case <-maintainTick.C:
+			if err := syncer.maintain(); err != nil {
+				writeErrors.WithLabelValues(syncer.Source).Inc()
+				log.Errorf("rotate or purge segments of %s failed: %v", syncer.lastFile, errors.ErrorStack(err))
+			}
+		case <-ctx.Done():
+			if err := syncer.drain(); err != nil {
+				return errors.Trace(err)
+			}
+			return syncer.Close()
+		}
+	}
+}
+
+// handle trx, the events of it written are rolled back if failed, nothing synced after it
+func (syncer *JsonSyncer) handle(trx *event.Transaction) error {
+	chanDepth.WithLabelValues(syncer.Source).Set(float64(len(syncer.ch)))
+	if err := syncer.SyncTrx(trx); err != nil {
+		writeErrors.WithLabelValues(syncer.Source).Inc()
+		if rerr := syncer.rollback(); rerr != nil {
+			log.Errorf("rollback %s failed: %v", syncer.lastFile, errors.ErrorStack(rerr))
+		}
+		return errors.Trace(err)
 	}
+	return nil
 }
 
-func (syncer *JsonSyncer) CountSync() error {
-	// 积攒 N 个binlog 后做一次同步
+func (syncer *JsonSyncer) drain() error {
+	timeout := time.After(drainTimeout)
 	for {
-		syncer.streamer.RLock()
-		if len(syncer.streamer.Events)%syncer.syncCounts == 0 {
-			_, err := json.Marshal(syncer.streamer)
-			syncer.streamer.RUnlock()
-			if err != nil {
+		select {
+		case trx, ok := <-syncer.ch:
+			if !ok {
+				return nil
+			}
+			if err := syncer.handle(trx); err != nil {
 				return errors.Trace(err)
 			}
+		case <-timeout:
+			log.Errorf("wait the listener stopped timeout, %d transactions left", len(syncer.ch))
 			return nil
-		} else {
-			syncer.streamer.RUnlock()
 		}
 	}
 }
 
-func (syncer *JsonSyncer) TimingSync() {
-	// 定时同步 binlog event
-	for {
-		time.Sleep(syncer.syncTimes * time.Second)
-		//syncer.Sync()
+// rollback cut current file at the end of its last complete transaction and close it,
+// so the transaction failed is dumped again from there when resumed
+func (syncer *JsonSyncer) rollback() error {
+	if syncer.store != nil {
+		// the events after the last transaction are truncated when opened, see truncate
+		return nil
+	}
+	if syncer.curFile == nil {
+		return nil
+	}
+
+	// the events buffered are cut with the others of the transaction
+	path := syncer.curFile.Name()
+	err := syncer.writer.Flush()
+	if cerr := syncer.curFile.Close(); err == nil {
+		err = cerr
+	}
+	syncer.curFile = nil
+	syncer.writer = nil
+	syncer.entries = 0
+	syncer.written = 0
+	syncer.unsynced = 0
+	syncer.resumed = false
+	if err != nil {
+		log.Errorf("flush %s before rollback failed: %v", path, err)
+	}
+
+	loaded, err := loadJsonFile(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = loaded.recover(path); err != nil {
+		return errors.Trace(err)
+	}
+	log.Errorf("rollback %s: %d events kept, %d of the incomplete transaction dropped",
+		path, len(loaded.events), loaded.dropped)
+	return nil
+}
+
+func (syncer *JsonSyncer) Stop() {
+	if syncer.cancel != nil {
+		syncer.cancel()
+	}
+}
+
+// Close flush and close current binlog file with a proper terminator
+func (syncer *JsonSyncer) Close() error {
+	log.Debug("Syncer stop")
+	if syncer.store != nil {
+		return syncer.store.Close()
 	}
+	err := syncer.closeFile()
+	syncer.stopArchiver()
+	return errors.Trace(err)
 }
 
 func (syncer *JsonSyncer) StartSync() {
@@ -172,102 +616,172 @@ func (syncer *JsonSyncer) GetByPk(schema, table string, field string, val []byte
 
 }
 
+// NewJsonSyncerFromLocalFile load the json files in event.BASE_BINLOG_PATH from startFile
 func NewJsonSyncerFromLocalFile(startFile string) (*JsonSyncer, error) {
+	return NewJsonSyncerFromDir(event.BASE_BINLOG_PATH, startFile)
+}
+
+// NewJsonSyncerFromDir load the json files in dir from startFile, a dir for each source
+func NewJsonSyncerFromDir(dir, startFile string) (*JsonSyncer, error) {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
 	js := &JsonSyncer{
-		streamer: &BinlogStreamer{
-			Events: make([]event.Event, 0, 1024),
-		},
+		streamer: NewBinlogStreamer(),
+		schemas:  NewSchemaHistory(),
+		index:    NewRowIndex(),
+		times:    NewTimeIndex(),
+		format:   FORMAT_JSON,
+		compress: COMPRESS_NONE,
+		dir:      dir,
 	}
 
-	fileName := startFile
-	for {
-		log.Debugf("parse binlog from %s", fileName)
-		data, err := ioutil.ReadFile(event.BASE_BINLOG_PATH + fileName)
-		if err != nil {
-			log.Debugf("read file: %v failed, return", fileName)
-			break
-		}
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Trace(err)
+	}
 
-		entrys := []JsonEntry{}
-		err = json.Unmarshal(data, &entrys)
-		if err != nil {
-			return nil, errors.Trace(fmt.Errorf("parse [%s] failed: %v", fileName, err))
+	segs, err := listSegments(dir, startFile, fs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if js.purged, err = loadPurgedGtids(dir); err != nil {
+		return nil, errors.Annotatef(err, "load purged gtids failed")
+	}
+	if js.manifest, err = loadArchiveManifest(dir); err != nil {
+		return nil, errors.Trace(err)
+	}
+	segs = withArchived(segs, js.manifest, startFile)
+
+	// the last file decides where to continue, the files before may end without
+	// a rotate event if some binlog skipped, see event.GapEvent
+	pos := binlog.Pos{FileName: startFile, Pos: 4}
+	for idx, seg := range segs {
+		fileName := seg.path()
+		complete := len(seg.ext) != 0
+		// only the segment written last can be appended
+		seg.sealed = seg.sealed || idx != len(segs)-1
+		js.lastFile = seg.name
+		cur := js.addFileRange(seg)
+
+		count, next := 0, binlog.Pos{}
+		summary, ok := (*segmentIndex)(nil), false
+		if cur.sealed {
+			// the events are not read until needed
+			if summary, ok, err = js.loadSegmentIndex(cur); err != nil {
+				return nil, errors.Trace(err)
+			}
 		}
-
-		for idx, entry := range entrys {
-			eve, err := DecodeFromJson(entry)
+		if ok {
+			if summary.SvrId != 0 {
+				js.svrId = summary.SvrId
+			}
+			count, next = summary.Events, summary.Next
+		} else if cur.remote {
+			return nil, errors.Errorf("index of %s lost, the segment only in the archive", fileName)
+		} else {
+			log.Debugf("parse binlog from %s", fileName)
+			loaded, err := loadJsonFile(dir + fileName)
 			if err != nil {
-				return nil, errors.Trace(err)
+				return nil, errors.Annotatef(err, "parse [%s] failed", fileName)
 			}
 
-			js.streamer.append(eve)
-
-			if idx == len(entrys)-1 {
-				if _, ok := eve.(*event.StopEvent); ok {
-					to := strings.Split(fileName, ".")
-					nextIdx, err := strconv.ParseUint(to[len(to)-1], 10, 64)
-					if err != nil {
-						return nil, err
-					}
-					fileName = fmt.Sprintf("mysql-bin.%06d", nextIdx+1)
-				} else if rotate, ok := eve.(*event.RotateEvent); ok {
-					log.Debugf("get next binlog %s from rotate event", rotate.NextBinlog)
-					fileName = rotate.NextBinlog
-				} else {
-					return nil, fmt.Errorf("last event should be RotateEvent, but recv: %v", eve)
+			if !loaded.complete {
+				if idx != len(segs)-1 || complete {
+					// only the file written last can be broken by a crash
+					return nil, errors.Errorf("parse [%s] failed: not a complete json file", fileName)
+				}
+				// crashed while writing, resume from the end of the last complete transaction
+				if err = loaded.recover(dir + fileName); err != nil {
+					return nil, errors.Annotatef(err, "recover [%s] failed", fileName)
+				}
+				log.Errorf("recover %s: %d events kept, %d of the incomplete transaction dropped",
+					fileName, len(loaded.events), loaded.dropped)
+				if info, err := os.Stat(dir + fileName); err == nil {
+					cur.size = info.Size()
 				}
 			}
+
+			for n, eve := range loaded.events {
+				if rotate, ok := eve.(*event.RotateEvent); ok && rotate.Header != nil && rotate.Header.Ts == 0 {
+					js.svrId = rotate.Header.SvrId
+				}
+				js.appendEvent(eve, loaded.offsets[n])
+			}
+			if count = len(loaded.events); count != 0 {
+				if next, err = continueFrom(seg.name, loaded.events[count-1]); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+			if cur.sealed {
+				// written before the index, or crashed before it saved
+				if err = js.sealTail(cur); err != nil {
+					return nil, errors.Annotatef(err, "index [%s] failed", fileName)
+				}
+			}
+		}
+
+		if count == 0 {
+			if seg.seq == 0 || pos.FileName != seg.name {
+				pos = binlog.Pos{FileName: seg.name, Pos: 4}
+			}
+			continue
 		}
+		pos = next
+		log.Debugf("%s continue from %v", fileName, pos)
 	}
-	js.CurPos = binlog.Pos{fileName, 4}
+	js.CurPos = pos
 	return js, nil
 }
 
-func (syncer *JsonSyncer) RemoveBinlogGtNow(filename string) error {
-	fs, err := ioutil.ReadDir(event.BASE_BINLOG_PATH)
-	if err != nil {
-		return errors.Trace(err)
+// ExecutedGtids is the mysql gtid set of the transactions stored, the purged ones included
+func (syncer *JsonSyncer) ExecutedGtids() (event.GtidSet, error) {
+	if syncer.store != nil {
+		return syncer.storedGtids()
 	}
 
-	for _, f := range fs {
-		if f.Name() >= filename {
-			if err = os.Remove(event.BASE_BINLOG_PATH + f.Name()); err != nil {
-				return errors.Trace(err)
-			}
-			log.Debugf("rm file: %v success", f.Name())
-		}
-	}
+	syncer.streamer.RLock()
+	defer syncer.streamer.RUnlock()
 
-	return nil
+	executed, err := gtidsOf(syncer.streamer.Events)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, seg := range syncer.streamer.files {
+		executed.Merge(seg.gtids)
+	}
+	executed.Merge(syncer.purged)
+	return executed, nil
 }
 
+// DecodeFromJson an entry alone, a rows event of it carries its table map event
 func DecodeFromJson(entry JsonEntry) (event.Event, error) {
-	var eve event.Event
-
-	switch entry.EventType {
-	case event.ROTATE_EVENT:
-		eve = &event.RotateEvent{}
-	case event.FORMAT_DESCRIPTION_EVENT:
-		eve = &event.FormatDescEvent{}
-	case event.QUERY_EVENT:
-		eve = &event.QueryEvent{}
-	case event.WRITE_ROWS_EVENT_V2, event.UPDATE_ROWS_EVENT_V2, event.DELETE_ROWS_EVENT_V2:
-		eve = &event.RowsEvent{}
-	case event.TABLE_MAP_EVENT:
-		eve = &event.TableMapEvent{}
-	case event.GTID_LOG_EVENT:
-		eve = &event.GtidEvent{}
-	case event.XID_EVENT:
-		eve = &event.XidEvnet{}
-	case event.STOP_EVENT:
-		eve = &event.StopEvent{}
-
-	default:
-		eve = &event.FormatDescEvent{}
+	return decodeEntry(event.NewDecoder(), entry)
+}
+
+// decodeEntry of a file by dec, the entries written before the codec are the json of
+// the event structs, the ones of an unknown codec version rejected by dec
+func decodeEntry(dec *event.Decoder, entry JsonEntry) (event.Event, error) {
+	version, err := event.CodecVersion(entry.Encoded)
+	if err != nil {
+		return nil, errors.Annotatef(err, "broken %s entry", entry.EventName)
+	}
+	if version != 0 {
+		return dec.Decode(entry.Encoded)
 	}
 
+	eve, err := event.NewEvent(entry.EventType, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	if err := json.Unmarshal(entry.Encoded, &eve); err != nil {
 		return nil, errors.Trace(err)
 	}
+	if re, ok := eve.(*event.RowsEvent); ok {
+		if err := re.RestoreBinary(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
 	return eve, nil
 }
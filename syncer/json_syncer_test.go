@@ -6,7 +6,13 @@
 package syncer
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
 	"testing"
+
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
 )
 
 func TestNewJsonSyncerFromReader(t *testing.T) {
@@ -19,3 +25,105 @@ func TestNewJsonSyncerFromReader(t *testing.T) {
 		t.Log(entry.Dump())
 	}
 }
+
+func TestNewJsonSyncerFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the sources never see the files of each other
+	for n, name := range []string{"a", "b"} {
+		syncer := NewJsonSyncer(nil)
+		syncer.dir = dir + "/" + name + "/"
+		events := append([]event.Event{fakeRotate(4, "mysql-bin.000001")},
+			rowsTrx(uint32(300*(n+1)), 10, event.WRITE_ROWS_EVENT_V2, map[int]interface{}{0: name, 1: int64(n)})...)
+		for _, eve := range events {
+			if err = syncer.Sync(eve); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = syncer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for n, name := range []string{"a", "b"} {
+		loaded, err := NewJsonSyncerFromDir(dir+"/"+name, "mysql-bin.000001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, end := loaded.Bounds(); end != 6 || loaded.CurPos.Pos != uint32(300*(n+1)+200) {
+			t.Errorf("%s: unexpect %d events loaded, continue from %v", name, end, loaded.CurPos)
+		}
+	}
+}
+
+func TestDecodeLegacyEntry(t *testing.T) {
+	trx := rowsTrx(300, 10, event.WRITE_ROWS_EVENT_V2, map[int]interface{}{0: "a", 1: int64(1)})
+	for _, eve := range trx {
+		// the struct encoded as is, before the codec versioned
+		encoded, err := json.Marshal(eve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eveType := event.GetEventType(eve)
+		decoded, err := DecodeFromJson(JsonEntry{EventName: event.EventName[eveType], EventType: eveType, Encoded: encoded})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.GetEventType(decoded) != eveType || event.GetEventHeader(decoded).LogPos != event.GetEventHeader(eve).LogPos {
+			t.Errorf("%s not decoded from the legacy entry: %v", event.EventName[eveType], decoded)
+		}
+	}
+
+	if _, err := DecodeFromJson(JsonEntry{EventType: event.UNKNOWN_EVENT, Encoded: []byte("{}")}); err == nil {
+		t.Error("expect the entry of unknown type rejected")
+	}
+}
+
+func TestMasterSwitched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "switched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rotate := func(svrId uint32, next string) *event.RotateEvent {
+		eve := fakeRotate(4, next)
+		eve.Header.SvrId = svrId
+		return eve
+	}
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	events := append([]event.Event{rotate(1, "mysql-bin.000003")},
+		rowsTrx(300, 10, event.WRITE_ROWS_EVENT_V2, map[int]interface{}{0: "a", 1: int64(1)})...)
+	// failover to server 2, the transactions after dumped from its own binlog
+	events = append(events, rotate(2, "mysql-bin.000005"))
+	events = append(events, rowsTrx(600, 20, event.WRITE_ROWS_EVENT_V2, map[int]interface{}{0: "b", 1: int64(2)})...)
+	for _, eve := range events {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if syncer.lastFile != "mysql-bin.000005" {
+		t.Errorf("expect the binlog of the new master written, got %s", syncer.lastFile)
+	}
+
+	// the binlog of server 3 sorts before the ones written
+	if err = syncer.Sync(rotate(3, "mysql-bin.000001")); err == nil {
+		t.Error("expect the binlog not after the ones written refused")
+	}
+	if err = syncer.Sync(rowsTrx(300, 30, event.WRITE_ROWS_EVENT_V2)[0]); err == nil {
+		t.Error("expect nothing written after the binlog refused")
+	}
+
+	loaded, err := NewJsonSyncerFromDir(dir, "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, end := loaded.Bounds(); end != 12 || loaded.CurPos != (binlog.Pos{FileName: "mysql-bin.000005", Pos: 800}) {
+		t.Errorf("unexpect %d events loaded, continue from %v", end, loaded.CurPos)
+	}
+}
@@ -0,0 +1,84 @@
+/**
+ *  author: lim
+ *  data  : 18-8-6 下午10:12
+ */
+
+package syncer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	chanDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "go_canal",
+		Subsystem: "syncer",
+		Name:      "channel_depth",
+		Help:      "Transactions waiting in the channel from the listener.",
+	}, []string{"source"})
+
+	writeLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "go_canal",
+		Subsystem: "syncer",
+		Name:      "write_seconds",
+		Help:      "Latency of writing one event to storage.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"source"})
+
+	fsyncLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "go_canal",
+		Subsystem: "syncer",
+		Name:      "fsync_seconds",
+		Help:      "Latency of fsync the json file by the sync policy.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"source"})
+
+	writeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "syncer",
+		Name:      "write_errors_total",
+		Help:      "Events failed to write to storage.",
+	}, []string{"source"})
+
+	segmentReads = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "go_canal",
+		Subsystem: "syncer",
+		Name:      "segment_read_seconds",
+		Help:      "Latency of reading a sealed segment not cached.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"source"})
+
+	purgedSegments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "syncer",
+		Name:      "purged_segments_total",
+		Help:      "Segments removed by the retention.",
+	}, []string{"source"})
+
+	archiveUploads = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "go_canal",
+		Subsystem: "syncer",
+		Name:      "archive_upload_seconds",
+		Help:      "Latency of uploading a sealed segment to the archive.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+	}, []string{"source"})
+
+	archiveErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "syncer",
+		Name:      "archive_errors_total",
+		Help:      "Segments failed to upload to the archive.",
+	}, []string{"source"})
+
+	archiveFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_canal",
+		Subsystem: "syncer",
+		Name:      "archive_fetches_total",
+		Help:      "Segments downloaded from the archive for the events purged locally.",
+	}, []string{"source"})
+)
+
+func init() {
+	prometheus.MustRegister(chanDepth, writeLatency, fsyncLatency, writeErrors, segmentReads, purgedSegments,
+		archiveUploads, archiveErrors, archiveFetches)
+}
@@ -0,0 +1,153 @@
+/**
+ *  author: lim
+ *  data  : 18-8-20 下午8:30
+ */
+
+package syncer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/log"
+)
+
+// formats of the files stored, a file keeps the format it's created with
+const (
+	FORMAT_JSON   = "json"   // a json array of JsonEntry, readable after closed
+	FORMAT_NDJSON = "ndjson" // one ndjsonRecord per line, readable while written
+)
+
+func checkFormat(format string) error {
+	switch format {
+	case FORMAT_JSON, FORMAT_NDJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown storage format: %s, must be one of %s/%s", format, FORMAT_JSON, FORMAT_NDJSON)
+}
+
+// SetFormat of the files created from now on, default FORMAT_JSON
+func (syncer *JsonSyncer) SetFormat(format string) error {
+	if err := checkFormat(format); err != nil {
+		return errors.Trace(err)
+	}
+	syncer.format = format
+	return nil
+}
+
+// ndjsonRecord is a line of FORMAT_NDJSON file, Len and Crc are of Event
+type ndjsonRecord struct {
+	Len   int             `json:"len"`
+	Crc   uint32          `json:"crc"`
+	File  string          `json:"file"`
+	Pos   uint32          `json:"pos"`
+	Name  string          `json:"name"`
+	Type  uint8           `json:"type"`
+	Event json.RawMessage `json:"event"`
+}
+
+func encodeRecord(file string, pos uint32, eveType uint8, encoded []byte) ([]byte, error) {
+	record := &ndjsonRecord{
+		Len:   len(encoded),
+		Crc:   crc32.ChecksumIEEE(encoded),
+		File:  file,
+		Pos:   pos,
+		Name:  event.EventName[eveType],
+		Type:  eveType,
+		Event: encoded,
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return append(data, '\n'), nil
+}
+
+// decodeRecord check the framing of a line and return the entry it carries
+func decodeRecord(line []byte) (JsonEntry, error) {
+	record := &ndjsonRecord{}
+	if err := json.Unmarshal(line, record); err != nil {
+		return JsonEntry{}, errors.Trace(err)
+	}
+	if len(record.Event) != record.Len {
+		return JsonEntry{}, errors.Errorf("length %d mismatch, expect %d", len(record.Event), record.Len)
+	}
+	if crc := crc32.ChecksumIEEE(record.Event); crc != record.Crc {
+		return JsonEntry{}, errors.Errorf("crc %d mismatch, expect %d", crc, record.Crc)
+	}
+	return JsonEntry{EventName: record.Name, EventType: record.Type, Encoded: record.Event}, nil
+}
+
+// detectFormat by the first byte, "" if the file is empty, nothing consumed from r
+func detectFormat(r *bufio.Reader) (string, error) {
+	for n := 1; ; n++ {
+		buf, err := r.Peek(n)
+		if err == io.EOF {
+			return "", nil
+		} else if err != nil {
+			return "", errors.Trace(err)
+		}
+		switch buf[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return FORMAT_NDJSON, nil
+		}
+		return FORMAT_JSON, nil
+	}
+}
+
+// loadNdjsonFile read the records line by line from offset, stop at the first broken one,
+// a line without '\n' is a record half written
+func loadNdjsonFile(path string, reader *bufio.Reader, offset int64) (*jsonFile, error) {
+	loaded := &jsonFile{events: []event.Event{}, offsets: []int64{}, format: FORMAT_NDJSON}
+
+	state := &trxState{}
+	decoder := event.NewDecoder()
+	pending := 0 // events after the last complete transaction
+	broken := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			broken = len(line) != 0
+			if broken {
+				log.Errorf("%s broken at %d: record without line end", path, offset)
+			}
+			break
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		entry, err := decodeRecord(line)
+		if err != nil {
+			log.Errorf("%s broken at %d: %v", path, offset, err)
+			broken = true
+			break
+		}
+		eve, err := decodeEntry(decoder, entry)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		loaded.events = append(loaded.events, eve)
+		loaded.offsets = append(loaded.offsets, offset)
+		offset += int64(len(line))
+		pending++
+		state.update(eve)
+		if !state.inTrx {
+			loaded.size = offset
+			pending = 0
+		}
+	}
+
+	// no terminator, it's complete if nothing broken or left in a transaction
+	loaded.complete = !broken && pending == 0
+	loaded.events = loaded.events[:len(loaded.events)-pending]
+	loaded.offsets = loaded.offsets[:len(loaded.events)]
+	loaded.dropped = pending
+	return loaded, nil
+}
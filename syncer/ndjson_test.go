@@ -0,0 +1,163 @@
+/**
+ *  author: lim
+ *  data  : 18-8-20 下午9:10
+ */
+
+package syncer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+)
+
+func fakeRotate(pos uint64, next string) *event.RotateEvent {
+	return &event.RotateEvent{Header: &event.EveHeader{EveType: event.ROTATE_EVENT, SvrId: 1}, Pos: pos, NextBinlog: next}
+}
+
+func TestNdjsonAfterJsonFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	events := []event.Event{fakeRotate(4, "mysql-bin.000001")}
+	events = append(events, trxEvents(200)...)
+	events = append(events, &event.RotateEvent{Header: header(event.ROTATE_EVENT, 400), Pos: 4, NextBinlog: "mysql-bin.000002"})
+	for _, eve := range events {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// files created from now on are ndjson, the json ones are still loaded
+	if err = syncer.SetFormat("yaml"); err == nil {
+		t.Error("unknown format should fail")
+	}
+	if err = syncer.SetFormat(FORMAT_NDJSON); err != nil {
+		t.Fatal(err)
+	}
+	events = []event.Event{fakeRotate(4, "mysql-bin.000002")}
+	events = append(events, trxEvents(200)...)
+	// crash in the middle of the second transaction
+	events = append(events, trxEvents(400)[:2]...)
+	for _, eve := range events {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = syncer.writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	syncer.curFile.Close()
+
+	// every line is a record readable by itself
+	path := dir + "/mysql-bin.000002"
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lines := 0
+	for ; scanner.Scan(); lines++ {
+		record := &ndjsonRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil || record.File != "mysql-bin.000002" {
+			t.Fatalf("unexpect record %s: %v", scanner.Text(), err)
+		}
+	}
+	if lines != 7 {
+		t.Fatalf("expect 7 records, got %d", lines)
+	}
+
+	// a record half written
+	if err = ioutil.WriteFile(path, append(data, []byte(`{"len":12,"crc":`)...), 0664); err != nil {
+		t.Fatal(err)
+	}
+	loaded := mustLoad(t, dir)
+	if n := loaded.streamer.count(); n != 11 {
+		t.Errorf("expect 11 events kept, got %d", n)
+	}
+	if loaded.CurPos != (binlog.Pos{FileName: "mysql-bin.000002", Pos: 350}) {
+		t.Errorf("should resume from the end of the first transaction: %v", loaded.CurPos)
+	}
+
+	// appended after the last complete transaction
+	resumed := []event.Event{fakeRotate(350, "mysql-bin.000002")}
+	resumed = append(resumed, trxEvents(400)...)
+	for _, eve := range resumed {
+		if err = loaded.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = loaded.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mustLoad(t, dir).streamer.count(); n != 15 {
+		t.Errorf("expect 15 events after resumed, got %d", n)
+	}
+}
+
+func TestNdjsonAfterEmptyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// crashed before anything written
+	for _, c := range [][2]string{{"mysql-bin.000001", ""}, {"mysql-bin.000002", "\n "}} {
+		name := c[0]
+		if err = ioutil.WriteFile(dir+"/"+name, []byte(c[1]), 0664); err != nil {
+			t.Fatal(err)
+		}
+		loaded := mustLoad(t, dir)
+		if err = loaded.SetFormat(FORMAT_NDJSON); err != nil {
+			t.Fatal(err)
+		}
+		events := append([]event.Event{fakeRotate(4, name)}, trxEvents(200)...)
+		for _, eve := range events {
+			if err = loaded.Sync(eve); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = loaded.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format, err := detectFormat(bufio.NewReader(bytes.NewReader(data))); err != nil || format != FORMAT_NDJSON {
+			t.Errorf("%s should be written in the format configured, got %q: %v", name, format, err)
+		}
+	}
+	if n := mustLoad(t, dir).streamer.count(); n != 10 {
+		t.Errorf("expect 10 events written, got %d", n)
+	}
+}
+
+func TestNdjsonCorruptedRecord(t *testing.T) {
+	line, err := encodeRecord("mysql-bin.000001", 350, event.XID_EVENT, []byte(`{"Xid":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decodeRecord(line); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decodeRecord(bytes.Replace(line, []byte(`"Xid":1`), []byte(`"Xid":2`), 1)); err == nil {
+		t.Error("crc mismatch should fail")
+	}
+	if _, err = decodeRecord(bytes.Replace(line, []byte(`"Xid":1`), []byte(`"Xid":10`), 1)); err == nil {
+		t.Error("length mismatch should fail")
+	}
+}
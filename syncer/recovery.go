@@ -0,0 +1,184 @@
+/**
+ *  author: lim
+ *  data  : 18-8-18 下午8:30
+ */
+
+package syncer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/log"
+)
+
+// jsonFile is the events loaded from a json file, a file not complete is cut
+// at the end of its last complete transaction
+type jsonFile struct {
+	format   string
+	events   []event.Event
+	offsets  []int64 // size of the file before the event written, see timePos
+	complete bool    // the json array is terminated, or no record broken and no transaction left open
+	size     int64   // bytes of the events kept, without terminator
+	dropped  int     // entries of the incomplete transaction dropped
+}
+
+// trxState tells whether the events read so far end with a complete transaction
+type trxState struct {
+	inTrx bool
+	begun bool // BEGIN query read, the transaction ends with COMMIT or XID
+}
+
+func (state *trxState) update(eve event.Event) {
+	switch e := eve.(type) {
+	case *event.GtidEvent, *event.MariadbGtidEvent:
+		state.inTrx, state.begun = true, false
+	case *event.XidEvnet:
+		state.inTrx, state.begun = false, false
+	case *event.QueryEvent:
+		query := strings.ToUpper(strings.TrimSpace(e.Query))
+		switch {
+		case query == "BEGIN":
+			state.inTrx, state.begun = true, true
+		case query == "COMMIT" || !state.begun:
+			// ddl ends its own transaction
+			state.inTrx, state.begun = false, false
+		}
+	}
+}
+
+// loadJsonFile decode the entries of path one by one, a crash may leave the file
+// without terminator or with an entry half written, compressed ones are decompressed
+func loadJsonFile(path string) (*jsonFile, error) {
+	return loadJsonFileAt(path, 0)
+}
+
+// loadJsonFileAt decode the entries of path from offset, an offset of an event indexed
+func loadJsonFileAt(path string, offset int64) (*jsonFile, error) {
+	r, err := openSegmentAt(path, offset)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close()
+
+	format, err := detectFormat(r.Reader)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch format {
+	case FORMAT_NDJSON:
+		return loadNdjsonFile(path, r.Reader, offset)
+	case "":
+		// nothing written, recovered as an empty file written in the format configured
+		return &jsonFile{events: []event.Event{}, offsets: []int64{}}, nil
+	}
+
+	// offset of the stream decoded in the file
+	var in io.Reader = r
+	shift := int64(0)
+	if offset != 0 {
+		// at the separator before the entry, decoded as the rest of the array
+		skipped, err := skipSeparator(r.Reader)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s has no entry at %d", path, offset)
+		}
+		in = io.MultiReader(strings.NewReader("["), r)
+		shift = offset + skipped - 1
+	}
+
+	loaded := &jsonFile{events: []event.Event{}, offsets: []int64{}, format: FORMAT_JSON}
+	dec := json.NewDecoder(in)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		// empty or even "[" not written
+		log.Errorf("%s has no json array: %v", path, err)
+		return loaded, nil
+	}
+
+	state := &trxState{}
+	decoder := event.NewDecoder()
+	pending := 0 // events after the last complete transaction
+	for dec.More() {
+		// the entry written after the separator
+		at := shift + dec.InputOffset()
+		if len(loaded.events) == 0 {
+			at = offset
+		}
+		entry := JsonEntry{}
+		if err = dec.Decode(&entry); err != nil {
+			log.Errorf("%s broken at %d: %v", path, dec.InputOffset(), err)
+			break
+		}
+		eve, err := decodeEntry(decoder, entry)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		loaded.events = append(loaded.events, eve)
+		loaded.offsets = append(loaded.offsets, at)
+		pending++
+		state.update(eve)
+		if !state.inTrx {
+			loaded.size = dec.InputOffset()
+			pending = 0
+		}
+	}
+
+	if err == nil {
+		if tok, err := dec.Token(); err == nil && tok == json.Delim(']') {
+			loaded.complete = true
+			return loaded, nil
+		}
+	}
+	loaded.events = loaded.events[:len(loaded.events)-pending]
+	loaded.offsets = loaded.offsets[:len(loaded.events)]
+	loaded.dropped = pending
+	return loaded, nil
+}
+
+// skipSeparator the ',' and blanks before an entry of the json array, return the bytes skipped
+func skipSeparator(r *bufio.Reader) (int64, error) {
+	for n := int64(1); ; n++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return n, errors.Trace(err)
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case ',':
+			return n, nil
+		}
+		return n, errors.Errorf("unexpect %q before entry", b)
+	}
+}
+
+// recover cut the file at the end of its last complete transaction and terminate it,
+// so it's resumed as a graceful stopped one
+func (loaded *jsonFile) recover(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0664)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	size, terminator := loaded.size, "\n]"
+	if len(loaded.events) == 0 {
+		size, terminator = 0, "[]"
+	}
+	if loaded.format != FORMAT_JSON {
+		// appended as it is, or the format unknown of an empty file
+		terminator = ""
+	}
+	if err = f.Truncate(size); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = f.WriteAt([]byte(terminator), size); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Sync())
+}
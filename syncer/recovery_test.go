@@ -0,0 +1,146 @@
+/**
+ *  author: lim
+ *  data  : 18-8-18 下午9:40
+ */
+
+package syncer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+)
+
+func header(eveType uint8, pos uint32) *event.EveHeader {
+	return &event.EveHeader{Ts: 1, EveType: eveType, SvrId: 1, LogPos: pos}
+}
+
+func trxEvents(start uint32) []event.Event {
+	return []event.Event{
+		&event.GtidEvent{Header: header(event.GTID_LOG_EVENT, start)},
+		&event.QueryEvent{Header: header(event.QUERY_EVENT, start+50), Query: "BEGIN"},
+		&event.TableMapEvent{Header: header(event.TABLE_MAP_EVENT, start+100), FullName: "test.t"},
+		&event.XidEvnet{Header: header(event.XID_EVENT, start+150)},
+	}
+}
+
+func TestRecoverIncompleteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/mysql-bin.000001"
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	events := []event.Event{
+		&event.RotateEvent{Header: &event.EveHeader{EveType: event.ROTATE_EVENT, SvrId: 1}, Pos: 4, NextBinlog: "mysql-bin.000001"},
+		&event.QueryEvent{Header: header(event.QUERY_EVENT, 150), Query: "create table t (id int)"},
+	}
+	events = append(events, trxEvents(200)...)
+	// crash in the middle of the second transaction
+	events = append(events, trxEvents(400)[:3]...)
+	for _, eve := range events {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the buffered events reach the file before crash
+	if err = syncer.writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syncer.curFile.WriteString(",\n\n\t{\"EventName\": \"XID_"); err != nil {
+		t.Fatal(err)
+	}
+	syncer.curFile.Close()
+
+	loaded := mustLoad(t, dir)
+	if n := loaded.streamer.count(); n != 6 {
+		t.Errorf("expect 6 events kept, got %d", n)
+	}
+	if loaded.CurPos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 350}) {
+		t.Errorf("should resume from the end of the first transaction: %v", loaded.CurPos)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []JsonEntry{}
+	if err = json.Unmarshal(data, &entries); err != nil || len(entries) != 6 {
+		t.Fatalf("file should be truncated and terminated: %d entries, %v", len(entries), err)
+	}
+
+	// the listener dump again from the position resumed
+	resumed := []event.Event{&event.RotateEvent{Header: &event.EveHeader{EveType: event.ROTATE_EVENT, SvrId: 1}, Pos: 350, NextBinlog: "mysql-bin.000001"}}
+	resumed = append(resumed, trxEvents(400)...)
+	for _, eve := range resumed {
+		if err = loaded.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = loaded.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mustLoad(t, dir).streamer.count(); n != 10 {
+		t.Errorf("expect 10 events after resumed, got %d", n)
+	}
+}
+
+func TestRecoverFileWithoutCompleteEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(dir+"/mysql-bin.000002", []byte("[\n\t{\"EventName\""), 0664); err != nil {
+		t.Fatal(err)
+	}
+	loaded := mustLoad(t, dir)
+	if loaded.streamer.count() != 0 || loaded.CurPos != (binlog.Pos{FileName: "mysql-bin.000002", Pos: 4}) {
+		t.Errorf("unexpect resume: %d events, %v", loaded.streamer.count(), loaded.CurPos)
+	}
+
+	// broken file followed by others is not the one crashed while writing
+	if err = ioutil.WriteFile(dir+"/mysql-bin.000001", []byte("[\n\t{"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewJsonSyncerFromDir(dir, "mysql-bin.000001"); err == nil {
+		t.Error("broken file not the last should fail")
+	}
+}
+
+func TestRollbackFailedTrx(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	events := append([]event.Event{fakeRotate(4, "mysql-bin.000001")}, trxEvents(200)...)
+	if err = syncer.handle(event.NewTransaction("mysql-bin.000001", events)); err != nil {
+		t.Fatal(err)
+	}
+
+	// failed after the first events of the transaction written
+	broken := &event.Transaction{Events: append(trxEvents(400)[:3], &event.XidEvnet{})}
+	if err = syncer.handle(broken); err == nil {
+		t.Fatal("expect the transaction failed")
+	}
+	if syncer.curFile != nil {
+		t.Error("nothing should be written after the transaction failed")
+	}
+
+	loaded := mustLoad(t, dir)
+	if n := loaded.streamer.count(); n != 5 || loaded.CurPos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 350}) {
+		t.Errorf("expect rolled back to the first transaction, got %d events, continue from %v", n, loaded.CurPos)
+	}
+}
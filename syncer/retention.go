@@ -0,0 +1,194 @@
+/**
+ *  author: lim
+ *  data  : 18-8-21 下午9:30
+ */
+
+package syncer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/log"
+)
+
+const (
+	// gtids of the transactions purged, so the executed ones are still known after restart
+	purgedGtidsFile = ".gtid_purged"
+
+	// how often the retention is checked while no segment closed
+	maintainInterval = time.Minute
+)
+
+// ErrPurged a request reaches the events already purged by the retention
+var ErrPurged = errors.New("binlog needed already purged")
+
+// SetRetention purge the oldest closed segments while the segments take more than
+// maxSize bytes or were closed before maxAge, at least minFiles segments kept, 0 unlimited
+func (syncer *JsonSyncer) SetRetention(maxSize int64, maxAge time.Duration, minFiles int) {
+	syncer.maxSize, syncer.maxAge, syncer.minFiles = maxSize, maxAge, minFiles
+}
+
+// maintain rotate current segment by age and apply the retention, for the idle time
+func (syncer *JsonSyncer) maintain() error {
+	if syncer.store != nil {
+		return errors.Trace(syncer.expire())
+	}
+	if err := syncer.rotateSegment(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(syncer.purge())
+}
+
+// purge the oldest segments beyond the retention, with their events in memory
+func (syncer *JsonSyncer) purge() error {
+	if syncer.maxSize <= 0 && syncer.maxAge <= 0 {
+		return nil
+	}
+	if syncer.archive != nil {
+		// kept in the archive instead
+		return errors.Trace(syncer.purgeLocal())
+	}
+
+	total := int64(0)
+	for idx, seg := range syncer.streamer.files {
+		if idx == len(syncer.streamer.files)-1 && syncer.curFile != nil {
+			// still written
+			seg.size = syncer.written
+		}
+		total += seg.size
+	}
+
+	n := 0
+	for ; n < len(syncer.streamer.files)-1 && len(syncer.streamer.files)-n > syncer.minFiles; n++ {
+		seg := syncer.streamer.files[n]
+		oversize := syncer.maxSize > 0 && total > syncer.maxSize
+		expired := syncer.maxAge > 0 && time.Since(seg.modTime) > syncer.maxAge
+		if !seg.sealed || !oversize && !expired {
+			break
+		}
+		total -= seg.size
+	}
+	return errors.Trace(syncer.purgeSegments(n))
+}
+
+// purgeSegments the first n segments, with their events in memory
+func (syncer *JsonSyncer) purgeSegments(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	// record the gtids before the files removed
+	gtids := make(event.GtidSet)
+	for _, seg := range syncer.streamer.files[:n] {
+		gtids.Merge(seg.gtids)
+	}
+	if err := syncer.addPurgedGtids(gtids); err != nil {
+		return errors.Trace(err)
+	}
+	if err := syncer.unarchive(syncer.streamer.files[:n]); err != nil {
+		return errors.Trace(err)
+	}
+	for _, seg := range syncer.streamer.files[:n] {
+		log.Debugf("purge %s: %d bytes, modified at %s", seg.path(), seg.size, seg.modTime)
+		if err := os.Remove(syncer.dir + seg.path()); err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		if err := os.Remove(syncer.dir + seg.indexPath()); err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+	}
+
+	streamer := syncer.streamer
+	streamer.Lock()
+	end := streamer.files[n].start
+	streamer.files = append(streamer.files[:0], streamer.files[n:]...)
+	streamer.base = end
+	streamer.Unlock()
+	streamer.cache.drop(end)
+	syncer.index.purge(end)
+	syncer.times.purge(end)
+	purgedSegments.WithLabelValues(syncer.Source).Add(float64(n))
+	return nil
+}
+
+func (syncer *JsonSyncer) addPurgedGtids(set event.GtidSet) error {
+	if syncer.purged == nil {
+		syncer.purged = make(event.GtidSet)
+	}
+	syncer.purged.Merge(set)
+
+	path := syncer.dir + purgedGtidsFile
+	if err := ioutil.WriteFile(path+tmpExt, []byte(syncer.purged.String()), 0664); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(path+tmpExt, path))
+}
+
+// expire the events of the storage older than maxAge, the other limits are of the json files
+func (syncer *JsonSyncer) expire() error {
+	if syncer.maxAge <= 0 {
+		return nil
+	}
+	// in the time of the events
+	expired := event.EventTime(uint32(time.Now().Add(-syncer.maxAge).Unix()))
+	idx, _, ok, err := syncer.store.SeekTime(expired)
+	if err != nil || !ok {
+		return errors.Trace(err)
+	}
+	if start, _ := syncer.store.Bounds(); idx == start {
+		return nil
+	}
+	if err = syncer.store.Purge(idx); err != nil {
+		return errors.Trace(err)
+	}
+	start, _ := syncer.store.Bounds()
+	syncer.index.purge(start)
+	return nil
+}
+
+// loadPurgedGtids of the segments purged before, empty if nothing purged
+func loadPurgedGtids(dir string) (event.GtidSet, error) {
+	data, err := ioutil.ReadFile(dir + purgedGtidsFile)
+	if os.IsNotExist(err) {
+		return make(event.GtidSet), nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if gtids := strings.TrimSpace(string(data)); len(gtids) != 0 {
+		return event.ParseGtidSet(gtids)
+	}
+	return make(event.GtidSet), nil
+}
+
+// gtidsOf the mysql gtid set of the transactions in events
+func gtidsOf(events []event.Event) (event.GtidSet, error) {
+	executed := make(event.GtidSet)
+	for _, eve := range events {
+		var gtids string
+		switch e := eve.(type) {
+		case *event.PreGtidLogEvent:
+			gtids = e.Gtids
+		case *event.GtidEvent:
+			gtids = e.Gtid
+		}
+		if len(gtids) == 0 {
+			continue
+		}
+
+		set, err := event.ParseGtidSet(gtids)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		executed.Merge(set)
+	}
+	return executed, nil
+}
+
+func purgedError(ts time.Time) error {
+	return errors.Annotatef(ErrPurged, "events before %s not retained", ts)
+}
@@ -9,9 +9,11 @@ import (
 	"database/sql"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
 	"github.com/lemonwx/go-canal/event"
 	"github.com/lemonwx/log"
 )
@@ -41,26 +43,256 @@ func (arg *RollbackArg) String() string {
 	return fmt.Sprintf("schema: %s table: %s %v", arg.Schema, arg.Table, arg.Fields)
 }
 
+// Get the events changed the row identified by the key of the table in [arg.Ts, arg.Te],
+// oldest first, the latest transaction matched arg if not looked up by the key
 func (syncer *JsonSyncer) Get(arg *RollbackArg) ([]event.Event, error) {
-	startIdx := len(syncer.streamer.Events) - 1
-	startEve := syncer.streamer.Events[startIdx]
+	_, events, err := syncer.versions(arg)
+	return events, err
+}
+
+// Changes the rows changed by the events Get returns, keyed by the column names
+func (syncer *JsonSyncer) Changes(arg *RollbackArg) ([]*event.RowChange, error) {
+	idxs, events, err := syncer.versions(arg)
+	if err != nil {
+		return nil, err
+	}
+	changes := []*event.RowChange{}
+	for i, eve := range events {
+		if re, ok := eve.(*event.RowsEvent); ok {
+			rows, err := syncer.rowChanges(idxs[i], re)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			changes = append(changes, rows...)
+		}
+	}
+	return changes, nil
+}
+
+// versions the events Get returns, and their indexes
+func (syncer *JsonSyncer) versions(arg *RollbackArg) ([]int, []event.Event, error) {
+	idxs, ok, err := syncer.versionsOf(arg)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if !ok {
+		trx, idxs, err := syncer.scan(arg)
+		if err != nil || trx == nil {
+			return nil, nil, err
+		}
+		return idxs, trx.Events, nil
+	}
+
+	if err := syncer.checkRetained(arg.Ts); err != nil {
+		return nil, nil, err
+	}
+	events := make([]event.Event, 0, len(idxs))
+	for _, idx := range idxs {
+		eve, err := syncer.stored(idx)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		events = append(events, eve)
+	}
+	return idxs, events, nil
+}
+
+// rowChanges of the RowsEvent at idx, by the definition of its table then
+func (syncer *JsonSyncer) rowChanges(idx int, re *event.RowsEvent) ([]*event.RowChange, error) {
+	if re.Table == nil {
+		return nil, errors.Errorf("rows event %d without table map event", idx)
+	}
+	schema, table := string(re.Table.Schema), string(re.Table.Table)
+	var cols []event.ColumnDef
+	var keys []event.KeyDef
+	if schemaEve := syncer.schemas.At(schema, table, idx); schemaEve != nil {
+		cols, keys = schemaEve.Columns, schemaEve.Keys
+	} else if tb, ok := syncer.snapshot[historyKey(schema, table)]; ok {
+		cols, keys = tb.Columns, tb.Keys
+	} else {
+		return nil, errors.Errorf("no definition of %s.%s tracked for event %d", schema, table, idx)
+	}
+
+	gtid, err := syncer.gtidOf(idx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	file := ""
+	if syncer.store == nil {
+		syncer.streamer.RLock()
+		file = syncer.fileOf(idx)
+		syncer.streamer.RUnlock()
+	}
+	return event.NewRowChanges(re, cols, keys, gtid, file)
+}
+
+// gtidOf the transaction the event at idx belongs to, empty if gtid mode off
+func (syncer *JsonSyncer) gtidOf(idx int) (string, error) {
+	base, _ := syncer.storage().Bounds()
+	for start := idx; idx >= base; idx-- {
+		eve, err := syncer.stored(idx)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		switch e := eve.(type) {
+		case *event.GtidEvent:
+			return e.Gtid, nil
+		case *event.MariadbGtidEvent:
+			return e.Gtid.String(), nil
+		}
+		if idx < start && event.CommitsTransaction(eve) {
+			// the end of the transaction before
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// checkRetained the events from ts not purged yet
+func (syncer *JsonSyncer) checkRetained(ts time.Time) error {
+	if start, end := syncer.storage().Bounds(); start == 0 || start == end {
+		return nil
+	}
+	first, err := syncer.firstTime()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if ts.Before(first) {
+		return purgedError(first)
+	}
+	return nil
+}
+
+// trxOf the transaction the event at idx belongs to, and the indexes of its events,
+// from its gtid event or BEGIN to its xid event or COMMIT, or a ddl alone
+func (syncer *JsonSyncer) trxOf(idx int) (*event.Transaction, []int, error) {
+	base, _ := syncer.storage().Bounds()
+	start := idx
+	for ; start >= base; start-- {
+		eve, err := syncer.stored(start)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if event.BeginsTransaction(eve) {
+			break
+		}
+		if start < idx && event.CommitsTransaction(eve) {
+			// the end of the transaction before
+			start++
+			break
+		}
+	}
+	if start < base {
+		return nil, nil, fmt.Errorf("transaction of the event at %d not complete", idx)
+	}
+	if start > base {
+		// the gtid event before BEGIN
+		eve, err := syncer.stored(start - 1)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		switch eve.(type) {
+		case *event.GtidEvent, *event.MariadbGtidEvent:
+			start--
+		}
+	}
+	return syncer.trxFrom(start, idx)
+}
+
+// trxFrom read the transactions from start until the one idx belongs to complete
+func (syncer *JsonSyncer) trxFrom(start, idx int) (*event.Transaction, []int, error) {
+	_, last := syncer.storage().Bounds()
+	trx := syncer.transaction(start, nil)
+	idxs := []int{}
+	for i := start; ; i++ {
+		if trx.Complete() {
+			if i > idx {
+				return trx, idxs, nil
+			}
+			// the ddl committed implicitly before idx
+			trx, idxs = syncer.transaction(i, nil), idxs[:0]
+		}
+		if i >= last {
+			return nil, nil, fmt.Errorf("transaction of the event at %d not complete", idx)
+		}
+		eve, err := syncer.stored(i)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		trx.Add(eve)
+		idxs = append(idxs, i)
+	}
+}
+
+// transaction of the events stored from start
+func (syncer *JsonSyncer) transaction(start int, events []event.Event) *event.Transaction {
+	file := ""
+	if syncer.store == nil {
+		syncer.streamer.RLock()
+		file = syncer.fileOf(start)
+		syncer.streamer.RUnlock()
+	}
+	return event.NewTransaction(file, events)
+}
+
+// scan the latest transaction matches arg, and the indexes of its events, nil if none matched
+func (syncer *JsonSyncer) scan(arg *RollbackArg) (*event.Transaction, []int, error) {
+	base, end := syncer.storage().Bounds()
+	if base == end {
+		return nil, nil, fmt.Errorf("no binlog synced")
+	}
+
+	startEve, err := syncer.stored(end - 1)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
 	startEveTs := event.GetEventTime(startEve)
 	log.Debugf("now sync to %s", startEveTs)
 
 	if startEveTs.Before(arg.Te) {
-		return nil, fmt.Errorf("startEvt's time: %s before than arg.Te: %s, "+
+		return nil, nil, fmt.Errorf("startEvt's time: %s before than arg.Te: %s, "+
 			"has not sync the binlog needed by this command", startEveTs, arg.Te)
 	}
 
-	log.Debugf("start: %s", event.GetEventTime(syncer.streamer.Events[startIdx]))
-	log.Debugf("end  : %s", event.GetEventTime(syncer.streamer.Events[1]))
+	firstTs, err := syncer.firstTime()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	log.Debugf("start: %s", startEveTs)
+	log.Debugf("end  : %s", firstTs)
+
+	if key, ok := syncer.rowKeyOf(arg); ok {
+		// the latest version of the row by the index, from the first event of its transaction
+		idxs, err := syncer.index.between(key, timestamp(arg.Ts), timestamp(arg.Te))
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if len(idxs) == 0 {
+			return nil, nil, syncer.checkRetained(arg.Ts)
+		}
+		latest := idxs[len(idxs)-1]
+		begin, ok, err := syncer.index.beginOf(key, latest)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if ok && begin >= base {
+			return syncer.trxFrom(begin, latest)
+		}
+		return syncer.trxOf(latest)
+	}
 
-	events := make([]event.Event, 0, 10)
-	getTrx := false
 	v := arg.Fields[0]
 
-	for idx := startIdx; idx >= 0; idx -= 1 {
-		eve := syncer.streamer.Events[idx]
+	// the events after arg.Te not read
+	last, err := syncer.lastBefore(timestamp(arg.Te))
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	for idx := last; idx >= base; idx -= 1 {
+		eve, err := syncer.stored(idx)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
 		curTs := event.GetEventTime(eve)
 
 		if curTs.After(arg.Te) {
@@ -68,34 +300,95 @@ func (syncer *JsonSyncer) Get(arg *RollbackArg) ([]event.Event, error) {
 		}
 
 		if curTs.Before(arg.Ts) {
-			log.Debugf("get %d events, scan finish !!!", len(events))
-			return events, nil
+			if curTs.Add(skewWindow * time.Second).Before(arg.Ts) {
+				log.Debugf("scan to %d, none matched, scan finish !!!", idx)
+				return nil, nil, nil
+			}
+			// the ones before may be in range if the timestamps went back
+			continue
 		}
 
 		if e, ok := eve.(*event.RowsEvent); ok {
 			if string(e.Table.Table) == arg.Table && string(e.Table.Schema) == arg.Schema {
+				// the column of the definition in effect when the event written
+				cols, _, err := syncer.columnsAt(arg.Schema, arg.Table, idx)
+				if err != nil {
+					return nil, nil, err
+				}
+				col := fieldIdx(cols, v.Name)
+				if col < 0 {
+					return nil, nil, fmt.Errorf("column %s not found in %s.%s", v.Name, arg.Schema, arg.Table)
+				}
 				for _, row := range e.Rows {
-					if strconv.FormatUint(row[0].(uint64), 10) == v.Val {
-						getTrx = true
+					if formatVal(row[col]) == v.Val {
+						// the whole transaction, by its boundaries
+						log.Debugf("get the rows event matched at %d, scan finish", idx)
+						return syncer.trxOf(idx)
 					}
 				}
 			}
 		}
-		events = append(events, eve)
+	}
 
-		if _, ok := eve.(*event.GtidEvent); ok {
-			if getTrx {
-				log.Debug("get trx and get gtid event finish, break")
-				break
-			} else {
-				// now grep an complete trx, but any row equal with args,
-				//     so clear the slice and expect next trx will be matched
-				log.Debugf("scan an complete trx, but rows not equal, so clear and continue")
-				events = events[:0]
-			}
+	if base > 0 {
+		// the events before arg.Ts may be in the segments purged
+		return nil, nil, purgedError(firstTs)
+	}
+	return nil, nil, nil
+}
+
+// fieldIdx of name in cols, -1 if not found
+func fieldIdx(cols []event.ColumnDef, name string) int {
+	for idx, col := range cols {
+		if strings.EqualFold(col.Name, name) {
+			return idx
 		}
 	}
-	return events, nil
+	return -1
+}
+
+// formatVal format the value of a row to compare with the arg,
+// numbers loaded from json files are float64
+func formatVal(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "NULL"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// columnsAt the columns and the row key of the table when the event at idx written,
+// the ones in meta snapshot or from master if no definition stored
+func (syncer *JsonSyncer) columnsAt(schema, table string, idx int) ([]event.ColumnDef, []string, error) {
+	if cols, key, ok := syncer.localColumns(schema, table, idx); ok {
+		return cols, key, nil
+	}
+
+	cols, err := syncer.getColumns(schema, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := syncer.getRowKey(schema, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cols, key, nil
+}
+
+// localColumns the same as columnsAt, without asking master
+func (syncer *JsonSyncer) localColumns(schema, table string, idx int) ([]event.ColumnDef, []string, bool) {
+	if schemaEve := syncer.schemas.At(schema, table, idx); schemaEve != nil {
+		return schemaEve.Columns, event.RowKey(schemaEve.Keys), true
+	}
+	if tb, ok := syncer.snapshot[historyKey(schema, table)]; ok {
+		return tb.Columns, event.RowKey(tb.Keys), true
+	}
+	return nil, nil, false
 }
 
 func (syncer *JsonSyncer) initDB() error {
@@ -108,7 +401,8 @@ func (syncer *JsonSyncer) initDB() error {
 	return nil
 }
 
-func (syncer *JsonSyncer) getFieldName(schema, table string) ([]string, error) {
+// getColumns the names and types of the columns from master
+func (syncer *JsonSyncer) getColumns(schema, table string) ([]event.ColumnDef, error) {
 	if db == nil {
 		err := syncer.initDB()
 		if err != nil {
@@ -116,16 +410,16 @@ func (syncer *JsonSyncer) getFieldName(schema, table string) ([]string, error) {
 		}
 	}
 
-	rows, err := db.Query("select column_name from information_schema.columns where "+
-		"table_schema=? and table_name=?", schema, table)
+	rows, err := db.Query("select column_name, column_type from information_schema.columns where "+
+		"table_schema=? and table_name=? order by ordinal_position", schema, table)
 	if err != nil {
 		return nil, err
 	}
 
-	cols := make([]string, 0, 8)
+	cols := make([]event.ColumnDef, 0, 8)
 	for rows.Next() {
-		col := ""
-		err := rows.Scan(&col)
+		col := event.ColumnDef{}
+		err := rows.Scan(&col.Name, &col.Type)
 		if err != nil {
 			return nil, err
 		}
@@ -135,45 +429,65 @@ func (syncer *JsonSyncer) getFieldName(schema, table string) ([]string, error) {
 	return cols, nil
 }
 
+// getRowKey the primary key columns, or the first unique key ones, nil if neither
+func (syncer *JsonSyncer) getRowKey(schema, table string) ([]string, error) {
+	if db == nil {
+		err := syncer.initDB()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.Query("select index_name, column_name from information_schema.statistics where "+
+		"non_unique=0 and table_schema=? and table_name=? order by index_name='PRIMARY' desc, index_name, seq_in_index",
+		schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []event.KeyDef{}
+	for rows.Next() {
+		name, col := "", ""
+		if err := rows.Scan(&name, &col); err != nil {
+			return nil, err
+		}
+		if n := len(keys); n != 0 && keys[n-1].Name == name {
+			keys[n-1].Columns = append(keys[n-1].Columns, col)
+		} else {
+			keys = append(keys, event.KeyDef{Name: name, Columns: []string{col}})
+		}
+	}
+	return event.RowKey(keys), rows.Err()
+}
+
 func (syncer *JsonSyncer) Rollback(arg *RollbackArg) error {
-	eves, err := syncer.Get(arg)
+	trx, idxs, err := syncer.scan(arg)
 	if err != nil {
 		log.Debug(err)
 		return err
 	}
 
-	if len(eves) == 0 {
+	if trx == nil {
 		return fmt.Errorf("no events to rollback")
 	}
-
-	size := len(eves)
-	if _, ok := eves[0].(*event.XidEvnet); !ok {
-		return fmt.Errorf("scan first event must be XidEvent, but get: %v", eves[0].Dump())
-	}
-	if _, ok := eves[size-1].(*event.GtidEvent); !ok {
-		return fmt.Errorf("scan last event must be GtidEvent, but get: %v", eves[size-1].Dump())
+	if !trx.Complete() {
+		return fmt.Errorf("transaction to rollback not complete: %s", trx.Dump())
 	}
 
-	fieldsMap := map[uint64][]string{}
 	stmts := []*stmt{}
 
-	for _, eve := range eves {
-		if e, ok := eve.(*event.RowsEvent); ok {
-			cols := []string{}
-			ok := false
-			cols, ok = fieldsMap[e.TblId]
-
-			if !ok {
-				var err error
-				cols, err = syncer.getFieldName(string(e.Table.Schema), string(e.Table.Table))
-				if err != nil {
-					return err
-				}
-				fieldsMap[e.TblId] = cols
+	// undo the rows changed, the latest first
+	for i := len(trx.Events) - 1; i >= 0; i-- {
+		if e, ok := trx.Events[i].(*event.RowsEvent); ok {
+			// the definitions in effect when committed
+			cols, key, err := syncer.columnsAt(string(e.Table.Schema), string(e.Table.Table), idxs[len(idxs)-1])
+			if err != nil {
+				return err
 			}
 
-			log.Debug(e.RollBack(cols))
-			sql, vals, err := e.RollBack(cols)
+			log.Debug(e.RollBack(cols, key))
+			sql, vals, err := e.RollBack(cols, key)
 			if err != nil {
 				return err
 			}
@@ -186,7 +500,7 @@ func (syncer *JsonSyncer) Rollback(arg *RollbackArg) error {
 	if len(stmts) != 0 {
 		syncer.execute(stmts)
 	} else {
-		return fmt.Errorf("general %s sqls to execute", len(stmts))
+		return fmt.Errorf("general %d sqls to execute", len(stmts))
 	}
 	return nil
 }
@@ -0,0 +1,120 @@
+/**
+ *  author: lim
+ *  data  : 18-8-30 下午11:20
+ */
+
+package syncer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lemonwx/go-canal/event"
+)
+
+// boundaryEvents the transactions without gtid, committed by xid, by COMMIT or implicitly by ddl,
+// and the ones of mariadb without BEGIN
+func boundaryEvents() []event.Event {
+	at := func(eveType uint8, pos uint32) *event.EveHeader {
+		return &event.EveHeader{Ts: pos / 100, EveType: eveType, SvrId: 1, LogPos: pos, EveSize: 50}
+	}
+	rows := func(pos uint32, name string, id int64) []event.Event {
+		tbl := &event.TableMapEvent{Header: at(event.TABLE_MAP_EVENT, pos), Schema: []byte("test"), Table: []byte("t"), FullName: "test.t"}
+		return []event.Event{tbl, &event.RowsEvent{Header: at(event.WRITE_ROWS_EVENT_V2, pos+50), Table: tbl,
+			Rows: []map[int]interface{}{{0: name, 1: id}}}}
+	}
+	cols := []event.ColumnDef{{Name: "name", Type: "varchar(8)"}, {Name: "id", Type: "bigint"}}
+	keys := []event.KeyDef{{Name: event.PRIMARY_KEY, Columns: []string{"id"}}}
+
+	events := []event.Event{
+		fakeRotate(4, "mysql-bin.000001"),
+		event.NewSchemaEvent(&event.EveHeader{Ts: 1, LogPos: 100}, "mysql-bin.000001", "", "test", "t", cols, keys),
+		&event.QueryEvent{Header: at(event.QUERY_EVENT, 200), Query: "BEGIN"},
+	}
+	events = append(events, rows(250, "a", 1)...)
+	events = append(events, &event.XidEvnet{Header: at(event.XID_EVENT, 350)},
+		&event.QueryEvent{Header: at(event.QUERY_EVENT, 400), Query: "create table t1(id int)"},
+		&event.QueryEvent{Header: at(event.QUERY_EVENT, 450), Query: "create table t2(id int)"},
+		&event.QueryEvent{Header: at(event.QUERY_EVENT, 500), Query: "BEGIN"})
+	events = append(events, rows(550, "b", 2)...)
+	events = append(events, &event.QueryEvent{Header: at(event.QUERY_EVENT, 650), Query: "COMMIT"},
+		&event.MariadbGtidEvent{Header: at(event.MARIADB_GTID_EVENT, 700), Gtid: event.MariadbGtid{DomainId: 0, ServerId: 1, SeqNo: 9}})
+	events = append(events, rows(750, "c", 3)...)
+	return append(events, &event.XidEvnet{Header: at(event.XID_EVENT, 850), Xid: 9})
+}
+
+func TestTrxBoundaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	for _, eve := range boundaryEvents() {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byName := func(name string) *RollbackArg {
+		return &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "name", Val: name}},
+			Ts: event.EventTime(0), Te: event.EventTime(8)}
+	}
+	for _, c := range []struct {
+		name      string
+		first     int
+		events    int
+		commitPos uint32
+		gtid      string
+	}{
+		{"a", 2, 4, 350, ""},
+		{"b", 8, 4, 650, ""},
+		{"c", 12, 4, 850, "0-1-9"},
+	} {
+		trx, idxs, err := syncer.scan(byName(c.name))
+		if err != nil || trx == nil {
+			t.Fatalf("%s: expect the transaction matched: %v", c.name, err)
+		}
+		if !trx.Complete() || len(trx.Events) != c.events || idxs[0] != c.first || trx.CommitPos != c.commitPos || trx.Gtid != c.gtid {
+			t.Errorf("%s: unexpect transaction from %v: %s", c.name, idxs, trx.Dump())
+		}
+		if gtid, err := syncer.gtidOf(idxs[2]); err != nil || gtid != c.gtid {
+			t.Errorf("%s: unexpect gtid %q: %v", c.name, gtid, err)
+		}
+	}
+
+	// the ddl alone, after the other one without gtid
+	for _, idx := range []int{6, 7} {
+		trx, idxs, err := syncer.trxOf(idx)
+		if err != nil || len(idxs) != 1 || idxs[0] != idx || !trx.Complete() || len(trx.Statements) != 1 {
+			t.Errorf("expect the ddl at %d alone, got %v: %v", idx, idxs, err)
+		}
+	}
+	if trx, _, err := syncer.scan(byName("d")); trx != nil || err != nil {
+		t.Errorf("expect none matched, got %v: %v", trx, err)
+	}
+}
+
+func TestScanUnknownColumn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	for _, eve := range boundaryEvents() {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	arg := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "gone", Val: "a"}},
+		Ts: event.EventTime(0), Te: event.EventTime(8)}
+	if _, _, err = syncer.scan(arg); err == nil || err.Error() != "column gone not found in test.t" {
+		t.Errorf("expect the column not found, got %v", err)
+	}
+}
@@ -0,0 +1,404 @@
+/**
+ *  author: lim
+ *  data  : 18-8-22 下午8:40
+ */
+
+package syncer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	bsync "sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/event"
+)
+
+// index file of a sealed segment, next to it, see segmentIndex
+const indexExt = ".idx"
+
+// rowPos is a version of a row in the index file, N is the event in the segment,
+// B the events back to the first one of its transaction
+type rowPos struct {
+	N  int    `json:"n"`
+	B  int    `json:"b"`
+	Ts uint32 `json:"ts"`
+}
+
+// posting is a version of a row in memory, idx is the event in BinlogStreamer,
+// begin the first event of its transaction
+type posting struct {
+	idx   int
+	begin int
+	ts    uint32
+}
+
+// rowPart is the versions of the rows in a part of the events not kept in memory, read on demand
+type rowPart interface {
+	// span the events [start, end) of the part, and the range of the timestamps of its versions
+	span() (int, int, uint32, uint32)
+	// postings of key in the part, in order
+	postings(key string) ([]posting, error)
+	// release the versions read
+	release()
+}
+
+// segmentRows is the versions of a sealed segment, read from its index file
+type segmentRows struct {
+	start, end   int
+	minTs, maxTs uint32
+	path         string
+	rows         map[string][]posting // nil until read
+}
+
+func newSegmentRows(start, end int, path string, segRows map[string][]rowPos) *segmentRows {
+	part := &segmentRows{start: start, end: end, minTs: math.MaxUint32, path: path}
+	for _, poses := range segRows {
+		for _, pos := range poses {
+			if pos.Ts < part.minTs {
+				part.minTs = pos.Ts
+			}
+			if pos.Ts > part.maxTs {
+				part.maxTs = pos.Ts
+			}
+		}
+	}
+	return part
+}
+
+func (part *segmentRows) span() (int, int, uint32, uint32) {
+	return part.start, part.end, part.minTs, part.maxTs
+}
+
+func (part *segmentRows) postings(key string) ([]posting, error) {
+	if part.rows == nil {
+		data, err := ioutil.ReadFile(part.path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		summary := &segmentIndex{}
+		if err = json.Unmarshal(data, summary); err != nil {
+			return nil, errors.Annotatef(err, "broken index file %s", part.path)
+		}
+		part.rows = make(map[string][]posting, len(summary.Rows))
+		for k, poses := range summary.Rows {
+			postings := make([]posting, 0, len(poses))
+			for _, pos := range poses {
+				idx := part.start + pos.N
+				postings = append(postings, posting{idx: idx, begin: idx - pos.B, ts: pos.Ts})
+			}
+			part.rows[k] = postings
+		}
+	}
+	return part.rows[key], nil
+}
+
+func (part *segmentRows) release() {
+	part.rows = nil
+}
+
+// parts read at most kept in memory, the one read first released first
+const maxPartsRead = 16
+
+// RowIndex maps schema.table and the key of a row to the events changed it, in order,
+// the versions of the sealed segments are read from their index files on demand
+type RowIndex struct {
+	rows    map[string][]posting // of the events after the parts
+	segRows map[string][]rowPos  // of the segment written, saved when it's sealed
+	parts   []rowPart            // in order
+	read    []rowPart            // the parts read, in the order read
+	from    int                  // the first event retained
+	trx     trxState             // of the events tracked
+	begin   int                  // the first event of the transaction tracked
+	store   indexStorage         // keeps the versions instead of rows if not nil, one of the parts
+	added   map[string]bool      // the keys added to store of the event at addedAt
+	addedAt int
+	bsync.Mutex
+}
+
+func NewRowIndex() *RowIndex {
+	return &RowIndex{rows: make(map[string][]posting), segRows: make(map[string][]rowPos)}
+}
+
+// rowKey of the row with the key values, in the order of the key columns
+func rowKey(schema, table string, vals []string) string {
+	return historyKey(schema, table) + "\x00" + strings.Join(vals, "\x00")
+}
+
+// track the event at idx for the transaction boundaries, the one before a transaction begun is its first
+func (index *RowIndex) track(idx int, eve event.Event) {
+	index.Lock()
+	defer index.Unlock()
+	if !index.trx.inTrx {
+		index.begin = idx
+	}
+	index.trx.update(eve)
+}
+
+// add the version at idx of the transaction tracked, n is the event in the segment written,
+// -1 if not in a segment
+func (index *RowIndex) add(key string, idx, n int, ts uint32) {
+	index.Lock()
+	defer index.Unlock()
+
+	if index.store != nil {
+		if index.addedAt != idx || index.added == nil {
+			index.added, index.addedAt = make(map[string]bool), idx
+		}
+		if !index.added[key] {
+			index.added[key] = true
+			index.store.addRow(key, posting{idx: idx, begin: index.begin, ts: ts})
+		}
+		return
+	}
+	postings := index.rows[key]
+	if len(postings) != 0 && postings[len(postings)-1].idx == idx {
+		// more rows of the event share the key, the before and after image of update
+		return
+	}
+	index.rows[key] = append(postings, posting{idx: idx, begin: index.begin, ts: ts})
+	if n >= 0 {
+		index.segRows[key] = append(index.segRows[key], rowPos{N: n, B: idx - index.begin, Ts: ts})
+	}
+}
+
+// newSegment start collecting the rows of the next segment
+func (index *RowIndex) newSegment() {
+	index.Lock()
+	defer index.Unlock()
+	index.segRows = make(map[string][]rowPos)
+}
+
+// addPart the versions of the events before the ones in memory, which are dropped from memory
+func (index *RowIndex) addPart(part rowPart) {
+	index.Lock()
+	defer index.Unlock()
+
+	_, end, _, _ := part.span()
+	for key, postings := range index.rows {
+		n := sort.Search(len(postings), func(i int) bool { return postings[i].idx >= end })
+		if n == len(postings) {
+			delete(index.rows, key)
+		} else if n != 0 {
+			index.rows[key] = append([]posting(nil), postings[n:]...)
+		}
+	}
+	index.parts = append(index.parts, part)
+}
+
+// setStore keeps the versions in store, which has the ones of the events stored
+func (index *RowIndex) setStore(store indexStorage) {
+	index.Lock()
+	defer index.Unlock()
+	index.store = store
+	index.parts = append(index.parts, store)
+}
+
+// addSegment the sealed segment of the events [start, end), its versions saved in the index file at path
+func (index *RowIndex) addSegment(start, end int, path string, segRows map[string][]rowPos) {
+	index.addPart(newSegmentRows(start, end, path, segRows))
+}
+
+// postingsOf key in the part, the part read kept until more than maxPartsRead read
+func (index *RowIndex) postingsOf(part rowPart, key string) ([]posting, error) {
+	read := false
+	for _, p := range index.read {
+		if p == part {
+			read = true
+			break
+		}
+	}
+	if !read {
+		index.read = append(index.read, part)
+		if len(index.read) > maxPartsRead {
+			index.read[0].release()
+			index.read = index.read[1:]
+		}
+	}
+	postings, err := part.postings(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	n := sort.Search(len(postings), func(i int) bool { return postings[i].idx >= index.from })
+	return postings[n:], nil
+}
+
+// between the events changed the row in [ts, te], of the versions of each part in range
+func (index *RowIndex) between(key string, ts, te uint32) ([]int, error) {
+	index.Lock()
+	defer index.Unlock()
+
+	idxs := []int{}
+	for _, part := range index.parts {
+		_, end, minTs, maxTs := part.span()
+		if end <= index.from || maxTs < ts || minTs > te {
+			continue
+		}
+		postings, err := index.postingsOf(part, key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		idxs = appendBetween(idxs, postings, ts, te)
+	}
+	return appendBetween(idxs, index.rows[key], ts, te), nil
+}
+
+// appendBetween the events of the postings in [ts, te], all of them checked since the
+// timestamps in dump order may go back, see skewWindow
+func appendBetween(idxs []int, postings []posting, ts, te uint32) []int {
+	for _, p := range postings {
+		if ts <= p.ts && p.ts <= te {
+			idxs = append(idxs, p.idx)
+		}
+	}
+	return idxs
+}
+
+// beginOf the first event of the transaction of the version at idx, false if not indexed, O(log n)
+func (index *RowIndex) beginOf(key string, idx int) (int, bool, error) {
+	index.Lock()
+	defer index.Unlock()
+
+	postings := index.rows[key]
+	for _, part := range index.parts {
+		if start, end, _, _ := part.span(); start <= idx && idx < end {
+			var err error
+			if postings, err = index.postingsOf(part, key); err != nil {
+				return 0, false, errors.Trace(err)
+			}
+			break
+		}
+	}
+	n := sort.Search(len(postings), func(i int) bool { return postings[i].idx >= idx })
+	if n == len(postings) || postings[n].idx != idx {
+		return 0, false, nil
+	}
+	return postings[n].begin, true, nil
+}
+
+// purge the versions before idx
+func (index *RowIndex) purge(idx int) {
+	index.Lock()
+	defer index.Unlock()
+
+	index.from = idx
+	n := 0
+	for ; n < len(index.parts); n++ {
+		if _, end, _, _ := index.parts[n].span(); end > idx {
+			break
+		}
+		index.parts[n].release()
+	}
+	index.parts = append([]rowPart(nil), index.parts[n:]...)
+	read := index.read[:0]
+	for _, part := range index.read {
+		if _, end, _, _ := part.span(); end > idx {
+			read = append(read, part)
+		}
+	}
+	index.read = read
+
+	for key, postings := range index.rows {
+		n := sort.Search(len(postings), func(i int) bool { return postings[i].idx >= idx })
+		if n == len(postings) {
+			delete(index.rows, key)
+		} else if n != 0 {
+			index.rows[key] = append([]posting(nil), postings[n:]...)
+		}
+	}
+}
+
+// segmentRows of the segment written
+func (index *RowIndex) segmentRows() map[string][]rowPos {
+	index.Lock()
+	defer index.Unlock()
+	return index.segRows
+}
+
+// indexRows of the RowsEvent at idx by the key of its table, skipped if the key unknown
+func (syncer *JsonSyncer) indexRows(idx int, eve event.Event) {
+	syncer.index.track(idx, eve)
+	e, ok := eve.(*event.RowsEvent)
+	if !ok || e.Table == nil || syncer.store == nil && len(syncer.streamer.files) == 0 {
+		return
+	}
+
+	schema, table := string(e.Table.Schema), string(e.Table.Table)
+	cols, key, ok := syncer.localColumns(schema, table, idx)
+	if !ok || len(key) == 0 {
+		return
+	}
+	keyIdxs := make([]int, 0, len(key))
+	for _, name := range key {
+		col := fieldIdx(cols, name)
+		if col < 0 {
+			return
+		}
+		keyIdxs = append(keyIdxs, col)
+	}
+
+	// no segment if not in the json files
+	n := -1
+	if syncer.store == nil {
+		n = idx - syncer.streamer.files[len(syncer.streamer.files)-1].start
+	}
+	for _, row := range e.Rows {
+		vals := make([]string, 0, len(keyIdxs))
+		for _, col := range keyIdxs {
+			vals = append(vals, formatVal(row[col]))
+		}
+		syncer.index.add(rowKey(schema, table, vals), idx, n, e.Header.Ts)
+	}
+}
+
+// versionsOf the indexes of the events changed the row arg identified by the key, in order,
+// false if arg gives not all the key columns
+func (syncer *JsonSyncer) versionsOf(arg *RollbackArg) ([]int, bool, error) {
+	key, ok := syncer.rowKeyOf(arg)
+	if !ok {
+		return nil, false, nil
+	}
+	idxs, err := syncer.index.between(key, timestamp(arg.Ts), timestamp(arg.Te))
+	return idxs, true, err
+}
+
+// rowKeyOf the row arg identified by the key in the index, false if arg gives not all the key columns
+func (syncer *JsonSyncer) rowKeyOf(arg *RollbackArg) (string, bool) {
+	_, end := syncer.storage().Bounds()
+	_, key, ok := syncer.localColumns(arg.Schema, arg.Table, end)
+	if !ok || len(key) == 0 {
+		return "", false
+	}
+
+	vals := make([]string, 0, len(key))
+	for _, name := range key {
+		found := false
+		for _, field := range arg.Fields {
+			if strings.EqualFold(field.Name, name) {
+				vals = append(vals, field.Val)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return rowKey(arg.Schema, arg.Table, vals), true
+}
+
+// timestamp in event header of t, the reverse of event.EventTime
+func timestamp(t time.Time) uint32 {
+	ts := t.Unix() - event.EventTime(0).Unix()
+	if ts < 0 {
+		return 0
+	}
+	if ts > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(ts)
+}
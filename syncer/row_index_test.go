@@ -0,0 +1,111 @@
+/**
+ *  author: lim
+ *  data  : 18-8-22 下午9:50
+ */
+
+package syncer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lemonwx/go-canal/event"
+)
+
+func rowsTrx(pos, ts uint32, eveType uint8, rows ...map[int]interface{}) []event.Event {
+	at := func(eveType uint8, pos uint32) *event.EveHeader {
+		return &event.EveHeader{Ts: ts, EveType: eveType, SvrId: 1, LogPos: pos}
+	}
+	tbl := &event.TableMapEvent{Header: at(event.TABLE_MAP_EVENT, pos+100), Schema: []byte("test"), Table: []byte("t"), FullName: "test.t"}
+	return []event.Event{
+		&event.GtidEvent{Header: at(event.GTID_LOG_EVENT, pos)},
+		&event.QueryEvent{Header: at(event.QUERY_EVENT, pos+50), Query: "BEGIN"},
+		tbl,
+		&event.RowsEvent{Header: at(eveType, pos+150), Table: tbl, Rows: rows},
+		&event.XidEvnet{Header: at(event.XID_EVENT, pos+200)},
+	}
+}
+
+func TestRowIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "row_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	// every transaction sealed with its index file
+	syncer.SetRotation(1, 0)
+
+	cols := []event.ColumnDef{{Name: "name", Type: "varchar(8)"}, {Name: "id", Type: "bigint"}}
+	keys := []event.KeyDef{{Name: event.PRIMARY_KEY, Columns: []string{"id"}}}
+	events := []event.Event{
+		fakeRotate(4, "mysql-bin.000001"),
+		event.NewSchemaEvent(&event.EveHeader{Ts: 10, LogPos: 100}, "mysql-bin.000001", "", "test", "t", cols, keys),
+	}
+	events = append(events, rowsTrx(200, 10, event.WRITE_ROWS_EVENT_V2,
+		map[int]interface{}{0: "a", 1: int64(1)}, map[int]interface{}{0: "b", 1: int64(2)})...)
+	events = append(events, rowsTrx(500, 20, event.UPDATE_ROWS_EVENT_V2,
+		map[int]interface{}{0: "a", 1: int64(1)}, map[int]interface{}{0: "c", 1: int64(1)})...)
+	events = append(events, rowsTrx(800, 30, event.DELETE_ROWS_EVENT_V2,
+		map[int]interface{}{0: "c", 1: int64(1)})...)
+	for _, eve := range events {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = syncer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dir + "/mysql-bin.000001.seg3.idx"); err != nil {
+		t.Fatalf("index of the sealed segment should be saved: %v", err)
+	}
+
+	arg := func(id string, ts, te uint32) *RollbackArg {
+		return &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "ID", Val: id}},
+			Ts: event.EventTime(ts), Te: event.EventTime(te)}
+	}
+	// the versions of the sealed segments not read until looked up
+	loaded := mustLoad(t, dir)
+	if len(loaded.index.rows) != 0 || len(loaded.index.parts) == 0 || len(loaded.index.read) != 0 {
+		t.Errorf("expect the versions left in the index files, %d in memory, %d parts, %d read",
+			len(loaded.index.rows), len(loaded.index.parts), len(loaded.index.read))
+	}
+	for _, sy := range []*JsonSyncer{syncer, loaded} {
+		for _, c := range []struct {
+			arg    *RollbackArg
+			expect int
+		}{
+			{arg("1", 0, 40), 3},
+			{arg("1", 15, 40), 2},
+			{arg("1", 20, 20), 1},
+			{arg("2", 0, 40), 1},
+			{arg("3", 0, 40), 0},
+		} {
+			versions, err := sy.Get(c.arg)
+			if err != nil || len(versions) != c.expect {
+				t.Errorf("%v in [%s, %s]: expect %d versions, got %d %v", c.arg.Fields, c.arg.Ts, c.arg.Te, c.expect, len(versions), err)
+			}
+			for _, eve := range versions {
+				if _, ok := eve.(*event.RowsEvent); !ok {
+					t.Errorf("version should be rows event: %s", eve.Dump())
+				}
+			}
+		}
+
+		// rollback the latest version by the index
+		trx, _, err := sy.scan(arg("1", 0, 30))
+		if err != nil || trx == nil || len(trx.Events) != 5 {
+			t.Fatalf("expect the delete transaction, got %v: %v", trx, err)
+		}
+		if !trx.Complete() || len(trx.Tables) != 1 || event.GetEventHeader(trx.Events[1]).LogPos != 850 {
+			t.Errorf("unexpect transaction scanned: %s", trx.Dump())
+		}
+		// the gtid event of the transaction kept with the version, saved in the index file
+		if begin, ok, err := sy.index.beginOf(rowKey("test", "t", []string{"1"}), 15); err != nil || !ok || begin != 12 {
+			t.Errorf("unexpect first event of the delete transaction: %d %v %v", begin, ok, err)
+		}
+	}
+}
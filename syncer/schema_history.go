@@ -0,0 +1,69 @@
+/**
+ *  author: lim
+ *  data  : 18-8-13 下午9:12
+ */
+
+package syncer
+
+import (
+	"sort"
+	bsync "sync"
+
+	"github.com/lemonwx/go-canal/event"
+)
+
+type schemaVersion struct {
+	idx int // index of the SchemaEvent in BinlogStreamer.Events
+	eve *event.SchemaEvent
+}
+
+// SchemaHistory keeps every definition of the tables stored, ordered by binlog position
+type SchemaHistory struct {
+	versions map[string][]schemaVersion
+	bsync.RWMutex
+}
+
+func NewSchemaHistory() *SchemaHistory {
+	return &SchemaHistory{versions: make(map[string][]schemaVersion)}
+}
+
+func historyKey(schema, table string) string {
+	return schema + "." + table
+}
+
+// add the SchemaEvent at idx of the events stored, idx must increase
+func (history *SchemaHistory) add(idx int, eve *event.SchemaEvent) {
+	history.Lock()
+	defer history.Unlock()
+
+	key := historyKey(eve.Schema, eve.Table)
+	history.versions[key] = append(history.versions[key], schemaVersion{idx: idx, eve: eve})
+}
+
+// latest definition of the table, nil if never stored
+func (history *SchemaHistory) latest(schema, table string) *event.SchemaEvent {
+	history.RLock()
+	defer history.RUnlock()
+
+	versions := history.versions[historyKey(schema, table)]
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions[len(versions)-1].eve
+}
+
+// At the definition of the table in effect for the event at idx,
+// nil if unknown or dropped
+func (history *SchemaHistory) At(schema, table string, idx int) *event.SchemaEvent {
+	history.RLock()
+	defer history.RUnlock()
+
+	versions := history.versions[historyKey(schema, table)]
+	n := sort.Search(len(versions), func(i int) bool {
+		return versions[i].idx > idx
+	})
+	if n == 0 || versions[n-1].eve.Dropped {
+		return nil
+	}
+	return versions[n-1].eve
+}
@@ -0,0 +1,85 @@
+/**
+ *  author: lim
+ *  data  : 18-8-13 下午10:30
+ */
+
+package syncer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+)
+
+func schemaEvent(pos uint32, cols ...string) *event.SchemaEvent {
+	var defs []event.ColumnDef
+	if cols != nil {
+		defs = []event.ColumnDef{}
+	}
+	for _, col := range cols {
+		defs = append(defs, event.ColumnDef{Name: col, Type: "int"})
+	}
+	header := &event.EveHeader{Ts: 1, LogPos: pos}
+	return event.NewSchemaEvent(header, "mysql-bin.000001", "", "test", "t", defs, nil)
+}
+
+func TestSchemaHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema_history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+
+	events := []event.Event{
+		&event.RotateEvent{Header: &event.EveHeader{EveType: event.ROTATE_EVENT}, Pos: 4, NextBinlog: "mysql-bin.000001"},
+		schemaEvent(100, "id", "a"),
+		&event.XidEvnet{Header: &event.EveHeader{Ts: 1, EveType: event.XID_EVENT, LogPos: 200}},
+		// the same definition send again after reconnect
+		schemaEvent(300, "id", "a"),
+		schemaEvent(400, "id", "b", "a"),
+		&event.XidEvnet{Header: &event.EveHeader{Ts: 1, EveType: event.XID_EVENT, LogPos: 500}},
+		schemaEvent(600),
+	}
+	for _, eve := range events {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = syncer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sy := range []*JsonSyncer{syncer, mustLoad(t, dir)} {
+		if sy.streamer.count() != 6 {
+			t.Fatalf("duplicate schema event should be dropped, got %d events", sy.streamer.count())
+		}
+
+		for idx, expect := range []string{"", "id,a", "id,a", "id,b,a", "id,b,a", ""} {
+			got := ""
+			if schemaEve := sy.schemas.At("test", "t", idx); schemaEve != nil {
+				got = strings.Join(schemaEve.ColumnNames(), ",")
+			}
+			if got != expect {
+				t.Errorf("columns at %d: %s, expect %s", idx, got, expect)
+			}
+		}
+		if events, err := sy.EventsSince(binlog.Pos{FileName: "mysql-bin.000001", Pos: 300}); err != nil || len(events) != 3 {
+			t.Errorf("expect 3 events after 300, got %d %v", len(events), err)
+		}
+	}
+}
+
+func mustLoad(t *testing.T, dir string) *JsonSyncer {
+	syncer, err := NewJsonSyncerFromDir(dir, "mysql-bin.000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return syncer
+}
@@ -0,0 +1,297 @@
+/**
+ *  author: lim
+ *  data  : 18-8-21 下午8:10
+ */
+
+package syncer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/lemonwx/log"
+)
+
+// compression of the closed segments
+const (
+	COMPRESS_NONE = "none"
+	COMPRESS_GZIP = "gzip"
+	COMPRESS_ZSTD = "zstd"
+
+	segmentMark = ".seg"
+	tmpExt      = ".tmp"
+)
+
+var compressExts = map[string]string{
+	COMPRESS_GZIP: ".gz",
+	COMPRESS_ZSTD: ".zst",
+}
+
+// a binlog file is stored as segments: the first one named as the binlog file,
+// the rest with .segN, a closed segment may be compressed with the extension appended
+func segmentName(binlogFile string, seq int) string {
+	if seq == 0 {
+		return binlogFile
+	}
+	return fmt.Sprintf("%s%s%d", binlogFile, segmentMark, seq)
+}
+
+// parseSegment the binlog file, segment and compression extension of name,
+// false if name is not a segment
+func parseSegment(name string) (string, int, string, bool) {
+	ext := ""
+	for _, e := range compressExts {
+		if strings.HasSuffix(name, e) {
+			name, ext = strings.TrimSuffix(name, e), e
+			break
+		}
+	}
+
+	seq := 0
+	if idx := strings.LastIndex(name, segmentMark); idx > 0 {
+		if n, err := strconv.Atoi(name[idx+len(segmentMark):]); err == nil && n > 0 {
+			name, seq = name[:idx], n
+		}
+	}
+
+	// binlog files end with the index
+	idx := strings.LastIndex(name, ".")
+	if idx <= 0 || idx == len(name)-1 {
+		return "", 0, "", false
+	}
+	if _, err := strconv.ParseUint(name[idx+1:], 10, 64); err != nil {
+		return "", 0, "", false
+	}
+	return name, seq, ext, true
+}
+
+// listSegments in dir of the binlog files from startFile, in dump order, a segment
+// left both plain and compressed by a crash keeps the compressed one
+func listSegments(dir, startFile string, infos []os.FileInfo) ([]fileRange, error) {
+	segs := []fileRange{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		name, seq, ext, ok := parseSegment(info.Name())
+		if !ok || name < startFile {
+			continue
+		}
+		segs = append(segs, fileRange{name: name, seq: seq, ext: ext, sealed: len(ext) != 0,
+			size: info.Size(), modTime: info.ModTime()})
+	}
+
+	sortSegments(segs)
+
+	kept := segs[:0]
+	for _, seg := range segs {
+		if n := len(kept); n != 0 && kept[n-1].name == seg.name && kept[n-1].seq == seg.seq {
+			log.Errorf("%s already compressed, remove it", dir+seg.path())
+			if err := os.Remove(dir + seg.path()); err != nil {
+				return nil, errors.Trace(err)
+			}
+			continue
+		}
+		kept = append(kept, seg)
+	}
+	return kept, nil
+}
+
+func (f *fileRange) path() string {
+	return segmentName(f.name, f.seq) + f.ext
+}
+
+// SetCompress the codec of the closed segments, default COMPRESS_NONE
+func (syncer *JsonSyncer) SetCompress(codec string) error {
+	if _, ok := compressExts[codec]; !ok && codec != COMPRESS_NONE {
+		return errors.Errorf("unknown compression: %s, must be one of %s/%s/%s",
+			codec, COMPRESS_GZIP, COMPRESS_ZSTD, COMPRESS_NONE)
+	}
+	syncer.compress = codec
+	return nil
+}
+
+// SetRotation start a new segment at the end of a transaction, once current one
+// reaches size bytes or is opened for age, 0 never
+func (syncer *JsonSyncer) SetRotation(size int64, age time.Duration) {
+	syncer.segSize, syncer.segAge = size, age
+}
+
+// rotateSegment close current segment and continue the binlog file with a new one
+func (syncer *JsonSyncer) rotateSegment() error {
+	if syncer.curFile == nil || syncer.trx.inTrx || syncer.written == 0 {
+		return nil
+	}
+	full := syncer.segSize > 0 && syncer.written >= syncer.segSize
+	old := syncer.segAge > 0 && time.Since(syncer.opened) >= syncer.segAge
+	if !full && !old {
+		return nil
+	}
+
+	lastPos, resumed := syncer.lastPos, syncer.resumed
+	if err := syncer.sealFile(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := syncer.reopen(syncer.lastFile); err != nil {
+		return errors.Trace(err)
+	}
+	// still the binlog file, the events dumped again are skipped the same way
+	syncer.lastPos, syncer.resumed = lastPos, resumed
+	return nil
+}
+
+// sealFile close current segment for good, compress it and apply the retention
+func (syncer *JsonSyncer) sealFile() error {
+	if syncer.curFile == nil {
+		return nil
+	}
+	size := syncer.written
+	if err := syncer.closeFile(); err != nil {
+		return errors.Trace(err)
+	}
+
+	syncer.streamer.Lock()
+	seg := &syncer.streamer.files[len(syncer.streamer.files)-1]
+	seg.sealed, seg.size, seg.modTime = true, size, time.Now()
+	syncer.streamer.Unlock()
+
+	if err := syncer.sealTail(seg); err != nil {
+		return errors.Trace(err)
+	}
+	if err := syncer.compressSegment(seg); err != nil {
+		return errors.Trace(err)
+	}
+	syncer.queueArchive(seg)
+	return errors.Trace(syncer.purge())
+}
+
+// compressSegment replace the plain segment with the compressed one
+func (syncer *JsonSyncer) compressSegment(seg *fileRange) error {
+	ext, ok := compressExts[syncer.compress]
+	if !ok || len(seg.ext) != 0 {
+		return nil
+	}
+
+	src := syncer.dir + seg.path()
+	dst := src + ext
+	size, err := compressFile(src, dst, syncer.compress)
+	if err != nil {
+		os.Remove(dst + tmpExt)
+		return errors.Annotatef(err, "compress %s", src)
+	}
+	syncer.streamer.Lock()
+	seg.ext, seg.size = ext, size
+	syncer.streamer.Unlock()
+	return errors.Trace(os.Remove(src))
+}
+
+// compressFile write src compressed to dst, dst appears only when complete
+func compressFile(src, dst, codec string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer in.Close()
+
+	tmp := dst + tmpExt
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer out.Close()
+
+	var w io.WriteCloser
+	switch codec {
+	case COMPRESS_GZIP:
+		w = gzip.NewWriter(out)
+	case COMPRESS_ZSTD:
+		if w, err = zstd.NewWriter(out); err != nil {
+			return 0, errors.Trace(err)
+		}
+	default:
+		return 0, errors.Errorf("unknown compression: %s", codec)
+	}
+
+	if _, err = io.Copy(w, in); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if err = w.Close(); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if err = out.Sync(); err != nil {
+		return 0, errors.Trace(err)
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return info.Size(), errors.Trace(os.Rename(tmp, dst))
+}
+
+type segmentReader struct {
+	*bufio.Reader
+	close func() error
+}
+
+func (r *segmentReader) Close() error {
+	return r.close()
+}
+
+// openSegment read the segment at path, decompressed by its extension
+func openSegment(path string) (*segmentReader, error) {
+	return openSegmentAt(path, 0)
+}
+
+// openSegmentAt read the segment at path from offset of the decompressed stream,
+// the compressed ones are read through to the offset
+func openSegmentAt(path string, offset int64) (*segmentReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var r *segmentReader
+	switch {
+	case strings.HasSuffix(path, compressExts[COMPRESS_GZIP]):
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, errors.Trace(err)
+		}
+		r = &segmentReader{bufio.NewReader(gr), func() error {
+			gr.Close()
+			return f.Close()
+		}}
+	case strings.HasSuffix(path, compressExts[COMPRESS_ZSTD]):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, errors.Trace(err)
+		}
+		r = &segmentReader{bufio.NewReader(zr), func() error {
+			zr.Close()
+			return f.Close()
+		}}
+	default:
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, errors.Trace(err)
+		}
+		return &segmentReader{bufio.NewReader(f), f.Close}, nil
+	}
+
+	if _, err = io.CopyN(ioutil.Discard, r, offset); err != nil {
+		r.Close()
+		return nil, errors.Annotatef(err, "seek %s to %d", path, offset)
+	}
+	return r, nil
+}
@@ -0,0 +1,140 @@
+/**
+ *  author: lim
+ *  data  : 18-8-21 下午10:20
+ */
+
+package syncer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+)
+
+const testSid = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+func TestParseSegment(t *testing.T) {
+	for name, expect := range map[string]string{
+		"mysql-bin.000001":          "mysql-bin.000001 0 ",
+		"mysql-bin.000001.seg12":    "mysql-bin.000001 12 ",
+		"mysql-bin.000001.gz":       "mysql-bin.000001 0 .gz",
+		"mysql-bin.000001.seg3.zst": "mysql-bin.000001 3 .zst",
+		"my.segs.000002":            "my.segs.000002 0 ",
+		"mysql-bin.000001.gz.tmp":   "",
+		".meta.json":                "",
+		".gtid_purged":              "",
+	} {
+		got := ""
+		if binlogFile, seq, ext, ok := parseSegment(name); ok {
+			got = fmt.Sprintf("%s %d %s", binlogFile, seq, ext)
+		}
+		if got != expect {
+			t.Errorf("parse %s: expect %q, got %q", name, expect, got)
+		}
+	}
+}
+
+func TestRotateCompressAndPurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	if err = syncer.SetCompress("lz4"); err == nil {
+		t.Error("unknown compression should fail")
+	}
+	if err = syncer.SetCompress(COMPRESS_GZIP); err != nil {
+		t.Fatal(err)
+	}
+	// a segment for every transaction, nothing expired yet
+	syncer.SetRotation(1, 0)
+	syncer.SetRetention(0, time.Hour, 2)
+
+	events := []event.Event{fakeRotate(4, "mysql-bin.000001")}
+	for idx := 0; idx < 3; idx++ {
+		trx := trxEvents(uint32(200 * (idx + 1)))
+		trx[0].(*event.GtidEvent).Gtid = fmt.Sprintf("%s:%d", testSid, idx+1)
+		events = append(events, trx...)
+	}
+	for _, eve := range events {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := []string{}
+	for _, seg := range syncer.streamer.files {
+		names = append(names, seg.path())
+	}
+	if fmt.Sprint(names) != "[mysql-bin.000001.gz mysql-bin.000001.seg1.gz mysql-bin.000001.seg2.gz "+
+		"mysql-bin.000001.seg3.gz mysql-bin.000001.seg4]" {
+		t.Fatalf("unexpect segments: %v", names)
+	}
+	if n := mustLoad(t, dir).streamer.count(); n != 13 {
+		t.Errorf("compressed segments should be loaded, got %d events", n)
+	}
+
+	// all expired, the last two kept
+	syncer.SetRetention(0, time.Nanosecond, 2)
+	if err = syncer.purge(); err != nil {
+		t.Fatal(err)
+	}
+	if len(syncer.streamer.files) != 2 || syncer.streamer.base != 9 || syncer.streamer.count() != 4 {
+		t.Fatalf("unexpect after purged: %d files, events from %d", len(syncer.streamer.files), syncer.streamer.base)
+	}
+	if _, err = os.Stat(dir + "/mysql-bin.000001.seg2.gz"); !os.IsNotExist(err) {
+		t.Errorf("segment purged should be removed: %v", err)
+	}
+
+	// rollback reaching the segments purged
+	arg := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "id", Val: "1"}},
+		Te: event.GetEventTime(events[len(events)-1])}
+	if _, err = syncer.Get(arg); errors.Cause(err) != ErrPurged {
+		t.Errorf("expect purged error, got %v", err)
+	}
+	if err = syncer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := mustLoad(t, dir)
+	if n := loaded.streamer.count(); n != 4 || loaded.CurPos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 750}) {
+		t.Errorf("unexpect reload: %d events, %v", n, loaded.CurPos)
+	}
+	gtids, err := loaded.ExecutedGtids()
+	if err != nil || gtids.String() != testSid+":1-3" {
+		t.Errorf("gtids purged should be kept: %v %v", gtids, err)
+	}
+}
+
+func TestCompressZstd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := dir + "/mysql-bin.000001"
+	if err = ioutil.WriteFile(src, []byte("[]"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = compressFile(src, src+".zst", COMPRESS_ZSTD); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openSegment(src + ".zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "[]" {
+		t.Errorf("unexpect decompressed: %q %v", data, err)
+	}
+}
@@ -0,0 +1,265 @@
+/**
+ *  author: lim
+ *  data  : 18-8-25 下午8:10
+ */
+
+package syncer
+
+import (
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/log"
+)
+
+// backends of Storage
+const (
+	STORAGE_JSON = "json"
+	STORAGE_BOLT = "bolt"
+)
+
+// Storage keeps the events synced in dump order, an event is identified by its index
+// in the order, the ones before the first retained are purged
+type Storage interface {
+	// Append eve after the events stored
+	Append(eve event.Event) error
+	// Bounds the index of the first event retained and the one appended next
+	Bounds() (int, int)
+	// Range the events in [start, end)
+	Range(start, end int) ([]event.Event, error)
+	// SeekPos the index of the first event after pos of the binlog, the end if none
+	SeekPos(pos binlog.Pos) (int, error)
+	// SeekTime the index of the first transaction at or after t and where to dump from
+	// for it, false if none stored at or after t
+	SeekTime(t time.Time) (int, binlog.Pos, bool, error)
+	// Checkpoint make the events appended durable, and tell where to continue dumping
+	Checkpoint() (binlog.Pos, error)
+	// Purge the events before idx, some of them may be kept to purge a whole unit
+	Purge(idx int) error
+	Close() error
+}
+
+// gtidStorage keeps the gtid set of the events stored itself
+type gtidStorage interface {
+	ExecutedGtids() (event.GtidSet, error)
+}
+
+// the bolt file in the data dir, sorted before the binlog files and never loaded as one
+const boltFile = ".events.db"
+
+// indexStorage keeps the versions of the rows and the schema events with the events, see BoltStorage
+type indexStorage interface {
+	rowPart
+	// addRow the version of key, durable with its event
+	addRow(key string, p posting)
+	// indexed report whether the versions and the schema events are of all the events stored
+	indexed() bool
+	// markIndexed the versions of all the events added, and schemas the schema events of them
+	markIndexed(schemas []int) error
+	// schemaIdxs the indexes of the schema events stored
+	schemaIdxs() ([]int, error)
+}
+
+// NewSyncer of the events kept by backend in dir, dump from startFile if nothing stored
+func NewSyncer(backend, dir, startFile string) (*JsonSyncer, error) {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	switch backend {
+	case STORAGE_JSON:
+		return NewJsonSyncerFromDir(dir, startFile)
+	case STORAGE_BOLT:
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			return nil, errors.Trace(err)
+		}
+		store, err := OpenBoltStorage(dir+boltFile, startFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		syncer, err := NewSyncerOnStorage(store)
+		if err != nil {
+			store.Close()
+			return nil, errors.Trace(err)
+		}
+		syncer.dir = dir
+		return syncer, nil
+	}
+	return nil, errors.Errorf("unknown storage: %s, must be one of %s/%s", backend, STORAGE_JSON, STORAGE_BOLT)
+}
+
+// NewSyncerOnStorage the syncer keeps the events in store instead of its json files,
+// the definitions and the versions of the rows are read from store if it keeps them,
+// or rebuilt from the events stored
+func NewSyncerOnStorage(store Storage) (*JsonSyncer, error) {
+	syncer := NewJsonSyncer(nil)
+	syncer.store = store
+
+	indexStore, ok := store.(indexStorage)
+	if ok {
+		syncer.index.setStore(indexStore)
+	}
+	if ok && indexStore.indexed() {
+		if err := syncer.loadSchemas(indexStore); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if err := syncer.rebuild(indexStore); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	pos, err := store.Checkpoint()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	syncer.CurPos = pos
+	return syncer, nil
+}
+
+// events read at a time to rebuild the indexes
+const rebuildBatch = 4096
+
+// loadSchemas of the schema events kept by store, the versions of the rows read from it on demand
+func (syncer *JsonSyncer) loadSchemas(store indexStorage) error {
+	idxs, err := store.schemaIdxs()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, idx := range idxs {
+		eve, err := syncer.stored(idx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		schemaEve, ok := eve.(*event.SchemaEvent)
+		if !ok {
+			return errors.Errorf("event %d is not a schema event", idx)
+		}
+		syncer.schemas.add(idx, schemaEve)
+	}
+	return nil
+}
+
+// rebuild the indexes from all the events stored, kept by store if not nil
+func (syncer *JsonSyncer) rebuild(store indexStorage) error {
+	start, end := syncer.store.Bounds()
+	schemas := []int{}
+	for idx := start; idx < end; idx += rebuildBatch {
+		events, err := syncer.store.Range(idx, minInt(idx+rebuildBatch, end))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for n, eve := range events {
+			syncer.indexEvent(idx+n, eve)
+			if _, ok := eve.(*event.SchemaEvent); ok {
+				schemas = append(schemas, idx+n)
+			}
+		}
+		if store == nil {
+			continue
+		}
+		// the versions of a batch committed
+		if _, err = syncer.store.Checkpoint(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if store == nil {
+		return nil
+	}
+	log.Infof("rebuilt the indexes of %d events", end-start)
+	return errors.Trace(store.markIndexed(schemas))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// storage the events kept in, the json files of the syncer itself if no other one
+func (syncer *JsonSyncer) storage() Storage {
+	if syncer.store != nil {
+		return syncer.store
+	}
+	return syncer
+}
+
+// appendTo the storage not the json files, with the definitions and the rows indexed
+func (syncer *JsonSyncer) appendTo(eve event.Event) error {
+	_, idx := syncer.store.Bounds()
+	if err := syncer.store.Append(eve); err != nil {
+		return errors.Trace(err)
+	}
+	if _, end := syncer.store.Bounds(); end == idx {
+		// skipped by the storage
+		return nil
+	}
+	syncer.indexEvent(idx, eve)
+
+	syncer.trx.update(eve)
+	if syncer.policy == SYNC_NONE || syncer.trx.inTrx {
+		return nil
+	}
+	_, err := syncer.store.Checkpoint()
+	return errors.Trace(err)
+}
+
+// stored the event at idx of the storage
+func (syncer *JsonSyncer) stored(idx int) (event.Event, error) {
+	events, err := syncer.storage().Range(idx, idx+1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(events) != 1 {
+		return nil, errors.Errorf("event %d not stored", idx)
+	}
+	return events[0], nil
+}
+
+// storedGtids of the storage, all the events read if it doesn't keep the set
+func (syncer *JsonSyncer) storedGtids() (event.GtidSet, error) {
+	if store, ok := syncer.store.(gtidStorage); ok {
+		return store.ExecutedGtids()
+	}
+	start, end := syncer.store.Bounds()
+	events, err := syncer.store.Range(start, end)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return gtidsOf(events)
+}
+
+// firstTime of the events retained
+func (syncer *JsonSyncer) firstTime() (time.Time, error) {
+	start, _ := syncer.storage().Bounds()
+	eve, err := syncer.stored(start)
+	if err != nil {
+		return time.Time{}, errors.Trace(err)
+	}
+	return event.GetEventTime(eve), nil
+}
+
+// the timestamps of the events may go back in dump order at most, like the ones of the
+// transactions committed in parallel, or after failover to a master whose clock is behind
+const skewWindow = 5 * 60
+
+// lastBefore the last index may be at or before ts by the time index of the storage,
+// the index keeps the max timestamp so far, the events in skewWindow after ts included
+func (syncer *JsonSyncer) lastBefore(ts uint32) (int, error) {
+	store := syncer.storage()
+	_, end := store.Bounds()
+	if ts >= math.MaxUint32-skewWindow {
+		return end - 1, nil
+	}
+	idx, _, ok, err := store.SeekTime(event.EventTime(ts + skewWindow + 1))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if !ok {
+		return end - 1, nil
+	}
+	return idx - 1, nil
+}
@@ -0,0 +1,144 @@
+/**
+ *  author: lim
+ *  data  : 18-8-25 下午10:40
+ */
+
+package syncer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+)
+
+// storageEvents six versions of the row id 1, a transaction every 10 seconds
+func storageEvents() []event.Event {
+	cols := []event.ColumnDef{{Name: "name", Type: "varchar(8)"}, {Name: "id", Type: "bigint"}}
+	keys := []event.KeyDef{{Name: event.PRIMARY_KEY, Columns: []string{"id"}}}
+	events := []event.Event{
+		fakeRotate(4, "mysql-bin.000001"),
+		event.NewSchemaEvent(&event.EveHeader{Ts: 5, LogPos: 100}, "mysql-bin.000001", "", "test", "t", cols, keys),
+	}
+	for n := 1; n <= 6; n++ {
+		trx := rowsTrx(uint32(300*n), uint32(10*n), event.UPDATE_ROWS_EVENT_V2,
+			map[int]interface{}{0: fmt.Sprintf("v%d", n-1), 1: int64(1)},
+			map[int]interface{}{0: fmt.Sprintf("v%d", n), 1: int64(1)})
+		gtid := trx[0].(*event.GtidEvent)
+		gtid.Gtid, gtid.Header.EveSize = fmt.Sprintf("%s:%d", testSid, n), 50
+		events = append(events, trx...)
+	}
+	return events
+}
+
+func TestStorage(t *testing.T) {
+	for _, backend := range []string{STORAGE_JSON, STORAGE_BOLT} {
+		dir, err := ioutil.TempDir("", "storage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		syncer, err := NewSyncer(backend, dir, "mysql-bin.000001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a segment for every transaction of the json files
+		syncer.SetRotation(1, 0)
+		for _, eve := range storageEvents() {
+			if err = syncer.Sync(eve); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		checkStorage(t, backend, syncer)
+		if err = syncer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := NewSyncer(backend, dir, "mysql-bin.000001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.CurPos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 2000}) {
+			t.Errorf("%s: unexpect position to continue: %v", backend, loaded.CurPos)
+		}
+		checkStorage(t, backend, loaded)
+
+		// the first three transactions purged
+		store := loaded.storage()
+		if err = store.Purge(17); err != nil {
+			t.Fatal(err)
+		}
+		if start, end := store.Bounds(); start != 17 || end != 32 {
+			t.Errorf("%s: unexpect bounds after purged: [%d, %d)", backend, start, end)
+		}
+		arg := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "id", Val: "1"}},
+			Ts: event.EventTime(0), Te: event.EventTime(60)}
+		if _, err = loaded.Get(arg); errors.Cause(err) != ErrPurged {
+			t.Errorf("%s: expect purged error, got %v", backend, err)
+		}
+		arg.Ts = event.EventTime(40)
+		if versions, err := loaded.Get(arg); err != nil || len(versions) != 3 {
+			t.Errorf("%s: expect 3 versions retained, got %d: %v", backend, len(versions), err)
+		}
+		if err = loaded.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkStorage(t *testing.T, backend string, syncer *JsonSyncer) {
+	store := syncer.storage()
+	if start, end := store.Bounds(); start != 0 || end != 32 {
+		t.Fatalf("%s: unexpect bounds [%d, %d)", backend, start, end)
+	}
+
+	// the xid event of the third transaction
+	idx, err := store.SeekPos(binlog.Pos{FileName: "mysql-bin.000001", Pos: 1050})
+	if err != nil || idx != 16 {
+		t.Errorf("%s: unexpect event after 1050: %d %v", backend, idx, err)
+	}
+	if events, err := syncer.EventsSince(binlog.Pos{FileName: "mysql-bin.000001", Pos: 1050}); err != nil || len(events) != 16 {
+		t.Errorf("%s: expect 16 events after 1050, got %d: %v", backend, len(events), err)
+	}
+
+	idx, pos, ok, err := store.SeekTime(event.EventTime(35))
+	if err != nil || !ok || idx != 17 || pos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 1150}) {
+		t.Errorf("%s: unexpect transaction at 35: %d %v %v %v", backend, idx, pos, ok, err)
+	}
+	if _, _, ok, err = store.SeekTime(event.EventTime(70)); ok || err != nil {
+		t.Errorf("%s: nothing stored after 60: %v", backend, err)
+	}
+
+	arg := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "id", Val: "1"}},
+		Ts: event.EventTime(0), Te: event.EventTime(60)}
+	if versions, err := syncer.Get(arg); err != nil || len(versions) != 6 {
+		t.Errorf("%s: expect 6 versions, got %d: %v", backend, len(versions), err)
+	}
+	changes, err := syncer.Changes(arg)
+	if err != nil || len(changes) != 6 {
+		t.Fatalf("%s: expect 6 rows changed, got %d: %v", backend, len(changes), err)
+	}
+	if last := changes[5]; last.Op != event.OP_UPDATE || last.Gtid != testSid+":6" || last.Key["id"] != int64(1) ||
+		last.Before["name"] != "v5" || last.After["name"] != "v6" || last.Types["id"] != "bigint" {
+		t.Errorf("%s: unexpect row changed last: %+v", backend, last)
+	}
+	byName := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "name", Val: "v3"}},
+		Ts: event.EventTime(0), Te: event.EventTime(30)}
+	if trx, _, err := syncer.scan(byName); err != nil || trx == nil || len(trx.Events) != 5 || trx.CommitPos != 1100 {
+		t.Errorf("%s: expect the transaction at 30, got %v: %v", backend, trx, err)
+	}
+
+	gtids, err := syncer.ExecutedGtids()
+	if err != nil || gtids.String() != testSid+":1-6" {
+		t.Errorf("%s: unexpect gtids: %v %v", backend, gtids, err)
+	}
+	if pos, err = store.Checkpoint(); err != nil || pos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 2000}) {
+		t.Errorf("%s: unexpect checkpoint: %v %v", backend, pos, err)
+	}
+}
@@ -0,0 +1,505 @@
+/**
+ *  author: lim
+ *  data  : 18-8-23 下午8:30
+ */
+
+package syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	bsync "sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+	"github.com/lemonwx/log"
+)
+
+// DEFAULT_CACHE_EVENTS of the sealed segments kept in memory after read
+const DEFAULT_CACHE_EVENTS = 1 << 16
+
+// BinlogStreamer keeps the events stored, indexed in dump order. Only the events of
+// the segment written are in memory, the sealed segments are read from disk on demand
+type BinlogStreamer struct {
+	Events []event.Event // of the segment written, Events[0] at tail
+	tail   int
+	base   int // index of the first event retained, the ones before purged with their segments
+	files  []fileRange
+	cache  *eventCache
+	bsync.RWMutex
+}
+
+func NewBinlogStreamer() *BinlogStreamer {
+	return &BinlogStreamer{
+		Events: make([]event.Event, 0, 1024),
+		cache:  newEventCache(DEFAULT_CACHE_EVENTS),
+	}
+}
+
+// fileRange is a segment of a binlog file stored
+type fileRange struct {
+	name     string    // the binlog file
+	seq      int       // segment of the binlog file, 0 for the first
+	ext      string    // extension of the compression, "" if not compressed
+	sealed   bool      // closed for good, nothing appended any more
+	archived bool      // uploaded to the archive
+	remote   bool      // local copy purged, read from the archive
+	size     int64     // bytes on disk
+	modTime  time.Time // when written last
+	start    int       // index of the first event of the segment in BinlogStreamer
+
+	// summary of a sealed segment, from its index file
+	count   int
+	firstTs uint32
+	lastTs  uint32
+	gtids   event.GtidSet
+}
+
+// append eve and return its index
+func (streamer *BinlogStreamer) append(eve event.Event) int {
+	streamer.Lock()
+	defer streamer.Unlock()
+	streamer.Events = append(streamer.Events, eve)
+	return streamer.end() - 1
+}
+
+// end is the index next event appended at
+func (streamer *BinlogStreamer) end() int {
+	return streamer.tail + len(streamer.Events)
+}
+
+// count of the events retained
+func (streamer *BinlogStreamer) count() int {
+	return streamer.end() - streamer.base
+}
+
+// segmentOf the event at idx, nil if purged or in the segment written
+func (streamer *BinlogStreamer) segmentOf(idx int) *fileRange {
+	n := sort.Search(len(streamer.files), func(i int) bool {
+		return streamer.files[i].start > idx
+	})
+	if n == 0 || idx < streamer.base || idx >= streamer.tail {
+		return nil
+	}
+	return &streamer.files[n-1]
+}
+
+// eventCache keeps the events of the sealed segments read lately, at most limit events
+// unless a single segment has more
+type eventCache struct {
+	limit int
+	size  int
+	segs  map[int][]event.Event // by start of the segment
+	order []int                 // least recently used first
+	bsync.Mutex
+}
+
+func newEventCache(limit int) *eventCache {
+	return &eventCache{limit: limit, segs: make(map[int][]event.Event)}
+}
+
+func (cache *eventCache) get(start int) ([]event.Event, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	events, ok := cache.segs[start]
+	if ok {
+		cache.touch(start)
+	}
+	return events, ok
+}
+
+func (cache *eventCache) put(start int, events []event.Event) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if _, ok := cache.segs[start]; !ok {
+		cache.size += len(events)
+		cache.order = append(cache.order, start)
+	}
+	cache.segs[start] = events
+	cache.touch(start)
+	cache.evict()
+}
+
+// evict the least recently used segments beyond the limit, the latest one kept
+func (cache *eventCache) evict() {
+	for cache.size > cache.limit && len(cache.order) > 1 {
+		cache.remove(cache.order[0])
+	}
+}
+
+// drop the segments before start
+func (cache *eventCache) drop(start int) {
+	cache.Lock()
+	defer cache.Unlock()
+	for seg := range cache.segs {
+		if seg < start {
+			cache.remove(seg)
+		}
+	}
+}
+
+func (cache *eventCache) touch(start int) {
+	for idx, seg := range cache.order {
+		if seg == start {
+			cache.order = append(append(cache.order[:idx:idx], cache.order[idx+1:]...), start)
+			return
+		}
+	}
+}
+
+func (cache *eventCache) remove(start int) {
+	cache.size -= len(cache.segs[start])
+	delete(cache.segs, start)
+	for idx, seg := range cache.order {
+		if seg == start {
+			cache.order = append(cache.order[:idx], cache.order[idx+1:]...)
+			return
+		}
+	}
+}
+
+// SetCacheSize the events of the sealed segments kept in memory after read
+func (syncer *JsonSyncer) SetCacheSize(events int) {
+	if events <= 0 {
+		events = DEFAULT_CACHE_EVENTS
+	}
+	cache := syncer.streamer.cache
+	cache.Lock()
+	defer cache.Unlock()
+	cache.limit = events
+	cache.evict()
+}
+
+// eventAt idx, read from its segment if not in memory, the streamer must be locked
+func (syncer *JsonSyncer) eventAt(idx int) (event.Event, error) {
+	streamer := syncer.streamer
+	if idx >= streamer.tail && idx < streamer.end() {
+		return streamer.Events[idx-streamer.tail], nil
+	}
+
+	seg := streamer.segmentOf(idx)
+	if seg == nil {
+		return nil, errors.Errorf("event %d not stored, retained [%d, %d)", idx, streamer.base, streamer.end())
+	}
+	events, err := syncer.segmentEvents(seg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if idx-seg.start >= len(events) {
+		return nil, errors.Errorf("event %d not in %s of %d events", idx, seg.path(), len(events))
+	}
+	return events[idx-seg.start], nil
+}
+
+// segmentEvents of the sealed segment, from the cache or its file
+func (syncer *JsonSyncer) segmentEvents(seg *fileRange) ([]event.Event, error) {
+	if events, ok := syncer.streamer.cache.get(seg.start); ok {
+		return events, nil
+	}
+
+	start := time.Now()
+	var loaded *jsonFile
+	var err error
+	if seg.remote {
+		// one download of a segment, the readers waited read it from the cache
+		syncer.fetchLock.Lock()
+		defer syncer.fetchLock.Unlock()
+		if events, ok := syncer.streamer.cache.get(seg.start); ok {
+			return events, nil
+		}
+		loaded, err = syncer.fetchArchived(seg)
+	} else {
+		loaded, err = loadJsonFile(syncer.dir + seg.path())
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "read %s failed", seg.path())
+	}
+	if !loaded.complete || len(loaded.events) != seg.count {
+		return nil, errors.Errorf("%s has %d events, expect %d", seg.path(), len(loaded.events), seg.count)
+	}
+	segmentReads.WithLabelValues(syncer.Source).Observe(time.Since(start).Seconds())
+	syncer.streamer.cache.put(seg.start, loaded.events)
+	return loaded.events, nil
+}
+
+// eventsBetween [start, end), the streamer must be locked
+func (syncer *JsonSyncer) eventsBetween(start, end int) ([]event.Event, error) {
+	events := make([]event.Event, 0, end-start)
+	for idx := start; idx < end; idx++ {
+		eve, err := syncer.eventAt(idx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		events = append(events, eve)
+	}
+	return events, nil
+}
+
+// Bounds of the events in the json files
+func (syncer *JsonSyncer) Bounds() (int, int) {
+	syncer.streamer.RLock()
+	defer syncer.streamer.RUnlock()
+	return syncer.streamer.base, syncer.streamer.end()
+}
+
+// Range of the events in the json files, the sealed segments read from disk
+func (syncer *JsonSyncer) Range(start, end int) ([]event.Event, error) {
+	syncer.streamer.RLock()
+	defer syncer.streamer.RUnlock()
+	return syncer.eventsBetween(start, end)
+}
+
+// SeekPos in the segments of the binlog file of pos
+func (syncer *JsonSyncer) SeekPos(pos binlog.Pos) (int, error) {
+	syncer.streamer.RLock()
+	defer syncer.streamer.RUnlock()
+
+	files := syncer.streamer.files
+	for idx, f := range files {
+		if f.name < pos.FileName {
+			continue
+		} else if f.name > pos.FileName {
+			return f.start, nil
+		}
+
+		end := syncer.streamer.end()
+		if idx+1 < len(files) {
+			end = files[idx+1].start
+		}
+		events, err := syncer.eventsBetween(f.start, end)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		for n, eve := range events {
+			if event.GetEventHeader(eve).LogPos > pos.Pos {
+				return f.start + n, nil
+			}
+		}
+	}
+	return syncer.streamer.end(), nil
+}
+
+// SeekTime by the time index, the position is the start of the binlog file if
+// the size of the event unknown
+func (syncer *JsonSyncer) SeekTime(t time.Time) (int, binlog.Pos, bool, error) {
+	syncer.streamer.RLock()
+	defer syncer.streamer.RUnlock()
+
+	entry, ok := syncer.times.after(timestamp(t))
+	if !ok {
+		return 0, binlog.Pos{}, false, nil
+	}
+	eve, err := syncer.eventAt(entry.idx)
+	if err != nil {
+		return 0, binlog.Pos{}, false, errors.Trace(err)
+	}
+	return entry.idx, startOf(syncer.fileOf(entry.idx), eve), true, nil
+}
+
+// startOf the position eve of binlog file starts at
+func startOf(fileName string, eve event.Event) binlog.Pos {
+	pos := binlog.Pos{FileName: fileName, Pos: 4}
+	if header := event.GetEventHeader(eve); header.LogPos >= header.EveSize+4 && header.EveSize != 0 {
+		pos.Pos = header.LogPos - header.EveSize
+	}
+	return pos
+}
+
+// fileOf the binlog file of the event at idx, the streamer must be locked
+func (syncer *JsonSyncer) fileOf(idx int) string {
+	if seg := syncer.streamer.segmentOf(idx); seg != nil {
+		return seg.name
+	}
+	if n := len(syncer.streamer.files); n != 0 {
+		return syncer.streamer.files[n-1].name
+	}
+	return ""
+}
+
+// Checkpoint fsync current json file, the position is after the last event stored
+func (syncer *JsonSyncer) Checkpoint() (binlog.Pos, error) {
+	if err := syncer.fsync(); err != nil {
+		return binlog.Pos{}, errors.Trace(err)
+	}
+
+	syncer.streamer.RLock()
+	defer syncer.streamer.RUnlock()
+	if syncer.streamer.count() == 0 {
+		return syncer.CurPos, nil
+	}
+	last, err := syncer.eventAt(syncer.streamer.end() - 1)
+	if err != nil {
+		return binlog.Pos{}, errors.Trace(err)
+	}
+	return continueFrom(syncer.fileOf(syncer.streamer.end()-1), last)
+}
+
+// Purge the sealed segments all before idx
+func (syncer *JsonSyncer) Purge(idx int) error {
+	files := syncer.streamer.files
+	n := 0
+	for ; n < len(files)-1 && files[n].sealed && files[n+1].start <= idx; n++ {
+	}
+	return errors.Trace(syncer.purgeSegments(n))
+}
+
+// segmentIndex is the summary of a sealed segment saved next to it,
+// so it's not read until its events needed
+type segmentIndex struct {
+	Version int                 `json:"version"`
+	Events  int                 `json:"events"`
+	FirstTs uint32              `json:"first_ts"`
+	LastTs  uint32              `json:"last_ts"`
+	Gtids   string              `json:"gtids"`
+	SvrId   uint32              `json:"svr_id"` // of the fake rotate event, 0 if none
+	Next    binlog.Pos          `json:"next"`   // where to continue after the segment
+	Schemas []schemaPos         `json:"schemas"`
+	Rows    map[string][]rowPos `json:"rows"`
+	Times   []timePos           `json:"times"`
+}
+
+type schemaPos struct {
+	N     int                `json:"n"`
+	Event *event.SchemaEvent `json:"event"`
+}
+
+// segmentIndexVersion changes with segmentIndex, the index files of other versions rebuilt
+const segmentIndexVersion = 4
+
+func (f *fileRange) indexPath() string {
+	return segmentName(f.name, f.seq) + indexExt
+}
+
+// sealTail summarize the events of the segment written, save its index file and
+// move the events to the cache, the streamer keeps the events of the next segment
+func (syncer *JsonSyncer) sealTail(seg *fileRange) error {
+	streamer := syncer.streamer
+	events := streamer.Events
+
+	summary := &segmentIndex{Version: segmentIndexVersion, Events: len(events), Rows: syncer.index.segmentRows(),
+		Times: syncer.times.segmentTimes(seg.start)}
+	gtids, err := gtidsOf(events)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	summary.Gtids = gtids.String()
+	for n, eve := range events {
+		header := event.GetEventHeader(eve)
+		if header.Ts != 0 {
+			if summary.FirstTs == 0 {
+				summary.FirstTs = header.Ts
+			}
+			summary.LastTs = header.Ts
+		}
+		switch e := eve.(type) {
+		case *event.SchemaEvent:
+			summary.Schemas = append(summary.Schemas, schemaPos{N: n, Event: e})
+		case *event.RotateEvent:
+			if header.Ts == 0 {
+				summary.SvrId = header.SvrId
+			}
+		}
+	}
+	if n := len(streamer.files); summary.FirstTs == 0 && n > 1 {
+		// only the fake events, right after the segment before
+		summary.FirstTs, summary.LastTs = streamer.files[n-2].lastTs, streamer.files[n-2].lastTs
+	}
+	if len(events) != 0 {
+		if summary.Next, err = continueFrom(seg.name, events[len(events)-1]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	path := syncer.dir + seg.indexPath()
+	if err = ioutil.WriteFile(path+tmpExt, data, 0664); err != nil {
+		return errors.Trace(err)
+	}
+	if err = os.Rename(path+tmpExt, path); err != nil {
+		return errors.Trace(err)
+	}
+	syncer.index.addSegment(seg.start, seg.start+len(events), path, summary.Rows)
+
+	streamer.Lock()
+	defer streamer.Unlock()
+	seg.count, seg.firstTs, seg.lastTs, seg.gtids = len(events), summary.FirstTs, summary.LastTs, gtids
+	if len(events) != 0 {
+		streamer.cache.put(seg.start, events)
+	}
+	streamer.tail = streamer.end()
+	streamer.Events = make([]event.Event, 0, 1024)
+	return nil
+}
+
+// loadSegmentIndex of the sealed segment just added, the events are skipped with the
+// definitions and rows restored, false if no index file of current version
+func (syncer *JsonSyncer) loadSegmentIndex(seg *fileRange) (*segmentIndex, bool, error) {
+	data, err := ioutil.ReadFile(syncer.dir + seg.indexPath())
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	summary := &segmentIndex{}
+	if err = json.Unmarshal(data, summary); err != nil || summary.Version != segmentIndexVersion {
+		log.Errorf("rebuild index of %s: version %d, %v", seg.path(), summary.Version, err)
+		return nil, false, nil
+	}
+	gtids := make(event.GtidSet)
+	if len(summary.Gtids) != 0 {
+		if gtids, err = event.ParseGtidSet(summary.Gtids); err != nil {
+			return nil, false, errors.Annotatef(err, "broken index file %s", seg.indexPath())
+		}
+	}
+
+	for _, schema := range summary.Schemas {
+		syncer.schemas.add(seg.start+schema.N, schema.Event)
+	}
+	// the versions read from the index file again when looked up
+	syncer.index.addSegment(seg.start, seg.start+summary.Events, syncer.dir+seg.indexPath(), summary.Rows)
+	syncer.times.loadTimes(seg.start, summary.Times)
+
+	streamer := syncer.streamer
+	streamer.Lock()
+	defer streamer.Unlock()
+	seg.count, seg.firstTs, seg.lastTs, seg.gtids = summary.Events, summary.FirstTs, summary.LastTs, gtids
+	streamer.tail += summary.Events
+	return summary, true, nil
+}
+
+// continueFrom where to dump after the last event of binlog file
+func continueFrom(fileName string, last event.Event) (binlog.Pos, error) {
+	if _, ok := last.(*event.StopEvent); ok {
+		// the next of the same basename, log_bin may name it other than mysql-bin
+		dot := strings.LastIndex(fileName, ".")
+		nextIdx, err := strconv.ParseUint(fileName[dot+1:], 10, 64)
+		if dot < 0 || err != nil {
+			return binlog.Pos{}, errors.Errorf("binlog file %s without sequence number", fileName)
+		}
+		return binlog.Pos{FileName: fmt.Sprintf("%s.%0*d", fileName[:dot], len(fileName)-dot-1, nextIdx+1), Pos: 4}, nil
+	} else if rotate, ok := last.(*event.RotateEvent); ok {
+		log.Debugf("get next binlog %s from rotate event", rotate.NextBinlog)
+		return binlog.Pos{FileName: rotate.NextBinlog, Pos: 4}, nil
+	}
+
+	// stopped in the middle of the binlog file, continue from the last event
+	pos := binlog.Pos{FileName: fileName, Pos: event.GetEventHeader(last).LogPos}
+	if pos.Pos < 4 {
+		// only the fake events kept
+		pos.Pos = 4
+	}
+	return pos, nil
+}
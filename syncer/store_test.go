@@ -0,0 +1,97 @@
+/**
+ *  author: lim
+ *  data  : 18-8-23 下午10:10
+ */
+
+package syncer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lemonwx/go-canal/event"
+)
+
+func TestReadSealedSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	// a segment for every transaction, only one of them cached
+	syncer.SetRotation(1, 0)
+	syncer.SetCacheSize(5)
+
+	cols := []event.ColumnDef{{Name: "name", Type: "varchar(8)"}, {Name: "id", Type: "bigint"}}
+	keys := []event.KeyDef{{Name: event.PRIMARY_KEY, Columns: []string{"id"}}}
+	events := []event.Event{
+		fakeRotate(4, "mysql-bin.000001"),
+		event.NewSchemaEvent(&event.EveHeader{Ts: 5, LogPos: 100}, "mysql-bin.000001", "", "test", "t", cols, keys),
+	}
+	for n := 1; n <= 8; n++ {
+		events = append(events, rowsTrx(uint32(300*n), uint32(10*n), event.UPDATE_ROWS_EVENT_V2,
+			map[int]interface{}{0: fmt.Sprintf("v%d", n-1), 1: int64(1)},
+			map[int]interface{}{0: fmt.Sprintf("v%d", n), 1: int64(1)})...)
+	}
+	for _, eve := range events {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = syncer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := mustLoad(t, dir)
+	loaded.SetCacheSize(5)
+	if n := loaded.streamer.count(); n != len(events) {
+		t.Fatalf("expect %d events, got %d", len(events), n)
+	}
+	if n := len(loaded.streamer.Events); n != 0 || loaded.streamer.cache.size != 0 {
+		t.Fatalf("sealed segments should not be read until needed: %d events, %d cached", n, loaded.streamer.cache.size)
+	}
+
+	for _, sy := range []*JsonSyncer{syncer, loaded} {
+		byKey := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "id", Val: "1"}},
+			Ts: event.EventTime(0), Te: event.EventTime(80)}
+		versions, err := sy.Get(byKey)
+		if err != nil || len(versions) != 8 {
+			t.Fatalf("expect 8 versions, got %d: %v", len(versions), err)
+		}
+		if size := sy.streamer.cache.size; size > 5 {
+			t.Errorf("cache should be bounded, %d events cached", size)
+		}
+
+		// not by the key, scanned back from the segment of arg.Te
+		byName := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "name", Val: "v3"}},
+			Ts: event.EventTime(0), Te: event.EventTime(30)}
+		trx, _, err := sy.scan(byName)
+		if err != nil || trx == nil || len(trx.Events) != 5 {
+			t.Fatalf("expect the transaction at 30, got %v: %v", trx, err)
+		}
+		if trx.CommitTs != 30 || trx.CommitPos != 1100 {
+			t.Errorf("unexpect transaction scanned: %s", trx.Dump())
+		}
+	}
+}
+
+func TestContinueAfterStop(t *testing.T) {
+	for file, expect := range map[string]string{
+		"mysql-bin.000009":     "mysql-bin.000010",
+		"db1-binlog.000123":    "db1-binlog.000124",
+		"host.example.bin.999": "host.example.bin.1000",
+	} {
+		pos, err := continueFrom(file, &event.StopEvent{Header: &event.EveHeader{}})
+		if err != nil || pos.FileName != expect || pos.Pos != 4 {
+			t.Errorf("%s: expect %s:4, got %v %v", file, expect, pos, err)
+		}
+	}
+	if _, err := continueFrom("binlog", &event.StopEvent{Header: &event.EveHeader{}}); err == nil {
+		t.Error("expect the file without sequence number rejected")
+	}
+}
@@ -11,6 +11,8 @@ import (
 
 type Syncer interface {
 	Sync(event event.Event) error
+	SyncTrx(trx *event.Transaction) error
 	Rollback(arg *RollbackArg) error
 	Get(arg *RollbackArg) ([]event.Event, error)
+	Changes(arg *RollbackArg) ([]*event.RowChange, error)
 }
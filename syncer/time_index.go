@@ -0,0 +1,159 @@
+/**
+ *  author: lim
+ *  data  : 18-8-24 下午8:20
+ */
+
+package syncer
+
+import (
+	"sort"
+	bsync "sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+)
+
+// timePos is an entry of the time index in the index file, N is the event in the segment,
+// Offset the size of the segment before the event written, decompressed
+type timePos struct {
+	Ts     uint32 `json:"ts"`
+	N      int    `json:"n"`
+	Offset int64  `json:"offset"`
+}
+
+// timeEntry is an entry of the time index in memory, idx is the event in BinlogStreamer
+type timeEntry struct {
+	ts     uint32
+	idx    int
+	offset int64
+}
+
+// TimeIndex is sparse: only the first transaction of every second is indexed. The entries
+// are of the max timestamp so far, a transaction whose timestamp went back is not indexed,
+// so they increase strictly and the first one at or after ts is the first transaction at
+// or after ts, searched by binary search
+type TimeIndex struct {
+	entries []timeEntry
+	trx     trxState // of the events added, entries only at the transaction boundaries
+	bsync.RWMutex
+}
+
+func NewTimeIndex() *TimeIndex {
+	return &TimeIndex{}
+}
+
+// add the event at idx, written at offset of its segment
+func (index *TimeIndex) add(idx int, eve event.Event, offset int64) {
+	index.Lock()
+	defer index.Unlock()
+
+	boundary := !index.trx.inTrx
+	index.trx.update(eve)
+	header := event.GetEventHeader(eve)
+	if !boundary || header == nil || header.Ts == 0 {
+		return
+	}
+	if n := len(index.entries); n != 0 && index.entries[n-1].ts >= header.Ts {
+		return
+	}
+	index.entries = append(index.entries, timeEntry{ts: header.Ts, idx: idx, offset: offset})
+}
+
+// after the first entry at or after ts, false if none
+func (index *TimeIndex) after(ts uint32) (timeEntry, bool) {
+	index.RLock()
+	defer index.RUnlock()
+
+	n := sort.Search(len(index.entries), func(i int) bool { return index.entries[i].ts >= ts })
+	if n == len(index.entries) {
+		return timeEntry{}, false
+	}
+	return index.entries[n], true
+}
+
+// segmentTimes of the segment from start
+func (index *TimeIndex) segmentTimes(start int) []timePos {
+	index.RLock()
+	defer index.RUnlock()
+
+	n := sort.Search(len(index.entries), func(i int) bool { return index.entries[i].idx >= start })
+	times := make([]timePos, 0, len(index.entries)-n)
+	for _, entry := range index.entries[n:] {
+		times = append(times, timePos{Ts: entry.ts, N: entry.idx - start, Offset: entry.offset})
+	}
+	return times
+}
+
+// loadTimes of the segment from start saved in its index file, it ends with a transaction
+func (index *TimeIndex) loadTimes(start int, times []timePos) {
+	index.Lock()
+	defer index.Unlock()
+	for _, pos := range times {
+		if n := len(index.entries); n == 0 || index.entries[n-1].ts < pos.Ts {
+			index.entries = append(index.entries, timeEntry{ts: pos.Ts, idx: start + pos.N, offset: pos.Offset})
+		}
+	}
+	index.trx = trxState{}
+}
+
+// purge the entries before idx
+func (index *TimeIndex) purge(idx int) {
+	index.Lock()
+	defer index.Unlock()
+
+	n := sort.Search(len(index.entries), func(i int) bool { return index.entries[i].idx >= idx })
+	index.entries = append([]timeEntry(nil), index.entries[n:]...)
+}
+
+// PosAt where to dump from for the transactions from t, false if none stored at
+// or after t
+func (syncer *JsonSyncer) PosAt(t time.Time) (binlog.Pos, bool, error) {
+	_, pos, ok, err := syncer.storage().SeekTime(t)
+	return pos, ok, err
+}
+
+// EventsSinceTime the events of the transactions from t, the segment of t read from
+// the offset indexed if not cached
+func (syncer *JsonSyncer) EventsSinceTime(t time.Time) ([]event.Event, error) {
+	if syncer.store != nil {
+		idx, _, ok, err := syncer.store.SeekTime(t)
+		if err != nil || !ok {
+			return []event.Event{}, errors.Trace(err)
+		}
+		_, end := syncer.store.Bounds()
+		return syncer.store.Range(idx, end)
+	}
+
+	syncer.streamer.RLock()
+	defer syncer.streamer.RUnlock()
+
+	entry, ok := syncer.times.after(timestamp(t))
+	if !ok {
+		return []event.Event{}, nil
+	}
+	seg := syncer.streamer.segmentOf(entry.idx)
+	if seg == nil {
+		return syncer.eventsBetween(entry.idx, syncer.streamer.end())
+	}
+	if _, ok := syncer.streamer.cache.get(seg.start); ok || seg.remote {
+		return syncer.eventsBetween(entry.idx, syncer.streamer.end())
+	}
+
+	start := time.Now()
+	loaded, err := loadJsonFileAt(syncer.dir+seg.path(), entry.offset)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read %s from %d failed", seg.path(), entry.offset)
+	}
+	if expect := seg.count - (entry.idx - seg.start); !loaded.complete || len(loaded.events) != expect {
+		return nil, errors.Errorf("%s has %d events from %d, expect %d", seg.path(), len(loaded.events), entry.offset, expect)
+	}
+	segmentReads.WithLabelValues(syncer.Source).Observe(time.Since(start).Seconds())
+
+	rest, err := syncer.eventsBetween(seg.start+seg.count, syncer.streamer.end())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return append(loaded.events, rest...), nil
+}
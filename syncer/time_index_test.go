@@ -0,0 +1,156 @@
+/**
+ *  author: lim
+ *  data  : 18-8-24 下午9:40
+ */
+
+package syncer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lemonwx/go-canal/binlog"
+	"github.com/lemonwx/go-canal/event"
+)
+
+func TestTimeIndex(t *testing.T) {
+	for _, c := range []struct {
+		format, compress string
+		rebuild          bool
+	}{
+		{FORMAT_JSON, COMPRESS_NONE, false},
+		{FORMAT_NDJSON, COMPRESS_GZIP, false},
+		{FORMAT_JSON, COMPRESS_ZSTD, true},
+	} {
+		dir, err := ioutil.TempDir("", "time_index")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		syncer := NewJsonSyncer(nil)
+		syncer.dir = dir + "/"
+		if err = syncer.SetFormat(c.format); err != nil {
+			t.Fatal(err)
+		}
+		if err = syncer.SetCompress(c.compress); err != nil {
+			t.Fatal(err)
+		}
+		// some transactions in a segment
+		syncer.SetRotation(3000, 0)
+
+		events := []event.Event{fakeRotate(4, "mysql-bin.000001")}
+		for n := 1; n <= 9; n++ {
+			// three transactions a second, not aligned with the segments
+			trx := rowsTrx(uint32(300*n), uint32(10*((n+2)/3)), event.WRITE_ROWS_EVENT_V2,
+				map[int]interface{}{0: fmt.Sprintf("v%d", n), 1: int64(n)})
+			trx[0].(*event.GtidEvent).Header.EveSize = 50
+			events = append(events, trx...)
+		}
+		for _, eve := range events {
+			if err = syncer.Sync(eve); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = syncer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(syncer.streamer.files) < 3 {
+			t.Fatalf("expect segments of some transactions, got %d", len(syncer.streamer.files))
+		}
+		if c.rebuild {
+			idxs, _ := filepath.Glob(dir + "/*" + indexExt)
+			for _, idx := range idxs {
+				os.Remove(idx)
+			}
+		}
+
+		loaded := mustLoad(t, dir)
+		if len(loaded.times.entries) != 3 || fmt.Sprint(loaded.times.entries) != fmt.Sprint(syncer.times.entries) {
+			t.Errorf("%v: expect the first transaction of every second indexed as written %v, got %v",
+				c, syncer.times.entries, loaded.times.entries)
+		}
+
+		// the first transaction at 20 is the fourth one
+		pos, ok, err := loaded.PosAt(event.EventTime(15))
+		if err != nil || !ok || pos != (binlog.Pos{FileName: "mysql-bin.000001", Pos: 1150}) {
+			t.Errorf("%v: unexpect position at 15: %v %v %v", c, pos, ok, err)
+		}
+		if _, ok, err = loaded.PosAt(event.EventTime(40)); ok || err != nil {
+			t.Errorf("%v: nothing stored after 30: %v", c, err)
+		}
+
+		// from the middle of the segments
+		for _, ts := range []uint32{10, 20, 30} {
+			since, err := mustLoad(t, dir).EventsSinceTime(event.EventTime(ts))
+			first := int(3*ts/10 - 2)
+			if err != nil || len(since) != 5*(10-first) {
+				t.Fatalf("%v: expect %d transactions since %d, got %d events: %v", c, 10-first, ts, len(since), err)
+			}
+			if header := event.GetEventHeader(since[0]); header.Ts != ts || header.LogPos != uint32(300*first) {
+				t.Errorf("%v: unexpect first event since %d: %s", c, ts, since[0].Dump())
+			}
+		}
+	}
+}
+
+func TestSkewedTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "time_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := NewJsonSyncer(nil)
+	syncer.dir = dir + "/"
+	cols := []event.ColumnDef{{Name: "name", Type: "varchar(8)"}, {Name: "id", Type: "bigint"}}
+	keys := []event.KeyDef{{Name: event.PRIMARY_KEY, Columns: []string{"id"}}}
+	events := []event.Event{
+		fakeRotate(4, "mysql-bin.000001"),
+		event.NewSchemaEvent(&event.EveHeader{Ts: 5, LogPos: 100}, "mysql-bin.000001", "", "test", "t", cols, keys),
+	}
+	// the third transaction goes back in time
+	for n, ts := range []uint32{10, 30, 20, 40} {
+		trx := rowsTrx(uint32(300*(n+1)), ts, event.WRITE_ROWS_EVENT_V2,
+			map[int]interface{}{0: fmt.Sprintf("v%d", n+1), 1: int64(1)})
+		trx[0].(*event.GtidEvent).Header.EveSize = 50
+		events = append(events, trx...)
+	}
+	for _, eve := range events {
+		if err = syncer.Sync(eve); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexed := []uint32{}
+	for _, entry := range syncer.times.entries {
+		indexed = append(indexed, entry.ts)
+	}
+	if fmt.Sprint(indexed) != "[5 10 30 40]" {
+		t.Errorf("expect the max timestamps so far indexed, got %v", indexed)
+	}
+	// the first transaction at or after 15 is the second one, at 30
+	if pos, ok, err := syncer.PosAt(event.EventTime(15)); err != nil || !ok || pos.Pos != 550 {
+		t.Errorf("unexpect position at 15: %v %v %v", pos, ok, err)
+	}
+
+	byKey := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "id", Val: "1"}},
+		Ts: event.EventTime(15), Te: event.EventTime(25)}
+	if versions, err := syncer.Get(byKey); err != nil || len(versions) != 1 || event.GetEventHeader(versions[0]).Ts != 20 {
+		t.Errorf("expect the version at 20 after the one at 30, got %v: %v", versions, err)
+	}
+	// after the one out of range, and before
+	for _, c := range []struct {
+		name   string
+		ts, te uint32
+	}{{"v3", 15, 25}, {"v2", 25, 35}} {
+		byName := &RollbackArg{Schema: "test", Table: "t", Fields: []*Field{{Name: "name", Val: c.name}},
+			Ts: event.EventTime(c.ts), Te: event.EventTime(c.te)}
+		if trx, _, err := syncer.scan(byName); err != nil || trx == nil {
+			t.Errorf("expect the transaction of %s in [%d, %d]: %v", c.name, c.ts, c.te, err)
+		}
+	}
+}